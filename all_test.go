@@ -2,12 +2,20 @@ package cimg
 
 import (
 	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/draw"
 	"image/png"
+	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/require"
+	"golang.org/x/image/tiff"
 )
 
 func MakeRGBA(width, height int) *Image {
@@ -156,6 +164,93 @@ func TestCompress(t *testing.T) {
 }
 
 // This isn't much of a unit test - but at least the code gets run
+func TestCompressInto(t *testing.T) {
+	for nchan := 1; nchan <= 4; nchan++ {
+		if nchan == 2 {
+			continue
+		}
+		org := MakeImage(nchan, 123, 77)
+		sampling := Sampling420
+		if nchan == 1 {
+			sampling = SamplingGray
+		}
+		params := MakeCompressParams(sampling, 90, 0)
+		ref, err := Compress(org, params)
+		require.Nil(t, err)
+
+		// Buffer
+		bound := CompressBound(org.Width, org.Height, sampling)
+		require.GreaterOrEqual(t, bound, len(ref))
+		buf := make([]byte, bound)
+		n, err := CompressInto(org, params, buf)
+		require.Nil(t, err)
+		require.Equal(t, ref, buf[:n])
+
+		// Buffer too small
+		_, err = CompressInto(org, params, buf[:bound-1])
+		require.NotNil(t, err)
+
+		// Writer
+		w := bytes.Buffer{}
+		require.Nil(t, CompressTo(&w, org, params))
+		require.Equal(t, ref, w.Bytes())
+	}
+	require.Equal(t, 0, CompressBound(10, 10, SamplingUnknown))
+}
+
+func TestEncoderDecoderReuse(t *testing.T) {
+	encoder, err := NewEncoder()
+	require.Nil(t, err)
+	defer encoder.Close()
+	decoder, err := NewDecoder()
+	require.Nil(t, err)
+	defer decoder.Close()
+
+	for i := 0; i < 10; i++ {
+		w := 50 + i*7
+		h := 30 + i*3
+		org := MakeImage(3+i%2, w, h)
+		jpg, err := encoder.Compress(org, MakeCompressParams(Sampling420, 90, 0))
+		require.Nil(t, err)
+		cfg, err := decoder.DecodeConfig(jpg)
+		require.Nil(t, err)
+		require.Equal(t, w, cfg.Width)
+		require.Equal(t, h, cfg.Height)
+		dec, err := decoder.Decompress(jpg)
+		require.Nil(t, err)
+		require.Equal(t, w, dec.Width)
+		require.Equal(t, h, dec.Height)
+	}
+
+	// The package-level functions share pooled handles between goroutines
+	org := MakeRGB(64, 64)
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		go func() {
+			for j := 0; j < 10; j++ {
+				jpg, err := Compress(org, MakeCompressParams(Sampling444, 90, 0))
+				if err == nil {
+					_, err = Decompress(jpg)
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+			errs <- nil
+		}()
+	}
+	for i := 0; i < 8; i++ {
+		require.Nil(t, <-errs)
+	}
+
+	// Close is idempotent
+	encoder.Close()
+	encoder.Close()
+	decoder.Close()
+	decoder.Close()
+}
+
 func TestResize(t *testing.T) {
 	w := 700
 	h := 400
@@ -196,6 +291,446 @@ func TestPNGLoad(t *testing.T) {
 	}
 }
 
+var allPixelFormats = []PixelFormat{
+	PixelFormatRGB, PixelFormatBGR, PixelFormatRGBX, PixelFormatBGRX, PixelFormatXBGR, PixelFormatXRGB,
+	PixelFormatGRAY, PixelFormatRGBA, PixelFormatBGRA, PixelFormatABGR, PixelFormatARGB, PixelFormatCMYK,
+}
+
+func TestDecompressWithOptions(t *testing.T) {
+	org := MakeRGB(64, 48)
+	jpg, err := Compress(org, MakeCompressParams(Sampling444, 95, 0))
+	require.Nil(t, err)
+	ref, err := Decompress(jpg)
+	require.Nil(t, err)
+
+	nat, err := org.ToImage()
+	require.Nil(t, err)
+	buf := bytes.Buffer{}
+	require.Nil(t, png.Encode(&buf, nat))
+
+	for _, pf := range allPixelFormats {
+		if pf != PixelFormatCMYK {
+			// TurboJPEG can only produce CMYK from a CMYK JPEG
+			img, err := DecompressWithOptions(jpg, &DecompressParams{Format: pf, HasFormat: true})
+			require.Nil(t, err)
+			require.Equal(t, pf, img.Format)
+			require.Equal(t, 64*NChan(pf), img.Stride)
+			if pf == PixelFormatGRAY {
+				require.LessOrEqual(t, AvgRGBDifference(ref.ToGray(), img), 1.0)
+			} else {
+				require.Equal(t, 0.0, AvgRGBDifference(ref, img.Convert(PixelFormatRGB)))
+			}
+		}
+
+		img, err := DecompressWithOptions(buf.Bytes(), &DecompressParams{Format: pf, HasFormat: true})
+		require.Nil(t, err)
+		require.Equal(t, pf, img.Format)
+		if pf == PixelFormatGRAY {
+			require.LessOrEqual(t, AvgRGBDifference(org.ToGray(), img), 1.0)
+		} else {
+			require.LessOrEqual(t, AvgRGBDifference(org, img.Convert(PixelFormatRGB)), 1.0)
+		}
+	}
+}
+
+func TestChooseScalingFactor(t *testing.T) {
+	require.Equal(t, ScalingFactor{1, 1}, ChooseScalingFactor(800, 600, 800, 600))
+	require.Equal(t, ScalingFactor{1, 1}, ChooseScalingFactor(800, 600, 1000, 100))
+	require.Equal(t, ScalingFactor{1, 2}, ChooseScalingFactor(800, 600, 400, 300))
+	require.Equal(t, ScalingFactor{5, 8}, ChooseScalingFactor(800, 600, 401, 300))
+	require.Equal(t, ScalingFactor{1, 8}, ChooseScalingFactor(800, 600, 1, 1))
+}
+
+func TestDecompressScaled(t *testing.T) {
+	org := MakeRGB(800, 600)
+	jpg, err := Compress(org, MakeCompressParams(Sampling420, 90, 0))
+	require.Nil(t, err)
+
+	img, err := DecompressScaled(jpg, 200, 150, nil)
+	require.Nil(t, err)
+	require.Equal(t, 200, img.Width)
+	require.Equal(t, 150, img.Height)
+
+	img, err = DecompressScaled(jpg, 201, 150, &DecompressParams{Format: PixelFormatBGRA, HasFormat: true})
+	require.Nil(t, err)
+	require.Equal(t, 300, img.Width)
+	require.Equal(t, 225, img.Height)
+	require.Equal(t, PixelFormatBGRA, img.Format)
+
+	img, err = DecompressWithOptions(jpg, &DecompressParams{Format: PixelFormatRGB, HasFormat: true, Scale: ScalingFactor{1, 8}})
+	require.Nil(t, err)
+	require.Equal(t, 100, img.Width)
+	require.Equal(t, 75, img.Height)
+
+	_, err = DecompressWithOptions(jpg, &DecompressParams{Format: PixelFormatRGB, HasFormat: true, Scale: ScalingFactor{1, 3}})
+	require.NotNil(t, err)
+
+	img, err = DecompressToFit(jpg, 256, 256, nil, nil)
+	require.Nil(t, err)
+	require.Equal(t, 256, img.Width)
+	require.Equal(t, 256, img.Height)
+	SaveJPEG(t, img, "test/decompress-fit.jpg")
+}
+
+func TestDecodeConfig(t *testing.T) {
+	// JPEG
+	jpg, err := Compress(MakeRGB(120, 80), MakeCompressParams(Sampling420, 90, FlagProgressive))
+	require.Nil(t, err)
+	jpgExif, err := LoadExif(jpg)
+	require.Nil(t, err)
+	require.Nil(t, jpgExif.SetOrientation(6))
+	buf := bytes.Buffer{}
+	require.Nil(t, jpgExif.Save(&buf))
+	cfg, err := DecodeConfig(buf.Bytes())
+	require.Nil(t, err)
+	require.Equal(t, ImageConfig{
+		Format:      FormatJPEG,
+		Width:       120,
+		Height:      80,
+		NChan:       3,
+		BitDepth:    8,
+		Sampling:    Sampling420,
+		Colorspace:  ColorspaceYCbCr,
+		Progressive: true,
+		Orientation: 6,
+	}, cfg)
+
+	jpg, err = Compress(MakeGray(50, 40), MakeCompressParams(SamplingGray, 90, 0))
+	require.Nil(t, err)
+	cfg, err = DecodeConfig(jpg)
+	require.Nil(t, err)
+	require.Equal(t, 1, cfg.NChan)
+	require.Equal(t, SamplingGray, cfg.Sampling)
+	require.Equal(t, ColorspaceGray, cfg.Colorspace)
+	require.False(t, cfg.Progressive)
+	require.Equal(t, 0, cfg.Orientation)
+
+	// A segment with an invalid length
+	for _, length := range []byte{0, 1} {
+		bad := append([]byte{0xff, 0xd8, 0xff, 0xfe, 0, length}, jpg[2:]...)
+		require.NotPanics(t, func() { DecodeConfig(bad) })
+		cfg = ImageConfig{NChan: 3}
+		scanJPEGMarkers(bad, &cfg)
+		require.Equal(t, ImageConfig{NChan: 3}, cfg)
+	}
+
+	// PNG
+	for _, nchan := range []int{1, 4} {
+		img := MakeImage(nchan, 30, 20)
+		if nchan == 4 {
+			// Go's PNG encoder writes RGB if the image is opaque
+			AddAlphaNoise(img)
+		}
+		nat, err := img.ToImage()
+		require.Nil(t, err)
+		buf = bytes.Buffer{}
+		require.Nil(t, png.Encode(&buf, nat))
+		cfg, err = DecodeConfig(buf.Bytes())
+		require.Nil(t, err)
+		require.Equal(t, FormatPNG, cfg.Format)
+		require.Equal(t, 30, cfg.Width)
+		require.Equal(t, 20, cfg.Height)
+		require.Equal(t, nchan, cfg.NChan)
+		require.Equal(t, 8, cfg.BitDepth)
+		require.Equal(t, SamplingUnknown, cfg.Sampling)
+	}
+
+	// TIFF
+	nat, err := MakeRGBA(30, 20).ToImage()
+	require.Nil(t, err)
+	buf = bytes.Buffer{}
+	require.Nil(t, tiff.Encode(&buf, nat, nil))
+	cfg, err = DecodeConfig(buf.Bytes())
+	require.Nil(t, err)
+	require.Equal(t, FormatTIFF, cfg.Format)
+	require.Equal(t, 30, cfg.Width)
+	require.Equal(t, 20, cfg.Height)
+	require.Equal(t, 4, cfg.NChan)
+	require.Equal(t, 8, cfg.BitDepth)
+	require.Equal(t, ColorspaceRGB, cfg.Colorspace)
+}
+
+func TestDecodeLimits(t *testing.T) {
+	jpg, err := Compress(MakeRGB(800, 600), MakeCompressParams(Sampling420, 90, 0))
+	require.Nil(t, err)
+	nat, err := MakeRGB(800, 600).ToImage()
+	require.Nil(t, err)
+	buf := bytes.Buffer{}
+	require.Nil(t, png.Encode(&buf, nat))
+
+	for _, enc := range [][]byte{jpg, buf.Bytes()} {
+		for _, limits := range []DecodeLimits{
+			{MaxWidth: 799},
+			{MaxHeight: 599},
+			{MaxPixels: 800*600 - 1},
+			{MaxInputBytes: len(enc) - 1},
+		} {
+			_, err = DecompressWithOptions(enc, &DecompressParams{Format: PixelFormatUNKNOWN, HasFormat: true, Limits: &limits})
+			require.ErrorIs(t, err, ErrImageTooLarge)
+			_, err = DecompressToFit(enc, 100, 100, &DecompressParams{Format: PixelFormatUNKNOWN, HasFormat: true, Limits: &limits}, nil)
+			require.ErrorIs(t, err, ErrImageTooLarge)
+		}
+		limits := DecodeLimits{MaxWidth: 800, MaxHeight: 600, MaxPixels: 800 * 600, MaxInputBytes: len(enc)}
+		img, err := DecompressWithOptions(enc, &DecompressParams{Format: PixelFormatUNKNOWN, HasFormat: true, Limits: &limits})
+		require.Nil(t, err)
+		require.Equal(t, 800, img.Width)
+	}
+}
+
+func TestDecodeReaderEncodeWriter(t *testing.T) {
+	org := MakeRGBA(60, 40)
+	for _, format := range []string{FormatJPEG, FormatPNG, FormatTIFF} {
+		buf := bytes.Buffer{}
+		params := EncodeParams{Format: format, JPEG: MakeCompressParams(Sampling444, 95, 0)}
+		require.Nil(t, EncodeWriter(&buf, org, params))
+		cfg, err := DecodeConfig(buf.Bytes())
+		require.Nil(t, err)
+		require.Equal(t, format, cfg.Format)
+
+		dec, err := DecodeReader(&buf, &DecompressParams{Format: PixelFormatRGBA, HasFormat: true})
+		require.Nil(t, err)
+		require.Equal(t, org.Width, dec.Width)
+		require.Equal(t, org.Height, dec.Height)
+		if format == FormatJPEG {
+			require.Less(t, AvgRGBDifference(org, dec), 15.0)
+		} else {
+			require.Equal(t, 0.0, AvgRGBDifference(org, dec))
+		}
+	}
+	require.NotNil(t, EncodeWriter(&bytes.Buffer{}, org, EncodeParams{Format: "nope"}))
+
+	// Limits
+	for _, format := range []string{FormatJPEG, FormatPNG} {
+		buf := bytes.Buffer{}
+		require.Nil(t, EncodeWriter(&buf, org, EncodeParams{Format: format, JPEG: MakeCompressParams(Sampling444, 95, 0)}))
+		encoded := buf.Bytes()
+		_, err := DecodeReader(bytes.NewReader(encoded), &DecompressParams{Limits: &DecodeLimits{MaxWidth: 59}})
+		require.ErrorIs(t, err, ErrImageTooLarge)
+		_, err = DecodeReader(bytes.NewReader(encoded), &DecompressParams{Limits: &DecodeLimits{MaxInputBytes: len(encoded) - 1}})
+		require.ErrorIs(t, err, ErrImageTooLarge)
+		_, err = DecodeReader(bytes.NewReader(encoded), &DecompressParams{Limits: &DecodeLimits{MaxInputBytes: len(encoded), MaxWidth: 60}})
+		require.Nil(t, err)
+	}
+}
+
+func TestEncodePNG(t *testing.T) {
+	org := MakeRGBA(50, 40)
+	AddAlphaNoise(org)
+	for _, pf := range allPixelFormats {
+		if pf == PixelFormatCMYK {
+			continue
+		}
+		src := org.Convert(pf)
+		enc, err := EncodePNG(src, nil)
+		require.Nil(t, err)
+		cfg, err := DecodeConfig(enc)
+		require.Nil(t, err)
+		_, _, _, alpha := channelOffsets(pf)
+		switch {
+		case pf == PixelFormatGRAY:
+			require.Equal(t, 1, cfg.NChan)
+		case alpha != -1:
+			require.Equal(t, 4, cfg.NChan)
+		default:
+			require.Equal(t, 3, cfg.NChan)
+		}
+		dec, err := DecompressWithOptions(enc, &DecompressParams{Format: pf, HasFormat: true})
+		require.Nil(t, err)
+		require.Equal(t, src.Pixels, dec.Pixels, "%v", pf)
+	}
+
+	// Premultiplied alpha is undone before writing
+	premul := org.Clone()
+	premul.Premultiply()
+	enc, err := EncodePNG(premul, nil)
+	require.Nil(t, err)
+	dec, err := Decompress(enc)
+	require.Nil(t, err)
+	require.False(t, dec.Premultiplied)
+
+	// The zero value of DecompressParams keeps the natural format, and its alpha channel
+	dec, err = DecompressWithOptions(enc, &DecompressParams{Limits: &DecodeLimits{MaxWidth: 1000}})
+	require.Nil(t, err)
+	require.Equal(t, PixelFormatRGBA, dec.Format)
+	for i := 0; i < len(org.Pixels); i += 4 {
+		if org.Pixels[i+3] >= 128 {
+			for c := 0; c < 4; c++ {
+				require.InDelta(t, int(org.Pixels[i+c]), int(dec.Pixels[i+c]), 1)
+			}
+		}
+	}
+
+	// Compression level
+	fast, err := EncodePNG(org, &PNGParams{CompressionLevel: png.NoCompression})
+	require.Nil(t, err)
+	best, err := EncodePNG(org, &PNGParams{CompressionLevel: png.BestCompression})
+	require.Nil(t, err)
+	require.Less(t, len(best), len(fast))
+
+	// Paletted
+	few := NewImage(40, 30, PixelFormatRGB)
+	few.DrawRectangle(5, 5, 20, 20, 200, 10, 10)
+	enc, err = EncodePNG(few, &PNGParams{Paletted: true})
+	require.Nil(t, err)
+	nat, err := png.Decode(bytes.NewReader(enc))
+	require.Nil(t, err)
+	paletted, ok := nat.(*image.Paletted)
+	require.True(t, ok)
+	require.Equal(t, 2, len(paletted.Palette))
+	require.Equal(t, color.RGBA{0, 0, 0, 255}, paletted.At(0, 0))
+	require.Equal(t, color.RGBA{200, 10, 10, 255}, paletted.At(5, 5))
+
+	_, err = EncodePNG(MakeRGB(100, 100), &PNGParams{Paletted: true})
+	require.ErrorIs(t, err, ErrTooManyColors)
+	_, err = EncodePNG(MakeRGB(100, 100), &PNGParams{Paletted: true, Palette: palette.Plan9, Dither: true})
+	require.Nil(t, err)
+}
+
+// A trivial codec for testing the registry: a magic string, then width and height, then gray pixels
+var rawGrayCodec = &Codec{
+	Name:       "rawgray",
+	Extensions: []string{".rawgray"},
+	Sniff: func(encoded []byte) bool {
+		return bytes.HasPrefix(encoded, []byte("RAWGRAY"))
+	},
+	DecodeConfig: func(encoded []byte) (ImageConfig, error) {
+		if len(encoded) < 9 {
+			return ImageConfig{}, errors.New("Truncated rawgray")
+		}
+		return ImageConfig{Format: "rawgray", Width: int(encoded[7]), Height: int(encoded[8]), NChan: 1, BitDepth: 8, Colorspace: ColorspaceGray}, nil
+	},
+	Decode: func(encoded []byte, params *DecompressParams) (*Image, error) {
+		img := NewImage(int(encoded[7]), int(encoded[8]), PixelFormatGRAY)
+		copy(img.Pixels, encoded[9:])
+		return applyDecompressFormat(img, params), nil
+	},
+	Encode: func(w io.Writer, img *Image, params *EncodeParams) error {
+		gray := img.Convert(PixelFormatGRAY)
+		w.Write([]byte{'R', 'A', 'W', 'G', 'R', 'A', 'Y', byte(img.Width), byte(img.Height)})
+		_, err := w.Write(gray.Pixels)
+		return err
+	},
+}
+
+func TestCodecRegistry(t *testing.T) {
+	org := MakeRGB(40, 30)
+	dir := t.TempDir()
+	for _, format := range []string{FormatJPEG, FormatPNG, FormatTIFF} {
+		buf := bytes.Buffer{}
+		require.Nil(t, EncodeWriter(&buf, org, EncodeParams{Format: format}))
+		detected, err := DetectFormat(buf.Bytes())
+		require.Nil(t, err)
+		require.Equal(t, format, detected)
+		require.NotNil(t, LookupCodec(format))
+	}
+
+	garbage := []byte("this is not an image")
+	_, err := DetectFormat(garbage)
+	require.ErrorIs(t, err, ErrUnknownFormat)
+	_, err = Decompress(garbage)
+	require.ErrorIs(t, err, ErrUnknownFormat)
+	_, err = DecodeConfig(garbage)
+	require.ErrorIs(t, err, ErrUnknownFormat)
+	require.ErrorIs(t, EncodeWriter(&bytes.Buffer{}, org, EncodeParams{Format: "nope"}), ErrUnknownFormat)
+
+	// WriteFile chooses the format by extension, and ReadFile by content
+	for _, ext := range []string{".jpg", ".png", ".tiff"} {
+		filename := filepath.Join(dir, "a"+ext)
+		require.Nil(t, org.WriteFile(filename, nil, 0644))
+		raw, err := os.ReadFile(filename)
+		require.Nil(t, err)
+		format, _ := DetectFormat(raw)
+		require.Equal(t, codecForExtension(ext).Name, format)
+		img, err := ReadFile(filename)
+		require.Nil(t, err)
+		require.Equal(t, 40, img.Width)
+	}
+	require.ErrorIs(t, org.WriteFile(filepath.Join(dir, "a.xyz"), nil, 0644), ErrUnknownFormat)
+
+	// Content wins over a misleading extension
+	require.Nil(t, org.WriteFile(filepath.Join(dir, "png.jpg"), &EncodeParams{Format: FormatPNG}, 0644))
+	img, err := ReadFile(filepath.Join(dir, "png.jpg"))
+	require.Nil(t, err)
+	require.Equal(t, org.Pixels, img.Convert(PixelFormatRGB).Pixels)
+
+	// Third-party codec
+	RegisterCodec(rawGrayCodec)
+	buf := bytes.Buffer{}
+	require.Nil(t, EncodeWriter(&buf, org, EncodeParams{Format: "rawgray"}))
+	format, err := DetectFormat(buf.Bytes())
+	require.Nil(t, err)
+	require.Equal(t, "rawgray", format)
+	cfg, err := DecodeConfig(buf.Bytes())
+	require.Nil(t, err)
+	require.Equal(t, 40, cfg.Width)
+	img, err = DecompressWithOptions(buf.Bytes(), &DecompressParams{Format: PixelFormatGRAY, HasFormat: true})
+	require.Nil(t, err)
+	require.Equal(t, org.Convert(PixelFormatGRAY).Pixels, img.Pixels)
+	_, err = DecompressWithOptions(buf.Bytes(), &DecompressParams{Limits: &DecodeLimits{MaxHeight: 29}})
+	require.ErrorIs(t, err, ErrImageTooLarge)
+	require.Nil(t, org.WriteFile(filepath.Join(dir, "a.rawgray"), nil, 0644))
+	img, err = ReadFile(filepath.Join(dir, "a.rawgray"))
+	require.Nil(t, err)
+	require.Equal(t, PixelFormatGRAY, img.Format)
+}
+
+func cropOf(img *Image, r image.Rectangle) *Image {
+	return img.ReferenceCrop(r.Min.X, r.Min.Y, r.Max.X, r.Max.Y)
+}
+
+func TestDecompressRegion(t *testing.T) {
+	org := MakeRGB(800, 600)
+	jpg, err := Compress(org, MakeCompressParams(Sampling420, 95, 0))
+	require.Nil(t, err)
+	full, err := Decompress(jpg)
+	require.Nil(t, err)
+
+	r := image.Rect(101, 51, 301, 251)
+	img, err := DecompressRegion(jpg, r, nil)
+	require.Nil(t, err)
+	require.Equal(t, 200, img.Width)
+	require.Equal(t, 200, img.Height)
+	require.Less(t, AvgRGBDifference(cropOf(full, r), img), 1.0)
+	SaveJPEG(t, img, "test/decompress-region.jpg")
+
+	// Region that extends beyond the image is clipped
+	img, err = DecompressRegion(jpg, image.Rect(700, 500, 900, 900), &DecompressParams{Format: PixelFormatBGRA, HasFormat: true})
+	require.Nil(t, err)
+	require.Equal(t, 100, img.Width)
+	require.Equal(t, 100, img.Height)
+	require.Equal(t, PixelFormatBGRA, img.Format)
+
+	// Scaled
+	half, err := DecompressWithOptions(jpg, &DecompressParams{Format: PixelFormatRGB, HasFormat: true, Scale: ScalingFactor{1, 2}})
+	require.Nil(t, err)
+	img, err = DecompressRegion(jpg, image.Rect(200, 100, 400, 300), &DecompressParams{Format: PixelFormatRGB, HasFormat: true, Scale: ScalingFactor{1, 2}})
+	require.Nil(t, err)
+	require.Equal(t, 100, img.Width)
+	require.Equal(t, 100, img.Height)
+	require.Less(t, AvgRGBDifference(cropOf(half, image.Rect(100, 50, 200, 150)), img), 1.0)
+
+	// Bottom-up
+	topDown, err := DecompressRegion(jpg, r, nil)
+	require.Nil(t, err)
+	img, err = DecompressRegion(jpg, r, &DecompressParams{Format: PixelFormatRGB, HasFormat: true, Flags: FlagBottomUp})
+	require.Nil(t, err)
+	for y := 0; y < img.Height; y++ {
+		require.Equal(t, topDown.Pixels[(img.Height-1-y)*topDown.Stride:][:topDown.Stride], img.Pixels[y*img.Stride:][:img.Stride], "row %v", y)
+	}
+
+	_, err = DecompressRegion(jpg, image.Rect(900, 900, 1000, 1000), nil)
+	require.NotNil(t, err)
+
+	// PNG
+	nat, err := org.ToImage()
+	require.Nil(t, err)
+	buf := bytes.Buffer{}
+	require.Nil(t, png.Encode(&buf, nat))
+	img, err = DecompressRegion(buf.Bytes(), r, nil)
+	require.Nil(t, err)
+	require.Equal(t, 0.0, AvgRGBDifference(cropOf(org, r), img))
+}
+
 // This was a bug, but it went away when I added explicit PixelFormat into Image
 //func TestPNGBad(t *testing.T) {
 //	raw, _ := os.ReadFile("/home/ben/Downloads/ptguiviewer_icon.png")
@@ -233,6 +768,72 @@ func TestMatte(t *testing.T) {
 	rgb.Matte(0, 255, 0)
 }
 
+func TestLinearLight(t *testing.T) {
+	linear := &ProcessParams{LinearLight: true}
+
+	// Black and white average to mid gray in sRGB, but to a much lighter value in linear light
+	img := NewImage(2, 1, PixelFormatRGBA)
+	copy(img.Pixels, []byte{0, 0, 0, 255, 255, 255, 255, 0})
+	require.Equal(t, []byte{127, 127, 127, 127}, img.AvgColor())
+	require.Equal(t, []byte{188, 188, 188, 127}, img.AvgColorWithOptions(linear))
+
+	// Premultiplied colors are averaged straight, and returned premultiplied
+	copy(img.Pixels, []byte{0, 0, 0, 255, 255, 255, 255, 128})
+	avg := NewImage(1, 1, PixelFormatRGBA)
+	copy(avg.Pixels, img.AvgColorWithOptions(linear))
+	require.Equal(t, []byte{188, 188, 188, 191}, avg.Pixels)
+	avg.Premultiply()
+	img.Premultiply()
+	require.Equal(t, avg.Pixels, img.AvgColorWithOptions(linear))
+
+	// CMYK is averaged as RGB
+	cmyk := MakeRGB(37, 29).Convert(PixelFormatCMYK)
+	avg = NewImage(1, 1, PixelFormatRGB)
+	copy(avg.Pixels, cmyk.Convert(PixelFormatRGB).AvgColorWithOptions(linear))
+	require.Equal(t, avg.Convert(PixelFormatCMYK).Pixels, cmyk.AvgColorWithOptions(linear))
+
+	// Every value survives the round trip through linear light
+	gray := NewImage(256, 1, PixelFormatGRAY)
+	for i := 0; i < 256; i++ {
+		gray.Pixels[i] = byte(i)
+		require.Equal(t, []byte{byte(i)}, gray.ReferenceCrop(i, 0, i+1, 1).AvgColorWithOptions(linear))
+	}
+
+	// Matte
+	for _, premul := range []bool{false, true} {
+		for _, pf := range []PixelFormat{PixelFormatRGBA, PixelFormatARGB} {
+			img = NewImage(1, 1, PixelFormatRGBA)
+			copy(img.Pixels, []byte{255, 255, 255, 128})
+			img.Premultiplied = premul
+			if premul {
+				copy(img.Pixels, []byte{128, 128, 128, 128})
+			}
+			img = img.Convert(pf)
+			srgb := img.Clone()
+			srgb.Matte(0, 0, 0)
+			require.Equal(t, []byte{128, 128, 128}, srgb.ToRGB().Pixels)
+			img.MatteWithOptions(0, 0, 0, linear)
+			require.Equal(t, []byte{188, 188, 188}, img.ToRGB().Pixels)
+			require.Equal(t, []byte{255}, img.AvgColor()[img.alphaChannel():][:1])
+		}
+	}
+
+	// Gray
+	green := NewImage(1, 1, PixelFormatBGR)
+	copy(green.Pixels, []byte{0, 255, 0})
+	require.Equal(t, []byte{149}, green.ToGray().Pixels)
+	require.Equal(t, []byte{220}, green.ToGrayWithOptions(linear).Pixels)
+	require.Equal(t, gray.Pixels, gray.Convert(PixelFormatRGB).ToGrayWithOptions(linear).Pixels)
+	gray16 := gray.ConvertType(ComponentUint16)
+	require.Equal(t, gray16.Pixels, gray16.Convert(PixelFormatXRGB).ToGrayWithOptions(linear).Pixels)
+
+	// The same as converting to float32, which is linear
+	rgb := MakeRGB(37, 29)
+	ref := rgb.ConvertType(ComponentFloat32).ToGray().ConvertType(ComponentUint8)
+	require.Less(t, AvgRGBDifference(ref, rgb.ToGrayWithOptions(linear)), 0.1)
+	require.Less(t, AvgRGBDifference(ref, rgb.Convert(PixelFormatCMYK).ToGrayWithOptions(linear)), 1.0)
+}
+
 func TestToRGB(t *testing.T) {
 	rgba := MakeImage(4, 200, 100)
 	rgb := rgba.ToRGB()
@@ -240,6 +841,300 @@ func TestToRGB(t *testing.T) {
 	require.Equal(t, 0.0, diff)
 }
 
+func TestConvert(t *testing.T) {
+	isColor := func(pf PixelFormat) bool { return pf != PixelFormatGRAY && pf != PixelFormatCMYK }
+	hasAlpha := func(pf PixelFormat) bool {
+		_, _, _, a := channelOffsets(pf)
+		return a != -1
+	}
+	org := MakeRGBA(37, 29)
+	AddAlphaNoise(org)
+	for _, typ := range []ComponentType{ComponentUint8, ComponentUint16, ComponentFloat32} {
+		src := org
+		if typ == ComponentUint16 {
+			src = org.ConvertType(typ)
+		} else if typ == ComponentFloat32 {
+			// Use the raw values, because ConvertType would apply the sRGB curve
+			src = NewImageOfType(org.Width, org.Height, org.Format, typ)
+			for i, v := range org.Pixels {
+				src.PixelsFloat32()[i] = float32(v) / 255
+			}
+		}
+		for _, a := range allPixelFormats {
+			for _, b := range allPixelFormats {
+				if !isColor(a) || !isColor(b) {
+					continue
+				}
+				// Every color format pair must preserve the colors, and alpha if both formats have it
+				back := src.Convert(a).Convert(b).Convert(PixelFormatRGBA)
+				require.Equal(t, typ, back.Type)
+				for y := 0; y < src.Height; y++ {
+					for x := 0; x < src.Width; x++ {
+						e := src.RGBA64At(x, y)
+						r, g, bl, al := back.At(x, y).RGBA()
+						if !hasAlpha(a) || !hasAlpha(b) {
+							// Without alpha, the straight color is kept, and alpha becomes opaque
+							// (NRGBA64Model would go via premultiplied color, which loses precision)
+							switch n := src.At(x, y).(type) {
+							case color.NRGBA:
+								e = color.RGBA64{uint16(n.R) * 0x101, uint16(n.G) * 0x101, uint16(n.B) * 0x101, 0xffff}
+							case color.NRGBA64:
+								e = color.RGBA64{n.R, n.G, n.B, 0xffff}
+							}
+						}
+						require.InDelta(t, e.R, r, 1, "%v %v %v", typ, a, b)
+						require.InDelta(t, e.G, g, 1, "%v %v %v", typ, a, b)
+						require.InDelta(t, e.B, bl, 1, "%v %v %v", typ, a, b)
+						require.InDelta(t, e.A, al, 1, "%v %v %v", typ, a, b)
+					}
+				}
+			}
+		}
+	}
+
+	// Swizzling, padding, gray and CMYK, for 8-bit
+	px := NewImage(1, 1, PixelFormatBGRA)
+	copy(px.Pixels, []byte{10, 20, 30, 40})
+	require.Equal(t, []byte{30, 20, 10}, px.ToRGB().Pixels)
+	require.Equal(t, PixelFormatRGB, px.ToRGB().Format)
+	require.Equal(t, []byte{255, 30, 20, 10}, px.Convert(PixelFormatXRGB).Pixels)
+	require.Equal(t, []byte{40, 10, 20, 30}, px.Convert(PixelFormatABGR).Pixels)
+	require.Equal(t, []byte{(30*77 + 20*150 + 10*29) >> 8}, px.ToGray().Pixels)
+	cmyk := px.Convert(PixelFormatCMYK)
+	require.Equal(t, []byte{255, 170, 85, 30}, cmyk.Pixels)
+	require.Equal(t, []byte{30, 20, 10}, cmyk.ToRGB().Pixels)
+	require.Equal(t, []byte{255, 255, 255, 0}, NewImage(1, 1, PixelFormatRGB).Convert(PixelFormatCMYK).Pixels)
+
+	// Premultiplied is only kept if both formats have alpha
+	px.Premultiplied = true
+	require.True(t, px.Convert(PixelFormatARGB).Premultiplied)
+	require.False(t, px.Convert(PixelFormatRGBX).Premultiplied)
+
+	// ConvertInto a crop of a larger image
+	big := NewImage(50, 40, PixelFormatBGRX)
+	crop := big.ReferenceCrop(5, 6, 5+org.Width, 6+org.Height)
+	require.Nil(t, org.ConvertInto(crop))
+	require.Equal(t, org.ToRGB().Pixels, crop.ToRGB().Pixels)
+	require.Equal(t, []byte{0, 0, 0, 0}, big.Pixels[:4])
+	require.NotNil(t, org.ConvertInto(NewImage(10, 10, PixelFormatRGB)))
+	require.NotNil(t, org.ConvertInto(NewImageOfType(org.Width, org.Height, PixelFormatRGB, ComponentUint16)))
+}
+
+func TestUnpremultiply(t *testing.T) {
+	org := MakeRGBA(37, 29)
+	AddAlphaNoise(org)
+	for _, typ := range []ComponentType{ComponentUint8, ComponentUint16, ComponentFloat32} {
+		for _, pf := range []PixelFormat{PixelFormatRGBA, PixelFormatBGRA, PixelFormatABGR, PixelFormatARGB} {
+			straight := org.Convert(pf).ConvertType(typ)
+			img := straight.Clone()
+			img.Premultiply()
+			img.Unpremultiply()
+			require.False(t, img.Premultiplied)
+			for y := 0; y < img.Height; y++ {
+				for x := 0; x < img.Width; x++ {
+					// Low alpha loses precision, in proportion to 1/alpha
+					e := straight.At(x, y)
+					_, _, _, a := e.RGBA()
+					if a < 0x8000 {
+						continue
+					}
+					requireColorNear(t, e, img.At(x, y), 0x101, "%v %v", typ, pf)
+				}
+			}
+		}
+	}
+
+	// Zero alpha becomes transparent black
+	px := NewImage(1, 1, PixelFormatRGBA)
+	copy(px.Pixels, []byte{10, 20, 30, 0})
+	px.Premultiplied = true
+	px.Unpremultiply()
+	require.Equal(t, []byte{0, 0, 0, 0}, px.Pixels)
+	copy(px.Pixels, []byte{64, 32, 0, 128})
+	px.Premultiplied = true
+	px.Unpremultiply()
+	require.Equal(t, []byte{128, 64, 0, 128}, px.Pixels)
+
+	// Formats without alpha are left alone
+	rgbx := NewImageOfType(1, 1, PixelFormatRGBX, ComponentUint16)
+	rgbx.Pixels16()[0] = 1000
+	rgbx.Premultiply()
+	require.False(t, rgbx.Premultiplied)
+	require.Equal(t, uint16(1000), rgbx.Pixels16()[0])
+}
+
+func TestAlphaState(t *testing.T) {
+	// The same colors, from image.NRGBA and image.RGBA, must produce the same results
+	nrgba := image.NewNRGBA(image.Rect(0, 0, 40, 30))
+	rgba := image.NewRGBA(nrgba.Rect)
+	for y := 0; y < 30; y++ {
+		for x := 0; x < 40; x++ {
+			c := color.NRGBA{uint8(x * 6), uint8(y * 8), 200, uint8(128 + x*3)}
+			nrgba.SetNRGBA(x, y, c)
+			rgba.Set(x, y, c)
+		}
+	}
+	straight, err := FromImage(nrgba, false)
+	require.Nil(t, err)
+	premul, err := FromImage(rgba, false)
+	require.Nil(t, err)
+	require.True(t, premul.Premultiplied)
+
+	// 8-bit premultiplication loses a little precision
+	require.Less(t, AvgRGBDifference(straight.ToRGB(), premul.ToRGB()), 1.5)
+	require.Less(t, AvgRGBDifference(straight.ToGray(), premul.ToGray()), 0.5)
+	require.Less(t, AvgRGBDifference(straight.Convert(PixelFormatBGRX).ToRGB(), premul.Convert(PixelFormatBGRX).ToRGB()), 1.5)
+
+	jpg1, err := Compress(straight, MakeCompressParams(Sampling444, 95, 0))
+	require.Nil(t, err)
+	jpg2, err := Compress(premul, MakeCompressParams(Sampling444, 95, 0))
+	require.Nil(t, err)
+	dec1, err := Decompress(jpg1)
+	require.Nil(t, err)
+	dec2, err := Decompress(jpg2)
+	require.Nil(t, err)
+	require.Less(t, AvgRGBDifference(dec1, dec2), 2.0)
+
+	// Resize and Rotate keep the alpha state
+	small := ResizeNew(premul, 20, 15, nil)
+	require.True(t, small.Premultiplied)
+	small = ResizeNew(straight, 20, 15, nil)
+	require.False(t, small.Premultiplied)
+	rot := NewImage(40, 30, PixelFormatRGBA)
+	Rotate(premul, rot, 0.2, nil)
+	require.True(t, rot.Premultiplied)
+
+	// Rotating straight alpha must not bleed the color of transparent pixels into opaque pixels
+	img := NewImage(40, 30, PixelFormatRGBA)
+	for y := 0; y < 30; y++ {
+		for x := 0; x < 40; x++ {
+			if (x/4+y/4)%2 == 0 {
+				copy(img.Pixels[img.PixelByte(x, y):], []byte{255, 0, 0, 0})
+			} else {
+				copy(img.Pixels[img.PixelByte(x, y):], []byte{0, 255, 0, 255})
+			}
+		}
+	}
+	for _, typ := range []ComponentType{ComponentUint8, ComponentUint16, ComponentFloat32} {
+		src := img.ConvertType(typ)
+		rot = NewImageOfType(40, 30, PixelFormatRGBA, typ)
+		Rotate(src, rot, 0.3, nil)
+		require.False(t, rot.Premultiplied)
+		for y := 0; y < 30; y++ {
+			for x := 0; x < 40; x++ {
+				r, _, _, a := rot.At(x, y).RGBA()
+				if a > 0x1000 {
+					require.LessOrEqual(t, r, uint32(0x200), "%v %v,%v", typ, x, y)
+				}
+			}
+		}
+	}
+}
+
+// customImage hides the concrete type of an image, so that FromImage has to use At()
+type customImage struct {
+	image.Image
+}
+
+type subImager interface {
+	SubImage(r image.Rectangle) image.Image
+}
+
+func TestFromImage(t *testing.T) {
+	full := image.Rect(0, 0, 13, 9)
+	sub := image.Rect(3, 2, 11, 7)
+	pattern := func(x, y int) color.NRGBA {
+		return color.NRGBA{uint8(x * 19), uint8(y * 27), uint8(x*y*5 + 1), uint8(255 - x*7)}
+	}
+	fill := func(img draw.Image) draw.Image {
+		for y := full.Min.Y; y < full.Max.Y; y++ {
+			for x := full.Min.X; x < full.Max.X; x++ {
+				img.Set(x, y, pattern(x, y))
+			}
+		}
+		return img
+	}
+	ycc := image.NewYCbCr(full, image.YCbCrSubsampleRatio420)
+	nycca := image.NewNYCbCrA(full, image.YCbCrSubsampleRatio422)
+	for i := range ycc.Y {
+		ycc.Y[i] = uint8(i * 7)
+	}
+	for i := range ycc.Cb {
+		ycc.Cb[i], ycc.Cr[i] = uint8(i*11), uint8(255-i*5)
+	}
+	for i := range nycca.Y {
+		nycca.Y[i], nycca.A[i] = uint8(i*7), uint8(i*3)
+	}
+	for i := range nycca.Cb {
+		nycca.Cb[i], nycca.Cr[i] = uint8(i*11), uint8(255-i*5)
+	}
+	pal := color.Palette{color.NRGBA{255, 0, 0, 255}, color.NRGBA{0, 0, 255, 128}, color.NRGBA{0, 255, 0, 0}, color.White}
+
+	images := []image.Image{
+		fill(image.NewGray(full)),
+		fill(image.NewRGBA(full)),
+		fill(image.NewNRGBA(full)),
+		fill(image.NewGray16(full)),
+		fill(image.NewRGBA64(full)),
+		fill(image.NewNRGBA64(full)),
+		fill(image.NewAlpha(full)),
+		fill(image.NewAlpha16(full)),
+		fill(image.NewCMYK(full)),
+		fill(image.NewPaletted(full, pal)),
+		ycc,
+		nycca,
+	}
+
+	// The second sub-image touches the bottom-right corner, so when it is shared, its last row is
+	// shorter than its stride
+	for _, sub := range []image.Rectangle{sub, image.Rect(5, 4, 13, 9)} {
+		var subImages []image.Image
+		for _, img := range images {
+			subImages = append(subImages, img.(subImager).SubImage(sub))
+		}
+		subImages = append(subImages, customImage{subImages[2]})
+		for _, src := range subImages {
+			for _, share := range []bool{false, true} {
+				c, err := FromImage(src, share)
+				require.Nil(t, err, "%T", src)
+				require.Equal(t, sub.Dx(), c.Width)
+				require.Equal(t, sub.Dy(), c.Height)
+				if c.Format == PixelFormatCMYK {
+					c = c.Convert(PixelFormatRGB)
+				}
+				back, err := c.ToImage()
+				require.Nil(t, err)
+				for y := 0; y < sub.Dy(); y++ {
+					for x := 0; x < sub.Dx(); x++ {
+						r1, g1, b1, a1 := src.At(sub.Min.X+x, sub.Min.Y+y).RGBA()
+						r2, g2, b2, a2 := back.At(x, y).RGBA()
+						for _, d := range []int{int(r1) - int(r2), int(g1) - int(g2), int(b1) - int(b2), int(a1) - int(a2)} {
+							require.LessOrEqual(t, intAbs(d), 2*257, "%T (%v,%v)", src, x, y)
+						}
+					}
+				}
+			}
+		}
+	}
+
+	// Palettes without transparency produce RGB
+	opaque := image.NewPaletted(full, color.Palette{color.Black, color.White})
+	c, err := FromImage(opaque, false)
+	require.Nil(t, err)
+	require.Equal(t, PixelFormatRGB, c.Format)
+
+	// Shared pixels
+	gray := fill(image.NewGray(full)).(*image.Gray)
+	c, err = FromImage(gray.SubImage(sub), true)
+	require.Nil(t, err)
+	gray.SetGray(sub.Min.X+1, sub.Min.Y+1, color.Gray{Y: 42})
+	require.Equal(t, byte(42), c.Pixels[c.PixelByte(1, 1)])
+	c, err = FromImage(gray.SubImage(sub), false)
+	require.Nil(t, err)
+	gray.SetGray(sub.Min.X+1, sub.Min.Y+1, color.Gray{Y: 43})
+	require.Equal(t, byte(42), c.Pixels[c.PixelByte(1, 1)])
+}
+
 // Read EXIF data from a known good JPEG file
 func TestReadExif(t *testing.T) {
 	enc, err := ioutil.ReadFile("test/rotated270.jpg")
@@ -409,3 +1304,57 @@ func BenchmarkResizeRGBUp(b *testing.B) {
 		ResizeNew(org, 640, 640, &params)
 	}
 }
+
+func TestYUV(t *testing.T) {
+	org := MakeRGB(101, 67)
+	for _, sampling := range []Sampling{Sampling444, Sampling422, Sampling420, SamplingGray} {
+		yuv, err := EncodeYUV(org, sampling)
+		require.Nil(t, err)
+		require.Equal(t, yuvNumPlanes(sampling), yuv.NumPlanes())
+
+		format := PixelFormatRGB
+		ref := org
+		if sampling == SamplingGray {
+			format = PixelFormatGRAY
+			ref = org.ToGray()
+		}
+
+		// YUV -> RGB
+		rgb, err := DecodeYUV(yuv, format)
+		require.Nil(t, err)
+		require.Less(t, AvgRGBDifference(ref, rgb), 15.0)
+
+		// YUV -> JPEG -> RGB
+		jpg, err := CompressYUV(yuv, MakeCompressParams(sampling, 95, 0))
+		require.Nil(t, err)
+		dec, err := DecompressWithOptions(jpg, &DecompressParams{Format: format, HasFormat: true})
+		require.Nil(t, err)
+		require.Less(t, AvgRGBDifference(ref, dec), 15.0)
+
+		// JPEG -> YUV
+		yuv2, err := DecompressToYUV(jpg, nil)
+		require.Nil(t, err)
+		require.Equal(t, sampling, yuv2.Sampling)
+		rgb2, err := DecodeYUV(yuv2, format)
+		require.Nil(t, err)
+		require.Less(t, AvgRGBDifference(dec, rgb2), 15.0)
+	}
+
+	// Wrap an I420 frame
+	w, h := 64, 48
+	y := make([]byte, w*h)
+	u := make([]byte, w*h/4)
+	v := make([]byte, w*h/4)
+	yuv, err := WrapYUVImage(w, h, Sampling420, [][]byte{y, u, v}, []int{w, w / 2, w / 2})
+	require.Nil(t, err)
+	_, err = CompressYUV(yuv, MakeCompressParams(Sampling420, 90, 0))
+	require.Nil(t, err)
+	_, err = WrapYUVImage(w, h, Sampling420, [][]byte{y, u[:10], v}, []int{w, w / 2, w / 2})
+	require.NotNil(t, err)
+
+	// An unknown sampling, which is what TurboJPEG reports for a JPEG with unusual sampling factors
+	require.NotNil(t, checkYUVDimensions(w, h, Sampling(-1)))
+	require.NotNil(t, checkYUVDimensions(0, h, Sampling420))
+	require.Nil(t, checkYUVDimensions(w, h, Sampling420))
+	require.Panics(t, func() { NewYUVImage(w, h, Sampling(-1)) })
+}
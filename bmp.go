@@ -0,0 +1,333 @@
+package cimg
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+)
+
+// BMP compression methods
+const (
+	bmpRGB            = 0
+	bmpBitFields      = 3
+	bmpAlphaBitFields = 6
+)
+
+type bmpHeader struct {
+	width       int
+	height      int
+	topDown     bool
+	bpp         int
+	compression uint32
+	masks       [4]uint32 // R, G, B, A
+	palette     [][3]byte // RGB
+	dataOffset  int
+}
+
+func isBMP(encoded []byte) bool {
+	return len(encoded) > 26 && encoded[0] == 'B' && encoded[1] == 'M'
+}
+
+func parseBMPHeader(encoded []byte) (*bmpHeader, error) {
+	if !isBMP(encoded) {
+		return nil, errors.New("Not a BMP file")
+	}
+	le := binary.LittleEndian
+	h := &bmpHeader{dataOffset: int(le.Uint32(encoded[10:]))}
+	dibSize := int(le.Uint32(encoded[14:]))
+	if dibSize < 12 || 14+dibSize > len(encoded) {
+		return nil, errors.New("Invalid BMP header")
+	}
+	dib := encoded[14 : 14+dibSize]
+	paletteEntrySize := 4
+	if dibSize == 12 {
+		// BITMAPCOREHEADER
+		h.width = int(le.Uint16(dib[4:]))
+		h.height = int(le.Uint16(dib[6:]))
+		h.bpp = int(le.Uint16(dib[10:]))
+		paletteEntrySize = 3
+	} else {
+		if dibSize < 40 {
+			return nil, errors.New("Invalid BMP header")
+		}
+		h.width = int(int32(le.Uint32(dib[4:])))
+		h.height = int(int32(le.Uint32(dib[8:])))
+		h.bpp = int(le.Uint16(dib[14:]))
+		h.compression = le.Uint32(dib[16:])
+	}
+	if h.height < 0 {
+		h.height = -h.height
+		h.topDown = true
+	}
+	if h.width <= 0 || h.height <= 0 {
+		return nil, fmt.Errorf("Invalid BMP dimensions %v x %v", h.width, h.height)
+	}
+
+	// The color masks are either inside the header (V2 and later), or they follow a BITMAPINFOHEADER
+	paletteStart := 14 + dibSize
+	switch h.compression {
+	case bmpRGB:
+		switch h.bpp {
+		case 16:
+			h.masks = [4]uint32{0x7c00, 0x03e0, 0x001f, 0}
+		case 24, 32:
+			h.masks = [4]uint32{0xff0000, 0x00ff00, 0x0000ff, 0}
+		}
+	case bmpBitFields, bmpAlphaBitFields:
+		nmasks := 3
+		if h.compression == bmpAlphaBitFields || dibSize >= 56 {
+			nmasks = 4
+		}
+		if 14+40+4*nmasks > len(encoded) {
+			return nil, errors.New("Truncated BMP header")
+		}
+		for i := 0; i < nmasks; i++ {
+			h.masks[i] = le.Uint32(encoded[14+40+4*i:])
+		}
+		if dibSize == 40 {
+			paletteStart += 4 * nmasks
+		}
+	default:
+		return nil, fmt.Errorf("Unsupported BMP compression %v", h.compression)
+	}
+
+	switch h.bpp {
+	case 1, 2, 4, 8:
+		n := 1 << h.bpp
+		if dibSize >= 40 {
+			if used := int(le.Uint32(dib[32:])); used > 0 && used < n {
+				n = used
+			}
+		}
+		if paletteStart+n*paletteEntrySize > len(encoded) {
+			return nil, errors.New("Truncated BMP palette")
+		}
+		h.palette = make([][3]byte, n)
+		for i := range h.palette {
+			e := encoded[paletteStart+i*paletteEntrySize:]
+			h.palette[i] = [3]byte{e[2], e[1], e[0]}
+		}
+	case 16, 24, 32:
+	default:
+		return nil, fmt.Errorf("Unsupported BMP bit depth %v", h.bpp)
+	}
+	return h, nil
+}
+
+func (h *bmpHeader) stride() int {
+	return ((h.width*h.bpp + 31) / 32) * 4
+}
+
+// pixelFormat returns GRAY for a paletted image whose palette is entirely gray,
+// RGBA if the image has an alpha mask, and otherwise RGB.
+func (h *bmpHeader) pixelFormat() PixelFormat {
+	if h.palette != nil {
+		for _, c := range h.palette {
+			if c[0] != c[1] || c[1] != c[2] {
+				return PixelFormatRGB
+			}
+		}
+		return PixelFormatGRAY
+	}
+	if h.masks[3] != 0 {
+		return PixelFormatRGBA
+	}
+	return PixelFormatRGB
+}
+
+func decodeConfigBMP(encoded []byte) (ImageConfig, error) {
+	h, err := parseBMPHeader(encoded)
+	if err != nil {
+		return ImageConfig{}, err
+	}
+	cfg := ImageConfig{
+		Format:     FormatBMP,
+		Width:      h.width,
+		Height:     h.height,
+		NChan:      NChan(h.pixelFormat()),
+		BitDepth:   8,
+		Sampling:   SamplingUnknown,
+		Colorspace: ColorspaceRGB,
+	}
+	if cfg.NChan == 1 {
+		cfg.Colorspace = ColorspaceGray
+	}
+	if h.bpp < 8 {
+		cfg.BitDepth = h.bpp
+	}
+	return cfg, nil
+}
+
+// bmpChannel extracts one channel from a pixel, and scales it to 8 bits
+type bmpChannel struct {
+	mask  uint32
+	shift int
+	max   uint32
+}
+
+func makeBMPChannel(mask uint32) bmpChannel {
+	if mask == 0 {
+		return bmpChannel{}
+	}
+	shift := bits.TrailingZeros32(mask)
+	return bmpChannel{mask: mask, shift: shift, max: mask >> shift}
+}
+
+func (c bmpChannel) get(v uint32) byte {
+	if c.max == 0 {
+		return 255
+	}
+	x := (v & c.mask) >> c.shift
+	if c.max == 255 {
+		return byte(x)
+	}
+	return byte((x*255 + c.max/2) / c.max)
+}
+
+func decompressBMP(encoded []byte, params *DecompressParams) (*Image, error) {
+	h, err := parseBMPHeader(encoded)
+	if err != nil {
+		return nil, err
+	}
+	stride := h.stride()
+	if h.dataOffset < 0 || h.dataOffset > len(encoded) || (len(encoded)-h.dataOffset)/stride < h.height {
+		return nil, errors.New("Truncated BMP file")
+	}
+	img := NewImage(h.width, h.height, h.pixelFormat())
+	nchan := img.NChan()
+	le := binary.LittleEndian
+	channels := [4]bmpChannel{makeBMPChannel(h.masks[0]), makeBMPChannel(h.masks[1]), makeBMPChannel(h.masks[2]), makeBMPChannel(h.masks[3])}
+
+	for y := 0; y < h.height; y++ {
+		srcY := h.height - 1 - y
+		if h.topDown {
+			srcY = y
+		}
+		src := encoded[h.dataOffset+srcY*stride : h.dataOffset+(srcY+1)*stride]
+		out := img.Pixels[y*img.Stride : y*img.Stride+h.width*nchan]
+		switch {
+		case h.palette != nil:
+			ppb := 8 / h.bpp // pixels per byte
+			for x := 0; x < h.width; x++ {
+				shift := 8 - h.bpp*(x%ppb+1)
+				idx := int(src[x/ppb]>>shift) & (1<<h.bpp - 1)
+				var c [3]byte
+				if idx < len(h.palette) {
+					c = h.palette[idx]
+				}
+				if nchan == 1 {
+					out[x] = c[0]
+				} else {
+					out[x*3], out[x*3+1], out[x*3+2] = c[0], c[1], c[2]
+				}
+			}
+		case h.bpp == 24 && h.compression == bmpRGB:
+			for x := 0; x < h.width; x++ {
+				out[x*3], out[x*3+1], out[x*3+2] = src[x*3+2], src[x*3+1], src[x*3]
+			}
+		default:
+			bpp := h.bpp / 8
+			for x := 0; x < h.width; x++ {
+				var v uint32
+				switch bpp {
+				case 2:
+					v = uint32(le.Uint16(src[x*2:]))
+				case 3:
+					v = uint32(src[x*3]) | uint32(src[x*3+1])<<8 | uint32(src[x*3+2])<<16
+				case 4:
+					v = le.Uint32(src[x*4:])
+				}
+				d := out[x*nchan:]
+				d[0] = channels[0].get(v)
+				d[1] = channels[1].get(v)
+				d[2] = channels[2].get(v)
+				if nchan == 4 {
+					d[3] = channels[3].get(v)
+				}
+			}
+		}
+	}
+	return applyDecompressFormat(img, params), nil
+}
+
+// EncodeBMP writes an image as a BMP.
+// GRAY images are written as 8-bit paletted, images with alpha as 32-bit BGRA (with a
+// BITMAPV4HEADER, so that readers know about the alpha channel), and all others as 24-bit BGR.
+func EncodeBMP(w io.Writer, img *Image) error {
+	src := img.asUint8().toGrayRGBOrRGBA()
+	nchan := src.NChan()
+	bpp := nchan * 8
+	dibSize := 40
+	paletteSize := 0
+	compression := uint32(bmpRGB)
+	switch nchan {
+	case 1:
+		paletteSize = 256 * 4
+	case 4:
+		dibSize = 108
+		compression = bmpBitFields
+	}
+	stride := ((src.Width*bpp + 31) / 32) * 4
+	dataOffset := 14 + dibSize + paletteSize
+	fileSize := int64(dataOffset) + int64(stride)*int64(src.Height)
+	if fileSize > 0xffffffff {
+		return errors.New("Image is too large for BMP")
+	}
+
+	le := binary.LittleEndian
+	header := make([]byte, 0, dataOffset)
+	header = append(header, 'B', 'M')
+	header = le.AppendUint32(header, uint32(fileSize))
+	header = le.AppendUint32(header, 0)
+	header = le.AppendUint32(header, uint32(dataOffset))
+	header = le.AppendUint32(header, uint32(dibSize))
+	header = le.AppendUint32(header, uint32(src.Width))
+	header = le.AppendUint32(header, uint32(src.Height)) // bottom-up
+	header = le.AppendUint16(header, 1)                  // planes
+	header = le.AppendUint16(header, uint16(bpp))
+	header = le.AppendUint32(header, compression)
+	header = le.AppendUint32(header, uint32(stride*src.Height))
+	header = le.AppendUint32(header, 2835) // 72 DPI
+	header = le.AppendUint32(header, 2835)
+	header = le.AppendUint32(header, 0) // colors used
+	header = le.AppendUint32(header, 0) // important colors
+	if dibSize == 108 {
+		header = le.AppendUint32(header, 0x00ff0000)
+		header = le.AppendUint32(header, 0x0000ff00)
+		header = le.AppendUint32(header, 0x000000ff)
+		header = le.AppendUint32(header, 0xff000000)
+		header = le.AppendUint32(header, 0x73524742) // LCS_sRGB
+		header = append(header, make([]byte, 36+12)...)
+	}
+	for i := 0; i < paletteSize/4; i++ {
+		header = append(header, byte(i), byte(i), byte(i), 0)
+	}
+
+	bw := bufio.NewWriter(w)
+	if _, err := bw.Write(header); err != nil {
+		return err
+	}
+	row := make([]byte, stride)
+	for y := src.Height - 1; y >= 0; y-- {
+		in := src.Pixels[y*src.Stride : y*src.Stride+src.Width*nchan]
+		switch nchan {
+		case 1:
+			copy(row, in)
+		case 3:
+			for x := 0; x < src.Width; x++ {
+				row[x*3], row[x*3+1], row[x*3+2] = in[x*3+2], in[x*3+1], in[x*3]
+			}
+		case 4:
+			for x := 0; x < src.Width; x++ {
+				row[x*4], row[x*4+1], row[x*4+2], row[x*4+3] = in[x*4+2], in[x*4+1], in[x*4], in[x*4+3]
+			}
+		}
+		if _, err := bw.Write(row); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,48 @@
+package cimg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBMP(t *testing.T) {
+	org := MakeRGBA(61, 43)
+	AddAlphaNoise(org)
+	for _, img := range []*Image{org.Convert(PixelFormatGRAY), org.Convert(PixelFormatRGB), org} {
+		buf := bytes.Buffer{}
+		require.Nil(t, EncodeBMP(&buf, img))
+		cfg, err := DecodeConfig(buf.Bytes())
+		require.Nil(t, err)
+		require.Equal(t, FormatBMP, cfg.Format)
+		require.Equal(t, img.NChan(), cfg.NChan)
+		dec, err := Decompress(buf.Bytes())
+		require.Nil(t, err)
+		require.Equal(t, img.Format, dec.Format)
+		require.Equal(t, img.Pixels, dec.Pixels, "%v", img.Format)
+	}
+
+	// A hand-made top-down 16-bit (5-5-5) BMP
+	le := binary.LittleEndian
+	enc := []byte{'B', 'M'}
+	enc = le.AppendUint32(enc, 14+40+4)
+	enc = le.AppendUint32(enc, 0)
+	enc = le.AppendUint32(enc, 14+40)
+	enc = le.AppendUint32(enc, 40)
+	enc = le.AppendUint32(enc, 2)
+	enc = le.AppendUint32(enc, 0xffffffff) // height -1
+	enc = le.AppendUint16(enc, 1)
+	enc = le.AppendUint16(enc, 16)
+	enc = append(enc, make([]byte, 24)...)
+	enc = le.AppendUint16(enc, 0x7c00) // red
+	enc = le.AppendUint16(enc, 0x001f) // blue
+	dec, err := Decompress(enc)
+	require.Nil(t, err)
+	require.Equal(t, PixelFormatRGB, dec.Format)
+	require.Equal(t, []byte{255, 0, 0, 0, 0, 255}, dec.Pixels)
+
+	_, err = Decompress(enc[:len(enc)-2])
+	require.NotNil(t, err)
+}
@@ -1,10 +1,10 @@
 package cimg
 
 /*
-#cgo darwin,amd64 CPPFLAGS: -I/usr/local/opt/jpeg-turbo/include
-#cgo darwin,amd64 LDFLAGS: -L/usr/local/opt/jpeg-turbo/lib
+#cgo darwin,amd64 CPPFLAGS: -I/usr/local/opt/jpeg-turbo/include -I/usr/local/opt/webp/include
+#cgo darwin,amd64 LDFLAGS: -L/usr/local/opt/jpeg-turbo/lib -L/usr/local/opt/webp/lib
 
-#cgo darwin,arm64 CPPFLAGS: -I/opt/homebrew/opt/jpeg-turbo/include
-#cgo darwin,arm64 LDFLAGS: -L/opt/homebrew/opt/jpeg-turbo/lib
+#cgo darwin,arm64 CPPFLAGS: -I/opt/homebrew/opt/jpeg-turbo/include -I/opt/homebrew/opt/webp/include
+#cgo darwin,arm64 LDFLAGS: -L/opt/homebrew/opt/jpeg-turbo/lib -L/opt/homebrew/opt/webp/lib
 */
 import "C"
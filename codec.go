@@ -0,0 +1,242 @@
+package cimg
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// ErrUnknownFormat is returned when an image is not in any of the registered formats
+var ErrUnknownFormat = errors.New("Unknown image format")
+
+// Codec is an image file format, which can be added to the registry with RegisterCodec
+type Codec struct {
+	Name         string                                                         // eg "jpeg". This is the value of ImageConfig.Format and EncodeParams.Format.
+	Extensions   []string                                                       // Lowercase file extensions, including the dot, eg ".jpg"
+	Sniff        func(encoded []byte) bool                                      // Returns true if the encoded data is in this format
+	Decode       func(encoded []byte, params *DecompressParams) (*Image, error) // params is never nil. Limits have already been checked.
+	DecodeConfig func(encoded []byte) (ImageConfig, error)                      // Read the header, without decoding any pixels
+	Encode       func(w io.Writer, img *Image, params *EncodeParams) error      // May be nil if the format is read-only. params is never nil.
+}
+
+var (
+	codecsLock sync.RWMutex
+	codecs     []*Codec
+)
+
+// The built-in codecs. JPEG is special, because it is decoded with the caller's Decoder.
+var (
+	jpegCodec = &Codec{
+		Name:       FormatJPEG,
+		Extensions: []string{".jpg", ".jpeg", ".jpe", ".jfif"},
+		Sniff:      isJPEG,
+		Decode: func(encoded []byte, params *DecompressParams) (*Image, error) {
+			decoder, err := getDecoder()
+			if err != nil {
+				return nil, err
+			}
+			defer putDecoder(decoder)
+			return decoder.decompressJPEG(encoded, params)
+		},
+		DecodeConfig: func(encoded []byte) (ImageConfig, error) {
+			decoder, err := getDecoder()
+			if err != nil {
+				return ImageConfig{}, err
+			}
+			defer putDecoder(decoder)
+			return decoder.decodeConfigJPEG(encoded)
+		},
+		Encode: func(w io.Writer, img *Image, params *EncodeParams) error {
+			jpeg := params.JPEG
+			if jpeg.Quality == 0 {
+				jpeg = MakeCompressParams(Sampling420, 90, jpeg.Flags)
+			}
+			return CompressTo(w, img, jpeg)
+		},
+	}
+	pngCodec = &Codec{
+		Name:         FormatPNG,
+		Extensions:   []string{".png"},
+		Sniff:        isPNG,
+		Decode:       decompressPNG,
+		DecodeConfig: decodeConfigPNG,
+		Encode: func(w io.Writer, img *Image, params *EncodeParams) error {
+			return EncodePNGTo(w, img, params.PNG)
+		},
+	}
+	tiffCodec = &Codec{
+		Name:         FormatTIFF,
+		Extensions:   []string{".tif", ".tiff"},
+		Sniff:        isTIFF,
+		Decode:       decompressTIFF,
+		DecodeConfig: decodeConfigTIFF,
+		Encode: func(w io.Writer, img *Image, params *EncodeParams) error {
+			return EncodeTIFFTo(w, img, params.TIFF)
+		},
+	}
+	gifCodec = &Codec{
+		Name:         FormatGIF,
+		Extensions:   []string{".gif"},
+		Sniff:        isGIF,
+		Decode:       decompressGIF,
+		DecodeConfig: decodeConfigGIF,
+		Encode: func(w io.Writer, img *Image, params *EncodeParams) error {
+			return EncodeGIF(w, img)
+		},
+	}
+	bmpCodec = &Codec{
+		Name:         FormatBMP,
+		Extensions:   []string{".bmp", ".dib"},
+		Sniff:        isBMP,
+		Decode:       decompressBMP,
+		DecodeConfig: decodeConfigBMP,
+		Encode: func(w io.Writer, img *Image, params *EncodeParams) error {
+			return EncodeBMP(w, img)
+		},
+	}
+	pnmCodec = &Codec{
+		Name:         FormatPNM,
+		Extensions:   []string{".pnm", ".pbm", ".pgm", ".ppm", ".pam"},
+		Sniff:        isPNM,
+		Decode:       decompressPNM,
+		DecodeConfig: decodeConfigPNM,
+		Encode: func(w io.Writer, img *Image, params *EncodeParams) error {
+			return EncodePNM(w, img)
+		},
+	}
+	webpCodec = &Codec{
+		Name:         FormatWebP,
+		Extensions:   []string{".webp"},
+		Sniff:        isWebP,
+		Decode:       decompressWebP,
+		DecodeConfig: decodeConfigWebP,
+		Encode: func(w io.Writer, img *Image, params *EncodeParams) error {
+			return EncodeWebP(w, img, params.WebP)
+		},
+	}
+	qoiCodec = &Codec{
+		Name:         FormatQOI,
+		Extensions:   []string{".qoi"},
+		Sniff:        isQOI,
+		Decode:       decompressQOI,
+		DecodeConfig: decodeConfigQOI,
+		Encode: func(w io.Writer, img *Image, params *EncodeParams) error {
+			return EncodeQOI(w, img)
+		},
+	}
+)
+
+func init() {
+	RegisterCodec(jpegCodec)
+	RegisterCodec(pngCodec)
+	RegisterCodec(tiffCodec)
+	RegisterCodec(gifCodec)
+	RegisterCodec(bmpCodec)
+	RegisterCodec(pnmCodec)
+	RegisterCodec(webpCodec)
+	RegisterCodec(qoiCodec)
+}
+
+// RegisterCodec adds an image format to the registry, so that it is recognized by Decompress,
+// DecodeConfig, ReadFile, WriteFile, etc.
+// If a codec with the same name is already registered, then it is replaced.
+// Name, Sniff, Decode and DecodeConfig are required.
+func RegisterCodec(c *Codec) {
+	if c.Name == "" || c.Sniff == nil || c.Decode == nil || c.DecodeConfig == nil {
+		panic("cimg: RegisterCodec requires Name, Sniff, Decode, and DecodeConfig")
+	}
+	codecsLock.Lock()
+	defer codecsLock.Unlock()
+	for i, existing := range codecs {
+		if existing.Name == c.Name {
+			codecs[i] = c
+			return
+		}
+	}
+	codecs = append(codecs, c)
+}
+
+// LookupCodec returns the codec with the given name, or nil if there is no such codec
+func LookupCodec(name string) *Codec {
+	codecsLock.RLock()
+	defer codecsLock.RUnlock()
+	for _, c := range codecs {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// Codecs returns all of the registered codecs, in the order in which they are sniffed
+func Codecs() []*Codec {
+	codecsLock.RLock()
+	defer codecsLock.RUnlock()
+	return append([]*Codec(nil), codecs...)
+}
+
+func detectCodec(encoded []byte) *Codec {
+	codecsLock.RLock()
+	defer codecsLock.RUnlock()
+	for _, c := range codecs {
+		if c.Sniff(encoded) {
+			return c
+		}
+	}
+	return nil
+}
+
+func codecForExtension(filename string) *Codec {
+	ext := strings.ToLower(filepath.Ext(filename))
+	codecsLock.RLock()
+	defer codecsLock.RUnlock()
+	for _, c := range codecs {
+		for _, e := range c.Extensions {
+			if e == ext {
+				return c
+			}
+		}
+	}
+	return nil
+}
+
+// DetectFormat returns the name of the format of an encoded image (eg FormatJPEG), by looking
+// at its content. Returns ErrUnknownFormat if none of the registered codecs recognize it.
+func DetectFormat(encoded []byte) (string, error) {
+	c := detectCodec(encoded)
+	if c == nil {
+		return "", ErrUnknownFormat
+	}
+	return c.Name, nil
+}
+
+func isJPEG(encoded []byte) bool {
+	return len(encoded) > 3 && encoded[0] == 0xff && encoded[1] == 0xd8 && encoded[2] == 0xff
+}
+
+// WriteFile encodes the image and writes it to a file.
+// If params.Format is empty, then the format is chosen by the file extension.
+// params may be nil.
+func (img *Image) WriteFile(filename string, params *EncodeParams, perm os.FileMode) error {
+	if params == nil {
+		params = &EncodeParams{}
+	}
+	p := *params
+	if p.Format == "" {
+		c := codecForExtension(filename)
+		if c == nil {
+			return fmt.Errorf("%w: %v", ErrUnknownFormat, filename)
+		}
+		p.Format = c.Name
+	}
+	buf := bytes.Buffer{}
+	if err := EncodeWriter(&buf, img, p); err != nil {
+		return err
+	}
+	return os.WriteFile(filename, buf.Bytes(), perm)
+}
@@ -0,0 +1,235 @@
+package cimg
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+)
+
+// Image implements image.Image and draw.Image, so that it can be passed directly to the
+// standard library (image/png, image/draw, golang.org/x/image/draw, font rendering, etc),
+// without copying. It also implements image.RGBA64Image and draw.RGBA64Image, which
+// image/draw uses to avoid allocating a color.Color for every pixel.
+//
+// The color type of each pixel depends on the format and component type:
+//   - GRAY is color.Gray, or color.Gray16 for 16-bit and float32 images
+//   - CMYK is color.CMYK (converted from our inverted CMYK)
+//   - Other 8-bit formats are color.RGBA if Premultiplied or without alpha, otherwise color.NRGBA
+//   - Other 16-bit and float32 formats are color.RGBA64 or color.NRGBA64, in the same way
+//
+// Float32 pixels are converted to and from sRGB, because that is what Go's colors hold.
+// For formats without an alpha channel, Set stores the color as if it were composited onto black,
+// and At always returns an opaque color.
+var _ draw.RGBA64Image = (*Image)(nil)
+
+// Bounds returns the rectangle (0, 0, Width, Height)
+func (img *Image) Bounds() image.Rectangle {
+	return image.Rect(0, 0, img.Width, img.Height)
+}
+
+// ColorModel returns the color model of the image's pixels. See At for the types.
+func (img *Image) ColorModel() color.Model {
+	_, _, _, alpha := channelOffsets(img.Format)
+	switch {
+	case img.Format == PixelFormatGRAY && img.Type == ComponentUint8:
+		return color.GrayModel
+	case img.Format == PixelFormatGRAY:
+		return color.Gray16Model
+	case img.Format == PixelFormatCMYK:
+		return color.CMYKModel
+	case img.Type == ComponentUint8 && (img.Premultiplied || alpha == -1):
+		return color.RGBAModel
+	case img.Type == ComponentUint8:
+		return color.NRGBAModel
+	case img.Premultiplied || alpha == -1:
+		return color.RGBA64Model
+	}
+	return color.NRGBA64Model
+}
+
+// At returns the color of the pixel at (x, y), in the type of ColorModel.
+// Pixels outside of the image are transparent black, converted by ColorModel.
+func (img *Image) At(x, y int) color.Color {
+	if !(image.Point{x, y}.In(img.Bounds())) {
+		return img.ColorModel().Convert(color.Transparent)
+	}
+	return img.makeColor(img.get16(x, y))
+}
+
+// RGBA64At returns the premultiplied color of the pixel at (x, y)
+func (img *Image) RGBA64At(x, y int) color.RGBA64 {
+	if !(image.Point{x, y}.In(img.Bounds())) {
+		return color.RGBA64{}
+	}
+	v := img.get16(x, y)
+	switch {
+	case img.Format == PixelFormatGRAY:
+		return color.RGBA64{uint16(v[0]), uint16(v[0]), uint16(v[0]), 0xffff}
+	case img.Format == PixelFormatCMYK:
+		// Inverted CMYK is already the fraction of light that is reflected
+		return color.RGBA64{uint16(v[0] * v[3] / 0xffff), uint16(v[1] * v[3] / 0xffff), uint16(v[2] * v[3] / 0xffff), 0xffff}
+	case !img.Premultiplied:
+		v[0] = v[0] * v[3] / 0xffff
+		v[1] = v[1] * v[3] / 0xffff
+		v[2] = v[2] * v[3] / 0xffff
+	}
+	return color.RGBA64{uint16(v[0]), uint16(v[1]), uint16(v[2]), uint16(v[3])}
+}
+
+// Set sets the pixel at (x, y), after converting c with ColorModel.
+// Pixels outside of the image are ignored.
+func (img *Image) Set(x, y int, c color.Color) {
+	if !(image.Point{x, y}.In(img.Bounds())) {
+		return
+	}
+	var v [4]uint32
+	switch m := img.ColorModel().Convert(c).(type) {
+	case color.Gray:
+		y := uint32(m.Y) * 0x101
+		v = [4]uint32{y, y, y, 0xffff}
+	case color.Gray16:
+		y := uint32(m.Y)
+		v = [4]uint32{y, y, y, 0xffff}
+	case color.CMYK:
+		v = [4]uint32{uint32(255-m.C) * 0x101, uint32(255-m.M) * 0x101, uint32(255-m.Y) * 0x101, uint32(255-m.K) * 0x101}
+	case color.RGBA:
+		v = [4]uint32{uint32(m.R) * 0x101, uint32(m.G) * 0x101, uint32(m.B) * 0x101, uint32(m.A) * 0x101}
+	case color.NRGBA:
+		v = [4]uint32{uint32(m.R) * 0x101, uint32(m.G) * 0x101, uint32(m.B) * 0x101, uint32(m.A) * 0x101}
+	case color.RGBA64:
+		v = [4]uint32{uint32(m.R), uint32(m.G), uint32(m.B), uint32(m.A)}
+	case color.NRGBA64:
+		v = [4]uint32{uint32(m.R), uint32(m.G), uint32(m.B), uint32(m.A)}
+	}
+	img.set16(x, y, v)
+}
+
+// SetRGBA64 sets the pixel at (x, y) to a premultiplied color
+func (img *Image) SetRGBA64(x, y int, c color.RGBA64) {
+	_, _, _, alpha := channelOffsets(img.Format)
+	if img.Format == PixelFormatGRAY || img.Format == PixelFormatCMYK || (alpha != -1 && !img.Premultiplied) {
+		img.Set(x, y, c)
+		return
+	}
+	if !(image.Point{x, y}.In(img.Bounds())) {
+		return
+	}
+	img.set16(x, y, [4]uint32{uint32(c.R), uint32(c.G), uint32(c.B), uint32(c.A)})
+}
+
+// makeColor builds the ColorModel's color from the 16-bit values returned by get16
+func (img *Image) makeColor(v [4]uint32) color.Color {
+	switch m := img.ColorModel(); m {
+	case color.GrayModel:
+		return color.Gray{uint8(v[0] >> 8)}
+	case color.Gray16Model:
+		return color.Gray16{uint16(v[0])}
+	case color.CMYKModel:
+		return color.CMYK{255 - uint8(v[0]>>8), 255 - uint8(v[1]>>8), 255 - uint8(v[2]>>8), 255 - uint8(v[3]>>8)}
+	case color.RGBAModel:
+		return color.RGBA{uint8(v[0] >> 8), uint8(v[1] >> 8), uint8(v[2] >> 8), uint8(v[3] >> 8)}
+	case color.NRGBAModel:
+		return color.NRGBA{uint8(v[0] >> 8), uint8(v[1] >> 8), uint8(v[2] >> 8), uint8(v[3] >> 8)}
+	case color.RGBA64Model:
+		return color.RGBA64{uint16(v[0]), uint16(v[1]), uint16(v[2]), uint16(v[3])}
+	}
+	return color.NRGBA64{uint16(v[0]), uint16(v[1]), uint16(v[2]), uint16(v[3])}
+}
+
+// get16 returns the channels of the pixel at (x, y), scaled to 16 bits, and in the image's alpha state.
+// The order is R, G, B, A, or C, M, Y, K for CMYK (which is inverted), or just Y for GRAY.
+// Alpha is 0xffff for formats without an alpha channel.
+func (img *Image) get16(x, y int) [4]uint32 {
+	p := img.PixelByte(x, y)
+	r, g, b, a := channelOffsets(img.Format)
+	if img.Format == PixelFormatCMYK {
+		r, g, b, a = 0, 1, 2, 3
+	}
+	if img.Type == ComponentFloat32 {
+		f := img.PixelsFloat32()[p/4:]
+		alpha := float32(1)
+		if a != -1 {
+			alpha = min(max(f[a], 0), 1)
+		}
+		v := [4]uint32{0, 0, 0, uint32(alpha*0xffff + 0.5)}
+		for i, c := range [3]int{r, g, b} {
+			switch {
+			case img.Format == PixelFormatCMYK:
+				v[i] = uint32(min(max(f[c], 0), 1)*0xffff + 0.5)
+			case img.Premultiplied && a != -1:
+				if alpha != 0 {
+					v[i] = uint32(linearToSRGB(f[c]/alpha)*alpha*0xffff + 0.5)
+				}
+			default:
+				v[i] = uint32(linearToSRGB(f[c])*0xffff + 0.5)
+			}
+		}
+		return v
+	}
+	sample := func(c int) uint32 {
+		if img.Type == ComponentUint16 {
+			return uint32(img.Pixels16()[p/2+c])
+		}
+		return uint32(img.Pixels[p+c]) * 0x101
+	}
+	v := [4]uint32{sample(r), sample(g), sample(b), 0xffff}
+	if a != -1 {
+		v[3] = sample(a)
+	}
+	return v
+}
+
+// set16 is the inverse of get16. The padding channel of formats such as RGBX is set to the maximum value.
+func (img *Image) set16(px, py int, v [4]uint32) {
+	p := img.PixelByte(px, py)
+	r, g, b, a := channelOffsets(img.Format)
+	x := -1
+	if img.Format == PixelFormatCMYK {
+		r, g, b, a = 0, 1, 2, 3
+	} else if a == -1 && img.NChan() == 4 {
+		// The padding channel is whichever of the 4 channels is left over
+		x = 6 - r - g - b
+	}
+	if img.Type == ComponentFloat32 {
+		f := img.PixelsFloat32()[p/4:]
+		alpha := float32(v[3]) / 0xffff
+		for i, c := range [3]int{r, g, b} {
+			s := float32(v[i]) / 0xffff
+			switch {
+			case img.Format == PixelFormatCMYK:
+				f[c] = s
+			case img.Premultiplied && a != -1:
+				if alpha == 0 {
+					f[c] = 0
+				} else {
+					f[c] = srgbToLinear(min(s/alpha, 1)) * alpha
+				}
+			default:
+				f[c] = srgbToLinear(s)
+			}
+		}
+		if a != -1 {
+			f[a] = alpha
+		} else if x != -1 {
+			f[x] = 1
+		}
+		return
+	}
+	put := func(c int, val uint32) {
+		if img.Type == ComponentUint16 {
+			img.Pixels16()[p/2+c] = uint16(val)
+		} else {
+			img.Pixels[p+c] = uint8((val*255 + 32767) / 65535)
+		}
+	}
+	put(r, v[0])
+	if img.Format != PixelFormatGRAY {
+		put(g, v[1])
+		put(b, v[2])
+	}
+	if a != -1 {
+		put(a, v[3])
+	} else if x != -1 {
+		put(x, 0xffff)
+	}
+}
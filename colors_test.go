@@ -0,0 +1,131 @@
+package cimg
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	xdraw "golang.org/x/image/draw"
+)
+
+func requireColorNear(t *testing.T, expect, actual color.Color, tolerance int, msgAndArgs ...any) {
+	r1, g1, b1, a1 := expect.RGBA()
+	r2, g2, b2, a2 := actual.RGBA()
+	for _, d := range []int{int(r1) - int(r2), int(g1) - int(g2), int(b1) - int(b2), int(a1) - int(a2)} {
+		require.LessOrEqual(t, intAbs(d), tolerance, msgAndArgs...)
+	}
+}
+
+func TestImageInterface(t *testing.T) {
+	colors := []color.Color{
+		color.NRGBA{200, 100, 50, 255},
+		color.NRGBA{10, 20, 30, 255},
+		color.NRGBA{200, 100, 50, 128},
+		color.Gray{77},
+	}
+	for _, typ := range []ComponentType{ComponentUint8, ComponentUint16, ComponentFloat32} {
+		for _, pf := range allPixelFormats {
+			for _, premul := range []bool{false, true} {
+				img := NewImageOfType(5, 4, pf, typ)
+				img.Premultiplied = premul
+				require.Equal(t, image.Rect(0, 0, 5, 4), img.Bounds())
+				for i, c := range colors {
+					img.Set(i, 1, c)
+					// The expected color is whatever the model makes of c, so that GRAY and CMYK are compared
+					// correctly. Formats without alpha are composited onto black.
+					expect := img.ColorModel().Convert(c)
+					if _, _, _, a := channelOffsets(pf); a == -1 {
+						switch e := expect.(type) {
+						case color.RGBA:
+							e.A = 0xff
+							expect = e
+						case color.RGBA64:
+							e.A = 0xffff
+							expect = e
+						}
+					}
+					actual := img.At(i, 1)
+					require.IsType(t, expect, actual, "%v %v", pf, typ)
+					tolerance := 0x101
+					if pf == PixelFormatCMYK {
+						tolerance = 3 * 0x101
+					}
+					requireColorNear(t, expect, actual, tolerance, "%v %v %v %v", pf, typ, premul, i)
+					r, g, b, a := actual.RGBA()
+					require.Equal(t, color.RGBA64{uint16(r), uint16(g), uint16(b), uint16(a)}, img.RGBA64At(i, 1), "%v %v %v", pf, typ, premul)
+				}
+				// Outside of the image
+				img.Set(-1, 0, color.White)
+				require.Equal(t, img.ColorModel().Convert(color.Transparent), img.At(5, 0))
+			}
+		}
+	}
+
+	// ColorModel respects Premultiplied
+	rgba := NewImage(1, 1, PixelFormatBGRA)
+	require.Equal(t, color.NRGBAModel, rgba.ColorModel())
+	rgba.Premultiplied = true
+	require.Equal(t, color.RGBAModel, rgba.ColorModel())
+	rgba.SetRGBA64(0, 0, color.RGBA64{0x8080, 0, 0, 0x8080})
+	require.Equal(t, []byte{0, 0, 0x80, 0x80}, rgba.Pixels)
+	require.Equal(t, color.RGBA64Model, NewImageOfType(1, 1, PixelFormatRGB, ComponentUint16).ColorModel())
+
+	// 16-bit values are rounded to 8 bits
+	rgba.SetRGBA64(0, 0, color.RGBA64{0xff00, 0, 0, 0xffff})
+	require.Equal(t, []byte{0, 0, 254, 255}, rgba.Pixels)
+
+	// The padding channel is set to the maximum value
+	xrgb := NewImage(1, 1, PixelFormatXRGB)
+	xrgb.Set(0, 0, color.RGBA{1, 2, 3, 255})
+	require.Equal(t, []byte{255, 1, 2, 3}, xrgb.Pixels)
+	rgbx16 := NewImageOfType(1, 1, PixelFormatRGBX, ComponentUint16)
+	rgbx16.SetRGBA64(0, 0, color.RGBA64{1, 2, 3, 0xffff})
+	require.Equal(t, []uint16{1, 2, 3, 0xffff}, rgbx16.Pixels16())
+	xbgrf := NewImageOfType(1, 1, PixelFormatXBGR, ComponentFloat32)
+	xbgrf.Set(0, 0, color.Black)
+	require.Equal(t, []float32{1, 0, 0, 0}, xbgrf.PixelsFloat32())
+
+	// CMYK is inverted in memory
+	cmyk := NewImage(1, 1, PixelFormatCMYK)
+	cmyk.Set(0, 0, color.CMYK{10, 20, 30, 40})
+	require.Equal(t, []byte{245, 235, 225, 215}, cmyk.Pixels)
+
+	// Float32 pixels are linear
+	f := NewImageOfType(1, 1, PixelFormatRGB, ComponentFloat32)
+	f.Set(0, 0, color.RGBA{128, 0, 255, 255})
+	require.InDelta(t, 0.2158, f.PixelsFloat32()[0], 0.0001)
+}
+
+func TestImageInterop(t *testing.T) {
+	// image/png can encode any format directly
+	for _, pf := range allPixelFormats {
+		org := MakeRGB(30, 20).Convert(pf)
+		buf := bytes.Buffer{}
+		require.Nil(t, png.Encode(&buf, org))
+		dec, err := DecompressWithOptions(buf.Bytes(), &DecompressParams{Format: PixelFormatRGB, HasFormat: true})
+		require.Nil(t, err)
+		// CMYK is written as 16-bit
+		require.Less(t, AvgRGBDifference(org.Convert(PixelFormatRGB), dec.asUint8()), 1.0, "%v", pf)
+	}
+
+	// image/draw into a strided crop
+	src := MakeRGBA(30, 20)
+	dst := NewImage(40, 30, PixelFormatXRGB)
+	crop := dst.ReferenceCrop(5, 5, 35, 25)
+	draw.Draw(crop, crop.Bounds(), src, image.Point{}, draw.Src)
+	ref := src.Convert(PixelFormatXRGB)
+	for y := 0; y < 20; y++ {
+		for x := 0; x < 30; x++ {
+			requireColorNear(t, ref.At(x, y), dst.At(x+5, y+5), 0)
+		}
+	}
+
+	// golang.org/x/image/draw scaling
+	small := NewImage(15, 10, PixelFormatBGR)
+	xdraw.BiLinear.Scale(small, small.Bounds(), src.ToRGB(), src.Bounds(), xdraw.Src, nil)
+	require.Less(t, AvgRGBDifference(small.Convert(PixelFormatRGB), ResizeNew(src.ToRGB(), 15, 10, &ResizeParams{CheapSRGBFilter: true})), 25.0)
+}
@@ -0,0 +1,139 @@
+#include <stdint.h>
+#include <algorithm>
+#include <type_traits>
+#include "imageops.h"
+#include "composite.h"
+#include "layout.h"
+
+// These must match the CompositeOp constants in composite.go
+enum CompositeOps {
+	CompositeOpOver     = 0,
+	CompositeOpIn       = 1,
+	CompositeOpOut      = 2,
+	CompositeOpAtop     = 3,
+	CompositeOpXor      = 4,
+	CompositeOpMultiply = 5,
+	CompositeOpScreen   = 6,
+	CompositeOpOverlay  = 7,
+	CompositeOpDarken   = 8,
+	CompositeOpLighten  = 9,
+};
+
+// The separable blend functions of the W3C Compositing and Blending spec, on straight colors
+static float BlendChannel(int op, float s, float d) {
+	switch (op) {
+	case CompositeOpMultiply: return s * d;
+	case CompositeOpScreen: return s + d - s * d;
+	case CompositeOpOverlay: return d <= 0.5f ? 2 * s * d : 1 - 2 * (1 - s) * (1 - d);
+	case CompositeOpDarken: return std::min(s, d);
+	case CompositeOpLighten: return std::max(s, d);
+	}
+	return s;
+}
+
+// Integer samples are clamped to their range, but float samples are not, because they may be HDR
+template <typename T>
+T FromUnit(float v, float maxV) {
+	return (T) (std::min(std::max(v, 0.0f), 1.0f) * maxV + 0.5f);
+}
+
+template <>
+float FromUnit<float>(float v, float maxV) {
+	return v;
+}
+
+// Composite src onto dst. The math is done on premultiplied colors in [0,1], regardless of the
+// alpha state of the two images. A missing alpha channel is treated as opaque.
+template <typename T>
+void CompositeImage(const uint8_t* src, const FormatLayout& s, int srcStride, bool srcPremul, uint8_t* dst, const FormatLayout& d, int dstStride, bool dstPremul,
+                    int width, int height, int op, float opacity) {
+	const float maxV     = std::is_floating_point<T>::value ? 1.0f : (float) (T) -1;
+	const float inv      = 1.0f / maxV;
+	const int   schan[3] = {s.r, s.g, s.b};
+	const int   dchan[3] = {d.r, d.g, d.b};
+	for (int y = 0; y < height; y++) {
+		const T* sp = (const T*) (src + (size_t) y * srcStride);
+		T*       dp = (T*) (dst + (size_t) y * dstStride);
+		for (int x = 0; x < width; x++) {
+			float sa = s.a != -1 ? sp[s.a] * inv : 1.0f;
+			float da = d.a != -1 ? dp[d.a] * inv : 1.0f;
+			float scol[3], dcol[3];
+			for (int i = 0; i < 3; i++) {
+				scol[i] = sp[schan[i]] * inv * (srcPremul ? 1.0f : sa) * opacity;
+				dcol[i] = dp[dchan[i]] * inv * (dstPremul ? 1.0f : da);
+			}
+			sa *= opacity;
+			float oa;
+			float ocol[3];
+			switch (op) {
+			case CompositeOpOver:
+				oa = sa + da * (1 - sa);
+				for (int i = 0; i < 3; i++)
+					ocol[i] = scol[i] + dcol[i] * (1 - sa);
+				break;
+			case CompositeOpIn:
+				oa = sa * da;
+				for (int i = 0; i < 3; i++)
+					ocol[i] = scol[i] * da;
+				break;
+			case CompositeOpOut:
+				oa = sa * (1 - da);
+				for (int i = 0; i < 3; i++)
+					ocol[i] = scol[i] * (1 - da);
+				break;
+			case CompositeOpAtop:
+				oa = da;
+				for (int i = 0; i < 3; i++)
+					ocol[i] = scol[i] * da + dcol[i] * (1 - sa);
+				break;
+			case CompositeOpXor:
+				oa = sa * (1 - da) + da * (1 - sa);
+				for (int i = 0; i < 3; i++)
+					ocol[i] = scol[i] * (1 - da) + dcol[i] * (1 - sa);
+				break;
+			default:
+				// Blend modes are composited with "source over", and only blend where both are present
+				oa = sa + da * (1 - sa);
+				for (int i = 0; i < 3; i++) {
+					float ss = sa > 0 ? scol[i] / sa : 0;
+					float ds = da > 0 ? dcol[i] / da : 0;
+					ocol[i]  = scol[i] * (1 - da) + dcol[i] * (1 - sa) + sa * da * BlendChannel(op, ss, ds);
+				}
+				break;
+			}
+			if (d.a != -1) {
+				dp[d.a] = FromUnit<T>(oa, maxV);
+				if (!dstPremul) {
+					for (int i = 0; i < 3; i++)
+						ocol[i] = oa > 0 ? ocol[i] / oa : 0;
+				}
+			}
+			for (int i = 0; i < 3; i++)
+				dp[dchan[i]] = FromUnit<T>(ocol[i], maxV);
+			if (d.x != -1)
+				dp[d.x] = (T) maxV;
+			sp += s.nchan;
+			dp += d.nchan;
+		}
+	}
+}
+
+extern "C" {
+
+void Composite(const void* src, int srcFormat, int srcStride, int srcPremultiplied, void* dst, int dstFormat, int dstStride, int dstPremultiplied,
+               int width, int height, int componentType, int op, float opacity) {
+	FormatLayout s = GetFormatLayout(srcFormat);
+	FormatLayout d = GetFormatLayout(dstFormat);
+	switch (componentType) {
+	case ConvertComponentUint8:
+		CompositeImage<uint8_t>((const uint8_t*) src, s, srcStride, srcPremultiplied != 0, (uint8_t*) dst, d, dstStride, dstPremultiplied != 0, width, height, op, opacity);
+		break;
+	case ConvertComponentUint16:
+		CompositeImage<uint16_t>((const uint8_t*) src, s, srcStride, srcPremultiplied != 0, (uint8_t*) dst, d, dstStride, dstPremultiplied != 0, width, height, op, opacity);
+		break;
+	case ConvertComponentFloat32:
+		CompositeImage<float>((const uint8_t*) src, s, srcStride, srcPremultiplied != 0, (uint8_t*) dst, d, dstStride, dstPremultiplied != 0, width, height, op, opacity);
+		break;
+	}
+}
+}
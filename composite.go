@@ -0,0 +1,70 @@
+package cimg
+
+/*
+#include "composite.h"
+*/
+import "C"
+import (
+	"errors"
+	"fmt"
+	"unsafe"
+)
+
+// CompositeOp is the operator that Composite uses to combine a source image with a destination image
+type CompositeOp int
+
+const (
+	CompositeOver     CompositeOp = iota // Source over destination. This is normal alpha blending.
+	CompositeIn                          // Source, where the destination is opaque
+	CompositeOut                         // Source, where the destination is transparent
+	CompositeAtop                        // Source over destination, but only where the destination is opaque
+	CompositeXor                         // Source and destination, where the other is transparent
+	CompositeMultiply                    // Blend: source * destination, which darkens
+	CompositeScreen                      // Blend: the inverse of multiplying the inverses, which lightens
+	CompositeOverlay                     // Blend: multiply dark destination colors, and screen light destination colors
+	CompositeDarken                      // Blend: the darker of source and destination
+	CompositeLighten                     // Blend: the lighter of source and destination
+)
+
+// Composite draws src onto the image, with the top-left corner of src at (x, y), combining
+// the two images with op. opacity scales the alpha of src, and must be between 0 and 1.
+// src is clipped to the image. Only the pixels underneath src are modified, even for operators
+// such as CompositeIn, which clear the rest of the destination in strict Porter-Duff compositing.
+//
+// The images must have the same component type. They may have any pixel format other than GRAY
+// and CMYK, and may differ in pixel format and alpha state (Premultiplied). An image without an alpha
+// channel is treated as opaque, and if the destination has no alpha channel, then a result that is
+// not opaque is composited onto black.
+//
+// The blend modes (multiply, etc) are composited "over" the destination, as in the W3C Compositing
+// and Blending spec. Like web browsers, 8 and 16-bit images are blended on their sRGB values.
+// Float32 images are linear, and are not clamped to [0,1].
+func (dst *Image) Composite(src *Image, x, y int, op CompositeOp, opacity float32) error {
+	if op < CompositeOver || op > CompositeLighten {
+		return errors.New("Unknown composite operator")
+	}
+	if !(opacity >= 0 && opacity <= 1) {
+		return fmt.Errorf("Composite opacity %v is outside of [0,1]", opacity)
+	}
+	if src.Type != dst.Type {
+		return fmt.Errorf("Source component type %v differs from target component type %v", int(src.Type), int(dst.Type))
+	}
+	for _, img := range []*Image{src, dst} {
+		if img.Format == PixelFormatGRAY || img.Format == PixelFormatCMYK {
+			return fmt.Errorf("Composite does not support pixel format %v", img.Format)
+		}
+	}
+	srcX1 := max(-x, 0)
+	srcY1 := max(-y, 0)
+	dstX1 := max(x, 0)
+	dstY1 := max(y, 0)
+	w := min(src.Width-srcX1, dst.Width-dstX1)
+	h := min(src.Height-srcY1, dst.Height-dstY1)
+	if w <= 0 || h <= 0 {
+		return nil
+	}
+	C.Composite(unsafe.Pointer(&src.Pixels[src.PixelByte(srcX1, srcY1)]), C.int(src.Format), C.int(src.Stride), C.int(boolToInt(src.Premultiplied)),
+		unsafe.Pointer(&dst.Pixels[dst.PixelByte(dstX1, dstY1)]), C.int(dst.Format), C.int(dst.Stride), C.int(boolToInt(dst.Premultiplied)),
+		C.int(w), C.int(h), C.int(src.Type), C.int(op), C.float(opacity))
+	return nil
+}
@@ -0,0 +1,15 @@
+#include <stdint.h>
+
+#ifdef __cplusplus
+extern "C" {
+#endif
+
+// Composite src onto dst, which are both width x height, and in any TurboJPEG color formats except
+// TJPF_GRAY and TJPF_CMYK. Strides are in bytes. componentType is a ComponentType from image.go,
+// and op is a CompositeOp from composite.go.
+void Composite(const void* src, int srcFormat, int srcStride, int srcPremultiplied, void* dst, int dstFormat, int dstStride, int dstPremultiplied,
+               int width, int height, int componentType, int op, float opacity);
+
+#ifdef __cplusplus
+}
+#endif
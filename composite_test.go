@@ -0,0 +1,163 @@
+package cimg
+
+import (
+	"image/color"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// compositeRef is a simple implementation of Composite, for premultiplied colors in [0,1]
+func compositeRef(op CompositeOp, s, d [4]float64) [4]float64 {
+	sa, da := s[3], d[3]
+	o := [4]float64{}
+	for i := 0; i < 3; i++ {
+		switch op {
+		case CompositeOver:
+			o[i], o[3] = s[i]+d[i]*(1-sa), sa+da*(1-sa)
+		case CompositeIn:
+			o[i], o[3] = s[i]*da, sa*da
+		case CompositeOut:
+			o[i], o[3] = s[i]*(1-da), sa*(1-da)
+		case CompositeAtop:
+			o[i], o[3] = s[i]*da+d[i]*(1-sa), da
+		case CompositeXor:
+			o[i], o[3] = s[i]*(1-da)+d[i]*(1-sa), sa*(1-da)+da*(1-sa)
+		default:
+			cs, cd := 0.0, 0.0
+			if sa > 0 {
+				cs = s[i] / sa
+			}
+			if da > 0 {
+				cd = d[i] / da
+			}
+			var b float64
+			switch op {
+			case CompositeMultiply:
+				b = cs * cd
+			case CompositeScreen:
+				b = cs + cd - cs*cd
+			case CompositeOverlay:
+				if cd <= 0.5 {
+					b = 2 * cs * cd
+				} else {
+					b = 1 - 2*(1-cs)*(1-cd)
+				}
+			case CompositeDarken:
+				b = math.Min(cs, cd)
+			case CompositeLighten:
+				b = math.Max(cs, cd)
+			}
+			o[i], o[3] = s[i]*(1-da)+d[i]*(1-sa)+sa*da*b, sa+da*(1-sa)
+		}
+	}
+	return o
+}
+
+func rgba64ToUnit(c color.RGBA64) [4]float64 {
+	return [4]float64{float64(c.R) / 0xffff, float64(c.G) / 0xffff, float64(c.B) / 0xffff, float64(c.A) / 0xffff}
+}
+
+func TestComposite(t *testing.T) {
+	ops := []CompositeOp{CompositeOver, CompositeIn, CompositeOut, CompositeAtop, CompositeXor,
+		CompositeMultiply, CompositeScreen, CompositeOverlay, CompositeDarken, CompositeLighten}
+	alphas := []uint8{0, 1, 60, 128, 200, 255}
+	makeImage := func(pf PixelFormat, typ ComponentType, premul bool, seed int) *Image {
+		img := NewImageOfType(len(alphas), len(alphas), pf, typ)
+		img.Premultiplied = premul
+		for y := 0; y < img.Height; y++ {
+			for x := 0; x < img.Width; x++ {
+				a := alphas[x]
+				if seed != 0 {
+					a = alphas[y]
+				}
+				img.Set(x, y, color.NRGBA{uint8(x*40 + seed), uint8(y*50 + seed), uint8(200 - x*y*5), a})
+			}
+		}
+		return img
+	}
+
+	for _, typ := range []ComponentType{ComponentUint8, ComponentUint16} {
+		tolerance := 3.0 / 255
+		if typ == ComponentUint16 {
+			tolerance = 3.0 / 65535
+		}
+		for _, sf := range []PixelFormat{PixelFormatRGBA, PixelFormatBGRA, PixelFormatARGB, PixelFormatABGR, PixelFormatRGB} {
+			for _, df := range []PixelFormat{PixelFormatRGBA, PixelFormatABGR, PixelFormatBGRX} {
+				for _, premul := range []bool{false, true} {
+					for _, op := range ops {
+						src := makeImage(sf, typ, premul, 0)
+						dst := makeImage(df, typ, !premul, 30)
+						org := dst.Clone()
+						require.Nil(t, dst.Composite(src, 0, 0, op, 0.75))
+						for y := 0; y < dst.Height; y++ {
+							for x := 0; x < dst.Width; x++ {
+								s := rgba64ToUnit(src.RGBA64At(x, y))
+								for i := range s {
+									s[i] *= 0.75
+								}
+								expect := compositeRef(op, s, rgba64ToUnit(org.RGBA64At(x, y)))
+								if dst.alphaChannel() == -1 {
+									expect[3] = 1
+								}
+								actual := rgba64ToUnit(dst.RGBA64At(x, y))
+								for i := range expect {
+									require.InDelta(t, expect[i], actual[i], tolerance, "%v %v %v %v %v op:%v (%v,%v)", typ, sf, df, premul, i, op, x, y)
+								}
+							}
+						}
+					}
+				}
+			}
+		}
+	}
+
+	// Straight 50% red over opaque blue
+	dst := NewImage(1, 1, PixelFormatRGB)
+	copy(dst.Pixels, []byte{0, 0, 255})
+	src := NewImage(1, 1, PixelFormatBGRA)
+	copy(src.Pixels, []byte{0, 0, 255, 128})
+	require.Nil(t, dst.Composite(src, 0, 0, CompositeOver, 1))
+	require.Equal(t, []byte{128, 0, 127}, dst.Pixels)
+
+	// Zero opacity leaves the destination alone
+	require.Nil(t, dst.Composite(src, 0, 0, CompositeOver, 0))
+	require.Equal(t, []byte{128, 0, 127}, dst.Pixels)
+
+	// Float32 is not clamped
+	fdst := NewImageOfType(1, 1, PixelFormatRGBA, ComponentFloat32)
+	copy(fdst.PixelsFloat32(), []float32{0.5, 4, 0, 1})
+	fsrc := NewImageOfType(1, 1, PixelFormatRGBX, ComponentFloat32)
+	copy(fsrc.PixelsFloat32(), []float32{0.5, 0.5, 1, 1})
+	require.Nil(t, fdst.Composite(fsrc, 0, 0, CompositeMultiply, 1))
+	require.Equal(t, []float32{0.25, 2, 0, 1}, fdst.PixelsFloat32())
+
+	// Clipping
+	dst = NewImage(6, 5, PixelFormatXRGB)
+	white := NewImage(4, 4, PixelFormatRGBA)
+	for i := range white.Pixels {
+		white.Pixels[i] = 255
+	}
+	require.Nil(t, dst.Composite(white, -2, 3, CompositeOver, 1))
+	for y := 0; y < dst.Height; y++ {
+		for x := 0; x < dst.Width; x++ {
+			expect := color.RGBA{0, 0, 0, 255}
+			if x < 2 && y >= 3 {
+				expect = color.RGBA{255, 255, 255, 255}
+			}
+			require.Equal(t, expect, dst.At(x, y), "%v,%v", x, y)
+		}
+	}
+	require.Nil(t, dst.Composite(white, 6, 0, CompositeOver, 1))
+	require.Nil(t, dst.Composite(white, -4, 0, CompositeOver, 1))
+
+	// Errors
+	require.NotNil(t, dst.Composite(white, 0, 0, CompositeOp(99), 1))
+	for _, opacity := range []float32{-1, 1.01, 2, float32(math.NaN())} {
+		require.NotNil(t, dst.Composite(white, 0, 0, CompositeOver, opacity), "%v", opacity)
+	}
+	require.NotNil(t, dst.Composite(white.ConvertType(ComponentUint16), 0, 0, CompositeOver, 1))
+	require.NotNil(t, dst.Composite(white.ToGray(), 0, 0, CompositeOver, 1))
+	require.NotNil(t, white.Convert(PixelFormatCMYK).Composite(white, 0, 0, CompositeOver, 1))
+}
@@ -0,0 +1,229 @@
+package cimg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image/png"
+)
+
+// Image file formats
+const (
+	FormatJPEG = "jpeg"
+	FormatPNG  = "png"
+	FormatTIFF = "tiff"
+	FormatGIF  = "gif"
+	FormatBMP  = "bmp"
+	FormatPNM  = "pnm" // PBM, PGM, PPM, and PAM
+	FormatWebP = "webp"
+	FormatQOI  = "qoi"
+)
+
+// ImageConfig describes an encoded image, without decoding its pixels
+type ImageConfig struct {
+	Format      string     // FormatJPEG, FormatPNG, etc, or the name of another registered codec
+	Width       int        // Width in pixels
+	Height      int        // Height in pixels
+	NChan       int        // Number of channels stored in the file (a paletted image has 3, or 4 if it has transparency)
+	BitDepth    int        // Bits per channel
+	Sampling    Sampling   // JPEG chroma subsampling. SamplingUnknown for other formats.
+	Colorspace  Colorspace // Colorspace of the pixels in the file
+	Progressive bool       // Progressive JPEG, or interlaced PNG
+	Orientation int        // EXIF orientation (see ExifData.GetOrientation), or zero if not present
+}
+
+// NumPixels returns Width * Height
+func (c *ImageConfig) NumPixels() int64 {
+	return int64(c.Width) * int64(c.Height)
+}
+
+// DecodeConfig reads the header of an image in any registered format (see RegisterCodec),
+// without decoding any pixels. The format is detected from the content of encoded.
+// JPEG: Uses TurboJPEG
+// TIFF: Reads the tags directly, so it also works for layouts that golang.org/x/image/tiff can't decode
+// Other formats: Uses the DecodeConfig function of the format's Codec
+func DecodeConfig(encoded []byte) (ImageConfig, error) {
+	decoder, err := getDecoder()
+	if err != nil {
+		return ImageConfig{}, err
+	}
+	defer putDecoder(decoder)
+	return decoder.DecodeConfig(encoded)
+}
+
+// DecodeConfig is the same as the package-level DecodeConfig, but uses this Decoder's handle
+func (d *Decoder) DecodeConfig(encoded []byte) (ImageConfig, error) {
+	c := detectCodec(encoded)
+	if c == nil {
+		return ImageConfig{}, ErrUnknownFormat
+	}
+	return d.decodeConfigWithCodec(c, encoded)
+}
+
+func (d *Decoder) decodeConfigWithCodec(c *Codec, encoded []byte) (ImageConfig, error) {
+	if c == jpegCodec {
+		return d.decodeConfigJPEG(encoded)
+	}
+	return c.DecodeConfig(encoded)
+}
+
+func (d *Decoder) decodeConfigJPEG(encoded []byte) (ImageConfig, error) {
+	width, height, sampling, colorspace, err := d.decompressJPEGHeader(encoded)
+	if err != nil {
+		return ImageConfig{}, err
+	}
+	cfg := ImageConfig{
+		Format:     FormatJPEG,
+		Width:      width,
+		Height:     height,
+		Sampling:   sampling,
+		Colorspace: colorspace,
+		NChan:      3,
+		BitDepth:   8,
+	}
+	scanJPEGMarkers(encoded, &cfg)
+	return cfg, nil
+}
+
+// scanJPEGMarkers walks the JPEG markers up to the start of the first frame, and fills in
+// the fields that TurboJPEG doesn't tell us about.
+func scanJPEGMarkers(encoded []byte, cfg *ImageConfig) {
+	p := 2
+	for p+4 <= len(encoded) {
+		if encoded[p] != 0xff {
+			return
+		}
+		marker := encoded[p+1]
+		if marker == 0xff {
+			// fill byte
+			p++
+			continue
+		}
+		length := int(binary.BigEndian.Uint16(encoded[p+2:]))
+		if length < 2 {
+			// Invalid segment length
+			return
+		}
+		segment := encoded[p+4 : min(p+2+length, len(encoded))]
+		switch {
+		case marker == 0xe1 && len(segment) > 6 && bytes.Equal(segment[:6], []byte("Exif\x00\x00")):
+			cfg.Orientation = exifOrientation(segment[6:])
+		case marker >= 0xc0 && marker <= 0xcf && marker != 0xc4 && marker != 0xc8 && marker != 0xcc:
+			// Start of frame. The image data follows, so we stop here.
+			cfg.Progressive = marker == 0xc2 || marker == 0xc6 || marker == 0xca || marker == 0xce
+			if len(segment) >= 6 {
+				cfg.BitDepth = int(segment[0])
+				cfg.NChan = int(segment[5])
+			}
+			return
+		}
+		p += 2 + length
+	}
+}
+
+func decodeConfigPNG(encoded []byte) (ImageConfig, error) {
+	c, err := png.DecodeConfig(bytes.NewReader(encoded))
+	if err != nil {
+		return ImageConfig{}, err
+	}
+	cfg := ImageConfig{
+		Format:   FormatPNG,
+		Width:    c.Width,
+		Height:   c.Height,
+		Sampling: SamplingUnknown,
+	}
+	// png.DecodeConfig has already validated the IHDR chunk
+	ihdr := encoded[16:29]
+	cfg.BitDepth = int(ihdr[8])
+	switch ihdr[9] {
+	case 0:
+		cfg.NChan = 1
+	case 2:
+		cfg.NChan = 3
+	case 3:
+		cfg.NChan = 3
+		cfg.BitDepth = 8
+	case 4:
+		cfg.NChan = 2
+	case 6:
+		cfg.NChan = 4
+	}
+	if cfg.NChan <= 2 {
+		cfg.Colorspace = ColorspaceGray
+	} else {
+		cfg.Colorspace = ColorspaceRGB
+	}
+	cfg.Progressive = ihdr[12] == 1
+
+	// Walk the chunks before the image data, looking for transparency and EXIF data
+	p := 8
+	for p+8 <= len(encoded) {
+		length := int(binary.BigEndian.Uint32(encoded[p:]))
+		chunk := string(encoded[p+4 : p+8])
+		if chunk == "IDAT" || length < 0 || p+8+length > len(encoded) {
+			break
+		}
+		data := encoded[p+8 : p+8+length]
+		switch chunk {
+		case "tRNS":
+			if ihdr[9] == 3 {
+				cfg.NChan = 4
+			}
+		case "eXIf":
+			cfg.Orientation = exifOrientation(data)
+		}
+		p += 12 + length
+	}
+	return cfg, nil
+}
+
+// decodeConfigTIFF reads the tags of the first IFD directly, so that it works for TIFF
+// files that golang.org/x/image/tiff can't decode, such as CMYK.
+func decodeConfigTIFF(encoded []byte) (ImageConfig, error) {
+	r, ok := newTIFFReader(encoded)
+	if !ok {
+		return ImageConfig{}, errors.New("Invalid TIFF header")
+	}
+	ifd := r.firstIFD()
+	width, okW := r.tag(ifd, tiffTagImageWidth)
+	height, okH := r.tag(ifd, tiffTagImageLength)
+	if !okW || !okH {
+		return ImageConfig{}, errors.New("TIFF file has no image dimensions")
+	}
+	samples, ok := r.tag(ifd, tiffTagSamplesPerPixel)
+	if !ok {
+		samples = 1
+	}
+	bits, ok := r.tag(ifd, tiffTagBitsPerSample)
+	if !ok {
+		bits = 1
+	}
+	photometric, _ := r.tag(ifd, tiffTagPhotometricInterpretation)
+	orientation, _ := r.tag(ifd, ExifTagOrientation)
+	cfg := ImageConfig{
+		Format:      FormatTIFF,
+		Width:       int(width),
+		Height:      int(height),
+		NChan:       int(samples),
+		BitDepth:    int(bits),
+		Sampling:    SamplingUnknown,
+		Orientation: int(orientation),
+	}
+	switch photometric {
+	case 0, tiffPhotometricBlackIsZero:
+		// 0 is WhiteIsZero
+		cfg.Colorspace = ColorspaceGray
+	case 3:
+		// Paletted
+		cfg.Colorspace = ColorspaceRGB
+		cfg.NChan = 3
+	case tiffPhotometricSeparated:
+		cfg.Colorspace = ColorspaceCMYK
+	case 6:
+		// YCbCr
+		cfg.Colorspace = ColorspaceYCbCr
+	default:
+		cfg.Colorspace = ColorspaceRGB
+	}
+	return cfg, nil
+}
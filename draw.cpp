@@ -0,0 +1,397 @@
+#include <stdint.h>
+#include <math.h>
+#include <vector>
+#include <algorithm>
+#include <type_traits>
+#include "imageops.h"
+#include "draw.h"
+#include "layout.h"
+
+// An anti-aliased scanline rasterizer. Each edge adds the signed area that it covers to an accumulation
+// buffer, and a running sum along each row then produces the coverage of every pixel (this is the
+// technique of font-rs and stb_truetype). Coverage is clamped to 1, so overlapping polygons that have
+// the same orientation are merged, which is the nonzero winding rule.
+// The buffer only holds a band of rows, so that memory does not grow with the area of the shape.
+// The spans of cells that the edges touch in each row are recorded, so that the cells between them,
+// which all have the same coverage, don't need to be accumulated, and the band can be cleared quickly.
+class Rasterizer {
+public:
+	typedef std::pair<int, int> Span; // First and last cell
+
+	int                            Width;
+	int                            Height; // Height of the current band
+	std::vector<float>             Acc;    // Each row has 2 extra cells, for the area to the right of the last pixel
+	std::vector<std::vector<Span>> Spans;  // The spans of cells that have been touched, in each row
+
+	Rasterizer(int width, int maxHeight) : Width(width), Height(maxHeight), Acc((size_t) (width + 2) * maxHeight), Spans(maxHeight) {}
+
+	float* Row(int y) { return &Acc[(size_t) y * (Width + 2)]; }
+
+	// Clear the band, and resize it to height rows
+	void Reset(int height) {
+		for (int y = 0; y < Height; y++) {
+			for (Span s : Spans[y])
+				std::fill(Row(y) + s.first, Row(y) + s.second + 1, 0.0f);
+			Spans[y].clear();
+		}
+		Height = height;
+	}
+
+	// Add an edge, which may extend outside of the band
+	void AddEdge(double x0, double y0, double x1, double y1) {
+		if (y0 == y1)
+			return;
+		// Split the edge where it crosses x = 0 and x = Width. The parts outside of that range are moved
+		// onto those lines, which doesn't change the coverage of the pixels inside.
+		double t[4] = {0};
+		int    nt   = 1;
+		for (double bound : {0.0, (double) Width}) {
+			if ((x0 - bound) * (x1 - bound) < 0)
+				t[nt++] = (bound - x0) / (x1 - x0);
+		}
+		t[nt++] = 1;
+		std::sort(t + 1, t + nt - 1);
+		for (int i = 0; i < nt - 1; i++) {
+			double xa = std::min(std::max(x0 + (x1 - x0) * t[i], 0.0), (double) Width);
+			double xb = std::min(std::max(x0 + (x1 - x0) * t[i + 1], 0.0), (double) Width);
+			AddClippedEdge(xa, y0 + (y1 - y0) * t[i], xb, y0 + (y1 - y0) * t[i + 1]);
+		}
+	}
+
+private:
+	void Touch(int y, int x1, int x2) {
+		Spans[y].push_back({x1, x2});
+	}
+
+	// Add an edge whose x coordinates are inside [0, Width]
+	void AddClippedEdge(double x0, double y0, double x1, double y1) {
+		if (y0 == y1)
+			return;
+		double dir = 1;
+		if (y0 > y1) {
+			std::swap(x0, x1);
+			std::swap(y0, y1);
+			dir = -1;
+		}
+		if (y1 <= 0 || y0 >= Height)
+			return;
+		double dxdy = (x1 - x0) / (y1 - y0);
+		double x    = x0;
+		if (y0 < 0) {
+			x -= y0 * dxdy;
+			y0 = 0;
+		}
+		int yEnd = (int) ceil(std::min(y1, (double) Height));
+		for (int y = (int) y0; y < yEnd; y++) {
+			float* row     = Row(y);
+			double dy      = std::min((double) (y + 1), y1) - std::max((double) y, y0);
+			double xnext   = x + dxdy * dy;
+			double d       = dy * dir;
+			double xa      = std::min(x, xnext);
+			double xb      = std::max(x, xnext);
+			double xaFloor = floor(xa);
+			double xbCeil  = ceil(xb);
+			int    xai     = (int) xaFloor;
+			int    xbi     = (int) xbCeil;
+			if (xbi <= xai + 1) {
+				// The edge is within a single pixel of this row
+				double xmf = 0.5 * (x + xnext) - xaFloor;
+				row[xai] += (float) (d - d * xmf);
+				row[xai + 1] += (float) (d * xmf);
+				Touch(y, xai, xai + 1);
+			} else {
+				double s   = 1 / (xb - xa);
+				double xaf = xa - xaFloor;
+				double a0  = 0.5 * s * (1 - xaf) * (1 - xaf);
+				double xbf = xb - xbCeil + 1;
+				double am  = 0.5 * s * xbf * xbf;
+				row[xai] += (float) (d * a0);
+				if (xbi == xai + 2) {
+					row[xai + 1] += (float) (d * (1 - a0 - am));
+				} else {
+					double a1 = s * (1.5 - xaf);
+					row[xai + 1] += (float) (d * (a1 - a0));
+					for (int xi = xai + 2; xi < xbi - 1; xi++)
+						row[xi] += (float) (d * s);
+					double a2 = a1 + (xbi - xai - 3) * s;
+					row[xbi - 1] += (float) (d * (1 - a2 - am));
+				}
+				row[xbi] += (float) (d * am);
+				Touch(y, xai, xbi);
+			}
+			x = xnext;
+		}
+	}
+};
+
+// The channels that are blended, for each kind of pixel format
+struct BlendTarget {
+	int n;       // Number of color channels
+	int chan[4]; // Offsets of the color channels
+	int a;       // Offset of the alpha channel, or -1
+	int x;       // Offset of the padding channel, or -1
+	int nchan;   // Total number of channels
+};
+
+static BlendTarget GetBlendTarget(int format) {
+	FormatLayout l = GetFormatLayout(format);
+	if (format == TJPF_CMYK)
+		return {4, {0, 1, 2, 3}, -1, -1, 4};
+	if (format == TJPF_GRAY)
+		return {1, {0}, -1, -1, 1};
+	return {3, {l.r, l.g, l.b}, l.a, l.x, l.nchan};
+}
+
+template <typename T>
+T ToSample(float v, float maxV) {
+	return (T) (std::min(std::max(v, 0.0f), 1.0f) * maxV + 0.5f);
+}
+
+template <>
+float ToSample<float>(float v, float maxV) {
+	return v;
+}
+
+// Blender blends a color over the pixels of an image, weighted by coverage
+template <typename T>
+class Blender {
+public:
+	uint8_t*     Dst;
+	int          Stride;
+	BlendTarget  Target;
+	bool         Premultiplied;
+	const float* Color;
+	float        Alpha;
+	float        MaxV;
+	float        Inv;
+
+	Blender(uint8_t* dst, int stride, int format, bool premultiplied, const float* color, float alpha) {
+		Dst           = dst;
+		Stride        = stride;
+		Target        = GetBlendTarget(format);
+		Premultiplied = premultiplied;
+		Color         = color;
+		Alpha         = alpha;
+		MaxV          = std::is_floating_point<T>::value ? 1.0f : (float) (T) -1;
+		Inv           = 1.0f / MaxV;
+	}
+
+	void Blend(int x, int y, float coverage) {
+		const BlendTarget& t = Target;
+		float              a = std::min(coverage, 1.0f) * Alpha;
+		if (a < 1.0f / 65536)
+			return;
+		T* p = (T*) (Dst + (size_t) y * Stride) + (size_t) x * t.nchan;
+		if (t.a == -1 || Premultiplied) {
+			for (int i = 0; i < t.n; i++)
+				p[t.chan[i]] = ToSample<T>(Color[i] * a + p[t.chan[i]] * Inv * (1 - a), MaxV);
+			if (t.a != -1)
+				p[t.a] = ToSample<T>(a + p[t.a] * Inv * (1 - a), MaxV);
+		} else {
+			float da = p[t.a] * Inv;
+			float oa = a + da * (1 - a);
+			for (int i = 0; i < t.n; i++)
+				p[t.chan[i]] = ToSample<T>((Color[i] * a + p[t.chan[i]] * Inv * da * (1 - a)) / oa, MaxV);
+			p[t.a] = ToSample<T>(oa, MaxV);
+		}
+		if (t.x != -1)
+			p[t.x] = (T) MaxV;
+	}
+};
+
+// Blend the coverage of the band, which is placed at (left, top) in the image
+template <typename T>
+void BlendBand(Rasterizer& r, int left, int top, Blender<T>& b) {
+	for (int y = 0; y < r.Height; y++) {
+		const float*                   row   = r.Row(y);
+		std::vector<Rasterizer::Span>& spans = r.Spans[y];
+		std::sort(spans.begin(), spans.end());
+		float acc = 0;
+		int   x   = 0; // The next cell
+		// The coverage is constant between the spans, so those cells can be skipped if it is zero
+		auto fill = [&](int end) {
+			if (fabsf(acc) >= 1.0f / 65536) {
+				for (; x < end; x++)
+					b.Blend(left + x, top + y, fabsf(acc));
+			}
+			x = std::max(x, end);
+		};
+		for (Rasterizer::Span s : spans) {
+			fill(std::min(s.first, r.Width));
+			for (int end = std::min(s.second + 1, r.Width); x < end; x++) {
+				acc += row[x];
+				b.Blend(left + x, top + y, fabsf(acc));
+			}
+		}
+		fill(r.Width);
+	}
+}
+
+struct Edge {
+	double x0, y0, x1, y1;
+	double Top() const { return std::min(y0, y1); }
+	double Bottom() const { return std::max(y0, y1); }
+};
+
+template <typename T>
+void FillPolygonsT(Blender<T>& b, int left, int top, int width, int height, std::vector<Edge>& edges) {
+	// Rasterize bands of about a million cells at a time, adding each edge to the bands that it crosses
+	int bandHeight = std::max(1, std::min(height, (1 << 20) / (width + 2)));
+	std::sort(edges.begin(), edges.end(), [](const Edge& e1, const Edge& e2) { return e1.Top() < e2.Top(); });
+	Rasterizer        r(width, bandHeight);
+	std::vector<Edge> active;
+	size_t            next = 0;
+	for (int bandTop = 0; bandTop < height; bandTop += bandHeight) {
+		int bandBottom = std::min(bandTop + bandHeight, height);
+		r.Reset(bandBottom - bandTop);
+		active.erase(std::remove_if(active.begin(), active.end(), [=](const Edge& e) { return e.Bottom() <= bandTop; }), active.end());
+		for (; next < edges.size() && edges[next].Top() < bandBottom; next++) {
+			if (edges[next].Bottom() > bandTop)
+				active.push_back(edges[next]);
+		}
+		for (const Edge& e : active)
+			r.AddEdge(e.x0, e.y0 - bandTop, e.x1, e.y1 - bandTop);
+		BlendBand(r, left, top + bandTop, b);
+	}
+}
+
+// The length of [a, b) that is inside pixel i
+static float SpanCoverage(int i, double a, double b) {
+	return (float) std::max(0.0, std::min((double) i + 1, b) - std::max((double) i, a));
+}
+
+template <typename T>
+void FillRectT(Blender<T>& b, int width, int height, double x1, double y1, double x2, double y2, double hx1, double hy1, double hx2, double hy2) {
+	bool hole   = hx1 < hx2 && hy1 < hy2;
+	int  left   = (int) floor(std::max(x1, 0.0));
+	int  top    = (int) floor(std::max(y1, 0.0));
+	int  right  = (int) ceil(std::min(x2, (double) width));
+	int  bottom = (int) ceil(std::min(y2, (double) height));
+	// The columns that are completely inside the hole
+	int holeLeft  = std::min(std::max(left, (int) ceil(hx1)), right);
+	int holeRight = std::max(holeLeft, std::min(right, (int) floor(hx2)));
+	for (int y = top; y < bottom; y++) {
+		float cy    = SpanCoverage(y, y1, y2);
+		float hcy   = hole ? SpanCoverage(y, hy1, hy2) : 0;
+		auto  blend = [&](int xa, int xb) {
+			for (int x = xa; x < xb; x++) {
+				float c = cy * SpanCoverage(x, x1, x2);
+				if (hcy != 0)
+					c -= hcy * SpanCoverage(x, hx1, hx2);
+				b.Blend(x, y, c);
+			}
+		};
+		if (hole && hcy == cy) {
+			// Skip the pixels that are completely inside the hole
+			blend(left, holeLeft);
+			blend(holeRight, right);
+		} else {
+			blend(left, right);
+		}
+	}
+}
+
+// Clamp a coordinate to [-1, size+1], which is enough to keep it outside of the image, and
+// small enough to convert to an int.
+static double ClampCoord(double v, int size) {
+	return std::min(std::max(v, -1.0), (double) size + 1);
+}
+
+template <typename T>
+Blender<T> MakeBlender(void* dst, int stride, int format, int premultiplied, const float* color, float alpha) {
+	return Blender<T>((uint8_t*) dst, stride, format, premultiplied != 0, color, alpha);
+}
+
+extern "C" {
+
+void FillPolygons(void* dst, int width, int height, int stride, int format, int premultiplied, int componentType,
+                  const double* points, const int* polyLengths, int numPolys, const float* color, float alpha) {
+	// Only rasterize the bounding box of the polygons, clipped to the image
+	int nPoints = 0;
+	for (int i = 0; i < numPolys; i++)
+		nPoints += polyLengths[i];
+	if (nPoints == 0)
+		return;
+	double minX = points[0], maxX = points[0], minY = points[1], maxY = points[1];
+	for (int i = 1; i < nPoints; i++) {
+		minX = std::min(minX, points[i * 2]);
+		maxX = std::max(maxX, points[i * 2]);
+		minY = std::min(minY, points[i * 2 + 1]);
+		maxY = std::max(maxY, points[i * 2 + 1]);
+	}
+	int left   = (int) floor(ClampCoord(minX, width));
+	int top    = (int) floor(ClampCoord(minY, height));
+	int right  = (int) ceil(ClampCoord(maxX, width));
+	int bottom = (int) ceil(ClampCoord(maxY, height));
+	left       = std::max(left, 0);
+	top        = std::max(top, 0);
+	right      = std::min(right, width);
+	bottom     = std::min(bottom, height);
+	if (left >= right || top >= bottom)
+		return;
+
+	std::vector<Edge> edges;
+	edges.reserve(nPoints);
+	const double* p = points;
+	for (int i = 0; i < numPolys; i++) {
+		int n = polyLengths[i];
+		for (int j = 0; j < n; j++) {
+			int  k = (j + 1) % n;
+			Edge e = {p[j * 2] - left, p[j * 2 + 1] - top, p[k * 2] - left, p[k * 2 + 1] - top};
+			if (e.y0 != e.y1)
+				edges.push_back(e);
+		}
+		p += n * 2;
+	}
+
+	switch (componentType) {
+	case ConvertComponentUint8: {
+		auto b = MakeBlender<uint8_t>(dst, stride, format, premultiplied, color, alpha);
+		FillPolygonsT(b, left, top, right - left, bottom - top, edges);
+		break;
+	}
+	case ConvertComponentUint16: {
+		auto b = MakeBlender<uint16_t>(dst, stride, format, premultiplied, color, alpha);
+		FillPolygonsT(b, left, top, right - left, bottom - top, edges);
+		break;
+	}
+	case ConvertComponentFloat32: {
+		auto b = MakeBlender<float>(dst, stride, format, premultiplied, color, alpha);
+		FillPolygonsT(b, left, top, right - left, bottom - top, edges);
+		break;
+	}
+	}
+}
+
+void FillRect(void* dst, int width, int height, int stride, int format, int premultiplied, int componentType,
+              double x1, double y1, double x2, double y2, double hx1, double hy1, double hx2, double hy2, const float* color, float alpha) {
+	x1  = ClampCoord(x1, width);
+	x2  = ClampCoord(x2, width);
+	hx1 = ClampCoord(hx1, width);
+	hx2 = ClampCoord(hx2, width);
+	y1  = ClampCoord(y1, height);
+	y2  = ClampCoord(y2, height);
+	hy1 = ClampCoord(hy1, height);
+	hy2 = ClampCoord(hy2, height);
+	if (x1 >= x2 || y1 >= y2)
+		return;
+
+	switch (componentType) {
+	case ConvertComponentUint8: {
+		auto b = MakeBlender<uint8_t>(dst, stride, format, premultiplied, color, alpha);
+		FillRectT(b, width, height, x1, y1, x2, y2, hx1, hy1, hx2, hy2);
+		break;
+	}
+	case ConvertComponentUint16: {
+		auto b = MakeBlender<uint16_t>(dst, stride, format, premultiplied, color, alpha);
+		FillRectT(b, width, height, x1, y1, x2, y2, hx1, hy1, hx2, hy2);
+		break;
+	}
+	case ConvertComponentFloat32: {
+		auto b = MakeBlender<float>(dst, stride, format, premultiplied, color, alpha);
+		FillRectT(b, width, height, x1, y1, x2, y2, hx1, hy1, hx2, hy2);
+		break;
+	}
+	}
+}
+}
@@ -0,0 +1,261 @@
+package cimg
+
+/*
+#include "draw.h"
+*/
+import "C"
+import (
+	"image/color"
+	"math"
+	"unsafe"
+)
+
+// The vector drawing functions are anti-aliased, and blend their color over the image, so a color
+// with an alpha below 255 is translucent. They work on every pixel format and component type, and
+// honour the channel order and alpha state (Premultiplied) of the image. Shapes are clipped to the image.
+//
+// Coordinates are in pixels, with the top-left corner of the image at (0,0), so the center of
+// pixel (x, y) is at (x+0.5, y+0.5). A rectangle with integer coordinates covers whole pixels,
+// and a line of thickness 1 through the centers of a row of pixels covers exactly that row.
+//
+// Colors are converted to the image's colors in the same way as Set does, so for float32 images
+// other than CMYK, the color is converted from sRGB to linear light.
+//
+// Shapes with coordinates that are NaN or infinite are not drawn.
+
+// PointF is a point with sub-pixel precision
+type PointF struct {
+	X, Y float64
+}
+
+// FillRect fills the rectangle from (x1, y1) to (x2, y2)
+func (img *Image) FillRect(x1, y1, x2, y2 float64, c color.Color) {
+	img.fillRect(min(x1, x2), min(y1, y2), max(x1, x2), max(y1, y2), 0, 0, 0, 0, c)
+}
+
+// StrokeRect draws the outline of the rectangle from (x1, y1) to (x2, y2), centered on its edges
+func (img *Image) StrokeRect(x1, y1, x2, y2, thickness float64, c color.Color) {
+	if thickness <= 0 {
+		return
+	}
+	h := thickness / 2
+	x1, y1, x2, y2 = min(x1, x2), min(y1, y2), max(x1, x2), max(y1, y2)
+	if x2-x1 <= thickness || y2-y1 <= thickness {
+		// The outline covers the whole rectangle
+		img.fillRect(x1-h, y1-h, x2+h, y2+h, 0, 0, 0, 0, c)
+		return
+	}
+	img.fillRect(x1-h, y1-h, x2+h, y2+h, x1+h, y1+h, x2-h, y2-h, c)
+}
+
+// DrawLine draws a line from (x1, y1) to (x2, y2), with square ends that stop at the two points
+func (img *Image) DrawLine(x1, y1, x2, y2, thickness float64, c color.Color) {
+	img.DrawPolyline([]PointF{{x1, y1}, {x2, y2}}, thickness, c)
+}
+
+// DrawPolyline draws connected lines through points, with rounded joins.
+// Where the lines overlap, pixels are only drawn once, so translucent colors are uniform.
+func (img *Image) DrawPolyline(points []PointF, thickness float64, c color.Color) {
+	img.fillPolygons(strokePolygons(points, false, thickness), c)
+}
+
+// StrokePolygon draws the outline of a closed polygon, with rounded joins
+func (img *Image) StrokePolygon(points []PointF, thickness float64, c color.Color) {
+	img.fillPolygons(strokePolygons(points, true, thickness), c)
+}
+
+// FillPolygon fills a closed polygon, with the nonzero winding rule, so the inside of a
+// self-intersecting polygon, such as a star, is completely filled
+func (img *Image) FillPolygon(points []PointF, c color.Color) {
+	img.fillPolygons([][]PointF{points}, c)
+}
+
+// FillEllipse fills the ellipse centered at (cx, cy), with radii rx and ry
+func (img *Image) FillEllipse(cx, cy, rx, ry float64, c color.Color) {
+	if rx <= 0 || ry <= 0 {
+		return
+	}
+	img.fillPolygons([][]PointF{ellipsePoints(cx, cy, rx, ry)}, c)
+}
+
+// StrokeEllipse draws the outline of the ellipse centered at (cx, cy), with radii rx and ry
+func (img *Image) StrokeEllipse(cx, cy, rx, ry, thickness float64, c color.Color) {
+	if rx <= 0 || ry <= 0 || thickness <= 0 {
+		return
+	}
+	h := thickness / 2
+	outer := ellipsePoints(cx, cy, rx+h, ry+h)
+	if h >= min(rx, ry) {
+		img.fillPolygons([][]PointF{outer}, c)
+		return
+	}
+	img.fillPolygons([][]PointF{outer, asHole(ellipsePoints(cx, cy, rx-h, ry-h))}, c)
+}
+
+// FillCircle fills the circle centered at (cx, cy)
+func (img *Image) FillCircle(cx, cy, radius float64, c color.Color) {
+	img.FillEllipse(cx, cy, radius, radius, c)
+}
+
+// StrokeCircle draws the outline of the circle centered at (cx, cy)
+func (img *Image) StrokeCircle(cx, cy, radius, thickness float64, c color.Color) {
+	img.StrokeEllipse(cx, cy, radius, radius, thickness, c)
+}
+
+// fillRect blends c over the rectangle from (x1, y1) to (x2, y2), minus the hole from (hx1, hy1)
+// to (hx2, hy2), which may be empty. Rectangles don't need the rasterizer, so only the pixels
+// that are covered are visited.
+func (img *Image) fillRect(x1, y1, x2, y2, hx1, hy1, hx2, hy2 float64, c color.Color) {
+	values, alpha := img.drawColor(c)
+	if alpha == 0 || img.Width == 0 || img.Height == 0 || !isFinite(x1, y1, x2, y2, hx1, hy1, hx2, hy2) {
+		return
+	}
+	C.FillRect(unsafe.Pointer(&img.Pixels[0]), C.int(img.Width), C.int(img.Height), C.int(img.Stride), C.int(img.Format), C.int(boolToInt(img.Premultiplied)), C.int(img.Type),
+		C.double(x1), C.double(y1), C.double(x2), C.double(y2), C.double(hx1), C.double(hy1), C.double(hx2), C.double(hy2), (*C.float)(unsafe.Pointer(&values[0])), C.float(alpha))
+}
+
+// fillPolygons fills the polygons with the nonzero winding rule, and blends c over the image
+func (img *Image) fillPolygons(polys [][]PointF, c color.Color) {
+	values, alpha := img.drawColor(c)
+	if alpha == 0 || img.Width == 0 || img.Height == 0 {
+		return
+	}
+	points := []float64{}
+	lengths := []C.int{}
+	for _, poly := range polys {
+		if len(poly) < 3 {
+			continue
+		}
+		for _, p := range poly {
+			if !isFinite(p.X, p.Y) {
+				return
+			}
+			points = append(points, p.X, p.Y)
+		}
+		lengths = append(lengths, C.int(len(poly)))
+	}
+	if len(lengths) == 0 {
+		return
+	}
+	C.FillPolygons(unsafe.Pointer(&img.Pixels[0]), C.int(img.Width), C.int(img.Height), C.int(img.Stride), C.int(img.Format), C.int(boolToInt(img.Premultiplied)), C.int(img.Type),
+		(*C.double)(unsafe.Pointer(&points[0])), &lengths[0], C.int(len(lengths)), (*C.float)(unsafe.Pointer(&values[0])), C.float(alpha))
+}
+
+// drawColor returns the straight color channels of c for FillPolygons, in [0,1], and its alpha.
+// GRAY images have a single gray value, CMYK images have 4 values of inverted CMYK, and all other
+// formats have R, G, B.
+func (img *Image) drawColor(c color.Color) ([4]float32, float32) {
+	n := color.NRGBA64Model.Convert(c).(color.NRGBA64)
+	r, g, b := float32(n.R)/0xffff, float32(n.G)/0xffff, float32(n.B)/0xffff
+	if img.Format == PixelFormatGRAY {
+		// The same weights as color.GrayModel
+		y := (19595*uint32(n.R) + 38470*uint32(n.G) + 7471*uint32(n.B) + 1<<15) >> 16
+		r = float32(y) / 0xffff
+	}
+	if img.Type == ComponentFloat32 && img.Format != PixelFormatCMYK {
+		r, g, b = srgbToLinear(r), srgbToLinear(g), srgbToLinear(b)
+	}
+	values := [4]float32{r, g, b}
+	if img.Format == PixelFormatCMYK {
+		// The same as ConvertInto
+		k := max(r, g, b)
+		values = [4]float32{1, 1, 1, k}
+		if k > 0 {
+			values = [4]float32{r / k, g / k, b / k, k}
+		}
+	}
+	return values, float32(n.A) / 0xffff
+}
+
+func isFinite(values ...float64) bool {
+	for _, v := range values {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return false
+		}
+	}
+	return true
+}
+
+// ellipsePoints approximates an ellipse with a polygon, which is accurate to about 1/20 of a pixel,
+// for radii up to about 40 million pixels. The polygon is scaled up slightly, so that its area is the
+// same as the ellipse. It returns nil if the ellipse is not finite.
+func ellipsePoints(cx, cy, rx, ry float64) []PointF {
+	if !isFinite(cx, cy, rx, ry) {
+		return nil
+	}
+	n := min(max(8, int(math.Ceil(math.Pi*math.Sqrt(10*max(rx, ry))))), 1<<16)
+	step := 2 * math.Pi / float64(n)
+	scale := math.Sqrt(step / math.Sin(step))
+	points := make([]PointF, n)
+	for i := range points {
+		a := step * float64(i)
+		points[i] = PointF{cx + scale*rx*math.Cos(a), cy + scale*ry*math.Sin(a)}
+	}
+	return points
+}
+
+// polygonArea returns the signed area of a polygon. It is positive for clockwise polygons,
+// because y points down.
+func polygonArea(points []PointF) float64 {
+	area := 0.0
+	for i, p := range points {
+		q := points[(i+1)%len(points)]
+		area += p.X*q.Y - q.X*p.Y
+	}
+	return area / 2
+}
+
+// asFill orients a polygon clockwise, so that the parts of a shape all add to the coverage
+func asFill(points []PointF) []PointF {
+	if polygonArea(points) < 0 {
+		return reversePoints(points)
+	}
+	return points
+}
+
+// asHole orients a polygon counter-clockwise, so that it cuts a hole in a clockwise polygon
+func asHole(points []PointF) []PointF {
+	if polygonArea(points) > 0 {
+		return reversePoints(points)
+	}
+	return points
+}
+
+func reversePoints(points []PointF) []PointF {
+	r := make([]PointF, len(points))
+	for i, p := range points {
+		r[len(points)-1-i] = p
+	}
+	return r
+}
+
+// strokePolygons returns the polygons that make up a thick polyline: one quad for each segment,
+// and a circle at each join. They all have the same orientation, so their union is filled.
+func strokePolygons(points []PointF, closed bool, thickness float64) [][]PointF {
+	if thickness <= 0 || len(points) < 2 {
+		return nil
+	}
+	h := thickness / 2
+	polys := [][]PointF{}
+	nseg := len(points) - 1
+	if closed {
+		nseg = len(points)
+	}
+	for i := 0; i < nseg; i++ {
+		a := points[i]
+		b := points[(i+1)%len(points)]
+		length := math.Hypot(b.X-a.X, b.Y-a.Y)
+		if length == 0 {
+			continue
+		}
+		nx := -(b.Y - a.Y) / length * h
+		ny := (b.X - a.X) / length * h
+		polys = append(polys, asFill([]PointF{{a.X + nx, a.Y + ny}, {b.X + nx, b.Y + ny}, {b.X - nx, b.Y - ny}, {a.X - nx, a.Y - ny}}))
+	}
+	for i, p := range points {
+		if closed || (i > 0 && i < len(points)-1) {
+			polys = append(polys, ellipsePoints(p.X, p.Y, h, h))
+		}
+	}
+	return polys
+}
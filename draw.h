@@ -0,0 +1,22 @@
+#include <stdint.h>
+
+#ifdef __cplusplus
+extern "C" {
+#endif
+
+// Fill a set of polygons with the nonzero winding rule, and blend a color over the image, weighted by
+// the anti-aliased coverage of each pixel. points holds x,y pairs, and polyLengths holds the number of
+// points in each polygon. color holds one value for each color channel (1 for TJPF_GRAY, 4 for TJPF_CMYK,
+// otherwise 3 in R,G,B order), on a scale of 0 to 1. componentType is a ComponentType from image.go.
+void FillPolygons(void* dst, int width, int height, int stride, int format, int premultiplied, int componentType,
+                  const double* points, const int* polyLengths, int numPolys, const float* color, float alpha);
+
+// Fill the axis-aligned rectangle (x1, y1) - (x2, y2), minus the hole (hx1, hy1) - (hx2, hy2), which must be
+// inside the rectangle, and may be empty. This is the same as FillPolygons, but it only visits the pixels
+// that are covered. The parameters are otherwise the same as FillPolygons.
+void FillRect(void* dst, int width, int height, int stride, int format, int premultiplied, int componentType,
+              double x1, double y1, double x2, double y2, double hx1, double hy1, double hx2, double hy2, const float* color, float alpha);
+
+#ifdef __cplusplus
+}
+#endif
@@ -0,0 +1,226 @@
+package cimg
+
+import (
+	"image/color"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// coverageArea returns the area that has been drawn in white onto a black GRAY image
+func coverageArea(img *Image) float64 {
+	sum := 0.0
+	for y := 0; y < img.Height; y++ {
+		for x := 0; x < img.Width; x++ {
+			sum += float64(img.Pixels[img.PixelByte(x, y)]) / 255
+		}
+	}
+	return sum
+}
+
+func TestDrawRectangleFormats(t *testing.T) {
+	red := color.NRGBA{200, 10, 20, 255}
+	for _, typ := range []ComponentType{ComponentUint8, ComponentUint16, ComponentFloat32} {
+		for _, pf := range allPixelFormats {
+			for _, premul := range []bool{false, true} {
+				img := NewImageOfType(12, 10, pf, typ)
+				img.Premultiplied = premul
+				img.DrawRectangle(2, 3, 9, 8, red.R, red.G, red.B)
+				expect := img.ColorModel().Convert(red)
+				empty := NewImageOfType(1, 1, pf, typ)
+				empty.Premultiplied = premul
+				for y := 0; y < img.Height; y++ {
+					for x := 0; x < img.Width; x++ {
+						onOutline := (x == 2 || x == 8) && y >= 3 && y < 8 || (y == 3 || y == 7) && x >= 2 && x < 9
+						if onOutline {
+							requireColorNear(t, expect, img.At(x, y), 0x101, "%v %v %v (%v,%v)", typ, pf, premul, x, y)
+						} else {
+							require.Equal(t, empty.At(0, 0), img.At(x, y), "%v %v %v (%v,%v)", typ, pf, premul, x, y)
+						}
+					}
+				}
+			}
+		}
+	}
+
+	// Channel order, and alpha
+	bgra := NewImage(3, 1, PixelFormatBGRA)
+	bgra.DrawRectangle(0, 0, 1, 1, 10, 20, 30)
+	require.Equal(t, []byte{30, 20, 10, 255}, bgra.Pixels[:4])
+	require.Equal(t, []byte{0, 0, 0, 0}, bgra.Pixels[4:8])
+	argb := NewImage(1, 1, PixelFormatARGB)
+	argb.DrawRectangle(0, 0, 1, 1, 10, 20, 30)
+	require.Equal(t, []byte{255, 10, 20, 30}, argb.Pixels)
+
+	// Clipping, and empty rectangles
+	img := NewImage(5, 5, PixelFormatGRAY)
+	img.DrawRectangle(-3, -3, 2, 2, 255, 255, 255)
+	img.DrawRectangle(4, 4, 10, 10, 255, 255, 255)
+	img.DrawRectangle(3, 0, 3, 5, 255, 255, 255)
+	img.DrawRectangle(-10, -10, -5, -5, 255, 255, 255)
+	require.Equal(t, []byte{
+		0, 255, 0, 0, 0,
+		255, 255, 0, 0, 0,
+		0, 0, 0, 0, 0,
+		0, 0, 0, 0, 0,
+		0, 0, 0, 0, 255,
+	}, img.Pixels)
+}
+
+func TestDrawShapes(t *testing.T) {
+	white := color.Gray{255}
+	newGray := func() *Image { return NewImage(100, 80, PixelFormatGRAY) }
+
+	// Whole pixels are covered exactly, and half pixels are half covered
+	img := newGray()
+	img.FillRect(10, 20, 30, 25, white)
+	require.Equal(t, 100.0, coverageArea(img))
+	require.Equal(t, byte(255), img.Pixels[img.PixelByte(10, 20)])
+	require.Equal(t, byte(0), img.Pixels[img.PixelByte(9, 20)])
+	require.Equal(t, byte(0), img.Pixels[img.PixelByte(30, 20)])
+	img = newGray()
+	img.FillRect(10.5, 20, 30, 21, white)
+	require.Equal(t, []byte{0, 128, 255}, img.Pixels[img.PixelByte(9, 20):][:3])
+
+	// A horizontal line through the pixel centers covers one row
+	img = newGray()
+	img.DrawLine(10, 30.5, 20, 30.5, 1, white)
+	require.Equal(t, 10.0, coverageArea(img))
+	require.Equal(t, byte(255), img.Pixels[img.PixelByte(15, 30)])
+
+	// Areas
+	area := func(draw func(img *Image)) float64 {
+		img := newGray()
+		draw(img)
+		return coverageArea(img)
+	}
+	require.InDelta(t, 30*math.Sqrt(2)*3, area(func(img *Image) { img.DrawLine(20, 20, 50, 50, 3, white) }), 1)
+	require.InDelta(t, math.Pi*30*30, area(func(img *Image) { img.FillCircle(50, 40, 30, white) }), 2)
+	require.InDelta(t, math.Pi*20*35, area(func(img *Image) { img.FillEllipse(50, 40, 35, 20, white) }), 2)
+	require.InDelta(t, math.Pi*(31*31-29*29), area(func(img *Image) { img.StrokeCircle(50, 40, 30, 2, white) }), 2)
+	require.InDelta(t, 40*30-36*26, area(func(img *Image) { img.StrokeRect(10, 10, 48, 38, 2, white) }), 0.01)
+	require.InDelta(t, 0.5*60*40, area(func(img *Image) { img.FillPolygon([]PointF{{10, 10}, {70, 10}, {10, 50}}, white) }), 0.1)
+	// The polygon may be in either orientation
+	require.InDelta(t, 0.5*60*40, area(func(img *Image) { img.FillPolygon([]PointF{{10, 50}, {70, 10}, {10, 10}}, white) }), 0.1)
+	// A thick outline covers the whole shape
+	require.InDelta(t, 22*22, area(func(img *Image) { img.StrokeRect(10, 10, 20, 20, 12, white) }), 0.01)
+	require.InDelta(t, math.Pi*12*12, area(func(img *Image) { img.StrokeCircle(50, 40, 5, 14, white) }), 1)
+
+	// A self-intersecting star is filled completely (the nonzero rule)
+	star := []PointF{}
+	for i := 0; i < 5; i++ {
+		a := float64(i*2) * 2 * math.Pi / 5
+		star = append(star, PointF{50 + 30*math.Sin(a), 40 - 30*math.Cos(a)})
+	}
+	img = newGray()
+	img.FillPolygon(star, white)
+	require.Equal(t, byte(255), img.Pixels[img.PixelByte(50, 40)])
+
+	// Clipping
+	require.Equal(t, 25.0, area(func(img *Image) { img.FillRect(-10, -10, 5, 5, white) }))
+	require.Equal(t, 20.0, area(func(img *Image) { img.FillRect(95, 76, 200, 200, white) }))
+	require.InDelta(t, math.Pi*30*30/4, area(func(img *Image) { img.FillCircle(0, 0, 30, white) }), 2)
+	require.InDelta(t, math.Pi*30*30/4, area(func(img *Image) { img.FillCircle(100, 80, 30, white) }), 2)
+	require.Equal(t, 0.0, area(func(img *Image) { img.FillCircle(-50, 40, 30, white) }))
+	require.Equal(t, 0.0, area(func(img *Image) { img.FillRect(10, 10, 20, 20, color.Transparent) }))
+	require.Equal(t, 0.0, area(func(img *Image) { img.DrawPolyline([]PointF{{10, 10}}, 2, white) }))
+
+	// Coordinates far outside of the image, and coordinates that are not finite
+	require.Equal(t, 3.0*78, area(func(img *Image) { img.FillRect(2, 2, 5, 1e12, white) }))
+	require.Equal(t, 3.0*78, area(func(img *Image) { img.FillPolygon([]PointF{{2, 2}, {5, 2}, {5, 1e12}, {2, 1e12}}, white) }))
+	require.Equal(t, 100.0*80, area(func(img *Image) { img.FillPolygon([]PointF{{-1e12, -1e12}, {1e12, -1e12}, {0, 1e12}}, white) }))
+	require.Equal(t, 100.0*80, area(func(img *Image) { img.StrokeRect(-1e12, -1e12, 1e12, 1e12, 2e12, white) }))
+	require.Equal(t, 0.0, area(func(img *Image) { img.FillRect(2, 2, 5, math.Inf(1), white) }))
+	require.Equal(t, 0.0, area(func(img *Image) { img.FillPolygon([]PointF{{2, 2}, {5, 2}, {5, math.NaN()}}, white) }))
+	require.Equal(t, 0.0, area(func(img *Image) { img.FillCircle(50, 40, math.Inf(1), white) }))
+	require.Equal(t, 0.0, area(func(img *Image) { img.DrawLine(10, 10, 50, 50, math.NaN(), white) }))
+
+	// Shapes that are rasterized in more than one band
+	big := NewImage(3000, 1200, PixelFormatGRAY)
+	big.FillCircle(1500, 600, 550, white)
+	require.InDelta(t, math.Pi*550*550, coverageArea(big), 2)
+	require.Equal(t, byte(255), big.Pixels[big.PixelByte(1500, 600)])
+	require.Equal(t, byte(255), big.Pixels[big.PixelByte(1500, 60)])
+	require.Equal(t, byte(0), big.Pixels[big.PixelByte(1500, 40)])
+}
+
+func TestDrawRectPath(t *testing.T) {
+	// Rectangles are drawn directly, without the rasterizer, with the same result
+	c := color.NRGBA{200, 100, 50, 150}
+	for _, r := range [][5]float64{
+		{10.3, 20.7, 60.2, 45.5, 3.6},
+		{10.5, 20.5, 60.5, 45.5, 1},
+		{-5.5, -2.25, 30.5, 200, 7},
+		{10.5, 10.5, 10.5, 30.5, 1},
+	} {
+		direct := NewImage(80, 60, PixelFormatBGRA)
+		direct.StrokeRect(r[0], r[1], r[2], r[3], r[4], c)
+		poly := NewImage(80, 60, PixelFormatBGRA)
+		h := r[4] / 2
+		outer := []PointF{{r[0] - h, r[1] - h}, {r[2] + h, r[1] - h}, {r[2] + h, r[3] + h}, {r[0] - h, r[3] + h}}
+		if r[2]-r[0] > r[4] && r[3]-r[1] > r[4] {
+			inner := []PointF{{r[0] + h, r[1] + h}, {r[2] - h, r[1] + h}, {r[2] - h, r[3] - h}, {r[0] + h, r[3] - h}}
+			poly.fillPolygons([][]PointF{outer, asHole(inner)}, c)
+		} else {
+			poly.fillPolygons([][]PointF{outer}, c)
+		}
+		maxAlpha := byte(0)
+		for i := range direct.Pixels {
+			require.InDelta(t, int(poly.Pixels[i]), int(direct.Pixels[i]), 1, "%v %v", r, i)
+			if i%4 == 3 {
+				maxAlpha = max(maxAlpha, direct.Pixels[i])
+			}
+		}
+		require.Equal(t, byte(150), maxAlpha, "%v", r)
+	}
+}
+
+func TestDrawBlending(t *testing.T) {
+	// Translucent colors blend over the image
+	rgb := NewImage(10, 10, PixelFormatBGR)
+	rgb.FillRect(0, 0, 10, 10, color.RGBA{0, 0, 255, 255})
+	rgb.FillRect(0, 0, 10, 10, color.NRGBA{255, 0, 0, 128})
+	require.Equal(t, []byte{127, 0, 128}, rgb.Pixels[:3])
+
+	// A polyline with overlapping segments and joins is drawn once, so its alpha is uniform
+	for _, premul := range []bool{false, true} {
+		img := NewImage(60, 60, PixelFormatARGB)
+		img.Premultiplied = premul
+		img.DrawPolyline([]PointF{{10, 10}, {50, 10}, {10, 50}, {50, 50}, {30, 5}}, 6, color.NRGBA{0, 255, 0, 100})
+		maxAlpha := byte(0)
+		for y := 0; y < img.Height; y++ {
+			for x := 0; x < img.Width; x++ {
+				p := img.Pixels[img.PixelByte(x, y):]
+				maxAlpha = max(maxAlpha, p[0])
+				if p[0] > 50 {
+					// The straight color is green, whatever the coverage
+					requireColorNear(t, color.NRGBA{0, 255, 0, p[0]}, color.NRGBAModel.Convert(img.At(x, y)), 2*0x101)
+				}
+			}
+		}
+		require.Equal(t, byte(100), maxAlpha)
+	}
+
+	// Drawing over straight alpha
+	img := NewImage(1, 1, PixelFormatRGBA)
+	copy(img.Pixels, []byte{0, 0, 255, 128})
+	img.FillRect(0, 0, 1, 1, color.NRGBA{255, 0, 0, 128})
+	require.Equal(t, []byte{170, 0, 85, 192}, img.Pixels)
+
+	// 16-bit and float32
+	img16 := NewImageOfType(4, 4, PixelFormatRGBX, ComponentUint16)
+	img16.FillRect(1, 1, 3, 3, color.RGBA64{0x1234, 0x5678, 0x9abc, 0xffff})
+	require.Equal(t, []uint16{0x1234, 0x5678, 0x9abc, 0xffff}, img16.Pixels16()[img16.PixelByte(1, 1)/2:][:4])
+	f := NewImageOfType(2, 1, PixelFormatGRAY, ComponentFloat32)
+	f.PixelsFloat32()[1] = 5
+	f.FillRect(0, 0, 1, 1, color.Gray{128})
+	f.StrokeCircle(1.5, 0.5, 20, 1, color.White)
+	require.InDelta(t, 0.2158, f.PixelsFloat32()[0], 0.0001)
+	require.Equal(t, float32(5), f.PixelsFloat32()[1])
+
+	// CMYK
+	cmyk := NewImage(1, 1, PixelFormatCMYK)
+	cmyk.FillRect(0, 0, 1, 1, color.RGBA{30, 20, 10, 255})
+	require.Equal(t, []byte{255, 170, 85, 30}, cmyk.Pixels)
+}
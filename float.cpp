@@ -0,0 +1,160 @@
+#include <stdint.h>
+#include <math.h>
+#include <algorithm>
+#include "float.h"
+#include "srgb.h"
+
+// These must match the ToneMapOperator constants in float.go
+enum ToneMapOps {
+	ToneMapOpReinhard = 0,
+	ToneMapOpACES     = 1,
+	ToneMapOpClamp    = 2,
+};
+
+template <typename T>
+void ToLinear(const uint8_t* src, int width, int height, int srcStride, int nchan, int alphaChan, bool premultiplied, uint8_t* dst, int dstStride) {
+	const float  maxVal = (float) (T) -1;
+	const float* table  = SRGBTableFor<T>();
+	for (int y = 0; y < height; y++) {
+		const T* s = (const T*) (src + y * srcStride);
+		float*   d = (float*) (dst + y * dstStride);
+		for (int x = 0; x < width; x++) {
+			float a = alphaChan == -1 ? 1.0f : s[alphaChan] / maxVal;
+			for (int c = 0; c < nchan; c++) {
+				if (c == alphaChan) {
+					d[c] = a;
+				} else if (premultiplied) {
+					// The transfer function must be applied to the straight color
+					d[c] = a == 0 ? 0 : SRGBToLinear(std::min(s[c] / maxVal / a, 1.0f)) * a;
+				} else {
+					d[c] = table[s[c]];
+				}
+			}
+			s += nchan;
+			d += nchan;
+		}
+	}
+}
+
+template <typename T>
+void FromLinear(const uint8_t* src, int width, int height, int srcStride, int nchan, int alphaChan, bool premultiplied, uint8_t* dst, int dstStride) {
+	const float maxVal = (float) (T) -1;
+	for (int y = 0; y < height; y++) {
+		const float* s = (const float*) (src + y * srcStride);
+		T*           d = (T*) (dst + y * dstStride);
+		for (int x = 0; x < width; x++) {
+			float a = alphaChan == -1 ? 1.0f : std::min(std::max(s[alphaChan], 0.0f), 1.0f);
+			for (int c = 0; c < nchan; c++) {
+				float v;
+				if (c == alphaChan)
+					v = a;
+				else if (premultiplied)
+					v = a == 0 ? 0 : LinearToSRGB(s[c] / a) * a;
+				else
+					v = LinearToSRGB(s[c]);
+				d[c] = (T) (v * maxVal + 0.5f);
+			}
+			s += nchan;
+			d += nchan;
+		}
+	}
+}
+
+// Narkowicz's fit of the ACES filmic curve
+static float ACES(float x) {
+	x = std::max(x, 0.0f);
+	return std::min((x * (2.51f * x + 0.03f)) / (x * (2.43f * x + 0.59f) + 0.14f), 1.0f);
+}
+
+extern "C" {
+
+void SRGBToLinearFloat(const void* _src, int componentSize, int width, int height, int srcStride, int nchan, int alphaChan, int premultiplied, void* _dst, int dstStride) {
+	const uint8_t* src = (const uint8_t*) _src;
+	uint8_t*       dst = (uint8_t*) _dst;
+	if (componentSize == 1)
+		ToLinear<uint8_t>(src, width, height, srcStride, nchan, alphaChan, premultiplied != 0, dst, dstStride);
+	else
+		ToLinear<uint16_t>(src, width, height, srcStride, nchan, alphaChan, premultiplied != 0, dst, dstStride);
+}
+
+void LinearFloatToSRGB(const void* _src, int width, int height, int srcStride, int nchan, int alphaChan, int premultiplied, void* _dst, int componentSize, int dstStride) {
+	const uint8_t* src = (const uint8_t*) _src;
+	uint8_t*       dst = (uint8_t*) _dst;
+	if (componentSize == 1)
+		FromLinear<uint8_t>(src, width, height, srcStride, nchan, alphaChan, premultiplied != 0, dst, dstStride);
+	else
+		FromLinear<uint16_t>(src, width, height, srcStride, nchan, alphaChan, premultiplied != 0, dst, dstStride);
+}
+
+void FloatAddWeighted(void* _dst, int width, int height, int dstStride, int nchan, const void* _src, int srcStride, float weight) {
+	for (int y = 0; y < height; y++) {
+		float*       d = (float*) ((uint8_t*) _dst + y * dstStride);
+		const float* s = (const float*) ((const uint8_t*) _src + y * srcStride);
+		for (int i = 0; i < width * nchan; i++)
+			d[i] += s[i] * weight;
+	}
+}
+
+void FloatMultiply(void* _dst, int width, int height, int dstStride, int nchan, const void* _src, int srcStride, int srcNChan) {
+	for (int y = 0; y < height; y++) {
+		float*       d = (float*) ((uint8_t*) _dst + y * dstStride);
+		const float* s = (const float*) ((const uint8_t*) _src + y * srcStride);
+		if (srcNChan == 1) {
+			for (int x = 0; x < width; x++) {
+				for (int c = 0; c < nchan; c++)
+					d[c] *= s[x];
+				d += nchan;
+			}
+		} else {
+			for (int i = 0; i < width * nchan; i++)
+				d[i] *= s[i];
+		}
+	}
+}
+
+void FloatScale(void* _dst, int width, int height, int stride, int nchan, int alphaChan, float factor) {
+	for (int y = 0; y < height; y++) {
+		float* d = (float*) ((uint8_t*) _dst + y * stride);
+		for (int x = 0; x < width; x++) {
+			for (int c = 0; c < nchan; c++) {
+				if (c != alphaChan)
+					d[c] *= factor;
+			}
+			d += nchan;
+		}
+	}
+}
+
+void FloatToneMap(void* _dst, int width, int height, int stride, int nchan, int alphaChan, int premultiplied, int op, float exposure, float whitePoint) {
+	float invWhite2 = whitePoint > 0 ? 1.0f / (whitePoint * whitePoint) : 0;
+	for (int y = 0; y < height; y++) {
+		float* d = (float*) ((uint8_t*) _dst + y * stride);
+		for (int x = 0; x < width; x++) {
+			float a = alphaChan == -1 ? 1.0f : d[alphaChan];
+			for (int c = 0; c < nchan; c++) {
+				if (c == alphaChan)
+					continue;
+				float v = d[c];
+				if (premultiplied) {
+					if (a <= 0) {
+						d[c] = 0;
+						continue;
+					}
+					v /= a;
+				}
+				v = std::max(v * exposure, 0.0f);
+				switch (op) {
+				case ToneMapOpReinhard: v = v * (1.0f + v * invWhite2) / (1.0f + v); break;
+				case ToneMapOpACES: v = ACES(v); break;
+				case ToneMapOpClamp: break;
+				}
+				v = std::min(v, 1.0f);
+				if (premultiplied)
+					v *= a;
+				d[c] = v;
+			}
+			d += nchan;
+		}
+	}
+}
+}
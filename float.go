@@ -0,0 +1,206 @@
+package cimg
+
+/*
+#include "float.h"
+*/
+import "C"
+import (
+	"errors"
+	"fmt"
+	"math"
+	"unsafe"
+)
+
+// Float32 images hold linear light, unlike 8 and 16 bit images, which hold sRGB encoded values.
+// ConvertType applies the sRGB transfer function when converting between the two.
+
+// ToneMapOperator is the curve that ToneMap uses to compress HDR values into [0,1]
+type ToneMapOperator int
+
+const (
+	ToneMapReinhard ToneMapOperator = iota // x / (1 + x), or the extended form if WhitePoint is set
+	ToneMapACES                            // A fit of the ACES filmic curve, which has more contrast than Reinhard
+	ToneMapClamp                           // Clip values above 1
+)
+
+// ToneMapParams control ToneMap
+type ToneMapParams struct {
+	Operator   ToneMapOperator
+	Exposure   float32 // Exposure adjustment in stops, applied before the curve. 0 = no adjustment
+	WhitePoint float32 // For ToneMapReinhard, the smallest value that maps to 1. 0 = infinite (plain Reinhard)
+}
+
+// PixelsFloat32 returns the pixels of a ComponentFloat32 image as 32-bit floats, without copying.
+// Stride is still measured in bytes, so row y starts at PixelsFloat32()[y*Stride/4].
+func (img *Image) PixelsFloat32() []float32 {
+	if img.Type != ComponentFloat32 {
+		panic("PixelsFloat32 called on an image that is not ComponentFloat32")
+	}
+	if len(img.Pixels) == 0 {
+		return nil
+	}
+	return unsafe.Slice((*float32)(unsafe.Pointer(&img.Pixels[0])), len(img.Pixels)/4)
+}
+
+// alphaChannel returns the index of the alpha channel, or -1 if there is no alpha channel
+func (img *Image) alphaChannel() int {
+	_, _, _, a := channelOffsets(img.Format)
+	return a
+}
+
+// toLinearFloat converts an 8 or 16 bit sRGB image into a linear float32 image
+func (img *Image) toLinearFloat() *Image {
+	dst := NewImageOfType(img.Width, img.Height, img.Format, ComponentFloat32)
+	dst.Premultiplied = img.Premultiplied
+	if img.Width == 0 || img.Height == 0 {
+		return dst
+	}
+	C.SRGBToLinearFloat(unsafe.Pointer(&img.Pixels[0]), C.int(img.Type.Size()), C.int(img.Width), C.int(img.Height), C.int(img.Stride),
+		C.int(img.NChan()), C.int(img.alphaChannel()), C.int(boolToInt(img.Premultiplied)), unsafe.Pointer(&dst.Pixels[0]), C.int(dst.Stride))
+	return dst
+}
+
+// fromLinearFloat converts a linear float32 image into an 8 or 16 bit sRGB image.
+// Values are clamped to [0,1]. Use ToneMap first to bring HDR values into range.
+func (img *Image) fromLinearFloat(typ ComponentType) *Image {
+	dst := NewImageOfType(img.Width, img.Height, img.Format, typ)
+	dst.Premultiplied = img.Premultiplied
+	if img.Width == 0 || img.Height == 0 {
+		return dst
+	}
+	C.LinearFloatToSRGB(unsafe.Pointer(&img.Pixels[0]), C.int(img.Width), C.int(img.Height), C.int(img.Stride),
+		C.int(img.NChan()), C.int(img.alphaChannel()), C.int(boolToInt(img.Premultiplied)), unsafe.Pointer(&dst.Pixels[0]), C.int(typ.Size()), C.int(dst.Stride))
+	return dst
+}
+
+// srgbToLinear decodes one sRGB value in [0,1] to linear light.
+// This matches the C++ implementation in float.cpp, for single pixel access from Go.
+func srgbToLinear(v float32) float32 {
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return float32(math.Pow((float64(v)+0.055)/1.055, 2.4))
+}
+
+// linearToSRGB encodes one linear light value to sRGB, clamping it to [0,1]
+func linearToSRGB(v float32) float32 {
+	v = min(max(v, 0), 1)
+	if v <= 0.0031308 {
+		return v * 12.92
+	}
+	return float32(1.055*math.Pow(float64(v), 1/2.4) - 0.055)
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func (img *Image) requireFloat32(function string) error {
+	if img.Type != ComponentFloat32 {
+		return fmt.Errorf("%v only supports float32 images", function)
+	}
+	return nil
+}
+
+func checkSameSize(a, b *Image) error {
+	if a.Width != b.Width || a.Height != b.Height {
+		return fmt.Errorf("Image sizes differ: %v x %v and %v x %v", a.Width, a.Height, b.Width, b.Height)
+	}
+	return nil
+}
+
+// Add adds src to the image, channel by channel, including alpha.
+// Both images must be float32, with the same size and pixel format.
+func (img *Image) Add(src *Image) error {
+	return img.AddWeighted(src, 1)
+}
+
+// AddWeighted adds src * weight to the image, channel by channel, including alpha.
+// Accumulating premultiplied images with weights that sum to 1 produces their weighted average.
+// Both images must be float32, with the same size and pixel format.
+func (img *Image) AddWeighted(src *Image, weight float32) error {
+	if err := img.checkFloatOperand("AddWeighted", src); err != nil {
+		return err
+	}
+	if src.Format != img.Format {
+		return fmt.Errorf("Source pixel format %v differs from target pixel format %v", src.Format, img.Format)
+	}
+	if img.Width == 0 || img.Height == 0 {
+		return nil
+	}
+	C.FloatAddWeighted(unsafe.Pointer(&img.Pixels[0]), C.int(img.Width), C.int(img.Height), C.int(img.Stride), C.int(img.NChan()),
+		unsafe.Pointer(&src.Pixels[0]), C.int(src.Stride), C.float(weight))
+	return nil
+}
+
+// Multiply multiplies the image by src, channel by channel, including alpha.
+// src must be float32 and the same size as the image. It must either have the same pixel format,
+// or be a GRAY image, in which case each pixel of the image is multiplied by the single gray value,
+// which is useful for applying a weight map.
+func (img *Image) Multiply(src *Image) error {
+	if err := img.checkFloatOperand("Multiply", src); err != nil {
+		return err
+	}
+	if src.Format != img.Format && src.Format != PixelFormatGRAY {
+		return fmt.Errorf("Source pixel format %v must be GRAY or the same as target pixel format %v", src.Format, img.Format)
+	}
+	if img.Width == 0 || img.Height == 0 {
+		return nil
+	}
+	C.FloatMultiply(unsafe.Pointer(&img.Pixels[0]), C.int(img.Width), C.int(img.Height), C.int(img.Stride), C.int(img.NChan()),
+		unsafe.Pointer(&src.Pixels[0]), C.int(src.Stride), C.int(src.NChan()))
+	return nil
+}
+
+func (img *Image) checkFloatOperand(function string, src *Image) error {
+	if err := img.requireFloat32(function); err != nil {
+		return err
+	}
+	if err := src.requireFloat32(function); err != nil {
+		return err
+	}
+	return checkSameSize(img, src)
+}
+
+// Scale multiplies the color channels of a float32 image by factor, leaving alpha unchanged.
+// This is an exposure adjustment of log2(factor) stops.
+func (img *Image) Scale(factor float32) error {
+	if err := img.requireFloat32("Scale"); err != nil {
+		return err
+	}
+	if img.Width == 0 || img.Height == 0 {
+		return nil
+	}
+	C.FloatScale(unsafe.Pointer(&img.Pixels[0]), C.int(img.Width), C.int(img.Height), C.int(img.Stride), C.int(img.NChan()), C.int(img.alphaChannel()), C.float(factor))
+	return nil
+}
+
+// ToneMap compresses the color channels of a float32 HDR image into [0,1], in place.
+// The image is still linear afterwards, so convert it with ConvertType to get sRGB.
+// If params is nil, then plain Reinhard is used.
+func (img *Image) ToneMap(params *ToneMapParams) error {
+	if err := img.requireFloat32("ToneMap"); err != nil {
+		return err
+	}
+	if params == nil {
+		params = &ToneMapParams{}
+	}
+	switch params.Operator {
+	case ToneMapReinhard, ToneMapACES, ToneMapClamp:
+	default:
+		return errors.New("Unknown tone map operator")
+	}
+	exposure := float32(1)
+	if params.Exposure != 0 {
+		exposure = float32(math.Exp2(float64(params.Exposure)))
+	}
+	if img.Width == 0 || img.Height == 0 {
+		return nil
+	}
+	C.FloatToneMap(unsafe.Pointer(&img.Pixels[0]), C.int(img.Width), C.int(img.Height), C.int(img.Stride), C.int(img.NChan()), C.int(img.alphaChannel()),
+		C.int(boolToInt(img.Premultiplied)), C.int(params.Operator), C.float(exposure), C.float(params.WhitePoint))
+	return nil
+}
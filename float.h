@@ -0,0 +1,22 @@
+#include <stdint.h>
+
+#ifdef __cplusplus
+extern "C" {
+#endif
+
+// Strides are in bytes. alphaChan is the index of the alpha channel, or -1 if there is none.
+// componentSize is 1 for 8-bit integer images, and 2 for 16-bit integer images.
+void SRGBToLinearFloat(const void* _src, int componentSize, int width, int height, int srcStride, int nchan, int alphaChan, int premultiplied, void* _dst, int dstStride);
+void LinearFloatToSRGB(const void* _src, int width, int height, int srcStride, int nchan, int alphaChan, int premultiplied, void* _dst, int componentSize, int dstStride);
+
+// If srcNChan is 1, then the single source channel is applied to all of the channels of dst
+void FloatAddWeighted(void* _dst, int width, int height, int dstStride, int nchan, const void* _src, int srcStride, float weight);
+void FloatMultiply(void* _dst, int width, int height, int dstStride, int nchan, const void* _src, int srcStride, int srcNChan);
+void FloatScale(void* _dst, int width, int height, int stride, int nchan, int alphaChan, float factor);
+
+// op is one of the ToneMapOperator constants in float.go
+void FloatToneMap(void* _dst, int width, int height, int stride, int nchan, int alphaChan, int premultiplied, int op, float exposure, float whitePoint);
+
+#ifdef __cplusplus
+}
+#endif
@@ -0,0 +1,193 @@
+package cimg
+
+import (
+	"image"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFloatConvert(t *testing.T) {
+	org := MakeRGBA(37, 29)
+	AddAlphaNoise(org)
+	f := org.ConvertType(ComponentFloat32)
+	require.Equal(t, ComponentFloat32, f.Type)
+	require.Equal(t, 16, f.BytesPerPixel())
+
+	// sRGB 128 is about 0.2158 in linear light, but alpha is not transformed
+	g := NewImage(1, 1, PixelFormatRGBA)
+	copy(g.Pixels, []byte{128, 0, 255, 128})
+	gf := g.ConvertType(ComponentFloat32).PixelsFloat32()
+	require.InDelta(t, 0.2158, gf[0], 0.0001)
+	require.Equal(t, float32(0), gf[1])
+	require.Equal(t, float32(1), gf[2])
+	require.InDelta(t, 128.0/255, gf[3], 0.000001)
+
+	// 8-bit values survive a round trip exactly
+	require.Equal(t, org.Pixels, f.ConvertType(ComponentUint8).Pixels)
+	rgb := MakeRGB(37, 29)
+	require.Equal(t, rgb.Pixels, rgb.ConvertType(ComponentFloat32).ConvertType(ComponentUint8).Pixels)
+
+	// Premultiplied images keep their alpha state, and round trip closely
+	premul := org.Clone()
+	premul.Premultiply()
+	pf := premul.ConvertType(ComponentFloat32)
+	require.True(t, pf.Premultiplied)
+	back := pf.ConvertType(ComponentUint8)
+	for i := range back.Pixels {
+		require.InDelta(t, premul.Pixels[i], back.Pixels[i], 1)
+	}
+
+	// 16-bit
+	org16 := MakeRGBA16(37, 29)
+	back16 := org16.ConvertType(ComponentFloat32).ConvertType(ComponentUint16)
+	for i, v := range back16.Pixels16() {
+		require.InDelta(t, org16.Pixels16()[i], v, 1)
+	}
+
+	// Out of range values are clamped
+	hdr := NewImageOfType(2, 1, PixelFormatGRAY, ComponentFloat32)
+	copy(hdr.PixelsFloat32(), []float32{-1, 5})
+	require.Equal(t, []byte{0, 255}, hdr.ConvertType(ComponentUint8).Pixels)
+
+	// Format conversions keep the component type
+	gray := f.ToGray()
+	require.Equal(t, ComponentFloat32, gray.Type)
+	p := f.PixelsFloat32()
+	require.InDelta(t, p[0]*0.2126+p[1]*0.7152+p[2]*0.0722, gray.PixelsFloat32()[0], 0.00001)
+	bgr := f.Convert(PixelFormatBGR)
+	require.Equal(t, p[0], bgr.PixelsFloat32()[2])
+	rgba := f.ToRGB().ToRGBA(255)
+	require.Equal(t, float32(1), rgba.PixelsFloat32()[3])
+
+	// Go images are 16-bit
+	goImg, err := f.ToImage()
+	require.Nil(t, err)
+	require.IsType(t, &image.NRGBA64{}, goImg)
+}
+
+func TestFloatEncode(t *testing.T) {
+	f := MakeRGB(37, 29).ConvertType(ComponentFloat32)
+	enc, err := EncodePNG(f, nil)
+	require.Nil(t, err)
+	dec, err := DecompressWithOptions(enc, &DecompressParams{Format: PixelFormatRGB, HasFormat: true})
+	require.Nil(t, err)
+	require.Equal(t, ComponentUint16, dec.Type)
+	require.Equal(t, MakeRGB(37, 29).Pixels, dec.ConvertType(ComponentUint8).Pixels)
+
+	enc, err = EncodeTIFF(f, nil)
+	require.Nil(t, err)
+	dec, err = DecompressWithOptions(enc, &DecompressParams{Format: PixelFormatRGB, HasFormat: true})
+	require.Nil(t, err)
+	require.Equal(t, ComponentUint16, dec.Type)
+
+	// 8-bit formats convert to 8-bit sRGB
+	jpg, err := Compress(f, MakeCompressParams(Sampling444, 95, 0))
+	require.Nil(t, err)
+	ref, err := Compress(MakeRGB(37, 29), MakeCompressParams(Sampling444, 95, 0))
+	require.Nil(t, err)
+	require.Equal(t, ref, jpg)
+}
+
+func TestFloatResizeRotate(t *testing.T) {
+	org := MakeRGB(64, 48)
+	f := org.ConvertType(ComponentFloat32)
+	small := ResizeNew(f, 31, 23, nil)
+	require.Equal(t, ComponentFloat32, small.Type)
+	// stbir's sRGB path also filters in linear light
+	ref := ResizeNew(org, 31, 23, nil)
+	require.Less(t, AvgRGBDifference(small.ConvertType(ComponentUint8), ref), 1.0)
+
+	rot := NewImageOfType(f.Height, f.Width, f.Format, f.Type)
+	Rotate(f, rot, math.Pi/2, nil)
+	require.Equal(t, f.PixelsFloat32()[0:3], rot.PixelsFloat32()[rot.PixelByte(f.Height-1, 0)/4:][:3])
+
+	// 8-bit rotation interpolates sRGB values, so compare on a smooth image, where that makes little difference
+	smooth := NewImage(61, 43, PixelFormatRGB)
+	for y := 0; y < smooth.Height; y++ {
+		for x := 0; x < smooth.Width; x++ {
+			copy(smooth.Pixels[smooth.PixelByte(x, y):], []byte{byte(x * 4), byte(y * 5), 128})
+		}
+	}
+	rot = NewImageOfType(smooth.Width, smooth.Height, smooth.Format, ComponentFloat32)
+	Rotate(smooth.ConvertType(ComponentFloat32), rot, 0.3, nil)
+	rot8 := NewImage(smooth.Width, smooth.Height, smooth.Format)
+	Rotate(smooth, rot8, 0.3, nil)
+	require.Less(t, AvgRGBDifference(rot.ConvertType(ComponentUint8), rot8), 2.0)
+}
+
+func TestFloatOps(t *testing.T) {
+	a := NewImageOfType(2, 1, PixelFormatRGBA, ComponentFloat32)
+	b := NewImageOfType(2, 1, PixelFormatRGBA, ComponentFloat32)
+	copy(a.PixelsFloat32(), []float32{0.5, 1, 2, 1, 0, 0, 0, 0})
+	copy(b.PixelsFloat32(), []float32{1, 1, 1, 1, 4, 2, 1, 0.5})
+
+	require.Nil(t, a.Add(b))
+	require.Equal(t, []float32{1.5, 2, 3, 2, 4, 2, 1, 0.5}, a.PixelsFloat32())
+	require.Nil(t, a.AddWeighted(b, -0.5))
+	require.Equal(t, []float32{1, 1.5, 2.5, 1.5, 2, 1, 0.5, 0.25}, a.PixelsFloat32())
+	require.Nil(t, a.Multiply(b))
+	require.Equal(t, []float32{1, 1.5, 2.5, 1.5, 8, 2, 0.5, 0.125}, a.PixelsFloat32())
+
+	// A GRAY weight map applies to every channel
+	w := NewImageOfType(2, 1, PixelFormatGRAY, ComponentFloat32)
+	copy(w.PixelsFloat32(), []float32{2, 0})
+	require.Nil(t, a.Multiply(w))
+	require.Equal(t, []float32{2, 3, 5, 3, 0, 0, 0, 0}, a.PixelsFloat32())
+
+	// Scale leaves alpha alone
+	require.Nil(t, b.Scale(2))
+	require.Equal(t, []float32{2, 2, 2, 1, 8, 4, 2, 0.5}, b.PixelsFloat32())
+
+	// Errors
+	require.NotNil(t, a.Add(NewImageOfType(2, 1, PixelFormatRGB, ComponentFloat32)))
+	require.NotNil(t, a.Add(NewImageOfType(3, 1, PixelFormatRGBA, ComponentFloat32)))
+	require.NotNil(t, a.Add(NewImage(2, 1, PixelFormatRGBA)))
+	require.NotNil(t, NewImage(2, 1, PixelFormatRGBA).Scale(2))
+	require.NotNil(t, a.ToneMap(&ToneMapParams{Operator: 99}))
+
+	// Empty images
+	for _, size := range [][2]int{{0, 0}, {0, 5}, {5, 0}} {
+		empty := NewImageOfType(size[0], size[1], PixelFormatRGBA, ComponentFloat32)
+		require.Nil(t, empty.Add(empty.Clone()))
+		require.Nil(t, empty.Multiply(empty.Clone()))
+		require.Nil(t, empty.Scale(2))
+		require.Nil(t, empty.ToneMap(nil))
+		require.Equal(t, size[0], empty.ConvertType(ComponentUint8).Width)
+		require.Equal(t, size[1], empty.ConvertType(ComponentUint16).ConvertType(ComponentFloat32).Height)
+	}
+}
+
+func TestToneMap(t *testing.T) {
+	hdr := NewImageOfType(4, 1, PixelFormatGRAY, ComponentFloat32)
+	values := []float32{0, 1, 3, 1000}
+
+	copy(hdr.PixelsFloat32(), values)
+	require.Nil(t, hdr.ToneMap(nil))
+	require.Equal(t, []float32{0, 0.5, 0.75}, hdr.PixelsFloat32()[:3])
+	require.Less(t, hdr.PixelsFloat32()[3], float32(1))
+
+	// Extended Reinhard maps the white point to 1
+	copy(hdr.PixelsFloat32(), values)
+	require.Nil(t, hdr.ToneMap(&ToneMapParams{WhitePoint: 3}))
+	require.InDelta(t, 1, hdr.PixelsFloat32()[2], 0.000001)
+	require.Equal(t, float32(1), hdr.PixelsFloat32()[3])
+
+	// Exposure is in stops
+	copy(hdr.PixelsFloat32(), values)
+	require.Nil(t, hdr.ToneMap(&ToneMapParams{Operator: ToneMapClamp, Exposure: -2}))
+	require.Equal(t, []float32{0, 0.25, 0.75, 1}, hdr.PixelsFloat32())
+
+	copy(hdr.PixelsFloat32(), values)
+	require.Nil(t, hdr.ToneMap(&ToneMapParams{Operator: ToneMapACES}))
+	p := hdr.PixelsFloat32()
+	require.True(t, p[0] < p[1] && p[1] < p[2] && p[2] <= p[3] && p[3] <= 1)
+
+	// Premultiplied color is tone mapped as straight color
+	rgba := NewImageOfType(1, 1, PixelFormatRGBA, ComponentFloat32)
+	rgba.Premultiplied = true
+	copy(rgba.PixelsFloat32(), []float32{0.5, 1.5, 0, 0.5})
+	require.Nil(t, rgba.ToneMap(nil))
+	require.Equal(t, []float32{0.25, 0.375, 0, 0.5}, rgba.PixelsFloat32())
+}
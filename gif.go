@@ -0,0 +1,279 @@
+package cimg
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/gif"
+	"io"
+	"time"
+)
+
+// GIFDisposal specifies what happens to the area of a GIF animation frame, before the next frame is drawn
+type GIFDisposal byte
+
+const (
+	GIFDisposalUnspecified GIFDisposal = 0                      // Treated the same as GIFDisposalNone
+	GIFDisposalNone        GIFDisposal = gif.DisposalNone       // Leave the frame in place
+	GIFDisposalBackground  GIFDisposal = gif.DisposalBackground // Clear the frame's area to transparent
+	GIFDisposalPrevious    GIFDisposal = gif.DisposalPrevious   // Restore the frame's area to what it was before the frame was drawn
+)
+
+// GIFFrame is one frame of a GIF animation
+type GIFFrame struct {
+	Image    *Image          // The complete canvas, after this frame has been drawn onto it
+	Bounds   image.Rectangle // The area of the canvas that this frame draws (ignored when encoding)
+	Delay    time.Duration   // How long to show this frame. GIF stores delays in hundredths of a second.
+	Disposal GIFDisposal     // What happens to Bounds after this frame has been shown (ignored when encoding)
+}
+
+// GIFAnimation is a decoded GIF animation
+type GIFAnimation struct {
+	Width     int
+	Height    int
+	Frames    []GIFFrame
+	LoopCount int // 0 loops forever, -1 shows each frame only once, otherwise the animation plays LoopCount+1 times
+}
+
+func isGIF(encoded []byte) bool {
+	return len(encoded) > 6 && (bytes.HasPrefix(encoded, []byte("GIF87a")) || bytes.HasPrefix(encoded, []byte("GIF89a")))
+}
+
+func decodeConfigGIF(encoded []byte) (ImageConfig, error) {
+	c, err := gif.DecodeConfig(bytes.NewReader(encoded))
+	if err != nil {
+		return ImageConfig{}, err
+	}
+	cfg := ImageConfig{
+		Format:     FormatGIF,
+		Width:      c.Width,
+		Height:     c.Height,
+		NChan:      3,
+		BitDepth:   8,
+		Sampling:   SamplingUnknown,
+		Colorspace: ColorspaceRGB,
+	}
+	if gifHasTransparency(encoded) {
+		cfg.NChan = 4
+	}
+	return cfg, nil
+}
+
+// gifHasTransparency returns true if the first frame of a GIF has a transparent color
+func gifHasTransparency(encoded []byte) bool {
+	// Skip the header, logical screen descriptor, and global color table
+	p := 13
+	if encoded[10]&0x80 != 0 {
+		p += 3 << (1 + encoded[10]&7)
+	}
+	for p+1 < len(encoded) {
+		switch encoded[p] {
+		case 0x21:
+			// Extension. A graphic control extension has a transparency flag.
+			if encoded[p+1] == 0xf9 && p+3 < len(encoded) && encoded[p+3]&1 != 0 {
+				return true
+			}
+			p += 2
+			for p < len(encoded) && encoded[p] != 0 {
+				p += int(encoded[p]) + 1
+			}
+			p++
+		default:
+			// The first image descriptor, or something that we don't understand
+			return false
+		}
+	}
+	return false
+}
+
+// gifCanvas composites the frames of a GIF animation
+type gifCanvas struct {
+	canvas   *Image // RGBA
+	previous *Image // Saved for GIFDisposalPrevious
+}
+
+func newGIFCanvas(width, height int) *gifCanvas {
+	return &gifCanvas{canvas: NewImage(width, height, PixelFormatRGBA)}
+}
+
+// draw draws a frame onto the canvas
+func (g *gifCanvas) draw(frame *image.Paletted, disposal GIFDisposal) {
+	if disposal == GIFDisposalPrevious {
+		g.previous = g.canvas.Clone()
+	}
+	var pal [256][4]byte
+	for i, c := range frame.Palette {
+		r, gr, b, a := c.RGBA()
+		pal[i] = [4]byte{byte(r >> 8), byte(gr >> 8), byte(b >> 8), byte(a >> 8)}
+	}
+	r := frame.Rect.Intersect(image.Rect(0, 0, g.canvas.Width, g.canvas.Height))
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		src := frame.Pix[frame.PixOffset(r.Min.X, y):]
+		dst := g.canvas.Pixels[g.canvas.PixelByte(r.Min.X, y):]
+		for x := 0; x < r.Dx(); x++ {
+			c := pal[src[x]]
+			if c[3] != 0 {
+				copy(dst[x*4:x*4+4], c[:])
+			}
+		}
+	}
+}
+
+// dispose applies the frame's disposal method, ready for the next frame
+func (g *gifCanvas) dispose(bounds image.Rectangle, disposal GIFDisposal) {
+	r := bounds.Intersect(image.Rect(0, 0, g.canvas.Width, g.canvas.Height))
+	switch disposal {
+	case GIFDisposalBackground:
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			clear(g.canvas.Pixels[g.canvas.PixelByte(r.Min.X, y):g.canvas.PixelByte(r.Max.X, y)])
+		}
+	case GIFDisposalPrevious:
+		if g.previous != nil {
+			g.canvas = g.previous
+			g.previous = nil
+		}
+	}
+}
+
+// isOpaque returns true if every pixel of the canvas is opaque
+func (g *gifCanvas) isOpaque() bool {
+	for i := 3; i < len(g.canvas.Pixels); i += 4 {
+		if g.canvas.Pixels[i] != 255 {
+			return false
+		}
+	}
+	return true
+}
+
+// decompressGIF decodes the first frame of a GIF.
+// The image is RGB if every pixel of the canvas is opaque, otherwise RGBA.
+func decompressGIF(encoded []byte, params *DecompressParams) (*Image, error) {
+	cfg, err := gif.DecodeConfig(bytes.NewReader(encoded))
+	if err != nil {
+		return nil, err
+	}
+	// gif.Decode only decodes the first frame
+	frame, err := gif.Decode(bytes.NewReader(encoded))
+	if err != nil {
+		return nil, err
+	}
+	paletted, ok := frame.(*image.Paletted)
+	if !ok {
+		return nil, errors.New("Unexpected GIF image type")
+	}
+	g := newGIFCanvas(cfg.Width, cfg.Height)
+	g.draw(paletted, GIFDisposalNone)
+	img := g.canvas
+	if g.isOpaque() {
+		img = img.Convert(PixelFormatRGB)
+	}
+	return applyDecompressFormat(img, params), nil
+}
+
+// DecodeGIFAnimation decodes all of the frames of a GIF animation.
+// Each frame's Image is the complete canvas after that frame has been drawn, which is what a
+// viewer would show. The frames are RGBA, unless params.Format specifies otherwise.
+// params may be nil. Limits are checked against the size of the canvas, and MaxPixels against the
+// total size of all of the frames.
+func DecodeGIFAnimation(encoded []byte, params *DecompressParams) (*GIFAnimation, error) {
+	if params == nil {
+		params = &DecompressParams{}
+	}
+	if params.Limits != nil {
+		if err := params.Limits.checkInputSize(len(encoded)); err != nil {
+			return nil, err
+		}
+		cfg, err := decodeConfigGIF(encoded)
+		if err != nil {
+			return nil, err
+		}
+		if err := params.Limits.checkDimensions(cfg.Width, cfg.Height); err != nil {
+			return nil, err
+		}
+	}
+	all, err := gif.DecodeAll(bytes.NewReader(encoded))
+	if err != nil {
+		return nil, err
+	}
+	anim := &GIFAnimation{
+		Width:     all.Config.Width,
+		Height:    all.Config.Height,
+		LoopCount: all.LoopCount,
+	}
+	g := newGIFCanvas(anim.Width, anim.Height)
+	for i, frame := range all.Image {
+		disposal := GIFDisposalUnspecified
+		if i < len(all.Disposal) {
+			disposal = GIFDisposal(all.Disposal[i])
+		}
+		if err := params.Limits.checkFrames(anim.Width, anim.Height, i+1); err != nil {
+			return nil, err
+		}
+		g.draw(frame, disposal)
+		snapshot := g.canvas.Clone()
+		anim.Frames = append(anim.Frames, GIFFrame{
+			Image:    applyDecompressFormat(snapshot, params),
+			Bounds:   frame.Rect,
+			Delay:    time.Duration(all.Delay[i]) * 10 * time.Millisecond,
+			Disposal: disposal,
+		})
+		g.dispose(frame.Rect, disposal)
+	}
+	return anim, nil
+}
+
+// EncodeGIF writes an image as a single frame GIF.
+// If the image has more than 256 colors, then they are reduced with the median cut algorithm.
+// Pixels with alpha below 128 become transparent.
+func EncodeGIF(w io.Writer, img *Image) error {
+	return EncodeGIFAnimation(w, &GIFAnimation{
+		Width:  img.Width,
+		Height: img.Height,
+		Frames: []GIFFrame{{Image: img}},
+	})
+}
+
+// EncodeGIFAnimation writes a GIF animation.
+// Every frame must be the size of the canvas, and is written in full, with its own palette (see EncodeGIF).
+func EncodeGIFAnimation(w io.Writer, anim *GIFAnimation) error {
+	if len(anim.Frames) == 0 {
+		return errors.New("GIF animation has no frames")
+	}
+	out := &gif.GIF{
+		LoopCount: anim.LoopCount,
+		Config:    image.Config{Width: anim.Width, Height: anim.Height},
+	}
+	transparent := false
+	for _, f := range anim.Frames {
+		if f.Image.Width != anim.Width || f.Image.Height != anim.Height {
+			return errors.New("GIF animation frames must be the same size as the canvas")
+		}
+		src := f.Image.asUint8().toGrayRGBOrRGBA()
+		if src.Format == PixelFormatGRAY {
+			src = src.Convert(PixelFormatRGB)
+		}
+		pal, indices := quantize(src)
+		for _, c := range pal {
+			if _, _, _, a := c.RGBA(); a == 0 {
+				transparent = true
+			}
+		}
+		out.Image = append(out.Image, &image.Paletted{
+			Pix:     indices,
+			Stride:  src.Width,
+			Rect:    image.Rect(0, 0, src.Width, src.Height),
+			Palette: pal,
+		})
+		out.Delay = append(out.Delay, int((f.Delay+5*time.Millisecond)/(10*time.Millisecond)))
+	}
+	// Because every frame covers the whole canvas, transparent pixels would reveal the previous
+	// frame, unless each frame is cleared before the next one is drawn.
+	disposal := byte(gif.DisposalNone)
+	if transparent {
+		disposal = gif.DisposalBackground
+	}
+	for range out.Image {
+		out.Disposal = append(out.Disposal, disposal)
+	}
+	return gif.EncodeAll(w, out)
+}
@@ -0,0 +1,141 @@
+package cimg
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGIF(t *testing.T) {
+	// Few enough colors to survive exactly
+	org := NewImage(40, 30, PixelFormatRGB)
+	for y := 0; y < org.Height; y++ {
+		for x := 0; x < org.Width; x++ {
+			p := org.Pixels[org.PixelByte(x, y):]
+			p[0], p[1], p[2] = byte(x/4*25), byte(y/3*25), 100
+		}
+	}
+	for _, img := range []*Image{org, org.Convert(PixelFormatBGRX)} {
+		buf := bytes.Buffer{}
+		require.Nil(t, EncodeGIF(&buf, img))
+		cfg, err := DecodeConfig(buf.Bytes())
+		require.Nil(t, err)
+		require.Equal(t, FormatGIF, cfg.Format)
+		require.Equal(t, 3, cfg.NChan)
+		dec, err := Decompress(buf.Bytes())
+		require.Nil(t, err)
+		require.Equal(t, PixelFormatRGB, dec.Format)
+		require.Equal(t, org.Pixels, dec.Pixels)
+	}
+
+	// Transparency
+	rgba := org.Convert(PixelFormatRGBA)
+	rgba.Pixels[rgba.PixelByte(3, 4)+3] = 0
+	buf := bytes.Buffer{}
+	require.Nil(t, EncodeGIF(&buf, rgba))
+	cfg, err := DecodeConfig(buf.Bytes())
+	require.Nil(t, err)
+	require.Equal(t, 4, cfg.NChan)
+	dec, err := Decompress(buf.Bytes())
+	require.Nil(t, err)
+	require.Equal(t, PixelFormatRGBA, dec.Format)
+	require.Equal(t, []byte{0, 0, 0, 0}, dec.Pixels[dec.PixelByte(3, 4):dec.PixelByte(4, 4)])
+	require.Equal(t, rgba.Pixels[rgba.PixelByte(5, 4):rgba.PixelByte(6, 4)], dec.Pixels[dec.PixelByte(5, 4):dec.PixelByte(6, 4)])
+
+	// More than 256 colors are quantized
+	noise := NewImage(64, 64, PixelFormatRGB)
+	rand.New(rand.NewSource(1)).Read(noise.Pixels)
+	gradient := MakeRGB(256, 100)
+	for i, img := range []*Image{noise, gradient} {
+		buf.Reset()
+		require.Nil(t, EncodeGIF(&buf, img))
+		dec, err = Decompress(buf.Bytes())
+		require.Nil(t, err)
+		require.Less(t, AvgRGBDifference(img, dec), []float64{40, 25}[i])
+	}
+}
+
+func TestGIFAnimation(t *testing.T) {
+	red := NewImage(20, 10, PixelFormatRGB)
+	blue := NewImage(20, 10, PixelFormatRGBA)
+	for i := 0; i < len(red.Pixels); i += 3 {
+		red.Pixels[i] = 255
+	}
+	for y := 0; y < 5; y++ {
+		for x := 0; x < blue.Width; x++ {
+			copy(blue.Pixels[blue.PixelByte(x, y):], []byte{0, 0, 255, 255})
+		}
+	}
+	anim := &GIFAnimation{
+		Width:  20,
+		Height: 10,
+		Frames: []GIFFrame{
+			{Image: red, Delay: 100 * time.Millisecond},
+			{Image: blue, Delay: 254 * time.Millisecond},
+		},
+	}
+	buf := bytes.Buffer{}
+	require.Nil(t, EncodeGIFAnimation(&buf, anim))
+	dec, err := DecodeGIFAnimation(buf.Bytes(), nil)
+	require.Nil(t, err)
+	require.Equal(t, 20, dec.Width)
+	require.Equal(t, 10, dec.Height)
+	require.Equal(t, 2, len(dec.Frames))
+	require.Equal(t, 100*time.Millisecond, dec.Frames[0].Delay)
+	require.Equal(t, 250*time.Millisecond, dec.Frames[1].Delay)
+	require.Equal(t, GIFDisposalBackground, dec.Frames[0].Disposal)
+	require.Equal(t, red.Convert(PixelFormatRGBA).Pixels, dec.Frames[0].Image.Pixels)
+	require.Equal(t, blue.Pixels, dec.Frames[1].Image.Pixels)
+
+	// Frames that only cover part of the canvas, with each of the disposal methods
+	pal := color.Palette{color.RGBA{}, color.RGBA{255, 0, 0, 255}, color.RGBA{0, 255, 0, 255}}
+	fill := func(r image.Rectangle, idx byte) *image.Paletted {
+		p := image.NewPaletted(r, pal)
+		for i := range p.Pix {
+			p.Pix[i] = idx
+		}
+		return p
+	}
+	g := &gif.GIF{
+		Image: []*image.Paletted{
+			fill(image.Rect(0, 0, 4, 4), 1),
+			fill(image.Rect(2, 2, 4, 4), 2),
+			fill(image.Rect(0, 0, 1, 1), 2),
+			fill(image.Rect(3, 3, 4, 4), 2),
+		},
+		Delay:    []int{1, 2, 3, 4},
+		Disposal: []byte{gif.DisposalNone, gif.DisposalPrevious, gif.DisposalBackground, gif.DisposalNone},
+	}
+	buf.Reset()
+	require.Nil(t, gif.EncodeAll(&buf, g))
+	dec, err = DecodeGIFAnimation(buf.Bytes(), &DecompressParams{Format: PixelFormatRGB, HasFormat: true})
+	require.Nil(t, err)
+	require.Equal(t, 4, len(dec.Frames))
+	require.Equal(t, image.Rect(2, 2, 4, 4), dec.Frames[1].Bounds)
+	require.Equal(t, GIFDisposalPrevious, dec.Frames[1].Disposal)
+	at := func(frame, x, y int) []byte {
+		img := dec.Frames[frame].Image
+		return img.Pixels[img.PixelByte(x, y) : img.PixelByte(x, y)+3]
+	}
+	require.Equal(t, []byte{255, 0, 0}, at(0, 3, 3))
+	require.Equal(t, []byte{0, 255, 0}, at(1, 3, 3))
+	require.Equal(t, []byte{0, 255, 0}, at(2, 0, 0))
+	require.Equal(t, []byte{255, 0, 0}, at(2, 3, 2)) // frame 1 was restored
+	require.Equal(t, []byte{0, 0, 0}, at(3, 0, 0))   // frame 2 was cleared
+	require.Equal(t, []byte{0, 255, 0}, at(3, 3, 3))
+
+	_, err = DecodeGIFAnimation(buf.Bytes(), &DecompressParams{Limits: &DecodeLimits{MaxWidth: 2}})
+	require.ErrorIs(t, err, ErrImageTooLarge)
+
+	// MaxPixels limits the total size of the frames
+	_, err = DecodeGIFAnimation(buf.Bytes(), &DecompressParams{Limits: &DecodeLimits{MaxPixels: 4*4*4 - 1}})
+	require.ErrorIs(t, err, ErrImageTooLarge)
+	_, err = DecodeGIFAnimation(buf.Bytes(), &DecompressParams{Limits: &DecodeLimits{MaxPixels: 4 * 4 * 4}})
+	require.Nil(t, err)
+}
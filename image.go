@@ -1,10 +1,12 @@
 package cimg
 
 import (
-	"errors"
+	"encoding/binary"
 	"fmt"
 	"image"
+	"image/color"
 	"os"
+	"unsafe"
 )
 
 // Image is the concrete image type that is used by all functions inside cimg
@@ -14,9 +16,32 @@ type Image struct {
 	Height        int
 	Stride        int // Distance from one line to the next, in bytes
 	Format        PixelFormat
+	Type          ComponentType // The data type of each channel. The zero value is ComponentUint8.
 	Premultiplied bool
 }
 
+// ComponentType is the data type of each channel of a pixel
+type ComponentType int
+
+const (
+	ComponentUint8   ComponentType = iota // 8 bits per channel
+	ComponentUint16                       // 16 bits per channel, in the native byte order of the machine
+	ComponentFloat32                      // 32-bit float per channel, holding linear light, where 1 is white
+)
+
+// Size returns the number of bytes in one channel of one pixel
+func (t ComponentType) Size() int {
+	switch t {
+	case ComponentUint8:
+		return 1
+	case ComponentUint16:
+		return 2
+	case ComponentFloat32:
+		return 4
+	}
+	panic(fmt.Errorf("Unrecognized component type %v", int(t)))
+}
+
 // NChan returns the number of channels of the pixel format
 func NChan(pf PixelFormat) int {
 	switch pf {
@@ -48,14 +73,52 @@ func NChan(pf PixelFormat) int {
 	panic(fmt.Errorf("Unrecognized pixel format %v", pf))
 }
 
+// channelOffsets returns the byte offsets of the red, green, blue, and alpha channels within a pixel.
+// An offset of -1 means that the channel is not present.
+// For GRAY, all three color offsets are 0. For CMYK, all offsets are -1.
+func channelOffsets(pf PixelFormat) (r, g, b, a int) {
+	switch pf {
+	case PixelFormatRGB:
+		return 0, 1, 2, -1
+	case PixelFormatBGR:
+		return 2, 1, 0, -1
+	case PixelFormatRGBX:
+		return 0, 1, 2, -1
+	case PixelFormatBGRX:
+		return 2, 1, 0, -1
+	case PixelFormatXBGR:
+		return 3, 2, 1, -1
+	case PixelFormatXRGB:
+		return 1, 2, 3, -1
+	case PixelFormatGRAY:
+		return 0, 0, 0, -1
+	case PixelFormatRGBA:
+		return 0, 1, 2, 3
+	case PixelFormatBGRA:
+		return 2, 1, 0, 3
+	case PixelFormatABGR:
+		return 3, 2, 1, 0
+	case PixelFormatARGB:
+		return 1, 2, 3, 0
+	}
+	return -1, -1, -1, -1
+}
+
 // NewImage creates a new 8-bit image
 func NewImage(width, height int, format PixelFormat) *Image {
+	return NewImageOfType(width, height, format, ComponentUint8)
+}
+
+// NewImageOfType creates a new image with the given component type
+func NewImageOfType(width, height int, format PixelFormat, typ ComponentType) *Image {
+	stride := width * NChan(format) * typ.Size()
 	return &Image{
 		Width:         width,
 		Height:        height,
-		Stride:        width * NChan(format),
+		Stride:        stride,
 		Format:        format,
-		Pixels:        make([]byte, height*width*NChan(format)),
+		Type:          typ,
+		Pixels:        make([]byte, height*stride),
 		Premultiplied: false,
 	}
 }
@@ -85,52 +148,199 @@ func WrapImageStrided(width, height int, format PixelFormat, pixels []byte, stri
 }
 
 // Convert a Go image.Image into a cimg.Image
-// If allowDeepClone is true, and the source image is type GRAY, NRGBA, or RGBA,
+// If allowDeepClone is true, and the source image is type Gray, NRGBA, or RGBA,
 // then the resulting Image points directly to the pixel buffer of the source image.
+// Sub-images are supported, whether or not they share pixels.
+// All other image types are converted, and so always copied:
+//   - Gray16, RGBA64, and NRGBA64 become 16-bit GRAY or RGBA
+//   - Alpha and Alpha16 become premultiplied RGBA (white, with the image's alpha)
+//   - YCbCr becomes RGB, and NYCbCrA becomes RGBA
+//   - CMYK becomes CMYK (inverted, like TurboJPEG's CMYK)
+//   - Paletted becomes RGB, or RGBA if any palette entry is not opaque
+//   - Any other type is read with At(), into RGBA
 func FromImage(src image.Image, allowDeepClone bool) (*Image, error) {
-	dst := &Image{
-		Width:  src.Bounds().Dx(),
-		Height: src.Bounds().Dy(),
-	}
+	width := src.Bounds().Dx()
+	height := src.Bounds().Dy()
 	switch v := src.(type) {
 	case *image.Gray:
-		dst.Format = PixelFormatGRAY
-		dst.Stride = NChan(dst.Format) * dst.Width
-		if allowDeepClone {
-			dst.Pixels = v.Pix
-		} else {
-			dst.Pixels = make([]byte, dst.Stride*dst.Height)
-			copy(dst.Pixels, v.Pix)
+		return fromPix8(v.Pix[v.PixOffset(v.Rect.Min.X, v.Rect.Min.Y):], v.Stride, width, height, PixelFormatGRAY, false, allowDeepClone), nil
+	case *image.RGBA:
+		return fromPix8(v.Pix[v.PixOffset(v.Rect.Min.X, v.Rect.Min.Y):], v.Stride, width, height, PixelFormatRGBA, true, allowDeepClone), nil
+	case *image.NRGBA:
+		return fromPix8(v.Pix[v.PixOffset(v.Rect.Min.X, v.Rect.Min.Y):], v.Stride, width, height, PixelFormatRGBA, false, allowDeepClone), nil
+	case *image.Gray16:
+		return fromBigEndian16(v.Pix[v.PixOffset(v.Rect.Min.X, v.Rect.Min.Y):], v.Stride, width, height, PixelFormatGRAY, false), nil
+	case *image.RGBA64:
+		return fromBigEndian16(v.Pix[v.PixOffset(v.Rect.Min.X, v.Rect.Min.Y):], v.Stride, width, height, PixelFormatRGBA, true), nil
+	case *image.NRGBA64:
+		return fromBigEndian16(v.Pix[v.PixOffset(v.Rect.Min.X, v.Rect.Min.Y):], v.Stride, width, height, PixelFormatRGBA, false), nil
+	case *image.Alpha:
+		dst := NewImage(width, height, PixelFormatRGBA)
+		dst.Premultiplied = true
+		for y := 0; y < height; y++ {
+			in := v.Pix[v.PixOffset(v.Rect.Min.X, v.Rect.Min.Y+y):]
+			out := dst.Pixels[y*dst.Stride:]
+			for x := 0; x < width; x++ {
+				a := in[x]
+				out[x*4], out[x*4+1], out[x*4+2], out[x*4+3] = a, a, a, a
+			}
 		}
 		return dst, nil
-	case *image.RGBA:
-		dst.Format = PixelFormatRGBA
+	case *image.Alpha16:
+		dst := NewImageOfType(width, height, PixelFormatRGBA, ComponentUint16)
 		dst.Premultiplied = true
-		dst.Stride = NChan(dst.Format) * dst.Width
-		if allowDeepClone {
-			dst.Pixels = v.Pix
-		} else {
-			dst.Pixels = make([]byte, dst.Stride*dst.Height)
-			copy(dst.Pixels, v.Pix)
+		pix := dst.Pixels16()
+		for y := 0; y < height; y++ {
+			in := v.Pix[v.PixOffset(v.Rect.Min.X, v.Rect.Min.Y+y):]
+			out := pix[y*dst.Stride/2:]
+			for x := 0; x < width; x++ {
+				a := binary.BigEndian.Uint16(in[x*2:])
+				out[x*4], out[x*4+1], out[x*4+2], out[x*4+3] = a, a, a, a
+			}
 		}
 		return dst, nil
-	case *image.NRGBA:
-		dst.Format = PixelFormatRGBA
-		dst.Premultiplied = false
-		dst.Stride = NChan(dst.Format) * dst.Width
-		if allowDeepClone {
-			dst.Pixels = v.Pix
-		} else {
-			dst.Pixels = make([]byte, dst.Stride*dst.Height)
-			copy(dst.Pixels, v.Pix)
+	case *image.CMYK:
+		dst := NewImage(width, height, PixelFormatCMYK)
+		for y := 0; y < height; y++ {
+			in := v.Pix[v.PixOffset(v.Rect.Min.X, v.Rect.Min.Y+y) : v.PixOffset(v.Rect.Min.X, v.Rect.Min.Y+y)+width*4]
+			out := dst.Pixels[y*dst.Stride:]
+			for i, c := range in {
+				// Go's CMYK is the amount of ink, but ours is inverted
+				out[i] = 255 - c
+			}
+		}
+		return dst, nil
+	case *image.YCbCr:
+		dst := NewImage(width, height, PixelFormatRGB)
+		for y := 0; y < height; y++ {
+			out := dst.Pixels[y*dst.Stride:]
+			for x := 0; x < width; x++ {
+				yi := v.YOffset(v.Rect.Min.X+x, v.Rect.Min.Y+y)
+				ci := v.COffset(v.Rect.Min.X+x, v.Rect.Min.Y+y)
+				out[x*3], out[x*3+1], out[x*3+2] = color.YCbCrToRGB(v.Y[yi], v.Cb[ci], v.Cr[ci])
+			}
 		}
 		return dst, nil
+	case *image.NYCbCrA:
+		dst := NewImage(width, height, PixelFormatRGBA)
+		for y := 0; y < height; y++ {
+			out := dst.Pixels[y*dst.Stride:]
+			for x := 0; x < width; x++ {
+				yi := v.YOffset(v.Rect.Min.X+x, v.Rect.Min.Y+y)
+				ci := v.COffset(v.Rect.Min.X+x, v.Rect.Min.Y+y)
+				out[x*4], out[x*4+1], out[x*4+2] = color.YCbCrToRGB(v.Y[yi], v.Cb[ci], v.Cr[ci])
+				out[x*4+3] = v.A[v.AOffset(v.Rect.Min.X+x, v.Rect.Min.Y+y)]
+			}
+		}
+		return dst, nil
+	case *image.Paletted:
+		return fromPaletted(v), nil
+	}
+	return fromAt(src), nil
+}
+
+// fromPix8 wraps or copies the 8-bit pixels of a Go image, which start at pix[0]
+func fromPix8(pix []byte, stride, width, height int, format PixelFormat, premultiplied, share bool) *Image {
+	if share {
+		img := WrapImageStrided(width, height, format, pix, stride)
+		img.Premultiplied = premultiplied
+		return img
+	}
+	dst := NewImage(width, height, format)
+	dst.Premultiplied = premultiplied
+	rowBytes := width * dst.NChan()
+	for y := 0; y < height; y++ {
+		copy(dst.Pixels[y*dst.Stride:y*dst.Stride+rowBytes], pix[y*stride:y*stride+rowBytes])
+	}
+	return dst
+}
+
+// fromPaletted expands a paletted image into RGB, or straight alpha RGBA if the palette has transparency
+func fromPaletted(v *image.Paletted) *Image {
+	format := PixelFormatRGB
+	var pal [256][4]byte
+	for i, c := range v.Palette {
+		n := color.NRGBAModel.Convert(c).(color.NRGBA)
+		pal[i] = [4]byte{n.R, n.G, n.B, n.A}
+		if n.A != 255 {
+			format = PixelFormatRGBA
+		}
+	}
+	width := v.Rect.Dx()
+	height := v.Rect.Dy()
+	dst := NewImage(width, height, format)
+	nchan := dst.NChan()
+	for y := 0; y < height; y++ {
+		in := v.Pix[v.PixOffset(v.Rect.Min.X, v.Rect.Min.Y+y):]
+		out := dst.Pixels[y*dst.Stride:]
+		for x := 0; x < width; x++ {
+			// Indices beyond the end of the palette become (transparent) black
+			copy(out[x*nchan:x*nchan+nchan], pal[in[x]][:nchan])
+		}
+	}
+	return dst
+}
+
+// fromAt converts any image into straight alpha RGBA, one pixel at a time
+func fromAt(src image.Image) *Image {
+	b := src.Bounds()
+	dst := NewImage(b.Dx(), b.Dy(), PixelFormatRGBA)
+	for y := 0; y < dst.Height; y++ {
+		out := dst.Pixels[y*dst.Stride:]
+		for x := 0; x < dst.Width; x++ {
+			c := color.NRGBAModel.Convert(src.At(b.Min.X+x, b.Min.Y+y)).(color.NRGBA)
+			out[x*4], out[x*4+1], out[x*4+2], out[x*4+3] = c.R, c.G, c.B, c.A
+		}
 	}
-	return nil, errors.New("Unsupported source image type")
+	return dst
 }
 
-// ToImage returns an image from the Go standard library 'image' package
+// fromBigEndian16 copies the big-endian 16-bit samples of a Go image into a new 16-bit Image.
+// Go's 16-bit images are always copied, because we store samples in native byte order.
+func fromBigEndian16(pix []byte, stride, width, height int, format PixelFormat, premultiplied bool) *Image {
+	dst := NewImageOfType(width, height, format, ComponentUint16)
+	dst.Premultiplied = premultiplied
+	out := dst.Pixels16()
+	rowSamples := width * dst.NChan()
+	for y := 0; y < height; y++ {
+		in := pix[y*stride : y*stride+rowSamples*2]
+		d := out[y*dst.Stride/2 : y*dst.Stride/2+rowSamples]
+		for i := range d {
+			d[i] = binary.BigEndian.Uint16(in[i*2:])
+		}
+	}
+	return dst
+}
+
+// toBigEndian16 returns the samples of a 16-bit image in big-endian order, which is what Go's
+// 16-bit image types use, with a stride of width * NChan * 2.
+func (img *Image) toBigEndian16() []byte {
+	rowSamples := img.Width * img.NChan()
+	out := make([]byte, rowSamples*2*img.Height)
+	in := img.Pixels16()
+	for y := 0; y < img.Height; y++ {
+		s := in[y*img.Stride/2 : y*img.Stride/2+rowSamples]
+		d := out[y*rowSamples*2:]
+		for i, v := range s {
+			binary.BigEndian.PutUint16(d[i*2:], v)
+		}
+	}
+	return out
+}
+
+// ToImage returns an image from the Go standard library 'image' package.
+// The pixels are always copied. Image implements image.Image itself, which avoids the copy.
+// CMYK becomes *image.CMYK, and formats with a padding channel are converted to RGB.
+// 16-bit images become *image.Gray16, *image.RGBA64, or *image.NRGBA64.
+// Float32 images are converted to 16-bit sRGB first.
 func (img *Image) ToImage() (image.Image, error) {
+	if img.Type == ComponentUint16 {
+		return img.toImage16(), nil
+	} else if img.Type == ComponentFloat32 {
+		return img.ConvertType(ComponentUint16).toImage16(), nil
+	} else if img.Type != ComponentUint8 {
+		return nil, fmt.Errorf("Unsupported component type %v", int(img.Type))
+	}
 	if img.Format == PixelFormatGRAY {
 		dst := image.NewGray(image.Rect(0, 0, img.Width, img.Height))
 		srcBuf := img.Pixels
@@ -138,7 +348,7 @@ func (img *Image) ToImage() (image.Image, error) {
 		for y := 0; y < img.Height; y++ {
 			srcP := img.Stride * y
 			dstP := dst.Stride * y
-			copy(dstBuf[dstP:dstP+dst.Stride], srcBuf[srcP:srcP+img.Stride])
+			copy(dstBuf[dstP:dstP+img.Width], srcBuf[srcP:srcP+img.Width])
 		}
 		return dst, nil
 	} else if img.Format == PixelFormatRGB || img.Format == PixelFormatBGR {
@@ -190,7 +400,7 @@ func (img *Image) ToImage() (image.Image, error) {
 		for y := 0; y < img.Height; y++ {
 			srcP := img.Stride * y
 			dstP := dstStride * y
-			copy(dstBuf[dstP:dstP+dstStride], srcBuf[srcP:srcP+img.Stride])
+			copy(dstBuf[dstP:dstP+img.Width*4], srcBuf[srcP:srcP+img.Width*4])
 		}
 		return dst, nil
 	} else if img.Format == PixelFormatBGRA || img.Format == PixelFormatABGR || img.Format == PixelFormatARGB {
@@ -244,14 +454,40 @@ func (img *Image) ToImage() (image.Image, error) {
 			}
 		}
 		return dst, nil
+	} else if img.Format == PixelFormatCMYK {
+		dst := image.NewCMYK(image.Rect(0, 0, img.Width, img.Height))
+		for y := 0; y < img.Height; y++ {
+			src := img.Pixels[y*img.Stride : y*img.Stride+img.Width*4]
+			out := dst.Pix[y*dst.Stride:]
+			for i, c := range src {
+				out[i] = 255 - c
+			}
+		}
+		return dst, nil
 	} else {
-		return nil, fmt.Errorf("Unsupported image type %v", img.Format)
+		// RGBX, BGRX, XBGR, XRGB
+		return img.Convert(PixelFormatRGB).ToImage()
+	}
+}
+
+func (img *Image) toImage16() image.Image {
+	rect := image.Rect(0, 0, img.Width, img.Height)
+	if img.Format == PixelFormatGRAY {
+		return &image.Gray16{Pix: img.toBigEndian16(), Stride: img.Width * 2, Rect: rect}
+	}
+	src := img
+	if img.Format != PixelFormatRGBA {
+		src = img.Convert(PixelFormatRGBA)
 	}
+	if src.Premultiplied {
+		return &image.RGBA64{Pix: src.toBigEndian16(), Stride: img.Width * 8, Rect: rect}
+	}
+	return &image.NRGBA64{Pix: src.toBigEndian16(), Stride: img.Width * 8, Rect: rect}
 }
 
 // Clone returns a deep clone of the image
 func (img *Image) Clone() *Image {
-	copy := NewImage(img.Width, img.Height, img.Format)
+	copy := NewImageOfType(img.Width, img.Height, img.Format, img.Type)
 	copy.Premultiplied = img.Premultiplied
 	copy.CopyImage(img, 0, 0)
 	return copy
@@ -262,13 +498,58 @@ func (img *Image) NChan() int {
 	return NChan(img.Format)
 }
 
-// Read a JPEG, PNG, or TIFF file into memory
+// BytesPerPixel returns the number of bytes in one pixel
+func (img *Image) BytesPerPixel() int {
+	return img.NChan() * img.Type.Size()
+}
+
+// Pixels16 returns the pixels of a ComponentUint16 image as 16-bit samples, without copying.
+// Stride is still measured in bytes, so row y starts at Pixels16()[y*Stride/2].
+func (img *Image) Pixels16() []uint16 {
+	if img.Type != ComponentUint16 {
+		panic("Pixels16 called on an image that is not ComponentUint16")
+	}
+	if len(img.Pixels) == 0 {
+		return nil
+	}
+	return unsafe.Slice((*uint16)(unsafe.Pointer(&img.Pixels[0])), len(img.Pixels)/2)
+}
+
+// Read an image file into memory.
+// The format is detected from the file's content, or if that fails, from its extension (see RegisterCodec).
 func ReadFile(filename string) (*Image, error) {
+	return ReadFileWithOptions(filename, nil)
+}
+
+// ReadFileWithOptions reads an image file into memory, using DecompressWithOptions.
+// If params has Limits, then the file size is checked before the file is read.
+func ReadFileWithOptions(filename string, params *DecompressParams) (*Image, error) {
+	if params != nil && params.Limits != nil && params.Limits.MaxInputBytes != 0 {
+		st, err := os.Stat(filename)
+		if err != nil {
+			return nil, err
+		}
+		if err := params.Limits.checkInputSize(int(st.Size())); err != nil {
+			return nil, err
+		}
+	}
 	raw, err := os.ReadFile(filename)
 	if err != nil {
 		return nil, err
 	}
-	return Decompress(raw)
+	c := detectCodec(raw)
+	if c == nil {
+		c = codecForExtension(filename)
+	}
+	if c == nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnknownFormat, filename)
+	}
+	decoder, err := getDecoder()
+	if err != nil {
+		return nil, err
+	}
+	defer putDecoder(decoder)
+	return decoder.decompressWithCodec(c, raw, params)
 }
 
 func (img *Image) WriteJPEG(filename string, params CompressParams, perm os.FileMode) error {
@@ -281,10 +562,10 @@ func (img *Image) WriteJPEG(filename string, params CompressParams, perm os.File
 
 // Returns the byte index of the pixel at (x, y)
 func (img *Image) PixelByte(x, y int) int {
-	return img.Stride*y + x*img.NChan()
+	return img.Stride*y + x*img.BytesPerPixel()
 }
 
-// Returns true if the image is dense (i.e. the stride is equal to the width * number of channels)
+// Returns true if the image is dense (i.e. the stride is equal to the width * bytes per pixel)
 func (img *Image) IsDense() bool {
-	return img.Stride == img.Width*img.NChan()
+	return img.Stride == img.Width*img.BytesPerPixel()
 }
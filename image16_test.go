@@ -0,0 +1,194 @@
+package cimg
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Make a 16-bit RGBA image whose values use the low byte, so that a round trip through 8 bits would be detected
+func MakeRGBA16(width, height int) *Image {
+	img := NewImageOfType(width, height, PixelFormatRGBA, ComponentUint16)
+	pix := img.Pixels16()
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			p := pix[y*img.Stride/2+x*4:]
+			p[0] = uint16(x * 1000)
+			p[1] = uint16(y*700 + 3)
+			p[2] = uint16(x*y*13 + 1)
+			p[3] = uint16(65535 - x*y*7)
+		}
+	}
+	return img
+}
+
+func TestImage16(t *testing.T) {
+	org := MakeRGBA16(37, 29)
+	require.Equal(t, 8, org.BytesPerPixel())
+	require.Equal(t, 37*8, org.Stride)
+	require.True(t, org.IsDense())
+
+	// ConvertType
+	img8 := org.ConvertType(ComponentUint8)
+	require.Equal(t, ComponentUint8, img8.Type)
+	require.Equal(t, byte(math.Round(float64(org.Pixels16()[4])/257)), img8.Pixels[4])
+	back := img8.ConvertType(ComponentUint16)
+	require.Equal(t, uint16(img8.Pixels[4])*257, back.Pixels16()[4])
+
+	// Format conversions keep the component type
+	gray := org.ToGray()
+	require.Equal(t, ComponentUint16, gray.Type)
+	require.Equal(t, PixelFormatGRAY, gray.Format)
+	bgr := org.Convert(PixelFormatBGR)
+	require.Equal(t, org.Pixels16()[4], bgr.Pixels16()[5])
+	rgb := org.ToRGB()
+	require.Equal(t, org.Pixels16()[4:7], rgb.Pixels16()[3:6])
+	rgba := rgb.ToRGBA(255)
+	require.Equal(t, uint16(65535), rgba.Pixels16()[3])
+
+	// Go images
+	goImg, err := org.ToImage()
+	require.Nil(t, err)
+	require.IsType(t, &image.NRGBA64{}, goImg)
+	require.Equal(t, color.NRGBA64{R: 1000, G: 3, B: 1, A: 65535}, goImg.At(1, 0))
+	fromGo, err := FromImage(goImg, true)
+	require.Nil(t, err)
+	require.Equal(t, org.Pixels, fromGo.Pixels)
+	g16 := image.NewGray16(image.Rect(0, 0, 3, 2))
+	g16.SetGray16(2, 1, color.Gray16{Y: 0x1234})
+	fromGo, err = FromImage(g16, false)
+	require.Nil(t, err)
+	require.Equal(t, PixelFormatGRAY, fromGo.Format)
+	require.Equal(t, uint16(0x1234), fromGo.Pixels16()[5])
+
+	// Premultiply
+	premul := org.Clone()
+	premul.Premultiply()
+	require.True(t, premul.Premultiplied)
+	require.Equal(t, uint16((uint32(1000)*uint32(org.Pixels16()[7])+32767)/65535), premul.Pixels16()[4])
+
+	// JPEG is always 8-bit
+	jpg, err := Compress(org.ToRGB(), MakeCompressParams(Sampling444, 95, 0))
+	require.Nil(t, err)
+	dec, err := Decompress(jpg)
+	require.Nil(t, err)
+	require.Equal(t, ComponentUint8, dec.Type)
+}
+
+func TestPNGTIFF16(t *testing.T) {
+	org := MakeRGBA16(37, 29)
+	images := []*Image{org, org.ToRGB(), org.ToGray()}
+	for _, img := range images {
+		enc, err := EncodePNG(img, nil)
+		require.Nil(t, err)
+		cfg, err := DecodeConfig(enc)
+		require.Nil(t, err)
+		require.Equal(t, 16, cfg.BitDepth)
+		// Make sure that Go's decoder agrees
+		goImg, err := png.Decode(bytes.NewReader(enc))
+		require.Nil(t, err)
+		r, _, _, _ := goImg.At(1, 1).RGBA()
+		require.NotEqual(t, r&0xff, r>>8)
+
+		dec, err := DecompressWithOptions(enc, &DecompressParams{Format: img.Format, HasFormat: true})
+		require.Nil(t, err)
+		require.Equal(t, ComponentUint16, dec.Type, "%v", img.Format)
+		require.Equal(t, img.Pixels, dec.Pixels, "%v", img.Format)
+
+		for _, predictor := range []bool{false, true} {
+			enc, err = EncodeTIFF(img, &TIFFParams{Predictor: predictor})
+			require.Nil(t, err)
+			dec, err = DecompressWithOptions(enc, &DecompressParams{Format: img.Format, HasFormat: true})
+			require.Nil(t, err)
+			require.Equal(t, ComponentUint16, dec.Type)
+			require.Equal(t, img.Pixels, dec.Pixels, "%v %v", img.Format, predictor)
+		}
+	}
+
+	// Paletted PNGs are 8-bit
+	enc, err := EncodePNG(org.ToGray(), &PNGParams{Paletted: true, Palette: color.Palette{color.Black, color.White}})
+	require.Nil(t, err)
+	goImg, err := png.Decode(bytes.NewReader(enc))
+	require.Nil(t, err)
+	require.IsType(t, &image.Paletted{}, goImg)
+	dec, err := Decompress(enc)
+	require.Nil(t, err)
+	require.Equal(t, ComponentUint8, dec.Type)
+	require.Equal(t, PixelFormatRGB, dec.Format)
+}
+
+func TestResizeRotate16(t *testing.T) {
+	org := MakeRGBA16(37, 29)
+	small := ResizeNew(org, 20, 15, nil)
+	require.Equal(t, ComponentUint16, small.Type)
+	ref := ResizeNew(org.ConvertType(ComponentUint8), 20, 15, &ResizeParams{CheapSRGBFilter: true})
+	require.Less(t, AvgRGBDifference(small.ConvertType(ComponentUint8), ref), 3.0)
+	require.NotNil(t, Resize(org, NewImage(20, 15, PixelFormatRGBA), nil))
+
+	// Discrete rotation moves whole pixels
+	rot := NewImageOfType(org.Height, org.Width, org.Format, org.Type)
+	Rotate(org, rot, math.Pi/2, nil)
+	require.Equal(t, org.Pixels16()[0:4], rot.Pixels16()[rot.PixelByte(org.Height-1, 0)/2:][:4])
+	unrot, err := UnrotateExif(6, org)
+	require.Nil(t, err)
+	require.Equal(t, rot.Pixels, unrot.Pixels)
+
+	// Bilinear rotation should match the 8-bit result
+	rot = NewImageOfType(org.Width, org.Height, org.Format, org.Type)
+	Rotate(org, rot, 0.3, nil)
+	rot8 := NewImage(org.Width, org.Height, org.Format)
+	Rotate(org.ConvertType(ComponentUint8), rot8, 0.3, nil)
+	require.Less(t, AvgRGBDifference(rot.ConvertType(ComponentUint8), rot8), 3.0)
+}
+
+func TestAvgColorMatte16(t *testing.T) {
+	org := MakeRGBA(37, 29)
+	AddAlphaNoise(org)
+	linear := &ProcessParams{LinearLight: true}
+	for _, typ := range []ComponentType{ComponentUint16, ComponentFloat32} {
+		img := org.ConvertType(typ)
+		require.Equal(t, org.AvgColor(), img.AvgColor())
+		require.Equal(t, org.AvgColorWithOptions(linear), img.AvgColorWithOptions(linear))
+
+		for _, premul := range []bool{false, true} {
+			for _, params := range []*ProcessParams{nil, linear} {
+				src, ref := img.Clone(), org.Clone()
+				if premul {
+					src.Premultiply()
+					ref.Premultiply()
+				}
+				if typ == ComponentFloat32 {
+					// Float32 is always blended in linear light
+					params = linear
+				}
+				src.MatteWithOptions(10, 200, 30, params)
+				ref.MatteWithOptions(10, 200, 30, params)
+				require.Equal(t, typ, src.Type)
+				require.Less(t, AvgRGBDifference(ref, src.ConvertType(ComponentUint8)), 1.0, "%v %v %v", typ, premul, params)
+			}
+		}
+	}
+
+	// Opaque pixels, and images without alpha, are not touched
+	hdr := NewImageOfType(1, 1, PixelFormatRGBA, ComponentFloat32)
+	copy(hdr.PixelsFloat32(), []float32{4, 0.5, 0.1235, 1})
+	hdr.Matte(255, 255, 255)
+	require.Equal(t, []float32{4, 0.5, 0.1235, 1}, hdr.PixelsFloat32())
+	for _, params := range []*ProcessParams{nil, linear} {
+		opaque := NewImageOfType(1, 1, PixelFormatBGRA, ComponentUint16)
+		copy(opaque.Pixels16(), []uint16{1000, 2000, 3000, 65535})
+		opaque.MatteWithOptions(255, 255, 255, params)
+		require.Equal(t, []uint16{1000, 2000, 3000, 65535}, opaque.Pixels16())
+	}
+	for _, pf := range []PixelFormat{PixelFormatRGBX, PixelFormatCMYK} {
+		noAlpha := NewImageOfType(1, 1, pf, ComponentUint16)
+		copy(noAlpha.Pixels16(), []uint16{1000, 2000, 3000, 4000})
+		noAlpha.Matte(255, 255, 255)
+		require.Equal(t, []uint16{1000, 2000, 3000, 4000}, noAlpha.Pixels16())
+	}
+}
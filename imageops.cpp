@@ -3,6 +3,8 @@
 #include <turbojpeg.h>
 #include <algorithm>
 #include "imageops.h"
+#include "srgb.h"
+#include "layout.h"
 
 // Jim Blinn's perfect unsigned byte multiply
 template <typename T>
@@ -50,7 +52,7 @@ struct OrderABGR {
 //constexpr uint8_t OrderARGB[4] = {1, 2, 3, 0};
 //constexpr uint8_t OrderABGR[4] = {3, 2, 1, 0};
 
-// This is all done in sRGB space, which is not correct (should be in linear space)
+// This is all done in sRGB space, which is fast but darkens the blend. See MatteLinear for the correct version.
 template <bool premultiply, int cR, int cG, int cB, int cA>
 void MatteLine(uint8_t* line, size_t width, uint8_t matteR, uint8_t matteG, uint8_t matteB) {
 	for (; width != 0; width--) {
@@ -66,7 +68,7 @@ void MatteLine(uint8_t* line, size_t width, uint8_t matteR, uint8_t matteG, uint
 		r        = ByteMul<int32_t>(matteR, 255 - a) + r;
 		g        = ByteMul<int32_t>(matteG, 255 - a) + g;
 		b        = ByteMul<int32_t>(matteB, 255 - a) + b;
-		a        = ByteMul<int32_t>(matteR, 255 - a) + a;
+		a        = 255;
 		line[cR] = r;
 		line[cG] = g;
 		line[cB] = b;
@@ -96,6 +98,164 @@ void PremultiplyLine2(uint8_t* line, size_t width) {
 	PremultiplyLine<order::R, order::G, order::B, order::A>(line, width);
 }
 
+static uint8_t ByteDiv(uint32_t c, uint32_t a) {
+	if (a == 0)
+		return 0;
+	return (uint8_t) std::min<uint32_t>((c * 255 + a / 2) / a, 255);
+}
+
+template <int cR, int cG, int cB, int cA>
+void UnpremultiplyLine(uint8_t* line, size_t width) {
+	for (; width != 0; width--) {
+		uint8_t a = line[cA];
+		line[cR]  = ByteDiv(line[cR], a);
+		line[cG]  = ByteDiv(line[cG], a);
+		line[cB]  = ByteDiv(line[cB], a);
+		line += 4;
+	}
+}
+
+template <typename order>
+void UnpremultiplyLine2(uint8_t* line, size_t width) {
+	UnpremultiplyLine<order::R, order::G, order::B, order::A>(line, width);
+}
+
+// Arithmetic for each component type. Integer types round to nearest.
+template <typename T>
+struct ConvertOps;
+
+template <>
+struct ConvertOps<uint8_t> {
+	typedef uint32_t V;
+	static constexpr V Max = 255;
+
+	static V Gray(V r, V g, V b) { return (r * 77 + g * 150 + b * 29) >> 8; }
+	static V Mul(V a, V b) { return (a * b + Max / 2) / Max; }
+	static V Div(V a, V k) { return (a * Max + k / 2) / k; }
+};
+
+template <>
+struct ConvertOps<uint16_t> {
+	typedef uint32_t V;
+	static constexpr V Max = 65535;
+
+	static V Gray(V r, V g, V b) { return (r * 77 + g * 150 + b * 29) >> 8; }
+	static V Mul(V a, V b) { return (a * b + Max / 2) / Max; }
+	static V Div(V a, V k) { return (a * Max + k / 2) / k; }
+};
+
+// Float images hold linear light, so gray uses the Rec. 709 luminance weights
+template <>
+struct ConvertOps<float> {
+	typedef float V;
+	static constexpr V Max = 1;
+
+	static V Gray(V r, V g, V b) { return r * 0.2126f + g * 0.7152f + b * 0.0722f; }
+	static V Mul(V a, V b) { return a * b; }
+	static V Div(V a, V k) { return a / k; }
+};
+
+enum ConvertDstKind {
+	ConvertDstColor,
+	ConvertDstGray,
+	ConvertDstCMYK,
+};
+
+// Convert one line of pixels. The channel counts and kinds are template parameters, so that the
+// branches on them are resolved at compile time. The channel offsets are read from the layouts
+// at runtime, which keeps the number of instantiations small.
+// CMYK is inverted (Adobe) CMYK, which is what TurboJPEG produces.
+template <typename T, int SN, bool srcCMYK, int DN, ConvertDstKind dstKind>
+void ConvertLine(const T* src, T* dst, size_t width, const FormatLayout& s, const FormatLayout& d) {
+	typedef ConvertOps<T>   Ops;
+	typedef typename Ops::V V;
+	const int               dstA = d.a != -1 ? d.a : d.x; // The 4th channel of a 4 channel color format
+	for (size_t x = 0; x < width; x++) {
+		V r, g, b, a;
+		if (srcCMYK) {
+			V k = src[3];
+			r   = Ops::Mul(src[0], k);
+			g   = Ops::Mul(src[1], k);
+			b   = Ops::Mul(src[2], k);
+			a   = Ops::Max;
+		} else {
+			r = src[s.r];
+			g = src[s.g];
+			b = src[s.b];
+			a = s.a != -1 ? (V) src[s.a] : Ops::Max;
+		}
+		if (dstKind == ConvertDstGray) {
+			dst[0] = (T) Ops::Gray(r, g, b);
+		} else if (dstKind == ConvertDstCMYK) {
+			// k is the inverse of the amount of black ink, and c,m,y are the remaining color
+			V k = std::max(std::max(r, g), b);
+			if (k <= 0) {
+				dst[0] = (T) Ops::Max;
+				dst[1] = (T) Ops::Max;
+				dst[2] = (T) Ops::Max;
+			} else {
+				dst[0] = (T) Ops::Div(r, k);
+				dst[1] = (T) Ops::Div(g, k);
+				dst[2] = (T) Ops::Div(b, k);
+			}
+			dst[3] = (T) k;
+		} else {
+			dst[d.r] = (T) r;
+			dst[d.g] = (T) g;
+			dst[d.b] = (T) b;
+			if (DN == 4)
+				dst[dstA] = (T) (d.a != -1 ? a : Ops::Max);
+		}
+		src += SN;
+		dst += DN;
+	}
+}
+
+template <typename T, int SN, bool srcCMYK>
+void ConvertImageFromSrc(const uint8_t* src, int srcStride, const FormatLayout& s, uint8_t* dst, int dstFormat, int dstStride, const FormatLayout& d, int width, int height) {
+	void (*line)(const T*, T*, size_t, const FormatLayout&, const FormatLayout&) = nullptr;
+	if (dstFormat == TJPF_GRAY)
+		line = ConvertLine<T, SN, srcCMYK, 1, ConvertDstGray>;
+	else if (dstFormat == TJPF_CMYK)
+		line = ConvertLine<T, SN, srcCMYK, 4, ConvertDstCMYK>;
+	else if (d.nchan == 3)
+		line = ConvertLine<T, SN, srcCMYK, 3, ConvertDstColor>;
+	else
+		line = ConvertLine<T, SN, srcCMYK, 4, ConvertDstColor>;
+	for (int y = 0; y < height; y++)
+		line((const T*) (src + (size_t) y * srcStride), (T*) (dst + (size_t) y * dstStride), width, s, d);
+}
+
+template <typename T>
+void ConvertImage(const uint8_t* src, int srcFormat, int srcStride, uint8_t* dst, int dstFormat, int dstStride, int width, int height) {
+	FormatLayout s = GetFormatLayout(srcFormat);
+	FormatLayout d = GetFormatLayout(dstFormat);
+	if (srcFormat == TJPF_CMYK)
+		ConvertImageFromSrc<T, 4, true>(src, srcStride, s, dst, dstFormat, dstStride, d, width, height);
+	else if (s.nchan == 1)
+		ConvertImageFromSrc<T, 1, false>(src, srcStride, s, dst, dstFormat, dstStride, d, width, height);
+	else if (s.nchan == 3)
+		ConvertImageFromSrc<T, 3, false>(src, srcStride, s, dst, dstFormat, dstStride, d, width, height);
+	else
+		ConvertImageFromSrc<T, 4, false>(src, srcStride, s, dst, dstFormat, dstStride, d, width, height);
+}
+
+// Convert RGB to gray in linear light, with the Rec. 709 luminance weights
+template <typename T>
+void ToGrayLinearImage(const uint8_t* src, int srcStride, const FormatLayout& s, uint8_t* dst, int dstStride, int width, int height) {
+	const float* toLinear = SRGBTableFor<T>();
+	const float* toSRGB   = LinearToSRGBTableValues();
+	for (int y = 0; y < height; y++) {
+		const T* sp = (const T*) (src + (size_t) y * srcStride);
+		T*       dp = (T*) (dst + (size_t) y * dstStride);
+		for (int x = 0; x < width; x++) {
+			float l = toLinear[sp[s.r]] * 0.2126f + toLinear[sp[s.g]] * 0.7152f + toLinear[sp[s.b]] * 0.0722f;
+			dp[x]   = LinearToSRGBSample<T>(toSRGB, l);
+			sp += s.nchan;
+		}
+	}
+}
+
 extern "C" {
 
 void AvgColor(void* _src, int _width, int _height, int stride, int _nchan, void* _outChannels) {
@@ -119,93 +279,55 @@ void AvgColor(void* _src, int _width, int _height, int stride, int _nchan, void*
 	}
 }
 
-// _src is either RGB or RGBA
-void ToGray(void* _src, int _width, int height, int srcStride, int _nchan, int dstStride, void* _out) {
-	auto src = (const uint8_t*) _src;
-	auto dst = (uint8_t*) _out;
-	for (int y = 0; y < height; y++) {
-		size_t width = _width;
-		size_t nchan = _nchan;
-		auto   srcP  = src;
-		auto   dstP  = dst;
-		if (nchan >= 3) {
-			for (size_t x = 0; x < width; x++) {
-				auto r  = srcP[0];
-				auto g  = srcP[1];
-				auto b  = srcP[2];
-				dstP[0] = r * 77 + g * 150 + b * 29 >> 8;
-				srcP += nchan;
-				dstP++;
+void AvgColorLinear(void* _src, int _width, int _height, int stride, int _nchan, int alphaChan, void* _outChannels) {
+	const uint8_t* src                      = (const uint8_t*) _src;
+	const float*   toLinear                 = SRGBTableFor<uint8_t>();
+	double         sum[AvgColorMaxChannels] = {0};
+	if (_nchan < 1 || _nchan > sizeof(sum) / sizeof(sum[0]))
+		return;
+	for (int y = 0; y < _height; y++) {
+		const uint8_t* p = src;
+		for (int x = 0; x < _width; x++) {
+			for (int c = 0; c < _nchan; c++) {
+				sum[c] += c == alphaChan ? (double) *p : (double) toLinear[*p];
+				p++;
 			}
 		}
-		src += srcStride;
-		dst += dstStride;
+		src += stride;
+	}
+	double   nPixels     = (double) _width * (double) _height;
+	uint8_t* outChannels = (uint8_t*) _outChannels;
+	for (int c = 0; c < _nchan; c++) {
+		if (c == alphaChan)
+			outChannels[c] = (uint8_t) (sum[c] / nPixels);
+		else
+			outChannels[c] = LinearToSRGBSample<uint8_t>(LinearToSRGBTableValues(), (float) (sum[c] / nPixels));
 	}
 }
 
-// _src is either RGBA or G
-void ToRGB(void* _src, int _width, int height, int srcStride, int _nchan, int dstStride, void* _out) {
-	auto src = (const uint8_t*) _src;
-	auto dst = (uint8_t*) _out;
-	for (int y = 0; y < height; y++) {
-		size_t width = _width;
-		size_t nchan = _nchan;
-		auto   srcP  = src;
-		auto   dstP  = dst;
-		if (nchan == 1) {
-			for (size_t x = 0; x < width; x++) {
-				auto g  = srcP[0];
-				dstP[0] = g;
-				dstP[1] = g;
-				dstP[2] = g;
-				srcP++;
-				dstP += 3;
-			}
-		} else {
-			for (size_t x = 0; x < width; x++) {
-				dstP[0] = srcP[0];
-				dstP[1] = srcP[1];
-				dstP[2] = srcP[2];
-				srcP += nchan;
-				dstP += 3;
-			}
-		}
-		src += srcStride;
-		dst += dstStride;
+void ToGrayLinear(const void* src, int srcFormat, int srcStride, void* dst, int dstStride, int width, int height, int componentType) {
+	FormatLayout s = GetFormatLayout(srcFormat);
+	switch (componentType) {
+	case ConvertComponentUint8:
+		ToGrayLinearImage<uint8_t>((const uint8_t*) src, srcStride, s, (uint8_t*) dst, dstStride, width, height);
+		break;
+	case ConvertComponentUint16:
+		ToGrayLinearImage<uint16_t>((const uint8_t*) src, srcStride, s, (uint8_t*) dst, dstStride, width, height);
+		break;
 	}
 }
 
-// _src is either RGB or G
-void ToRGBA(void* _src, int _width, int height, int srcStride, int _nchan, int dstStride, uint8_t alpha, void* _out) {
-	auto src = (const uint8_t*) _src;
-	auto dst = (uint8_t*) _out;
-	for (int y = 0; y < height; y++) {
-		size_t width = _width;
-		size_t nchan = _nchan;
-		auto   srcP  = src;
-		auto   dstP  = dst;
-		if (nchan == 1) {
-			for (size_t x = 0; x < width; x++) {
-				auto g  = srcP[0];
-				dstP[0] = g;
-				dstP[1] = g;
-				dstP[2] = g;
-				dstP[3] = alpha;
-				srcP++;
-				dstP += 4;
-			}
-		} else if (nchan == 3) {
-			for (size_t x = 0; x < width; x++) {
-				dstP[0] = srcP[0];
-				dstP[1] = srcP[1];
-				dstP[2] = srcP[2];
-				dstP[3] = alpha;
-				srcP += nchan;
-				dstP += 4;
-			}
-		}
-		src += srcStride;
-		dst += dstStride;
+void ConvertFormat(const void* src, int srcFormat, int srcStride, void* dst, int dstFormat, int dstStride, int width, int height, int componentType) {
+	switch (componentType) {
+	case ConvertComponentUint8:
+		ConvertImage<uint8_t>((const uint8_t*) src, srcFormat, srcStride, (uint8_t*) dst, dstFormat, dstStride, width, height);
+		break;
+	case ConvertComponentUint16:
+		ConvertImage<uint16_t>((const uint8_t*) src, srcFormat, srcStride, (uint8_t*) dst, dstFormat, dstStride, width, height);
+		break;
+	case ConvertComponentFloat32:
+		ConvertImage<float>((const uint8_t*) src, srcFormat, srcStride, (uint8_t*) dst, dstFormat, dstStride, width, height);
+		break;
 	}
 }
 
@@ -243,6 +365,29 @@ void Matte(void* src, int width, int height, int srcStride, int format, int isPr
 	}
 }
 
+void MatteLinear(void* src, int width, int height, int srcStride, int format, int isPremultiplied, uint8_t matteR, uint8_t matteG, uint8_t matteB) {
+	FormatLayout l = GetFormatLayout(format);
+	if (l.a == -1)
+		return;
+	const float* toLinear = SRGBTableFor<uint8_t>();
+	const float* toSRGB   = LinearToSRGBTableValues();
+	const int    chan[3]  = {l.r, l.g, l.b};
+	const float  matte[3] = {toLinear[matteR], toLinear[matteG], toLinear[matteB]};
+	for (int y = 0; y < height; y++) {
+		uint8_t* line = (uint8_t*) src + (size_t) srcStride * y;
+		for (int x = 0; x < width; x++) {
+			uint8_t a  = line[l.a];
+			float   af = a * (1.0f / 255.0f);
+			for (int i = 0; i < 3; i++) {
+				uint8_t v     = isPremultiplied ? ByteDiv(line[chan[i]], a) : line[chan[i]];
+				line[chan[i]] = LinearToSRGBSample<uint8_t>(toSRGB, toLinear[v] * af + matte[i] * (1.0f - af));
+			}
+			line[l.a] = 255;
+			line += 4;
+		}
+	}
+}
+
 void Premultiply(void* src, int width, int height, int stride, int format) {
 	for (int y = 0; y < height; y++) {
 		void* line = (uint8_t*) src + stride * y;
@@ -265,104 +410,24 @@ void Premultiply(void* src, int width, int height, int stride, int format) {
 	}
 }
 
-void DrawHorizontalLine(uint8_t* src, int stride, int nchan, uint8_t c1, uint8_t c2, uint8_t c3, int y, int xs, int xe) {
-	uint8_t* row = src + static_cast<size_t>(y) * stride;
-	if (nchan == 1) {
-		uint8_t* p = row + static_cast<size_t>(xs) * 1;
-		for (int x = xs; x < xe; ++x) {
-			*p = c1;
-			p += 1;
-		}
-	} else if (nchan == 3) {
-		uint8_t* p = row + static_cast<size_t>(xs) * 3;
-		for (int x = xs; x < xe; ++x) {
-			p[0] = c1;
-			p[1] = c2;
-			p[2] = c3;
-			p += 3;
-		}
-	} else if (nchan == 4) {
-		uint8_t* p = row + static_cast<size_t>(xs) * 4;
-		for (int x = xs; x < xe; ++x) {
-			p[0] = c1;
-			p[1] = c2;
-			p[2] = c3;
-			p[3] = 255;
-			p += 4;
-		}
-	}
-}
-
-void DrawVerticalLine(uint8_t* src, int stride, int nchan, uint8_t c1, uint8_t c2, uint8_t c3, int x, int ys, int ye) {
-	uint8_t* col = src + static_cast<size_t>(x) * nchan;
-	if (nchan == 1) {
-		uint8_t* p = col + static_cast<size_t>(ys) * stride;
-		for (int y = ys; y < ye; ++y) {
-			*p = c1;
-			p += stride;
-		}
-	} else if (nchan == 3) {
-		uint8_t* p = col + static_cast<size_t>(ys) * stride;
-		for (int y = ys; y < ye; ++y) {
-			p[0] = c1;
-			p[1] = c2;
-			p[2] = c3;
-			p += stride;
-		}
-	} else if (nchan == 4) {
-		uint8_t* p = col + static_cast<size_t>(ys) * stride;
-		for (int y = ys; y < ye; ++y) {
-			p[0] = c1;
-			p[1] = c2;
-			p[2] = c3;
-			p[3] = 255;
-			p += stride;
-		}
-	}
-}
-
-void DrawRect(void* _src, int _width, int _height, int _stride, int _nchan, uint8_t c1, uint8_t c2, uint8_t c3, int x1, int y1, int x2, int y2) {
-	if (x1 >= x2 || y1 >= y2)
-		return;
-	auto src = (uint8_t*) _src;
-
-	// Top line
-	int yy = y1;
-	if (yy >= 0 && yy < _height) {
-		int xs = std::max(x1, 0);
-		int xe = std::min(x2, _width);
-		if (xs < xe) {
-			DrawHorizontalLine(src, _stride, _nchan, c1, c2, c3, yy, xs, xe);
-		}
-	}
-
-	// Bottom line
-	yy = y2 - 1;
-	if (yy >= 0 && yy < _height) {
-		int xs = std::max(x1, 0);
-		int xe = std::min(x2, _width);
-		if (xs < xe) {
-			DrawHorizontalLine(src, _stride, _nchan, c1, c2, c3, yy, xs, xe);
-		}
-	}
-
-	// Left line
-	int xx = x1;
-	if (xx >= 0 && xx < _width) {
-		int ys = std::max(y1, 0);
-		int ye = std::min(y2, _height);
-		if (ys < ye) {
-			DrawVerticalLine(src, _stride, _nchan, c1, c2, c3, xx, ys, ye);
-		}
-	}
-
-	// Right line
-	xx = x2 - 1;
-	if (xx >= 0 && xx < _width) {
-		int ys = std::max(y1, 0);
-		int ye = std::min(y2, _height);
-		if (ys < ye) {
-			DrawVerticalLine(src, _stride, _nchan, c1, c2, c3, xx, ys, ye);
+void Unpremultiply(void* src, int width, int height, int stride, int format) {
+	for (int y = 0; y < height; y++) {
+		void* line = (uint8_t*) src + stride * y;
+		switch (format) {
+		case TJPF_RGBA:
+			UnpremultiplyLine2<OrderRGBA>((uint8_t*) line, (size_t) width);
+			break;
+		case TJPF_BGRA:
+			UnpremultiplyLine2<OrderBGRA>((uint8_t*) line, (size_t) width);
+			break;
+		case TJPF_ABGR:
+			UnpremultiplyLine2<OrderABGR>((uint8_t*) line, (size_t) width);
+			break;
+		case TJPF_ARGB:
+			UnpremultiplyLine2<OrderARGB>((uint8_t*) line, (size_t) width);
+			break;
+		default:
+			return;
 		}
 	}
 }
@@ -7,23 +7,60 @@ import "C"
 import (
 	"errors"
 	"fmt"
+	"image/color"
 	"unsafe"
 )
 
 var ErrNoAlpha = errors.New("Image has no alpha channel")
 
+// ProcessParams control the color math of AvgColor, Matte and ToGray.
+// Resize has its own equivalent: 8-bit images are filtered in linear light, unless ResizeParams.CheapSRGBFilter is set.
+type ProcessParams struct {
+	LinearLight bool // Average and blend in linear light, instead of directly on the sRGB values. This is more accurate, but slower.
+}
+
 // AvgColor computes the average color of the entire image, per channel
-// The averaging is performed in sRGB space (i.e. not linear light)
+// The averaging is performed in sRGB space (i.e. not linear light). Use AvgColorWithOptions for linear light.
 // If the image has more than 8 channels, then the function will panic
+// 16-bit and float32 images are converted to 8-bit sRGB first, so the result is always 8-bit.
 func (img *Image) AvgColor() []uint8 {
+	return img.AvgColorWithOptions(nil)
+}
+
+// AvgColorWithOptions is AvgColor, with options. params may be nil.
+// In linear light, the color channels are decoded from sRGB before averaging, and alpha is averaged as-is.
+// Premultiplied colors are unpremultiplied before averaging, and CMYK is averaged as RGB.
+func (img *Image) AvgColorWithOptions(params *ProcessParams) []uint8 {
+	img = img.asUint8()
 	if C.int(img.NChan()) > C.AvgColorMaxChannels {
 		panic("Image for AvgColor has more than 8 channels")
 	}
+	if params != nil && params.LinearLight {
+		return img.avgColorLinear()
+	}
 	channels := [8]uint8{}
 	C.AvgColor(unsafe.Pointer(&img.Pixels[0]), C.int(img.Width), C.int(img.Height), C.int(img.Stride), C.int(img.NChan()), unsafe.Pointer(&channels[0]))
 	return channels[:img.NChan()]
 }
 
+// avgColorLinear averages the straight colors in linear light. CMYK is averaged as RGB, and the
+// result is returned in the format and alpha state of img.
+func (img *Image) avgColorLinear() []uint8 {
+	src := img.withStraightAlpha()
+	if src.Format == PixelFormatCMYK {
+		src = src.Convert(PixelFormatRGB)
+	}
+	avg := NewImage(1, 1, src.Format)
+	C.AvgColorLinear(unsafe.Pointer(&src.Pixels[0]), C.int(src.Width), C.int(src.Height), C.int(src.Stride), C.int(src.NChan()), C.int(src.alphaChannel()), unsafe.Pointer(&avg.Pixels[0]))
+	if img.Format == PixelFormatCMYK {
+		avg = avg.Convert(PixelFormatCMYK)
+	}
+	if img.Premultiplied {
+		avg.Premultiply()
+	}
+	return avg.Pixels
+}
+
 // CopyImage copies src into dst at the location dstX1, dstY1
 func (dst *Image) CopyImage(src *Image, dstX1, dstY1 int) error {
 	return dst.CopyImageRect(src, 0, 0, src.Width, src.Height, dstX1, dstY1)
@@ -31,8 +68,16 @@ func (dst *Image) CopyImage(src *Image, dstX1, dstY1 int) error {
 
 // Return a crop of the image, where the crop points to the same underlying bytes
 func (img *Image) ReferenceCrop(x1, y1, x2, y2 int) *Image {
-	pixels := img.Pixels[y1*img.Stride+x1*img.NChan() : y2*img.Stride+x2*img.NChan()]
-	return WrapImageStrided(x2-x1, y2-y1, img.Format, pixels, img.Stride)
+	start := y1*img.Stride + x1*img.BytesPerPixel()
+	end := start
+	if y2 > y1 {
+		// The last row of the crop ends at x2, so a crop can touch the bottom edge of the image
+		end = (y2-1)*img.Stride + x2*img.BytesPerPixel()
+	}
+	crop := WrapImageStrided(x2-x1, y2-y1, img.Format, img.Pixels[start:end], img.Stride)
+	crop.Type = img.Type
+	crop.Premultiplied = img.Premultiplied
+	return crop
 }
 
 func clamp(v, vmin, vmax int) int {
@@ -46,13 +91,19 @@ func clamp(v, vmin, vmax int) int {
 
 // CopyImageRect copies src into dst, at dstX1,dstY1. The source imagery is read from the rectangle
 // specified by the 4 source location parameters. All coordinates are clipped prior to drawing.
-// The only error condition is when the two images have a different number of channels.
+// The only error condition is when the two images have a different number of channels, or component types.
 // Note that you will get swapped RGB channels if you do something like copy from an RGB image
 // into a BGR image (i.e. this function does not swizzle the channels, it just does a dumb memcpy of the rows).
+// To copy between different formats, use ReferenceCrop on both images, and ConvertInto.
+// The alpha state is not converted either, so src and dst should have the same Premultiplied state.
+// To blend src onto dst using its alpha channel, use Composite.
 func (dst *Image) CopyImageRect(src *Image, srcX1, srcY1, srcX2, srcY2 int, dstX1, dstY1 int) error {
 	if src.NChan() != dst.NChan() {
 		return fmt.Errorf("Source image channels: %v, target image channels: %v", src.NChan(), dst.NChan())
 	}
+	if src.Type != dst.Type {
+		return fmt.Errorf("Source component type %v differs from target component type %v", int(src.Type), int(dst.Type))
+	}
 	srcX1 = max(srcX1, 0)
 	srcY1 = max(srcY1, 0)
 	srcX2 = min(srcX2, src.Width)
@@ -64,9 +115,9 @@ func (dst *Image) CopyImageRect(src *Image, srcX1, srcY1, srcX2, srcY2 int, dstX
 	if w <= 0 || h <= 0 {
 		return nil
 	}
-	bytesPerLine := w * dst.NChan()
-	srcOffset := srcX1 * src.NChan()
-	dstOffset := dstX1 * dst.NChan()
+	bytesPerLine := w * dst.BytesPerPixel()
+	srcOffset := srcX1 * src.BytesPerPixel()
+	dstOffset := dstX1 * dst.BytesPerPixel()
 	for y := 0; y < h; y++ {
 		srcP := src.Stride*(srcY1+y) + srcOffset
 		dstP := dst.Stride*(dstY1+y) + dstOffset
@@ -76,66 +127,401 @@ func (dst *Image) CopyImageRect(src *Image, srcX1, srcY1, srcX2, srcY2 int, dstX
 }
 
 // ToGray returns a grayscale image.
-// If the image is already a grayscale image, then a clone is returned
+// If the image is already a grayscale image, then a clone is returned.
+// Gray is computed directly from the sRGB values. Use ToGrayWithOptions for linear light.
 func (img *Image) ToGray() *Image {
+	return img.ToGrayWithOptions(nil)
+}
+
+// ToGrayWithOptions is ToGray, with options. params may be nil.
+// In linear light, gray is the Rec. 709 luminance, which is what ToGray already computes for float32 images.
+func (img *Image) ToGrayWithOptions(params *ProcessParams) *Image {
 	if img.NChan() == 1 {
 		return img.Clone()
 	}
-	dst := NewImage(img.Width, img.Height, PixelFormatGRAY)
-	C.ToGray(unsafe.Pointer(&img.Pixels[0]), C.int(img.Width), C.int(img.Height), C.int(img.Stride), C.int(img.NChan()), C.int(dst.Stride), unsafe.Pointer(&dst.Pixels[0]))
+	if params == nil || !params.LinearLight || img.Type == ComponentFloat32 {
+		return img.Convert(PixelFormatGRAY)
+	}
+	src := img.withStraightAlpha()
+	if src.Format == PixelFormatCMYK {
+		src = src.Convert(PixelFormatRGB)
+	}
+	dst := NewImageOfType(img.Width, img.Height, PixelFormatGRAY, img.Type)
+	if img.Width == 0 || img.Height == 0 {
+		return dst
+	}
+	C.ToGrayLinear(unsafe.Pointer(&src.Pixels[0]), C.int(src.Format), C.int(src.Stride), unsafe.Pointer(&dst.Pixels[0]), C.int(dst.Stride),
+		C.int(img.Width), C.int(img.Height), C.int(img.Type))
 	return dst
 }
 
 // ToRGB returns a 3 channel image.
 // This is used to remove the alpha channel from an image that was loaded from a PNG,
-// or to turn a gray image into an RGB image.
-// If the image is already a 3 channel image, then a clone is returned
+// or to turn a gray image into an RGB image. Premultiplied colors are unpremultiplied.
+// If the image is already a 3 channel image, then a clone is returned, otherwise the result is RGB.
 func (img *Image) ToRGB() *Image {
 	if img.NChan() == 3 {
 		return img.Clone()
 	}
-	dst := NewImage(img.Width, img.Height, PixelFormatRGB)
-	C.ToRGB(unsafe.Pointer(&img.Pixels[0]), C.int(img.Width), C.int(img.Height), C.int(img.Stride), C.int(img.NChan()), C.int(dst.Stride), unsafe.Pointer(&dst.Pixels[0]))
-	return dst
+	return img.Convert(PixelFormatRGB)
 }
 
 // ToRGBA returns a 4 channel image.
-// If the image is already a 4 channel image, then a clone is returned
+// If the image is already a 4 channel image, then a clone is returned, otherwise the result is RGBA.
+// For a 16-bit image, alpha is scaled to 16 bits, and for a float32 image, to [0,1].
 func (img *Image) ToRGBA(alpha uint8) *Image {
 	if img.NChan() == 4 {
 		return img.Clone()
 	}
-	dst := NewImage(img.Width, img.Height, PixelFormatRGBA)
-	C.ToRGBA(unsafe.Pointer(&img.Pixels[0]), C.int(img.Width), C.int(img.Height), C.int(img.Stride), C.int(img.NChan()), C.int(dst.Stride), C.uint8_t(alpha), unsafe.Pointer(&dst.Pixels[0]))
+	dst := img.Convert(PixelFormatRGBA)
+	if alpha == 255 {
+		return dst
+	}
+	switch dst.Type {
+	case ComponentUint8:
+		for i := 3; i < len(dst.Pixels); i += 4 {
+			dst.Pixels[i] = alpha
+		}
+	case ComponentUint16:
+		pix := dst.Pixels16()
+		for i := 3; i < len(pix); i += 4 {
+			pix[i] = uint16(alpha) * 257
+		}
+	case ComponentFloat32:
+		pix := dst.PixelsFloat32()
+		for i := 3; i < len(pix); i += 4 {
+			pix[i] = float32(alpha) / 255
+		}
+	}
 	return dst
 }
 
 // For an RGBA image, blend it on top of the given color, so that transparent regions of the image
-// will be filled with the given color.
+// will be filled with the given color. Alpha is set to 255 everywhere.
+// The blending is performed in sRGB space. Use MatteWithOptions for linear light.
+// Float32 images are always blended in linear light, because that is what their values are.
 // If the image has no alpha channel, then this is a no-op.
 func (img *Image) Matte(r, g, b uint8) {
-	if img.NChan() != 4 {
+	img.MatteWithOptions(r, g, b, nil)
+}
+
+// MatteWithOptions is Matte, with options. params may be nil.
+func (img *Image) MatteWithOptions(r, g, b uint8, params *ProcessParams) {
+	if img.alphaChannel() == -1 || img.Width == 0 || img.Height == 0 {
+		return
+	}
+	linear := params != nil && params.LinearLight
+	if img.Type == ComponentUint16 {
+		img.matte16(r, g, b, linear)
+		return
+	} else if img.Type == ComponentFloat32 {
+		img.matteFloat(r, g, b)
 		return
 	}
+	img.requireUint8("Matte")
 	premul := 0
 	if img.Premultiplied {
 		premul = 1
 	}
-	C.Matte(unsafe.Pointer(&img.Pixels[0]), C.int(img.Width), C.int(img.Height), C.int(img.Stride), C.int(img.Format), C.int(premul), C.uint8_t(r), C.uint8_t(g), C.uint8_t(b))
+	if linear {
+		C.MatteLinear(unsafe.Pointer(&img.Pixels[0]), C.int(img.Width), C.int(img.Height), C.int(img.Stride), C.int(img.Format), C.int(premul), C.uint8_t(r), C.uint8_t(g), C.uint8_t(b))
+	} else {
+		C.Matte(unsafe.Pointer(&img.Pixels[0]), C.int(img.Width), C.int(img.Height), C.int(img.Stride), C.int(img.Format), C.int(premul), C.uint8_t(r), C.uint8_t(g), C.uint8_t(b))
+	}
+}
+
+// matte16 is Matte for 16-bit images. Opaque pixels are left untouched.
+func (img *Image) matte16(r, g, b uint8, linear bool) {
+	a := img.alphaChannel()
+	cr, cg, cb, _ := channelOffsets(img.Format)
+	matte := [3]uint32{uint32(r) * 257, uint32(g) * 257, uint32(b) * 257}
+	matteLinear := [3]float32{srgbToLinear(float32(r) / 255), srgbToLinear(float32(g) / 255), srgbToLinear(float32(b) / 255)}
+	pix := img.Pixels16()
+	for y := 0; y < img.Height; y++ {
+		row := pix[y*img.Stride/2 : y*img.Stride/2+img.Width*4]
+		for x := 0; x < len(row); x += 4 {
+			alpha := uint32(row[x+a])
+			if alpha == 65535 {
+				continue
+			}
+			for i, c := range [3]int{cr, cg, cb} {
+				v := uint32(row[x+c])
+				if linear {
+					fa := float32(alpha) / 65535
+					s := float32(v) / 65535
+					if img.Premultiplied {
+						s = 0
+						if alpha != 0 {
+							s = min(float32(v)/float32(alpha), 1)
+						}
+					}
+					row[x+c] = uint16(linearToSRGB(srgbToLinear(s)*fa+matteLinear[i]*(1-fa))*65535 + 0.5)
+				} else {
+					if !img.Premultiplied {
+						v = (v*alpha + 32767) / 65535
+					}
+					row[x+c] = uint16(min(v+(matte[i]*(65535-alpha)+32767)/65535, 65535))
+				}
+			}
+			row[x+a] = 65535
+		}
+	}
+}
+
+// matteFloat is Matte for float32 images, which are blended in linear light
+func (img *Image) matteFloat(r, g, b uint8) {
+	a := img.alphaChannel()
+	cr, cg, cb, _ := channelOffsets(img.Format)
+	matte := [3]float32{srgbToLinear(float32(r) / 255), srgbToLinear(float32(g) / 255), srgbToLinear(float32(b) / 255)}
+	pix := img.PixelsFloat32()
+	for y := 0; y < img.Height; y++ {
+		row := pix[y*img.Stride/4 : y*img.Stride/4+img.Width*4]
+		for x := 0; x < len(row); x += 4 {
+			alpha := row[x+a]
+			for i, c := range [3]int{cr, cg, cb} {
+				if !img.Premultiplied {
+					row[x+c] *= alpha
+				}
+				row[x+c] += matte[i] * (1 - alpha)
+			}
+			row[x+a] = 1
+		}
+	}
 }
 
 // Premultiply RGB by A.
 // If the image does not have an alpha channel, or if Premultiplied=true then this is a no-op.
 func (img *Image) Premultiply() {
-	if img.Premultiplied || img.NChan() != 4 {
+	a := img.alphaChannel()
+	if img.Premultiplied || a == -1 {
+		return
+	}
+	if img.Type == ComponentUint16 {
+		pix := img.Pixels16()
+		for y := 0; y < img.Height; y++ {
+			row := pix[y*img.Stride/2 : y*img.Stride/2+img.Width*4]
+			for x := 0; x < len(row); x += 4 {
+				alpha := uint32(row[x+a])
+				for c := x; c < x+4; c++ {
+					if c != x+a {
+						row[c] = uint16((uint32(row[c])*alpha + 32767) / 65535)
+					}
+				}
+			}
+		}
+		img.Premultiplied = true
 		return
 	}
+	if img.Type == ComponentFloat32 {
+		pix := img.PixelsFloat32()
+		for y := 0; y < img.Height; y++ {
+			row := pix[y*img.Stride/4 : y*img.Stride/4+img.Width*4]
+			for x := 0; x < len(row); x += 4 {
+				for c := x; c < x+4; c++ {
+					if c != x+a {
+						row[c] *= row[x+a]
+					}
+				}
+			}
+		}
+		img.Premultiplied = true
+		return
+	}
+	img.requireUint8("Premultiply")
 	C.Premultiply(unsafe.Pointer(&img.Pixels[0]), C.int(img.Width), C.int(img.Height), C.int(img.Stride), C.int(img.Format))
 	img.Premultiplied = true
 }
 
-// Draw a rectangle.
+// Unpremultiply divides RGB by A, which is the inverse of Premultiply.
+// Pixels with zero alpha become transparent black.
+// If the image does not have an alpha channel, or if Premultiplied=false then this is a no-op.
+func (img *Image) Unpremultiply() {
+	a := img.alphaChannel()
+	if !img.Premultiplied || a == -1 {
+		return
+	}
+	if img.Type == ComponentUint16 {
+		pix := img.Pixels16()
+		for y := 0; y < img.Height; y++ {
+			row := pix[y*img.Stride/2 : y*img.Stride/2+img.Width*4]
+			for x := 0; x < len(row); x += 4 {
+				alpha := uint32(row[x+a])
+				for c := x; c < x+4; c++ {
+					if c == x+a {
+						continue
+					}
+					if alpha == 0 {
+						row[c] = 0
+					} else {
+						row[c] = uint16(min((uint32(row[c])*65535+alpha/2)/alpha, 65535))
+					}
+				}
+			}
+		}
+		img.Premultiplied = false
+		return
+	}
+	if img.Type == ComponentFloat32 {
+		pix := img.PixelsFloat32()
+		for y := 0; y < img.Height; y++ {
+			row := pix[y*img.Stride/4 : y*img.Stride/4+img.Width*4]
+			for x := 0; x < len(row); x += 4 {
+				alpha := row[x+a]
+				for c := x; c < x+4; c++ {
+					if c == x+a {
+						continue
+					}
+					if alpha == 0 {
+						row[c] = 0
+					} else {
+						row[c] /= alpha
+					}
+				}
+			}
+		}
+		img.Premultiplied = false
+		return
+	}
+	img.requireUint8("Unpremultiply")
+	C.Unpremultiply(unsafe.Pointer(&img.Pixels[0]), C.int(img.Width), C.int(img.Height), C.int(img.Stride), C.int(img.Format))
+	img.Premultiplied = false
+}
+
+// withStraightAlpha returns the image with straight (not premultiplied) alpha.
+// If the image is not premultiplied, or has no alpha channel, then it is returned without a copy.
+// This is used by operations that discard alpha, which would otherwise leave darkened colors behind.
+func (img *Image) withStraightAlpha() *Image {
+	if !img.Premultiplied || img.alphaChannel() == -1 {
+		return img
+	}
+	straight := img.Clone()
+	straight.Unpremultiply()
+	return straight
+}
+
+// DrawRectangle draws a 1 pixel wide outline of the rectangle from (x1, y1) to (x2, y2), where x2 and y2
+// are exclusive. The color is opaque, so the outline's alpha is 255. Use StrokeRect for other thicknesses.
 func (img *Image) DrawRectangle(x1, y1, x2, y2 int, r, g, b uint8) {
-	// TODO: swizzle r,g,b if pixel format is not RGB
-	C.DrawRect(unsafe.Pointer(&img.Pixels[0]), C.int(img.Width), C.int(img.Height), C.int(img.Stride), C.int(img.NChan()), C.uint8_t(r), C.uint8_t(g), C.uint8_t(b), C.int(x1), C.int(y1), C.int(x2), C.int(y2))
+	if x1 >= x2 || y1 >= y2 {
+		return
+	}
+	img.StrokeRect(float64(x1)+0.5, float64(y1)+0.5, float64(x2)-0.5, float64(y2)-0.5, 1, color.RGBA{r, g, b, 255})
+}
+
+// Convert returns a copy of the image in a different pixel format, with the same component type.
+// See ConvertInto for details.
+func (img *Image) Convert(format PixelFormat) *Image {
+	dst := NewImageOfType(img.Width, img.Height, format, img.Type)
+	img.ConvertInto(dst)
+	return dst
+}
+
+// ConvertInto converts the image into dst, which may have any pixel format, but must be the same
+// size and component type. dst may be a crop of a larger image.
+// Channels are swizzled as needed, so for example, BGRA becomes RGB correctly.
+// CMYK is inverted (Adobe) CMYK, which is what TurboJPEG produces.
+// Alpha is discarded when converting to a format without alpha, and set to opaque when
+// converting from a format without alpha. Padding channels (the X of RGBX, etc) are set to opaque.
+// dst is premultiplied if the image is premultiplied, and both formats have alpha. If dst has no
+// alpha, then premultiplied colors are unpremultiplied, so the result is the same for either alpha state.
+// Gray is computed with the Rec. 601 luminance weights, or Rec. 709 for float32 images, which are linear.
+func (img *Image) ConvertInto(dst *Image) error {
+	if err := checkSameSize(img, dst); err != nil {
+		return err
+	}
+	if img.Type != dst.Type {
+		return fmt.Errorf("Source component type %v differs from target component type %v", int(img.Type), int(dst.Type))
+	}
+	_, _, _, sa := channelOffsets(img.Format)
+	_, _, _, da := channelOffsets(dst.Format)
+	dst.Premultiplied = img.Premultiplied && sa != -1 && da != -1
+	if img.Width == 0 || img.Height == 0 {
+		return nil
+	}
+	if da == -1 {
+		// Alpha is about to be discarded, so the colors must be straight
+		img = img.withStraightAlpha()
+	}
+	if img.Format == dst.Format {
+		return dst.CopyImage(img, 0, 0)
+	}
+	C.ConvertFormat(unsafe.Pointer(&img.Pixels[0]), C.int(img.Format), C.int(img.Stride), unsafe.Pointer(&dst.Pixels[0]), C.int(dst.Format), C.int(dst.Stride),
+		C.int(img.Width), C.int(img.Height), C.int(img.Type))
+	return nil
+}
+
+// ConvertType returns a copy of the image with a different component type.
+// 8-bit values are widened to 16 bits by multiplying by 257, so that 255 becomes 65535,
+// and 16-bit values are narrowed to 8 bits with rounding.
+// Integer images are sRGB encoded and float32 images are linear, so conversions to and from
+// float32 apply the sRGB transfer function to the color channels (but not to alpha).
+// Float32 values outside of [0,1] are clamped.
+func (img *Image) ConvertType(typ ComponentType) *Image {
+	if img.Type == typ {
+		return img.Clone()
+	}
+	if typ == ComponentFloat32 {
+		return img.toLinearFloat()
+	} else if img.Type == ComponentFloat32 {
+		return img.fromLinearFloat(typ)
+	}
+	dst := NewImageOfType(img.Width, img.Height, img.Format, typ)
+	dst.Premultiplied = img.Premultiplied
+	rowSamples := img.Width * img.NChan()
+	for y := 0; y < img.Height; y++ {
+		switch {
+		case img.Type == ComponentUint8 && typ == ComponentUint16:
+			src := img.Pixels[y*img.Stride : y*img.Stride+rowSamples]
+			out := dst.Pixels16()[y*dst.Stride/2:]
+			for i, v := range src {
+				out[i] = uint16(v) * 257
+			}
+		case img.Type == ComponentUint16 && typ == ComponentUint8:
+			src := img.Pixels16()[y*img.Stride/2 : y*img.Stride/2+rowSamples]
+			out := dst.Pixels[y*dst.Stride:]
+			for i, v := range src {
+				out[i] = uint8((uint32(v)*255 + 32767) / 65535)
+			}
+		default:
+			panic(fmt.Errorf("Unsupported component type conversion %v -> %v", int(img.Type), int(typ)))
+		}
+	}
+	return dst
+}
+
+// asUint8 returns the image with 8-bit components, converting it only if necessary.
+// This is used by the encoders for formats that can only store 8 bits per channel, and by AvgColor.
+func (img *Image) asUint8() *Image {
+	if img.Type == ComponentUint8 {
+		return img
+	}
+	return img.ConvertType(ComponentUint8)
+}
+
+// requireUint8 panics if the image does not have 8-bit components
+func (img *Image) requireUint8(function string) {
+	if img.Type != ComponentUint8 {
+		panic(fmt.Errorf("%v only supports 8-bit images", function))
+	}
+}
+
+// toGrayRGBOrRGBA returns the image in one of the layouts that most file formats store:
+// GRAY, RGB, or straight (not premultiplied) RGBA. The component type is not changed.
+// If the image is already in one of these layouts, then it is returned without a copy.
+func (img *Image) toGrayRGBOrRGBA() *Image {
+	_, _, _, alpha := channelOffsets(img.Format)
+	switch {
+	case img.Format == PixelFormatGRAY || img.Format == PixelFormatRGB:
+		return img
+	case alpha == -1:
+		return img.Convert(PixelFormatRGB)
+	case img.Format == PixelFormatRGBA && !img.Premultiplied:
+		return img
+	case img.Type == ComponentUint16:
+		dst := img.Convert(PixelFormatRGBA)
+		dst.Unpremultiply()
+		return dst
+	}
+	nrgba := img.toNRGBA()
+	return WrapImageStrided(img.Width, img.Height, PixelFormatRGBA, nrgba.Pix, nrgba.Stride)
 }
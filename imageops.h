@@ -7,12 +7,26 @@ extern "C" {
 const int AvgColorMaxChannels = 8;
 
 void AvgColor(void* _src, int _width, int _height, int stride, int _nchan, void* _outChannels);
-void ToGray(void* _src, int _width, int height, int srcStride, int _nchan, int dstStride, void* _out);
-void ToRGB(void* _src, int _width, int height, int srcStride, int _nchan, int dstStride, void* _out);
-void ToRGBA(void* _src, int _width, int height, int srcStride, int _nchan, int dstStride, uint8_t alpha, void* _out);
+
+// The linear light versions of AvgColor, Matte and ToGray (which is ConvertFormat to TJPF_GRAY).
+// alphaChan is the index of the alpha channel, or -1 if there is none, and componentType is 8 or 16 bit.
+void AvgColorLinear(void* _src, int _width, int _height, int stride, int _nchan, int alphaChan, void* _outChannels);
+void MatteLinear(void* src, int width, int height, int srcStride, int format, int isPremultiplied, uint8_t matteR, uint8_t matteG, uint8_t matteB);
+void ToGrayLinear(const void* src, int srcFormat, int srcStride, void* dst, int dstStride, int width, int height, int componentType);
+
+// These must match the ComponentType constants in image.go
+enum ConvertComponentTypes {
+	ConvertComponentUint8   = 0,
+	ConvertComponentUint16  = 1,
+	ConvertComponentFloat32 = 2,
+};
+
+// Convert between any two TurboJPEG pixel formats (TJPF_*). Strides are in bytes.
+void ConvertFormat(const void* src, int srcFormat, int srcStride, void* dst, int dstFormat, int dstStride, int width, int height, int componentType);
+
 void Matte(void* src, int width, int height, int srcStride, int format, int isPremultiplied, uint8_t matteR, uint8_t matteG, uint8_t matteB);
 void Premultiply(void* src, int width, int height, int stride, int format);
-void DrawRect(void* _src, int _width, int _height, int _stride, int _nchan, uint8_t c1, uint8_t c2, uint8_t c3, int x1, int y1, int x2, int y2);
+void Unpremultiply(void* src, int width, int height, int stride, int format);
 
 #ifdef __cplusplus
 }
@@ -0,0 +1,29 @@
+// The channel layout of TurboJPEG pixel formats, shared by the C++ image kernels.
+// This header is C++ only.
+#pragma once
+
+#include <turbojpeg.h>
+
+// The layout of a TurboJPEG pixel format. Offsets of -1 mean that the channel is not present.
+// x is the offset of the padding channel of RGBX, XRGB, etc.
+struct FormatLayout {
+	int nchan, r, g, b, a, x;
+};
+
+static FormatLayout GetFormatLayout(int format) {
+	switch (format) {
+	case TJPF_RGB: return {3, 0, 1, 2, -1, -1};
+	case TJPF_BGR: return {3, 2, 1, 0, -1, -1};
+	case TJPF_RGBX: return {4, 0, 1, 2, -1, 3};
+	case TJPF_BGRX: return {4, 2, 1, 0, -1, 3};
+	case TJPF_XBGR: return {4, 3, 2, 1, -1, 0};
+	case TJPF_XRGB: return {4, 1, 2, 3, -1, 0};
+	case TJPF_GRAY: return {1, 0, 0, 0, -1, -1};
+	case TJPF_RGBA: return {4, 0, 1, 2, 3, -1};
+	case TJPF_BGRA: return {4, 2, 1, 0, 3, -1};
+	case TJPF_ABGR: return {4, 3, 2, 1, 0, -1};
+	case TJPF_ARGB: return {4, 1, 2, 3, 0, -1};
+	case TJPF_CMYK: return {4, -1, -1, -1, -1, -1};
+	}
+	return {0, -1, -1, -1, -1, -1};
+}
@@ -0,0 +1,84 @@
+package cimg
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrImageTooLarge is returned when an image exceeds the DecodeLimits
+var ErrImageTooLarge = errors.New("Image exceeds decode limits")
+
+// DecodeLimits protect against images that would consume an unreasonable amount of memory,
+// such as a tiny malicious file whose header claims that it is 60000 x 60000 pixels.
+// The limits are checked against the image header, before any pixel buffer is allocated.
+// A zero value for any field means no limit.
+type DecodeLimits struct {
+	MaxWidth      int   // Maximum width in pixels
+	MaxHeight     int   // Maximum height in pixels
+	MaxPixels     int64 // Maximum width * height. For an animation, this is the total of all of its frames.
+	MaxInputBytes int   // Maximum size of the encoded image
+}
+
+func (l *DecodeLimits) checkInputSize(size int) error {
+	if l.MaxInputBytes != 0 && size > l.MaxInputBytes {
+		return fmt.Errorf("%w: input size %v bytes exceeds maximum of %v bytes", ErrImageTooLarge, size, l.MaxInputBytes)
+	}
+	return nil
+}
+
+func (l *DecodeLimits) checkDimensions(width, height int) error {
+	if l.MaxWidth != 0 && width > l.MaxWidth {
+		return fmt.Errorf("%w: width %v exceeds maximum of %v", ErrImageTooLarge, width, l.MaxWidth)
+	}
+	if l.MaxHeight != 0 && height > l.MaxHeight {
+		return fmt.Errorf("%w: height %v exceeds maximum of %v", ErrImageTooLarge, height, l.MaxHeight)
+	}
+	if l.MaxPixels != 0 && int64(width)*int64(height) > l.MaxPixels {
+		return fmt.Errorf("%w: %v x %v pixels exceeds maximum of %v pixels", ErrImageTooLarge, width, height, l.MaxPixels)
+	}
+	return nil
+}
+
+// checkFrames checks the number of pixels in an animation with the given number of frames,
+// each of which is a complete canvas. l may be nil.
+func (l *DecodeLimits) checkFrames(width, height, frames int) error {
+	if l != nil && l.MaxPixels != 0 && int64(width)*int64(height)*int64(frames) > l.MaxPixels {
+		return fmt.Errorf("%w: %v frames of %v x %v pixels exceeds maximum of %v pixels", ErrImageTooLarge, frames, width, height, l.MaxPixels)
+	}
+	return nil
+}
+
+// Check verifies that an encoded image is within the limits, by reading only its header
+func (l *DecodeLimits) Check(encoded []byte) error {
+	decoder, err := getDecoder()
+	if err != nil {
+		return err
+	}
+	defer putDecoder(decoder)
+	return decoder.checkLimits(l, encoded)
+}
+
+func (d *Decoder) checkLimits(l *DecodeLimits, encoded []byte) error {
+	if l == nil {
+		return nil
+	}
+	c := detectCodec(encoded)
+	if c == nil {
+		return ErrUnknownFormat
+	}
+	return d.checkLimitsWithCodec(c, l, encoded)
+}
+
+func (d *Decoder) checkLimitsWithCodec(c *Codec, l *DecodeLimits, encoded []byte) error {
+	if l == nil {
+		return nil
+	}
+	if err := l.checkInputSize(len(encoded)); err != nil {
+		return err
+	}
+	cfg, err := d.decodeConfigWithCodec(c, encoded)
+	if err != nil {
+		return err
+	}
+	return l.checkDimensions(cfg.Width, cfg.Height)
+}
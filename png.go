@@ -0,0 +1,154 @@
+package cimg
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"os"
+)
+
+// PNGParams control PNG encoding
+type PNGParams struct {
+	CompressionLevel png.CompressionLevel // The zero value is png.DefaultCompression
+	Paletted         bool                 // Write an 8-bit paletted PNG
+	Palette          color.Palette        // Used with Paletted. If nil, then the image's own colors are used, which fails if there are more than 256 of them.
+	Dither           bool                 // Use Floyd-Steinberg dithering when mapping the image onto Palette
+}
+
+// ErrTooManyColors is returned when a paletted PNG is requested without a palette,
+// and the image has more than 256 distinct colors.
+var ErrTooManyColors = errors.New("Image has more than 256 colors")
+
+// EncodePNG encodes an image as a PNG. params may be nil.
+// Premultiplied images are un-premultiplied, because PNG stores straight alpha.
+// Images without an alpha channel, or whose alpha is 255 everywhere, are written without alpha.
+// 16-bit and float32 images are written as 16-bit PNGs, unless params.Paletted is set.
+func EncodePNG(img *Image, params *PNGParams) ([]byte, error) {
+	buf := bytes.Buffer{}
+	if err := EncodePNGTo(&buf, img, params); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// EncodePNGTo is the same as EncodePNG, but writes the PNG to w
+func EncodePNGTo(w io.Writer, img *Image, params *PNGParams) error {
+	if params == nil {
+		params = &PNGParams{}
+	}
+	if params.Paletted {
+		img = img.asUint8()
+	} else if img.Type == ComponentFloat32 {
+		img = img.ConvertType(ComponentUint16)
+	}
+	var src image.Image
+	switch {
+	case img.Type == ComponentUint16:
+		src16 := img.toGrayRGBOrRGBA()
+		if src16.Format == PixelFormatGRAY {
+			src = &image.Gray16{Pix: src16.toBigEndian16(), Stride: img.Width * 2, Rect: image.Rect(0, 0, img.Width, img.Height)}
+		} else {
+			src = &image.NRGBA64{Pix: src16.Convert(PixelFormatRGBA).toBigEndian16(), Stride: img.Width * 8, Rect: image.Rect(0, 0, img.Width, img.Height)}
+		}
+	case img.Format == PixelFormatGRAY:
+		src = &image.Gray{Pix: img.Pixels, Stride: img.Stride, Rect: image.Rect(0, 0, img.Width, img.Height)}
+	default:
+		src = img.toNRGBA()
+	}
+	if params.Paletted {
+		var err error
+		src, err = toPaletted(src, params)
+		if err != nil {
+			return err
+		}
+	}
+	enc := png.Encoder{CompressionLevel: params.CompressionLevel}
+	return enc.Encode(w, src)
+}
+
+// WritePNG writes the image to a PNG file. params may be nil.
+func (img *Image) WritePNG(filename string, params *PNGParams, perm os.FileMode) error {
+	raw, err := EncodePNG(img, params)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, raw, perm)
+}
+
+// toNRGBA converts any pixel format into a Go NRGBA image, un-premultiplying if necessary.
+// A straight-alpha RGBA image is wrapped without copying.
+func (img *Image) toNRGBA() *image.NRGBA {
+	rect := image.Rect(0, 0, img.Width, img.Height)
+	if img.Format == PixelFormatRGBA && !img.Premultiplied {
+		return &image.NRGBA{Pix: img.Pixels, Stride: img.Stride, Rect: rect}
+	}
+	src := img
+	if img.Format == PixelFormatCMYK {
+		src = img.Convert(PixelFormatRGB)
+	}
+	dst := image.NewNRGBA(rect)
+	sr, sg, sb, sa := channelOffsets(src.Format)
+	nchan := src.NChan()
+	for y := 0; y < src.Height; y++ {
+		in := src.Pixels[y*src.Stride : y*src.Stride+src.Width*nchan]
+		out := dst.Pix[y*dst.Stride : y*dst.Stride+src.Width*4]
+		for x := 0; x < src.Width; x++ {
+			s := in[x*nchan : x*nchan+nchan]
+			d := out[x*4 : x*4+4]
+			d[0], d[1], d[2], d[3] = s[sr], s[sg], s[sb], 255
+			if sa != -1 {
+				d[3] = s[sa]
+				if src.Premultiplied {
+					d[0] = unpremultiplyChannel(d[0], d[3])
+					d[1] = unpremultiplyChannel(d[1], d[3])
+					d[2] = unpremultiplyChannel(d[2], d[3])
+				}
+			}
+		}
+	}
+	return dst
+}
+
+func unpremultiplyChannel(c, a uint8) uint8 {
+	if a == 0 {
+		return 0
+	}
+	return uint8(min((uint32(c)*255+uint32(a)/2)/uint32(a), 255))
+}
+
+// toPaletted maps an image onto params.Palette, or onto its own colors if there is no palette
+func toPaletted(src image.Image, params *PNGParams) (*image.Paletted, error) {
+	bounds := src.Bounds()
+	if params.Palette != nil {
+		dst := image.NewPaletted(bounds, params.Palette)
+		if params.Dither {
+			draw.FloydSteinberg.Draw(dst, bounds, src, image.Point{})
+		} else {
+			draw.Draw(dst, bounds, src, image.Point{}, draw.Src)
+		}
+		return dst, nil
+	}
+
+	dst := image.NewPaletted(bounds, nil)
+	index := map[color.NRGBA]uint8{}
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.NRGBAModel.Convert(src.At(x, y)).(color.NRGBA)
+			i, ok := index[c]
+			if !ok {
+				if len(dst.Palette) == 256 {
+					return nil, ErrTooManyColors
+				}
+				i = uint8(len(dst.Palette))
+				index[c] = i
+				dst.Palette = append(dst.Palette, c)
+			}
+			dst.SetColorIndex(x, y, i)
+		}
+	}
+	return dst, nil
+}
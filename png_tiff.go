@@ -3,22 +3,53 @@ package cimg
 import (
 	"bytes"
 	"image/png"
+	"io"
 
 	"golang.org/x/image/tiff"
 )
 
-func decompressPNG(encoded []byte) (*Image, error) {
-	img, err := png.Decode(bytes.NewReader(encoded))
+func decompressPNG(encoded []byte, params *DecompressParams) (*Image, error) {
+	return decodePNG(bytes.NewReader(encoded), params)
+}
+
+func decodePNG(r io.Reader, params *DecompressParams) (*Image, error) {
+	img, err := png.Decode(r)
 	if err != nil {
 		return nil, err
 	}
-	return FromImage(img, true)
+	dst, err := FromImage(img, true)
+	if err != nil {
+		return nil, err
+	}
+	return applyDecompressFormat(dst, params), nil
+}
+
+func decompressTIFF(encoded []byte, params *DecompressParams) (*Image, error) {
+	if r, ok := newTIFFReader(encoded); ok {
+		return decodeTIFFIFD(r, r.firstIFD(), params)
+	}
+	return decodeTIFF(bytes.NewReader(encoded), params)
 }
 
-func decompressTIFF(encoded []byte) (*Image, error) {
-	img, err := tiff.Decode(bytes.NewReader(encoded))
+// decodeTIFF decodes the first page of a TIFF file.
+// r should implement io.ReaderAt, otherwise the TIFF decoder reads all of r into memory.
+func decodeTIFF(r io.Reader, params *DecompressParams) (*Image, error) {
+	img, err := tiff.Decode(r)
+	if err != nil {
+		return nil, err
+	}
+	dst, err := FromImage(img, true)
 	if err != nil {
 		return nil, err
 	}
-	return FromImage(img, true)
+	return applyDecompressFormat(dst, params), nil
+}
+
+// Convert a decoded image to the pixel format requested in params (if any)
+func applyDecompressFormat(img *Image, params *DecompressParams) *Image {
+	format := params.outFormat()
+	if format == PixelFormatUNKNOWN || format == img.Format {
+		return img
+	}
+	return img.Convert(format)
 }
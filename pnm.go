@@ -0,0 +1,294 @@
+package cimg
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// Netpbm formats: PBM (P1, P4), PGM (P2, P5), PPM (P3, P6), and PAM (P7).
+// Bitmaps and gray images decode to GRAY, color images to RGB, and images with alpha to RGBA.
+// Samples with a maxval other than 255 are scaled to 8 bits.
+
+// pnmMaxPixels keeps the size of the pixel data well within the range of an int
+const pnmMaxPixels = 400000000
+
+type pnmHeader struct {
+	magic  byte // '1' .. '7'
+	width  int
+	height int
+	depth  int // Number of channels in the file
+	maxval int
+	alpha  bool
+	offset int // Start of the pixel data
+}
+
+func isPNM(encoded []byte) bool {
+	return len(encoded) > 3 && encoded[0] == 'P' && encoded[1] >= '1' && encoded[1] <= '7' && isPNMSpace(encoded[2])
+}
+
+func isPNMSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\v' || c == '\f'
+}
+
+// pnmSkip skips whitespace and comments
+func pnmSkip(encoded []byte, p *int) {
+	for *p < len(encoded) {
+		if encoded[*p] == '#' {
+			for *p < len(encoded) && encoded[*p] != '\n' {
+				*p++
+			}
+		} else if isPNMSpace(encoded[*p]) {
+			*p++
+		} else {
+			break
+		}
+	}
+}
+
+// pnmToken returns the next whitespace-delimited token, skipping comments
+func pnmToken(encoded []byte, p *int) (string, error) {
+	pnmSkip(encoded, p)
+	start := *p
+	for *p < len(encoded) && !isPNMSpace(encoded[*p]) && encoded[*p] != '#' {
+		*p++
+	}
+	if start == *p {
+		return "", errors.New("Truncated PNM header")
+	}
+	return string(encoded[start:*p]), nil
+}
+
+func pnmInt(encoded []byte, p *int) (int, error) {
+	tok, err := pnmToken(encoded, p)
+	if err != nil {
+		return 0, err
+	}
+	v, err := strconv.Atoi(tok)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("Invalid PNM header value '%v'", tok)
+	}
+	return v, nil
+}
+
+func parsePNMHeader(encoded []byte) (*pnmHeader, error) {
+	if !isPNM(encoded) {
+		return nil, errors.New("Not a PNM file")
+	}
+	h := &pnmHeader{magic: encoded[1], maxval: 1, depth: 1}
+	p := 2
+	var err error
+	if h.magic == '7' {
+		// PAM has a line-based header
+		for {
+			key, err := pnmToken(encoded, &p)
+			if err != nil {
+				return nil, err
+			}
+			if key == "ENDHDR" {
+				break
+			}
+			if key == "TUPLTYPE" {
+				// We infer the tuple type from DEPTH
+				if _, err := pnmToken(encoded, &p); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			v, err := pnmInt(encoded, &p)
+			if err != nil {
+				return nil, err
+			}
+			switch key {
+			case "WIDTH":
+				h.width = v
+			case "HEIGHT":
+				h.height = v
+			case "DEPTH":
+				h.depth = v
+			case "MAXVAL":
+				h.maxval = v
+			}
+		}
+		if h.depth < 1 || h.depth > 4 {
+			return nil, fmt.Errorf("Unsupported PAM depth %v", h.depth)
+		}
+		h.alpha = h.depth == 2 || h.depth == 4
+	} else {
+		if h.width, err = pnmInt(encoded, &p); err != nil {
+			return nil, err
+		}
+		if h.height, err = pnmInt(encoded, &p); err != nil {
+			return nil, err
+		}
+		if h.magic != '1' && h.magic != '4' {
+			if h.maxval, err = pnmInt(encoded, &p); err != nil {
+				return nil, err
+			}
+		}
+		if h.magic == '3' || h.magic == '6' {
+			h.depth = 3
+		}
+	}
+	if p >= len(encoded) {
+		return nil, errors.New("Truncated PNM file")
+	}
+	// Exactly one whitespace character separates the header from binary data
+	h.offset = p + 1
+	if h.width <= 0 || h.height <= 0 || h.height >= pnmMaxPixels/h.width {
+		return nil, fmt.Errorf("Invalid PNM dimensions %v x %v", h.width, h.height)
+	}
+	if h.maxval < 1 || h.maxval > 65535 {
+		return nil, fmt.Errorf("Invalid PNM maxval %v", h.maxval)
+	}
+	return h, nil
+}
+
+func (h *pnmHeader) pixelFormat() PixelFormat {
+	switch {
+	case h.alpha:
+		return PixelFormatRGBA
+	case h.depth == 1:
+		return PixelFormatGRAY
+	}
+	return PixelFormatRGB
+}
+
+func decodeConfigPNM(encoded []byte) (ImageConfig, error) {
+	h, err := parsePNMHeader(encoded)
+	if err != nil {
+		return ImageConfig{}, err
+	}
+	cfg := ImageConfig{
+		Format:     FormatPNM,
+		Width:      h.width,
+		Height:     h.height,
+		NChan:      h.depth,
+		BitDepth:   8,
+		Sampling:   SamplingUnknown,
+		Colorspace: ColorspaceRGB,
+	}
+	switch {
+	case h.maxval == 1:
+		cfg.BitDepth = 1
+	case h.maxval > 255:
+		cfg.BitDepth = 16
+	}
+	if h.depth <= 2 {
+		cfg.Colorspace = ColorspaceGray
+	}
+	return cfg, nil
+}
+
+func decompressPNM(encoded []byte, params *DecompressParams) (*Image, error) {
+	h, err := parsePNMHeader(encoded)
+	if err != nil {
+		return nil, err
+	}
+	p := h.offset
+	n := h.width * h.height * h.depth
+	bytesPerSample := 1
+	if h.maxval > 255 {
+		bytesPerSample = 2
+	}
+	rowBytes := (h.width + 7) / 8
+
+	// Make sure that the file is big enough before allocating the image. ASCII samples take at least one byte.
+	switch {
+	case h.magic == '4' && len(encoded)-p < rowBytes*h.height,
+		h.magic >= '5' && len(encoded)-p < n*bytesPerSample,
+		h.magic <= '3' && len(encoded)-p+1 < n:
+		return nil, errors.New("Truncated PNM file")
+	}
+
+	img := NewImage(h.width, h.height, h.pixelFormat())
+	nchan := img.NChan()
+
+	// Read all of the samples in the file, in order, and place them into the image
+	switch h.magic {
+	case '4':
+		// Packed bitmap. 1 is black.
+		for y := 0; y < h.height; y++ {
+			row := encoded[p+y*rowBytes:]
+			out := img.Pixels[y*img.Stride:]
+			for x := 0; x < h.width; x++ {
+				if row[x>>3]&(0x80>>(x&7)) == 0 {
+					out[x] = 255
+				}
+			}
+		}
+	case '1', '2', '3':
+		// ASCII
+		p--
+		for i := 0; i < n; i++ {
+			var v int
+			if h.magic == '1' {
+				// Bitmap digits need not be separated by whitespace
+				pnmSkip(encoded, &p)
+				if p >= len(encoded) || (encoded[p] != '0' && encoded[p] != '1') {
+					return nil, errors.New("Truncated PBM file")
+				}
+				v = 1 - int(encoded[p]-'0')
+				p++
+			} else if v, err = pnmInt(encoded, &p); err != nil {
+				return nil, err
+			}
+			img.Pixels[i] = pnmScale(v, h.maxval)
+		}
+	default:
+		// Binary, 1 or 2 bytes per sample
+		src := encoded[p:]
+		if bytesPerSample == 1 && h.maxval == 255 {
+			copy(img.Pixels, src[:n])
+		} else {
+			for i := 0; i < n; i++ {
+				v := int(src[i])
+				if bytesPerSample == 2 {
+					v = int(src[2*i])<<8 | int(src[2*i+1])
+				}
+				img.Pixels[i] = pnmScale(v, h.maxval)
+			}
+		}
+	}
+
+	if h.depth == 2 {
+		// Expand GRAYSCALE_ALPHA into RGBA, from the back so that we can do it in place
+		for i := h.width*h.height - 1; i >= 0; i-- {
+			g, a := img.Pixels[i*2], img.Pixels[i*2+1]
+			d := img.Pixels[i*nchan:]
+			d[0], d[1], d[2], d[3] = g, g, g, a
+		}
+	}
+	return applyDecompressFormat(img, params), nil
+}
+
+func pnmScale(v, maxval int) byte {
+	if maxval == 255 {
+		return byte(min(v, 255))
+	}
+	return byte((min(v, maxval)*255 + maxval/2) / maxval)
+}
+
+// EncodePNM writes an image as a binary PGM (P5) if it is GRAY, a PAM (P7) with
+// TUPLTYPE RGB_ALPHA if it has an alpha channel, and otherwise as a binary PPM (P6).
+func EncodePNM(w io.Writer, img *Image) error {
+	src := img.asUint8().toGrayRGBOrRGBA()
+	bw := bufio.NewWriter(w)
+	switch src.Format {
+	case PixelFormatGRAY:
+		fmt.Fprintf(bw, "P5\n%v %v\n255\n", src.Width, src.Height)
+	case PixelFormatRGB:
+		fmt.Fprintf(bw, "P6\n%v %v\n255\n", src.Width, src.Height)
+	default:
+		fmt.Fprintf(bw, "P7\nWIDTH %v\nHEIGHT %v\nDEPTH 4\nMAXVAL 255\nTUPLTYPE RGB_ALPHA\nENDHDR\n", src.Width, src.Height)
+	}
+	rowBytes := src.Width * src.NChan()
+	for y := 0; y < src.Height; y++ {
+		if _, err := bw.Write(src.Pixels[y*src.Stride : y*src.Stride+rowBytes]); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,55 @@
+package cimg
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPNM(t *testing.T) {
+	org := MakeRGBA(61, 43)
+	AddAlphaNoise(org)
+	for _, img := range []*Image{org.Convert(PixelFormatGRAY), org.Convert(PixelFormatRGB), org} {
+		buf := bytes.Buffer{}
+		require.Nil(t, EncodePNM(&buf, img))
+		cfg, err := DecodeConfig(buf.Bytes())
+		require.Nil(t, err)
+		require.Equal(t, FormatPNM, cfg.Format)
+		require.Equal(t, img.NChan(), cfg.NChan)
+		dec, err := Decompress(buf.Bytes())
+		require.Nil(t, err)
+		require.Equal(t, img.Format, dec.Format)
+		require.Equal(t, img.Pixels, dec.Pixels, "%v", img.Format)
+	}
+
+	cases := []struct {
+		encoded string
+		format  PixelFormat
+		pixels  []byte
+	}{
+		{"P1\n# comment\n3 2\n0 1 0\n101", PixelFormatGRAY, []byte{255, 0, 255, 0, 255, 0}},
+		{"P4 3 2\n\x40\xa0", PixelFormatGRAY, []byte{255, 0, 255, 0, 255, 0}},
+		{"P2 2 1 4\n0 4", PixelFormatGRAY, []byte{0, 255}},
+		{"P3 1 1 255 10 20 30", PixelFormatRGB, []byte{10, 20, 30}},
+		{"P5 2 1 65535\n\xff\xff\x80\x00", PixelFormatGRAY, []byte{255, 128}},
+		{"P7\nWIDTH 1\nHEIGHT 1\nDEPTH 2\nMAXVAL 255\nTUPLTYPE GRAYSCALE_ALPHA\nENDHDR\n\x40\x80", PixelFormatRGBA, []byte{64, 64, 64, 128}},
+	}
+	for _, c := range cases {
+		dec, err := Decompress([]byte(c.encoded))
+		require.Nil(t, err, c.encoded)
+		require.Equal(t, c.format, dec.Format, c.encoded)
+		require.Equal(t, c.pixels, dec.Pixels, c.encoded)
+	}
+
+	_, err := Decompress([]byte("P6 100 100 255\n\x00\x00\x00"))
+	require.NotNil(t, err)
+
+	// Dimensions that would overflow the size of the pixel data
+	for _, encoded := range []string{"P5\n3037000500 3037000500\n255\nxxxx", "P6\n3037000500 3037000500\n255\nxxxx", "P4 9223372036854775807 2\nxxxx"} {
+		_, err = Decompress([]byte(encoded))
+		require.NotNil(t, err, encoded)
+		_, err = DecodeConfig([]byte(encoded))
+		require.NotNil(t, err, encoded)
+	}
+}
@@ -0,0 +1,208 @@
+package cimg
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// QOI, the "Quite OK Image" format (https://qoiformat.org), is a simple lossless format that
+// is much faster to encode and decode than PNG, at a similar size.
+
+const (
+	qoiOpIndex = 0x00 // 00xxxxxx
+	qoiOpDiff  = 0x40 // 01xxxxxx
+	qoiOpLuma  = 0x80 // 10xxxxxx
+	qoiOpRun   = 0xc0 // 11xxxxxx
+	qoiOpRGB   = 0xfe
+	qoiOpRGBA  = 0xff
+	qoiMask2   = 0xc0
+
+	qoiHeaderSize = 14
+	qoiMaxPixels  = 400000000
+)
+
+var qoiPadding = []byte{0, 0, 0, 0, 0, 0, 0, 1}
+
+func isQOI(encoded []byte) bool {
+	return len(encoded) >= qoiHeaderSize && string(encoded[:4]) == "qoif"
+}
+
+func qoiHash(r, g, b, a byte) byte {
+	return (r*3 + g*5 + b*7 + a*11) & 63
+}
+
+type qoiHeader struct {
+	width    int
+	height   int
+	channels int
+}
+
+func parseQOIHeader(encoded []byte) (qoiHeader, error) {
+	if !isQOI(encoded) {
+		return qoiHeader{}, errors.New("Not a QOI file")
+	}
+	h := qoiHeader{
+		width:    int(binary.BigEndian.Uint32(encoded[4:])),
+		height:   int(binary.BigEndian.Uint32(encoded[8:])),
+		channels: int(encoded[12]),
+	}
+	if h.width == 0 || h.height == 0 || h.height >= qoiMaxPixels/h.width {
+		return qoiHeader{}, fmt.Errorf("Invalid QOI dimensions %v x %v", h.width, h.height)
+	}
+	if h.channels != 3 && h.channels != 4 {
+		return qoiHeader{}, fmt.Errorf("Invalid QOI channel count %v", h.channels)
+	}
+	return h, nil
+}
+
+func decodeConfigQOI(encoded []byte) (ImageConfig, error) {
+	h, err := parseQOIHeader(encoded)
+	if err != nil {
+		return ImageConfig{}, err
+	}
+	return ImageConfig{
+		Format:     FormatQOI,
+		Width:      h.width,
+		Height:     h.height,
+		NChan:      h.channels,
+		BitDepth:   8,
+		Sampling:   SamplingUnknown,
+		Colorspace: ColorspaceRGB,
+	}, nil
+}
+
+// decompressQOI decodes a QOI image into RGB or RGBA, depending on the channel count in the header
+func decompressQOI(encoded []byte, params *DecompressParams) (*Image, error) {
+	h, err := parseQOIHeader(encoded)
+	if err != nil {
+		return nil, err
+	}
+	// A single run op covers at most 62 pixels, so a small file can't be a huge image
+	if (len(encoded)-qoiHeaderSize)*62 < h.width*h.height {
+		return nil, errors.New("Truncated QOI file")
+	}
+	format := PixelFormatRGB
+	if h.channels == 4 {
+		format = PixelFormatRGBA
+	}
+	img := NewImage(h.width, h.height, format)
+
+	var index [64][4]byte
+	px := [4]byte{0, 0, 0, 255}
+	p := qoiHeaderSize
+	end := len(encoded) - len(qoiPadding)
+	run := 0
+	for y := 0; y < h.height; y++ {
+		row := img.Pixels[y*img.Stride : y*img.Stride+h.width*h.channels]
+		for x := 0; x < len(row); x += h.channels {
+			if run > 0 {
+				run--
+			} else if p < end {
+				b1 := encoded[p]
+				p++
+				switch {
+				case b1 == qoiOpRGB:
+					px[0], px[1], px[2] = encoded[p], encoded[p+1], encoded[p+2]
+					p += 3
+				case b1 == qoiOpRGBA:
+					px[0], px[1], px[2], px[3] = encoded[p], encoded[p+1], encoded[p+2], encoded[p+3]
+					p += 4
+				case b1&qoiMask2 == qoiOpIndex:
+					px = index[b1]
+				case b1&qoiMask2 == qoiOpDiff:
+					px[0] += (b1>>4)&3 - 2
+					px[1] += (b1>>2)&3 - 2
+					px[2] += b1&3 - 2
+				case b1&qoiMask2 == qoiOpLuma:
+					b2 := encoded[p]
+					p++
+					vg := b1&0x3f - 32
+					px[0] += vg - 8 + (b2>>4)&0x0f
+					px[1] += vg
+					px[2] += vg - 8 + b2&0x0f
+				case b1&qoiMask2 == qoiOpRun:
+					run = int(b1 & 0x3f)
+				}
+				index[qoiHash(px[0], px[1], px[2], px[3])] = px
+			} else {
+				return nil, errors.New("Truncated QOI file")
+			}
+			copy(row[x:x+h.channels], px[:])
+		}
+	}
+	return applyDecompressFormat(img, params), nil
+}
+
+// EncodeQOI writes an image as a QOI.
+// RGB and RGBA images are encoded directly from their pixels. GRAY images are written as RGB,
+// other formats are converted to RGB or RGBA, and premultiplied alpha is undone first.
+func EncodeQOI(w io.Writer, img *Image) error {
+	src := img.asUint8().toGrayRGBOrRGBA()
+	if src.Format == PixelFormatGRAY {
+		src = src.Convert(PixelFormatRGB)
+	}
+	if src.Height >= qoiMaxPixels/src.Width {
+		return errors.New("Image is too large for QOI")
+	}
+	nchan := src.NChan()
+
+	out := make([]byte, 0, qoiHeaderSize+src.Width*src.Height*(nchan+1)+len(qoiPadding))
+	out = append(out, "qoif"...)
+	out = binary.BigEndian.AppendUint32(out, uint32(src.Width))
+	out = binary.BigEndian.AppendUint32(out, uint32(src.Height))
+	out = append(out, byte(nchan), 0) // colorspace 0 is sRGB, with linear alpha
+
+	var index [64][4]byte
+	prev := [4]byte{0, 0, 0, 255}
+	px := prev
+	run := 0
+	for y := 0; y < src.Height; y++ {
+		row := src.Pixels[y*src.Stride : y*src.Stride+src.Width*nchan]
+		for x := 0; x < len(row); x += nchan {
+			copy(px[:], row[x:x+nchan])
+			if px == prev {
+				run++
+				if run == 62 {
+					out = append(out, qoiOpRun|byte(run-1))
+					run = 0
+				}
+				continue
+			}
+			if run > 0 {
+				out = append(out, qoiOpRun|byte(run-1))
+				run = 0
+			}
+			h := qoiHash(px[0], px[1], px[2], px[3])
+			switch {
+			case index[h] == px:
+				out = append(out, qoiOpIndex|h)
+			case px[3] != prev[3]:
+				out = append(out, qoiOpRGBA, px[0], px[1], px[2], px[3])
+			default:
+				vr := int8(px[0] - prev[0])
+				vg := int8(px[1] - prev[1])
+				vb := int8(px[2] - prev[2])
+				vgr := vr - vg
+				vgb := vb - vg
+				switch {
+				case vr > -3 && vr < 2 && vg > -3 && vg < 2 && vb > -3 && vb < 2:
+					out = append(out, qoiOpDiff|byte(vr+2)<<4|byte(vg+2)<<2|byte(vb+2))
+				case vgr > -9 && vgr < 8 && vg > -33 && vg < 32 && vgb > -9 && vgb < 8:
+					out = append(out, qoiOpLuma|byte(vg+32), byte(vgr+8)<<4|byte(vgb+8))
+				default:
+					out = append(out, qoiOpRGB, px[0], px[1], px[2])
+				}
+			}
+			index[h] = px
+			prev = px
+		}
+	}
+	if run > 0 {
+		out = append(out, qoiOpRun|byte(run-1))
+	}
+	out = append(out, qoiPadding...)
+	_, err := w.Write(out)
+	return err
+}
@@ -0,0 +1,45 @@
+package cimg
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestQOI(t *testing.T) {
+	org := MakeRGBA(61, 43)
+	AddAlphaNoise(org)
+	noise := NewImage(300, 200, PixelFormatRGBA)
+	rand.New(rand.NewSource(1)).Read(noise.Pixels)
+	// Long runs, and a stride that is wider than the image
+	flat := NewImage(200, 100, PixelFormatRGB)
+	flat.Stride += 5
+	flat.Pixels = make([]byte, flat.Stride*flat.Height)
+	for y := 50; y < 100; y++ {
+		for x := 0; x < 200; x++ {
+			copy(flat.Pixels[flat.PixelByte(x, y):], []byte{10, 20, 30})
+		}
+	}
+
+	for _, img := range []*Image{org, org.Convert(PixelFormatRGB), org.Convert(PixelFormatBGRA), noise, flat} {
+		buf := bytes.Buffer{}
+		require.Nil(t, EncodeQOI(&buf, img))
+		cfg, err := DecodeConfig(buf.Bytes())
+		require.Nil(t, err)
+		require.Equal(t, FormatQOI, cfg.Format)
+		require.Equal(t, img.NChan(), cfg.NChan)
+		dec, err := DecompressWithOptions(buf.Bytes(), &DecompressParams{Format: img.Format, HasFormat: true})
+		require.Nil(t, err)
+		require.Equal(t, img.Width, dec.Width)
+		for y := 0; y < img.Height; y++ {
+			require.Equal(t, img.Pixels[y*img.Stride:y*img.Stride+img.Width*img.NChan()], dec.Pixels[y*dec.Stride:y*dec.Stride+dec.Width*dec.NChan()])
+		}
+		if img == flat {
+			require.Less(t, buf.Len(), 1000)
+		}
+		_, err = Decompress(buf.Bytes()[:buf.Len()/2])
+		require.NotNil(t, err)
+	}
+}
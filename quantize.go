@@ -0,0 +1,178 @@
+package cimg
+
+import (
+	"image/color"
+	"sort"
+)
+
+// quantize maps an RGB or straight-alpha RGBA image onto a palette of at most 256 colors,
+// and returns the palette and one palette index per pixel (with a stride of img.Width).
+// Pixels with alpha below 128 become a single fully transparent palette entry.
+// If the image has 256 or fewer distinct colors, then they are reproduced exactly.
+// Otherwise the palette is chosen by median cut, over colors reduced to 5 bits per channel.
+func quantize(img *Image) (color.Palette, []byte) {
+	nchan := img.NChan()
+	indices := make([]byte, img.Width*img.Height)
+	if pal, ok := quantizeExact(img, indices); ok {
+		return pal, indices
+	}
+
+	// Build a histogram of 5-bit colors, with the sum of the 8-bit colors in each bin, so that
+	// the final palette entries are accurate averages.
+	type bin struct {
+		count      uint32
+		r, g, b    uint64
+		key        uint16
+		rq, gq, bq uint8
+	}
+	bins := make([]bin, 32768)
+	transparent := false
+	for y := 0; y < img.Height; y++ {
+		row := img.Pixels[y*img.Stride:]
+		for x := 0; x < img.Width; x++ {
+			p := row[x*nchan:]
+			if nchan == 4 && p[3] < 128 {
+				transparent = true
+				continue
+			}
+			key := uint16(p[0]>>3)<<10 | uint16(p[1]>>3)<<5 | uint16(p[2]>>3)
+			b := &bins[key]
+			b.count++
+			b.r += uint64(p[0])
+			b.g += uint64(p[1])
+			b.b += uint64(p[2])
+		}
+	}
+	used := []*bin{}
+	for i := range bins {
+		if bins[i].count != 0 {
+			b := &bins[i]
+			b.key = uint16(i)
+			b.rq, b.gq, b.bq = uint8(i>>10), uint8(i>>5)&31, uint8(i)&31
+			used = append(used, b)
+		}
+	}
+
+	maxColors := 256
+	if transparent {
+		maxColors = 255
+	}
+
+	// Median cut. Repeatedly split the box with the widest range of any channel.
+	channel := func(b *bin, c int) uint8 {
+		switch c {
+		case 0:
+			return b.rq
+		case 1:
+			return b.gq
+		}
+		return b.bq
+	}
+	widest := func(box []*bin) (c int, rng uint8) {
+		for ch := 0; ch < 3; ch++ {
+			lo, hi := uint8(255), uint8(0)
+			for _, b := range box {
+				v := channel(b, ch)
+				lo = min(lo, v)
+				hi = max(hi, v)
+			}
+			if hi-lo >= rng {
+				c, rng = ch, hi-lo
+			}
+		}
+		return
+	}
+	boxes := [][]*bin{used}
+	for len(boxes) < maxColors {
+		best, bestCh, bestRange := -1, 0, uint8(0)
+		for i, box := range boxes {
+			if len(box) < 2 {
+				continue
+			}
+			if ch, rng := widest(box); best == -1 || rng > bestRange {
+				best, bestCh, bestRange = i, ch, rng
+			}
+		}
+		if best == -1 {
+			break
+		}
+		box := boxes[best]
+		sort.Slice(box, func(i, j int) bool { return channel(box[i], bestCh) < channel(box[j], bestCh) })
+		total := uint64(0)
+		for _, b := range box {
+			total += uint64(b.count)
+		}
+		// Split at the median pixel, but leave at least one bin on each side
+		split, acc := 1, uint64(0)
+		for i, b := range box[:len(box)-1] {
+			acc += uint64(b.count)
+			split = i + 1
+			if acc*2 >= total {
+				break
+			}
+		}
+		boxes[best] = box[:split]
+		boxes = append(boxes, box[split:])
+	}
+
+	pal := make(color.Palette, 0, maxColors+1)
+	lookup := make([]byte, 32768)
+	for i, box := range boxes {
+		var n, r, g, b uint64
+		for _, bn := range box {
+			n += uint64(bn.count)
+			r += bn.r
+			g += bn.g
+			b += bn.b
+			lookup[bn.key] = byte(i)
+		}
+		pal = append(pal, color.RGBA{uint8((r + n/2) / n), uint8((g + n/2) / n), uint8((b + n/2) / n), 255})
+	}
+	transparentIndex := byte(len(pal))
+	if transparent {
+		pal = append(pal, color.RGBA{})
+	}
+
+	for y := 0; y < img.Height; y++ {
+		row := img.Pixels[y*img.Stride:]
+		out := indices[y*img.Width:]
+		for x := 0; x < img.Width; x++ {
+			p := row[x*nchan:]
+			if nchan == 4 && p[3] < 128 {
+				out[x] = transparentIndex
+			} else {
+				out[x] = lookup[uint16(p[0]>>3)<<10|uint16(p[1]>>3)<<5|uint16(p[2]>>3)]
+			}
+		}
+	}
+	return pal, indices
+}
+
+// quantizeExact builds a palette of the image's own colors, and fails if there are more than 256
+func quantizeExact(img *Image, indices []byte) (color.Palette, bool) {
+	nchan := img.NChan()
+	index := map[uint32]byte{}
+	pal := color.Palette{}
+	for y := 0; y < img.Height; y++ {
+		row := img.Pixels[y*img.Stride:]
+		out := indices[y*img.Width:]
+		for x := 0; x < img.Width; x++ {
+			p := row[x*nchan:]
+			key := uint32(0) // transparent
+			if nchan == 3 || p[3] >= 128 {
+				key = 0xff000000 | uint32(p[0])<<16 | uint32(p[1])<<8 | uint32(p[2])
+			}
+			i, ok := index[key]
+			if !ok {
+				if len(pal) == 256 {
+					return nil, false
+				}
+				i = byte(len(pal))
+				index[key] = i
+				pal = append(pal, color.RGBA{uint8(key >> 16), uint8(key >> 8), uint8(key), uint8(key >> 24)})
+			}
+			out[x] = i
+		}
+	}
+	return pal, true
+}
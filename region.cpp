@@ -0,0 +1,127 @@
+#include <stdio.h>
+#include <stdlib.h>
+#include <stdint.h>
+#include <string.h>
+#include <setjmp.h>
+#include <jpeglib.h>
+#include <turbojpeg.h>
+#include "region.h"
+
+// This uses the libjpeg API directly, because the TurboJPEG 2.x API has no partial decoding.
+// jpeg_crop_scanline and jpeg_skip_scanlines are libjpeg-turbo extensions.
+
+struct RegionErrorMgr {
+	jpeg_error_mgr pub;
+	jmp_buf        jump;
+	char*          errBuf;
+	int            errBufSize;
+};
+
+static void RegionErrorExit(j_common_ptr cinfo) {
+	RegionErrorMgr* err = (RegionErrorMgr*) cinfo->err;
+	char            msg[JMSG_LENGTH_MAX];
+	(*cinfo->err->format_message)(cinfo, msg);
+	snprintf(err->errBuf, err->errBufSize, "libjpeg error: %s", msg);
+	longjmp(err->jump, 1);
+}
+
+static void RegionOutputMessage(j_common_ptr cinfo) {
+	// Swallow warnings
+}
+
+static J_COLOR_SPACE PixelFormatToColorSpace(int pf) {
+	switch (pf) {
+	case TJPF_RGB: return JCS_EXT_RGB;
+	case TJPF_BGR: return JCS_EXT_BGR;
+	case TJPF_RGBX: return JCS_EXT_RGBX;
+	case TJPF_BGRX: return JCS_EXT_BGRX;
+	case TJPF_XBGR: return JCS_EXT_XBGR;
+	case TJPF_XRGB: return JCS_EXT_XRGB;
+	case TJPF_GRAY: return JCS_GRAYSCALE;
+	case TJPF_RGBA: return JCS_EXT_RGBA;
+	case TJPF_BGRA: return JCS_EXT_BGRA;
+	case TJPF_ABGR: return JCS_EXT_ABGR;
+	case TJPF_ARGB: return JCS_EXT_ARGB;
+	case TJPF_CMYK: return JCS_CMYK;
+	}
+	return JCS_UNKNOWN;
+}
+
+extern "C" {
+
+int DecompressRegion(const void* jpeg, size_t jpegSize, int scaleNum, int scaleDenom, int pixelFormat, int flags,
+                     int x, int y, int width, int height, void* dst, int dstStride, char* errBuf, int errBufSize) {
+	jpeg_decompress_struct cinfo;
+	RegionErrorMgr         err;
+	// row is volatile, so that its value is still valid after longjmp
+	JSAMPLE* volatile row = nullptr;
+
+	J_COLOR_SPACE colorSpace = PixelFormatToColorSpace(pixelFormat);
+	if (colorSpace == JCS_UNKNOWN) {
+		snprintf(errBuf, errBufSize, "Unsupported pixel format %d", pixelFormat);
+		return -1;
+	}
+
+	cinfo.err              = jpeg_std_error(&err.pub);
+	err.pub.error_exit     = RegionErrorExit;
+	err.pub.output_message = RegionOutputMessage;
+	err.errBuf             = errBuf;
+	err.errBufSize         = errBufSize;
+	if (setjmp(err.jump)) {
+		jpeg_destroy_decompress(&cinfo);
+		free(row);
+		return -1;
+	}
+
+	jpeg_create_decompress(&cinfo);
+	jpeg_mem_src(&cinfo, (const unsigned char*) jpeg, (unsigned long) jpegSize);
+	jpeg_read_header(&cinfo, TRUE);
+	cinfo.scale_num       = scaleNum;
+	cinfo.scale_denom     = scaleDenom;
+	cinfo.out_color_space = colorSpace;
+	if (flags & TJFLAG_FASTUPSAMPLE)
+		cinfo.do_fancy_upsampling = FALSE;
+	if (flags & TJFLAG_FASTDCT)
+		cinfo.dct_method = JDCT_FASTEST;
+	if (flags & TJFLAG_ACCURATEDCT)
+		cinfo.dct_method = JDCT_ISLOW;
+	jpeg_start_decompress(&cinfo);
+
+	if (x < 0 || y < 0 || width <= 0 || height <= 0 || (JDIMENSION) (x + width) > cinfo.output_width || (JDIMENSION) (y + height) > cinfo.output_height) {
+		snprintf(errBuf, errBufSize, "Region (%d,%d,%d,%d) is outside of the %ux%u image", x, y, width, height, cinfo.output_width, cinfo.output_height);
+		jpeg_destroy_decompress(&cinfo);
+		return -1;
+	}
+
+	// jpeg_crop_scanline expands the region to iMCU column boundaries
+	JDIMENSION cropX     = x;
+	JDIMENSION cropWidth = width;
+	if (x != 0 || (JDIMENSION) width != cinfo.output_width)
+		jpeg_crop_scanline(&cinfo, &cropX, &cropWidth);
+
+	int    nchan    = cinfo.output_components;
+	size_t rowBytes = (size_t) width * nchan;
+	size_t skipX    = (size_t) (x - cropX) * nchan;
+	row             = (JSAMPLE*) malloc((size_t) cropWidth * nchan);
+
+	if (y > 0)
+		jpeg_skip_scanlines(&cinfo, y);
+
+	uint8_t* out = (uint8_t*) dst;
+	if (flags & TJFLAG_BOTTOMUP) {
+		out += (size_t) (height - 1) * dstStride;
+		dstStride = -dstStride;
+	}
+	for (int i = 0; i < height; i++) {
+		JSAMPROW rows[1] = {row};
+		jpeg_read_scanlines(&cinfo, rows, 1);
+		memcpy(out, row + skipX, rowBytes);
+		out += dstStride;
+	}
+
+	// There is no need to read the rest of the image
+	jpeg_destroy_decompress(&cinfo);
+	free(row);
+	return 0;
+}
+}
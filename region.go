@@ -0,0 +1,91 @@
+package cimg
+
+/*
+#cgo LDFLAGS: -ljpeg
+#include "region.h"
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"unsafe"
+)
+
+// DecompressRegion decodes only the pixels inside rect, which is in the coordinates of the original image.
+// For JPEG images, scanlines above and below rect are skipped, and iMCU columns to the left and right are
+// not decoded, so memory and time scale with the size of rect instead of the size of the whole image.
+// If params has a Scale, then the region is also DCT scaled, and the result has the scaled size of rect.
+// PNG and TIFF images are decoded in full, and then cropped.
+// rect is clipped to the bounds of the image. params may be nil.
+func DecompressRegion(encoded []byte, rect image.Rectangle, params *DecompressParams) (*Image, error) {
+	decoder, err := getDecoder()
+	if err != nil {
+		return nil, err
+	}
+	defer putDecoder(decoder)
+	return decoder.DecompressRegion(encoded, rect, params)
+}
+
+// DecompressRegion is the same as the package-level DecompressRegion, but uses this Decoder's handle
+func (d *Decoder) DecompressRegion(encoded []byte, rect image.Rectangle, params *DecompressParams) (*Image, error) {
+	if params == nil {
+		params = &DecompressParams{}
+	}
+	if err := d.checkLimits(params.Limits, encoded); err != nil {
+		return nil, err
+	}
+	if detectCodec(encoded) != jpegCodec {
+		p := *params
+		p.Limits = nil
+		full, err := d.DecompressWithOptions(encoded, &p)
+		if err != nil {
+			return nil, err
+		}
+		rect = rect.Intersect(image.Rect(0, 0, full.Width, full.Height))
+		if rect.Empty() {
+			return nil, fmt.Errorf("Region %v does not intersect the image", rect)
+		}
+		dst := NewImageOfType(rect.Dx(), rect.Dy(), full.Format, full.Type)
+		dst.Premultiplied = full.Premultiplied
+		dst.CopyImageRect(full, rect.Min.X, rect.Min.Y, rect.Max.X, rect.Max.Y, 0, 0)
+		return dst, nil
+	}
+
+	width, height, _, _, err := d.decompressJPEGHeader(encoded)
+	if err != nil {
+		return nil, err
+	}
+	rect = rect.Intersect(image.Rect(0, 0, width, height))
+	if rect.Empty() {
+		return nil, fmt.Errorf("Region %v does not intersect the image", rect)
+	}
+
+	scale := params.Scale
+	if scale.Num == 0 {
+		scale = ScalingFactor{Num: 1, Denom: 1}
+	} else if !isSupportedScalingFactor(scale) {
+		return nil, fmt.Errorf("Unsupported JPEG scaling factor %v/%v", scale.Num, scale.Denom)
+	}
+	// Map the region into the coordinates of the scaled image
+	scaled := image.Rect(rect.Min.X*scale.Num/scale.Denom, rect.Min.Y*scale.Num/scale.Denom, scale.Scale(rect.Max.X), scale.Scale(rect.Max.Y))
+	scaled = scaled.Intersect(image.Rect(0, 0, scale.Scale(width), scale.Scale(height)))
+	if scaled.Empty() {
+		return nil, errors.New("Scaled region is empty")
+	}
+
+	outFormat := params.outFormat()
+	if outFormat == PixelFormatUNKNOWN {
+		outFormat = PixelFormatRGB
+	}
+	img := NewImage(scaled.Dx(), scaled.Dy(), outFormat)
+
+	errBuf := [256]C.char{}
+	res := C.DecompressRegion(unsafe.Pointer(&encoded[0]), C.size_t(len(encoded)), C.int(scale.Num), C.int(scale.Denom), C.int(outFormat), C.int(params.Flags),
+		C.int(scaled.Min.X), C.int(scaled.Min.Y), C.int(scaled.Dx()), C.int(scaled.Dy()), unsafe.Pointer(&img.Pixels[0]), C.int(img.Stride), &errBuf[0], C.int(len(errBuf)))
+	if res != 0 {
+		return nil, errors.New(C.GoString(&errBuf[0]))
+	}
+	return img, nil
+}
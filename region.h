@@ -0,0 +1,15 @@
+#include <stddef.h>
+
+#ifdef __cplusplus
+extern "C" {
+#endif
+
+// Decode the rectangle (x, y, width, height) of a JPEG image into dst.
+// The rectangle is in the coordinates of the scaled output image.
+// Returns 0 on success, or -1 on failure, in which case an error message is written into errBuf.
+int DecompressRegion(const void* jpeg, size_t jpegSize, int scaleNum, int scaleDenom, int pixelFormat, int flags,
+                     int x, int y, int width, int height, void* dst, int dstStride, char* errBuf, int errBufSize);
+
+#ifdef __cplusplus
+}
+#endif
@@ -38,15 +38,19 @@ type ResizeParams struct {
 }
 
 // ResizeNew allocates the output image for you and returns it
-// Assumes sRGB image
+// Assumes sRGB image. The output has the same alpha state (Premultiplied) as src.
 func ResizeNew(src *Image, dstWidth, dstHeight int, params *ResizeParams) *Image {
-	dst := NewImage(dstWidth, dstHeight, src.Format)
+	dst := NewImageOfType(dstWidth, dstHeight, src.Format, src.Type)
 	Resize(src, dst, params)
 	return dst
 }
 
 // Resize resizes an image into a destination buffer that you provide
-// Assumes sRGB image
+// Assumes sRGB image. 16-bit images are filtered directly on their values, because
+// stb_image_resize2 has no sRGB mode for 16-bit data. Float32 images are linear, so they
+// are filtered correctly without any conversion.
+// Straight alpha is premultiplied internally while filtering, so transparent pixels don't bleed
+// their colors into their neighbours. dst.Premultiplied is set to src.Premultiplied.
 func Resize(src, dst *Image, params *ResizeParams) error {
 	if dst.Width == 0 || dst.Height == 0 {
 		return errors.New("Image target dimensions must be non-zero")
@@ -102,10 +106,23 @@ func Resize(src, dst *Image, params *ResizeParams) error {
 		return fmt.Errorf("Source channel count %v differs from target channel count %v", src.NChan(), dst.NChan())
 	}
 
+	if src.Type != dst.Type {
+		return fmt.Errorf("Source component type %v differs from target component type %v", int(src.Type), int(dst.Type))
+	}
+
 	var dataType C.stbir_datatype
-	dataType = C.STBIR_TYPE_UINT8_SRGB
-	if params != nil && params.CheapSRGBFilter {
-		dataType = C.STBIR_TYPE_UINT8
+	switch src.Type {
+	case ComponentUint8:
+		dataType = C.STBIR_TYPE_UINT8_SRGB
+		if params != nil && params.CheapSRGBFilter {
+			dataType = C.STBIR_TYPE_UINT8
+		}
+	case ComponentUint16:
+		dataType = C.STBIR_TYPE_UINT16
+	case ComponentFloat32:
+		dataType = C.STBIR_TYPE_FLOAT
+	default:
+		return fmt.Errorf("Unsupported component type for resize: %v", int(src.Type))
 	}
 
 	var filter C.stbir_filter
@@ -126,6 +143,8 @@ func Resize(src, dst *Image, params *ResizeParams) error {
 		                               stbir_pixel_layout pixel_layout, stbir_datatype data_type,
 		                               stbir_edge edge, stbir_filter filter );
 	*/
+	// The filtering is done in the source's alpha state, so dst ends up in that state too
+	dst.Premultiplied = src.Premultiplied
 	C.stbir_resize(
 		unsafe.Pointer(&src.Pixels[0]), C.int(src.Width), C.int(src.Height), C.int(src.Stride),
 		unsafe.Pointer(&dst.Pixels[0]), C.int(dst.Width), C.int(dst.Height), C.int(dst.Stride),
@@ -1,5 +1,6 @@
 #include <math.h>
 #include <stdint.h>
+#include <type_traits>
 #include "rotate.h"
 
 // This is a great site with illustrations of EXIF orientations:
@@ -56,16 +57,17 @@ void Rotate90CCW(const uint8_t* src, unsigned width, unsigned height, int srcStr
 	}
 }
 
-// Inline fixed-point bilinear interpolation
-template <unsigned nchan>
+// Inline fixed-point bilinear interpolation.
+// T is uint8_t, uint16_t, or float, and stride is in bytes. Floats are interpolated with floating point weights.
+template <typename T, unsigned nchan>
 void Bilinear(
-    const uint8_t* input,
-    int            width,
-    int            height,
-    int            stride,
-    double         x,
-    double         y,
-    uint8_t*       output) {
+    const T* input,
+    int      width,
+    int      height,
+    int      stride,
+    double   x,
+    double   y,
+    T*       output) {
 	// Compute integral parts
 	int x_floor = (int) floor(x);
 	int y_floor = (int) floor(y);
@@ -102,53 +104,127 @@ void Bilinear(
 	int32_t W01 = (int32_t) (((int64_t) one_minus_x * y_frac) >> 16);
 	int32_t W11 = (int32_t) (((int64_t) x_frac * y_frac) >> 16);
 
-	const uint8_t* p00 = input + y_floor * stride + x_floor * nchan;
-	const uint8_t* p10 = input + y_floor * stride + (x_floor + 1) * nchan;
-	const uint8_t* p01 = input + (y_floor + 1) * stride + x_floor * nchan;
-	const uint8_t* p11 = input + (y_floor + 1) * stride + (x_floor + 1) * nchan;
+	const T* row0 = (const T*) ((const uint8_t*) input + y_floor * stride);
+	const T* row1 = (const T*) ((const uint8_t*) input + (y_floor + 1) * stride);
+	const T* p00  = row0 + x_floor * nchan;
+	const T* p10  = row0 + (x_floor + 1) * nchan;
+	const T* p01  = row1 + x_floor * nchan;
+	const T* p11  = row1 + (x_floor + 1) * nchan;
 
 	// Interpolate each channel using fixed-point arithmetic.
 	// Final = (p00*C00 + p10*C10 + p01*C01 + p11*C11) >> 16, with rounding.
 	// We'll add half (32768) before shifting for rounding.
+	// 16-bit samples need a 64-bit accumulator.
+	if (std::is_floating_point<T>::value) {
+		double w00 = (1 - x_frac_d) * (1 - y_frac_d);
+		double w10 = x_frac_d * (1 - y_frac_d);
+		double w01 = (1 - x_frac_d) * y_frac_d;
+		double w11 = x_frac_d * y_frac_d;
+		for (unsigned i = 0; i < nchan; i++)
+			output[i] = (T) (p00[i] * w00 + p10[i] * w10 + p01[i] * w01 + p11[i] * w11);
+		return;
+	}
 	for (unsigned i = 0; i < nchan; i++) {
-		int32_t v = ((int32_t) p00[i] * W00) + ((int32_t) p10[i] * W10) +
-		            ((int32_t) p01[i] * W01) + ((int32_t) p11[i] * W11);
+		int64_t v = ((int64_t) p00[i] * W00) + ((int64_t) p10[i] * W10) +
+		            ((int64_t) p01[i] * W01) + ((int64_t) p11[i] * W11);
 
 		// Add 0x8000 for rounding and shift right by 16
-		output[i] = (uint8_t) ((v + 32768) >> 16);
+		output[i] = (T) ((v + 32768) >> 16);
+	}
+}
+
+template <typename T>
+void RotateBilinear(
+    const T* input,
+    T*       output,
+    int      nchan,
+    int      input_width,
+    int      input_height,
+    int      input_stride,
+    int      output_width,
+    int      output_height,
+    int      output_stride,
+    double   angle_radians) {
+	// Precompute cos and sin of angle
+	double cos_angle = cos(angle_radians);
+	double sin_angle = sin(angle_radians);
+
+	// Precompute centers
+	double cx_input  = (input_width - 1) / 2.0;
+	double cy_input  = (input_height - 1) / 2.0;
+	double cx_output = (output_width - 1) / 2.0;
+	double cy_output = (output_height - 1) / 2.0;
+
+	for (int y = 0; y < output_height; y++) {
+		double y_rel   = y - cy_output;
+		T*     dst_row = (T*) ((uint8_t*) output + y * output_stride);
+		for (int x = 0; x < output_width; x++) {
+			double x_rel = x - cx_output;
+
+			// Rotate back to source coordinates
+			double src_x = x_rel * cos_angle + y_rel * sin_angle + cx_input;
+			double src_y = -x_rel * sin_angle + y_rel * cos_angle + cy_input;
+
+			T* dst = dst_row + x * nchan;
+			if (nchan == 1) {
+				Bilinear<T, 1>(input, input_width, input_height, input_stride, src_x, src_y, dst);
+			} else if (nchan == 2) {
+				Bilinear<T, 2>(input, input_width, input_height, input_stride, src_x, src_y, dst);
+			} else if (nchan == 3) {
+				Bilinear<T, 3>(input, input_width, input_height, input_stride, src_x, src_y, dst);
+			} else if (nchan == 4) {
+				Bilinear<T, 4>(input, input_width, input_height, input_stride, src_x, src_y, dst);
+			}
+		}
 	}
 }
 
 extern "C" {
 
-void RotateDiscrete(int angle, void* _src, int _width, int _height, int stride, int _nchan, void* _dst, int dstStride) {
+void RotateDiscrete(int angle, void* _src, int _width, int _height, int stride, int _pixelSize, void* _dst, int dstStride) {
 	const uint8_t* src    = (const uint8_t*) _src;
 	uint8_t*       dst    = (uint8_t*) _dst;
 	unsigned       width  = _width;
 	unsigned       height = _height;
+	// The pixels are moved as opaque blocks of bytes, so we don't care about the component type
 	switch (angle) {
 	case -180:
 	case 180:
-		switch (_nchan) {
+		switch (_pixelSize) {
 		case 1: Rotate180<1>(src, width, height, stride, dst, dstStride); break;
+		case 2: Rotate180<2>(src, width, height, stride, dst, dstStride); break;
 		case 3: Rotate180<3>(src, width, height, stride, dst, dstStride); break;
 		case 4: Rotate180<4>(src, width, height, stride, dst, dstStride); break;
+		case 6: Rotate180<6>(src, width, height, stride, dst, dstStride); break;
+		case 8: Rotate180<8>(src, width, height, stride, dst, dstStride); break;
+		case 12: Rotate180<12>(src, width, height, stride, dst, dstStride); break;
+		case 16: Rotate180<16>(src, width, height, stride, dst, dstStride); break;
 		}
 		break;
 	case 90:
 	case -270:
-		switch (_nchan) {
+		switch (_pixelSize) {
 		case 1: Rotate90CW<1>(src, width, height, stride, dst, dstStride); break;
+		case 2: Rotate90CW<2>(src, width, height, stride, dst, dstStride); break;
 		case 3: Rotate90CW<3>(src, width, height, stride, dst, dstStride); break;
 		case 4: Rotate90CW<4>(src, width, height, stride, dst, dstStride); break;
+		case 6: Rotate90CW<6>(src, width, height, stride, dst, dstStride); break;
+		case 8: Rotate90CW<8>(src, width, height, stride, dst, dstStride); break;
+		case 12: Rotate90CW<12>(src, width, height, stride, dst, dstStride); break;
+		case 16: Rotate90CW<16>(src, width, height, stride, dst, dstStride); break;
 		}
 		break;
 	case -90:
 	case 270:
-		switch (_nchan) {
+		switch (_pixelSize) {
 		case 1: Rotate90CCW<1>(src, width, height, stride, dst, dstStride); break;
+		case 2: Rotate90CCW<2>(src, width, height, stride, dst, dstStride); break;
 		case 3: Rotate90CCW<3>(src, width, height, stride, dst, dstStride); break;
 		case 4: Rotate90CCW<4>(src, width, height, stride, dst, dstStride); break;
+		case 6: Rotate90CCW<6>(src, width, height, stride, dst, dstStride); break;
+		case 8: Rotate90CCW<8>(src, width, height, stride, dst, dstStride); break;
+		case 12: Rotate90CCW<12>(src, width, height, stride, dst, dstStride); break;
+		case 16: Rotate90CCW<16>(src, width, height, stride, dst, dstStride); break;
 		}
 		break;
 	}
@@ -165,43 +241,38 @@ void RotateImageBilinear(
     int            output_height,
     int            output_stride,
     double         angle_radians) {
-	// Precompute cos and sin of angle
-	double cos_angle = cos(angle_radians);
-	double sin_angle = sin(angle_radians);
-
-	// Precompute centers
-	double cx_input  = (input_width - 1) / 2.0;
-	double cy_input  = (input_height - 1) / 2.0;
-	double cx_output = (output_width - 1) / 2.0;
-	double cy_output = (output_height - 1) / 2.0;
-
-	for (int y = 0; y < output_height; y++) {
-		double y_rel = y - cy_output;
-		for (int x = 0; x < output_width; x++) {
-			double x_rel = x - cx_output;
+	RotateBilinear<uint8_t>(input, output, nchan, input_width, input_height, input_stride, output_width, output_height, output_stride, angle_radians);
+}
 
-			// Rotate back to source coordinates
-			double src_x = x_rel * cos_angle + y_rel * sin_angle + cx_input;
-			double src_y = -x_rel * sin_angle + y_rel * cos_angle + cy_input;
+void RotateImageBilinear16(
+    const uint16_t* input,
+    uint16_t*       output,
+    int             nchan,
+    int             input_width,
+    int             input_height,
+    int             input_stride,
+    int             output_width,
+    int             output_height,
+    int             output_stride,
+    double          angle_radians) {
+	RotateBilinear<uint16_t>(input, output, nchan, input_width, input_height, input_stride, output_width, output_height, output_stride, angle_radians);
+}
 
-			if (nchan == 1) {
-				uint8_t* dst = output + y * output_stride + x;
-				Bilinear<1>(input, input_width, input_height, input_stride, src_x, src_y, dst);
-			} else if (nchan == 2) {
-				uint8_t* dst = output + y * output_stride + x * 2;
-				Bilinear<2>(input, input_width, input_height, input_stride, src_x, src_y, dst);
-			} else if (nchan == 3) {
-				uint8_t* dst = output + y * output_stride + x * 3;
-				Bilinear<3>(input, input_width, input_height, input_stride, src_x, src_y, dst);
-			} else if (nchan == 4) {
-				uint8_t* dst = output + y * output_stride + x * 4;
-				Bilinear<4>(input, input_width, input_height, input_stride, src_x, src_y, dst);
-			}
-		}
-	}
+void RotateImageBilinearFloat(
+    const float* input,
+    float*       output,
+    int          nchan,
+    int          input_width,
+    int          input_height,
+    int          input_stride,
+    int          output_width,
+    int          output_height,
+    int          output_stride,
+    double       angle_radians) {
+	RotateBilinear<float>(input, output, nchan, input_width, input_height, input_stride, output_width, output_height, output_stride, angle_radians);
 }
 
-void UnrotateExif(int exifOrientation, void* _src, int _width, int _height, int stride, int _nchan, void* _dst, int dstStride) {
+void UnrotateExif(int exifOrientation, void* _src, int _width, int _height, int stride, int _pixelSize, void* _dst, int dstStride) {
 	int angle = 0;
 	switch (exifOrientation) {
 	case 1: angle = 0; break;
@@ -209,6 +280,6 @@ void UnrotateExif(int exifOrientation, void* _src, int _width, int _height, int
 	case 6: angle = 90; break;
 	case 8: angle = -90; break;
 	}
-	RotateDiscrete(angle, _src, _width, _height, stride, _nchan, _dst, dstStride);
+	RotateDiscrete(angle, _src, _width, _height, stride, _pixelSize, _dst, dstStride);
 }
 }
\ No newline at end of file
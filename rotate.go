@@ -43,18 +43,23 @@ func UnrotateExif(exifOrientation int, src *Image) (*Image, error) {
 	if exifOrientation == 6 || exifOrientation == 8 {
 		dstWidth, dstHeight = src.Height, src.Width
 	}
-	dst := NewImage(dstWidth, dstHeight, src.Format)
-	C.UnrotateExif(C.int(exifOrientation), unsafe.Pointer(&src.Pixels[0]), C.int(src.Width), C.int(src.Height), C.int(src.Stride), C.int(src.NChan()), unsafe.Pointer(&dst.Pixels[0]), C.int(dst.Stride))
+	dst := NewImageOfType(dstWidth, dstHeight, src.Format, src.Type)
+	dst.Premultiplied = src.Premultiplied
+	C.UnrotateExif(C.int(exifOrientation), unsafe.Pointer(&src.Pixels[0]), C.int(src.Width), C.int(src.Height), C.int(src.Stride), C.int(src.BytesPerPixel()), unsafe.Pointer(&dst.Pixels[0]), C.int(dst.Stride))
 	return dst, nil
 }
 
 // Rotate src into dst, by angleRadians
 // If params is nil, then default values are used.
 // A positive angle produces a clockwise rotation.
+// dst.Premultiplied is set to src.Premultiplied.
 func Rotate(src *Image, dst *Image, angleRadians float64, params *RotateParams) {
 	if src.NChan() != dst.NChan() {
 		panic("Rotate: src and dst must have the same number of channels")
 	}
+	if src.Type != dst.Type {
+		panic("Rotate: src and dst must have the same component type")
+	}
 
 	snapThreshold := RotateDefaultSnapThreshold * 180 / math.Pi
 	if params != nil {
@@ -67,15 +72,43 @@ func Rotate(src *Image, dst *Image, angleRadians float64, params *RotateParams)
 	isDiscrete90 := sizeMatch90 && (math.Abs(angleDegrees-90) < snapThreshold || math.Abs(angleDegrees+90) < snapThreshold || math.Abs(angleDegrees-270) < snapThreshold || math.Abs(angleDegrees+270) < snapThreshold)
 	isDiscrete180 := sizeMatch180 && (math.Abs(angleDegrees-180) < snapThreshold || math.Abs(angleDegrees+180) < snapThreshold)
 
+	dst.Premultiplied = src.Premultiplied
 	if angleRadians == 0 && src.Width == dst.Width && src.Height == dst.Height {
 		dst.CopyImage(src, 0, 0)
 	} else if isDiscrete90 || isDiscrete180 {
-		C.RotateDiscrete(C.int(math.Round(angleDegrees)), unsafe.Pointer(&src.Pixels[0]), C.int(src.Width), C.int(src.Height), C.int(src.Stride), C.int(src.NChan()),
+		C.RotateDiscrete(C.int(math.Round(angleDegrees)), unsafe.Pointer(&src.Pixels[0]), C.int(src.Width), C.int(src.Height), C.int(src.Stride), C.int(src.BytesPerPixel()),
 			unsafe.Pointer(&dst.Pixels[0]), C.int(dst.Stride))
+	} else {
+		rotateBilinear(src, dst, angleRadians)
+	}
+}
+
+// rotateBilinear interpolates premultiplied colors, so that transparent pixels don't bleed their
+// color into their neighbours. Images with straight alpha are premultiplied first, and restored afterwards.
+func rotateBilinear(src, dst *Image, angleRadians float64) {
+	straight := src.alphaChannel() != -1 && !src.Premultiplied
+	if straight {
+		src = src.Clone()
+		src.Premultiply()
+	}
+	if src.Type == ComponentFloat32 {
+		C.RotateImageBilinearFloat((*C.float)(unsafe.Pointer(&src.Pixels[0])), (*C.float)(unsafe.Pointer(&dst.Pixels[0])), C.int(src.NChan()),
+			C.int(src.Width), C.int(src.Height), C.int(src.Stride),
+			C.int(dst.Width), C.int(dst.Height), C.int(dst.Stride),
+			C.double(angleRadians))
+	} else if src.Type == ComponentUint16 {
+		C.RotateImageBilinear16((*C.uint16_t)(unsafe.Pointer(&src.Pixels[0])), (*C.uint16_t)(unsafe.Pointer(&dst.Pixels[0])), C.int(src.NChan()),
+			C.int(src.Width), C.int(src.Height), C.int(src.Stride),
+			C.int(dst.Width), C.int(dst.Height), C.int(dst.Stride),
+			C.double(angleRadians))
 	} else {
 		C.RotateImageBilinear((*C.uint8_t)(&src.Pixels[0]), (*C.uint8_t)(&dst.Pixels[0]), C.int(src.NChan()),
 			C.int(src.Width), C.int(src.Height), C.int(src.Stride),
 			C.int(dst.Width), C.int(dst.Height), C.int(dst.Stride),
 			C.double(angleRadians))
 	}
+	if straight {
+		dst.Premultiplied = true
+		dst.Unpremultiply()
+	}
 }
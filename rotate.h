@@ -4,10 +4,12 @@ extern "C" {
 
 #include <stdint.h>
 
-void UnrotateExif(int exifOrientation, void* _src, int _width, int _height, int stride, int _nchan, void* _dst, int dstStride);
+// _pixelSize is the number of bytes per pixel
+void UnrotateExif(int exifOrientation, void* _src, int _width, int _height, int stride, int _pixelSize, void* _dst, int dstStride);
 
 // Rotate image by 90,180,270,-90,-180,-270 degrees (A few of these are duplicates: -90 = 270, -180 = 180, -270 = 90)
-void RotateDiscrete(int angle, void* _src, int _width, int _height, int stride, int _nchan, void* _dst, int dstStride);
+// _pixelSize is the number of bytes per pixel
+void RotateDiscrete(int angle, void* _src, int _width, int _height, int stride, int _pixelSize, void* _dst, int dstStride);
 
 void RotateImageBilinear(
     const uint8_t* input,
@@ -21,6 +23,32 @@ void RotateImageBilinear(
     int            output_stride,
     double         angle_radians);
 
+// Strides are in bytes
+void RotateImageBilinear16(
+    const uint16_t* input,
+    uint16_t*       output,
+    int             nchan,
+    int             input_width,
+    int             input_height,
+    int             input_stride,
+    int             output_width,
+    int             output_height,
+    int             output_stride,
+    double          angle_radians);
+
+// Strides are in bytes
+void RotateImageBilinearFloat(
+    const float* input,
+    float*       output,
+    int          nchan,
+    int          input_width,
+    int          input_height,
+    int          input_stride,
+    int          output_width,
+    int          output_height,
+    int          output_stride,
+    double       angle_radians);
+
 #ifdef __cplusplus
 }
 #endif
@@ -0,0 +1,64 @@
+// sRGB transfer functions and lookup tables, shared by the C++ image kernels.
+// This header is C++ only.
+#pragma once
+
+#include <stdint.h>
+#include <math.h>
+#include <algorithm>
+
+static inline float SRGBToLinear(float c) {
+	if (c <= 0.04045f)
+		return c * (1.0f / 12.92f);
+	return powf((c + 0.055f) * (1.0f / 1.055f), 2.4f);
+}
+
+static inline float LinearToSRGB(float l) {
+	l = std::min(std::max(l, 0.0f), 1.0f);
+	if (l <= 0.0031308f)
+		return l * 12.92f;
+	return 1.055f * powf(l, 1.0f / 2.4f) - 0.055f;
+}
+
+// A table of sRGB to linear values, for every possible value of an 8 or 16 bit sample
+template <typename T>
+struct SRGBTable {
+	float Values[(int) (T) -1 + 1];
+	SRGBTable() {
+		const float maxVal = (float) (T) -1;
+		for (int i = 0; i <= (int) (T) -1; i++)
+			Values[i] = SRGBToLinear(i / maxVal);
+	}
+};
+
+template <typename T>
+const float* SRGBTableFor() {
+	// Function-local statics are initialized once, in a thread safe manner
+	static SRGBTable<T>* table = new SRGBTable<T>();
+	return table->Values;
+}
+
+// A table of linear to sRGB values, indexed by linear light quantized to 16 bits.
+// The values are sRGB scaled to [0, 65535], but kept as floats, so that they can be interpolated.
+struct LinearToSRGBTable {
+	float Values[65536];
+	LinearToSRGBTable() {
+		for (int i = 0; i < 65536; i++)
+			Values[i] = LinearToSRGB(i / 65535.0f) * 65535.0f;
+	}
+};
+
+static inline const float* LinearToSRGBTableValues() {
+	static LinearToSRGBTable* table = new LinearToSRGBTable();
+	return table->Values;
+}
+
+// Convert linear light to an 8 or 16 bit sRGB sample, by interpolating the table. Values are clamped to [0,1].
+// The interpolation matters for 16-bit output near black, where the sRGB curve is steep.
+template <typename T>
+T LinearToSRGBSample(const float* table, float l) {
+	float pos  = std::min(std::max(l, 0.0f), 1.0f) * 65535.0f;
+	int   i    = std::min((int) pos, 65534);
+	float v    = table[i] + (table[i + 1] - table[i]) * (pos - i);
+	float maxV = (float) (T) -1;
+	return (T) (v * (maxV / 65535.0f) + 0.5f);
+}
@@ -0,0 +1,101 @@
+package cimg
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// EncodeParams control how EncodeWriter encodes an image
+type EncodeParams struct {
+	Format string         // FormatJPEG, FormatPNG, FormatTIFF, or the name of another registered codec. If empty, then FormatJPEG is used.
+	JPEG   CompressParams // Used when Format is FormatJPEG. If Quality is zero, then Sampling420 at quality 90 is used.
+	PNG    *PNGParams     // Used when Format is FormatPNG. May be nil.
+	TIFF   *TIFFParams    // Used when Format is FormatTIFF. May be nil.
+	WebP   *WebPParams    // Used when Format is FormatWebP. May be nil.
+	Other  any            // Options for a codec that was added with RegisterCodec
+}
+
+// limitReader returns ErrImageTooLarge as soon as more than MaxInputBytes have been read.
+// This stops a huge upload before it has been buffered in memory.
+type limitReader struct {
+	r      io.Reader
+	limits *DecodeLimits
+	n      int
+	err    error // Sticky ErrImageTooLarge
+}
+
+func (l *limitReader) Read(p []byte) (int, error) {
+	if l.err != nil {
+		return 0, l.err
+	}
+	n, err := l.r.Read(p)
+	l.n += n
+	if l.err = l.limits.checkInputSize(l.n); l.err != nil {
+		return n, l.err
+	}
+	return n, err
+}
+
+// The PNG signature and the IHDR chunk
+const pngHeaderSize = 33
+
+// DecodeReader decodes a JPEG, PNG, or TIFF image from r, such as a file or an http.Request body.
+// params may be nil, and are interpreted the same as for DecompressWithOptions.
+// PNG images are decoded as they are read. JPEG and TIFF images need random access to the
+// encoded bytes, so they are read into memory in full before they are decoded.
+// If params has Limits, then MaxInputBytes stops the read as soon as it is exceeded,
+// and the dimensions are checked before any pixels are decoded.
+func DecodeReader(r io.Reader, params *DecompressParams) (*Image, error) {
+	if params == nil {
+		params = &DecompressParams{}
+	}
+	var limited *limitReader
+	if params.Limits != nil && params.Limits.MaxInputBytes != 0 {
+		limited = &limitReader{r: r, limits: params.Limits}
+		r = limited
+	}
+	br := bufio.NewReader(r)
+	header, _ := br.Peek(pngHeaderSize)
+	if isPNG(header) && len(header) == pngHeaderSize {
+		if params.Limits != nil {
+			width := int(binary.BigEndian.Uint32(header[16:]))
+			height := int(binary.BigEndian.Uint32(header[20:]))
+			if err := params.Limits.checkDimensions(width, height); err != nil {
+				return nil, err
+			}
+		}
+		img, err := decodePNG(br, params)
+		if err == nil && limited != nil && limited.err != nil {
+			// bufio may have hit the limit while reading ahead of the PNG decoder
+			err = limited.err
+		}
+		if err != nil {
+			return nil, err
+		}
+		return img, nil
+	}
+	encoded, err := io.ReadAll(br)
+	if err != nil {
+		return nil, err
+	}
+	return DecompressWithOptions(encoded, params)
+}
+
+// EncodeWriter encodes an image and writes it to w, such as a file or an http.ResponseWriter.
+// JPEG images are written straight out of TurboJPEG's buffer (see CompressTo).
+// See EncodePNG and EncodeTIFF for how PNG and TIFF images are encoded.
+func EncodeWriter(w io.Writer, img *Image, params EncodeParams) error {
+	if params.Format == "" {
+		params.Format = FormatJPEG
+	}
+	c := LookupCodec(params.Format)
+	if c == nil {
+		return fmt.Errorf("%w: '%v'", ErrUnknownFormat, params.Format)
+	}
+	if c.Encode == nil {
+		return fmt.Errorf("Image format '%v' does not support encoding", params.Format)
+	}
+	return c.Encode(w, img, &params)
+}
@@ -0,0 +1,432 @@
+package cimg
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+)
+
+// TIFFCompression is the compression method of a TIFF file
+type TIFFCompression int
+
+const (
+	TIFFDeflate      TIFFCompression = iota // zlib/Deflate (TIFF compression 8)
+	TIFFLZW                                 // LZW (TIFF compression 5)
+	TIFFUncompressed                        // No compression (TIFF compression 1)
+)
+
+// TIFFParams control TIFF encoding
+type TIFFParams struct {
+	Compression TIFFCompression // The zero value is TIFFDeflate
+	Predictor   bool            // Use horizontal differencing, which usually makes Deflate and LZW compress better
+}
+
+// More TIFF tags that we write. The tags that we read are in tiff_ifd.go.
+const (
+	tiffTagCompression               = 259
+	tiffTagPhotometricInterpretation = 262
+	tiffTagStripOffsets              = 273
+	tiffTagRowsPerStrip              = 278
+	tiffTagStripByteCounts           = 279
+	tiffTagPlanarConfiguration       = 284
+	tiffTagPredictor                 = 317
+	tiffTagExtraSamples              = 338
+)
+
+const (
+	tiffPhotometricBlackIsZero = 1
+	tiffPhotometricRGB         = 2
+	tiffPhotometricSeparated   = 5 // CMYK
+
+	tiffExtraSamplesAssociatedAlpha   = 1
+	tiffExtraSamplesUnassociatedAlpha = 2
+)
+
+// EncodeTIFF encodes an image as a TIFF. params may be nil.
+// GRAY images are written as grayscale, formats with alpha as RGBA (associated alpha if
+// the image is Premultiplied), CMYK as CMYK, and all other formats as RGB.
+// 16-bit images are written with 16 bits per sample, and float32 images are converted to 16-bit sRGB.
+func EncodeTIFF(img *Image, params *TIFFParams) ([]byte, error) {
+	buf := bytes.Buffer{}
+	if err := EncodeTIFFPages(&buf, []*Image{img}, params); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// EncodeTIFFTo is the same as EncodeTIFF, but writes the TIFF to w
+func EncodeTIFFTo(w io.Writer, img *Image, params *TIFFParams) error {
+	return EncodeTIFFPages(w, []*Image{img}, params)
+}
+
+// WriteTIFF writes the image to a TIFF file. params may be nil.
+func (img *Image) WriteTIFF(filename string, params *TIFFParams, perm os.FileMode) error {
+	raw, err := EncodeTIFF(img, params)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, raw, perm)
+}
+
+type tiffEntry struct {
+	tag    uint16
+	typ    uint16
+	values []uint32
+}
+
+// EncodeTIFFPages writes a multi-page TIFF, with one page per image. params may be nil.
+// Only one page is held in compressed form at a time.
+func EncodeTIFFPages(w io.Writer, pages []*Image, params *TIFFParams) error {
+	if params == nil {
+		params = &TIFFParams{}
+	}
+	if len(pages) == 0 {
+		return errors.New("No pages to write")
+	}
+	bo := binary.LittleEndian
+	header := []byte("II*\x00\x08\x00\x00\x00")
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	offset := uint64(len(header))
+
+	for i, img := range pages {
+		data, entries, err := encodeTIFFPage(img, params)
+		if err != nil {
+			return err
+		}
+
+		// Layout is IFD, then the IFD's out-of-line values, then the pixel data
+		ifdSize := uint64(2 + 12*len(entries) + 4)
+		extra := []byte{}
+		extraOffset := offset + ifdSize
+		for _, e := range entries {
+			if e.size() > 4 {
+				extra = e.appendValues(extra, bo)
+			}
+		}
+		dataOffset := extraOffset + uint64(len(extra))
+		next := dataOffset + uint64(len(data))
+		next += next & 1 // IFDs must start on a word boundary
+		if next > math.MaxUint32 {
+			return errors.New("TIFF file exceeds 4GB")
+		}
+		if i == len(pages)-1 {
+			next = 0
+		}
+
+		ifd := make([]byte, 0, ifdSize)
+		ifd = bo.AppendUint16(ifd, uint16(len(entries)))
+		extraPos := uint32(extraOffset)
+		for _, e := range entries {
+			if e.tag == tiffTagStripOffsets {
+				e.values[0] = uint32(dataOffset)
+			}
+			ifd = bo.AppendUint16(ifd, e.tag)
+			ifd = bo.AppendUint16(ifd, e.typ)
+			ifd = bo.AppendUint32(ifd, uint32(len(e.values)))
+			if e.size() > 4 {
+				ifd = bo.AppendUint32(ifd, extraPos)
+				extraPos += uint32(e.size())
+			} else {
+				inline := e.appendValues(nil, bo)
+				ifd = append(ifd, inline...)
+				ifd = append(ifd, make([]byte, 4-len(inline))...)
+			}
+		}
+		ifd = bo.AppendUint32(ifd, uint32(next))
+
+		for _, b := range [][]byte{ifd, extra, data} {
+			if _, err := w.Write(b); err != nil {
+				return err
+			}
+		}
+		offset = dataOffset + uint64(len(data))
+		if offset&1 != 0 && next != 0 {
+			if _, err := w.Write([]byte{0}); err != nil {
+				return err
+			}
+			offset++
+		}
+	}
+	return nil
+}
+
+func (e *tiffEntry) size() int {
+	if e.typ == tiffTypeShort {
+		return 2 * len(e.values)
+	}
+	return 4 * len(e.values)
+}
+
+func (e *tiffEntry) appendValues(buf []byte, bo binary.AppendByteOrder) []byte {
+	for _, v := range e.values {
+		if e.typ == tiffTypeShort {
+			buf = bo.AppendUint16(buf, uint16(v))
+		} else {
+			buf = bo.AppendUint32(buf, v)
+		}
+	}
+	return buf
+}
+
+// encodeTIFFPage produces the compressed pixels of a page, and its IFD entries, sorted by tag.
+// The strip offset is filled in by the caller.
+func encodeTIFFPage(img *Image, params *TIFFParams) ([]byte, []tiffEntry, error) {
+	if img.Width <= 0 || img.Height <= 0 {
+		return nil, nil, fmt.Errorf("Invalid image dimensions %v x %v", img.Width, img.Height)
+	}
+	if img.Type == ComponentFloat32 {
+		img = img.ConvertType(ComponentUint16)
+	}
+	_, _, _, sa := channelOffsets(img.Format)
+	samples := 3
+	photometric := tiffPhotometricRGB
+	switch {
+	case img.Format == PixelFormatGRAY:
+		samples = 1
+		photometric = tiffPhotometricBlackIsZero
+	case img.Format == PixelFormatCMYK:
+		samples = 4
+		photometric = tiffPhotometricSeparated
+	case sa != -1:
+		samples = 4
+	}
+
+	// Reorder the channels into TIFF's order. 16-bit samples are written little-endian, to match the header.
+	var raw []byte
+	switch img.Type {
+	case ComponentUint8:
+		raw = tiffSamples(img, img.Pixels, samples, 255, params.Predictor)
+	case ComponentUint16:
+		s16 := tiffSamples(img, img.Pixels16(), samples, 65535, params.Predictor)
+		raw = make([]byte, 0, len(s16)*2)
+		for _, v := range s16 {
+			raw = binary.LittleEndian.AppendUint16(raw, v)
+		}
+	default:
+		return nil, nil, fmt.Errorf("Unsupported component type %v", int(img.Type))
+	}
+
+	var data []byte
+	compression := uint32(tiffCompressionNone)
+	switch params.Compression {
+	case TIFFDeflate:
+		compression = tiffCompressionDeflate
+		buf := bytes.Buffer{}
+		zw := zlib.NewWriter(&buf)
+		zw.Write(raw)
+		if err := zw.Close(); err != nil {
+			return nil, nil, err
+		}
+		data = buf.Bytes()
+	case TIFFLZW:
+		compression = tiffCompressionLZW
+		data = tiffLZWCompress(raw)
+	case TIFFUncompressed:
+		data = raw
+	default:
+		return nil, nil, fmt.Errorf("Unsupported TIFF compression %v", params.Compression)
+	}
+
+	bits := make([]uint32, samples)
+	for i := range bits {
+		bits[i] = uint32(8 * img.Type.Size())
+	}
+	entries := []tiffEntry{
+		{tiffTagImageWidth, tiffTypeLong, []uint32{uint32(img.Width)}},
+		{tiffTagImageLength, tiffTypeLong, []uint32{uint32(img.Height)}},
+		{tiffTagBitsPerSample, tiffTypeShort, bits},
+		{tiffTagCompression, tiffTypeShort, []uint32{compression}},
+		{tiffTagPhotometricInterpretation, tiffTypeShort, []uint32{uint32(photometric)}},
+		{tiffTagStripOffsets, tiffTypeLong, []uint32{0}},
+		{tiffTagSamplesPerPixel, tiffTypeShort, []uint32{uint32(samples)}},
+		{tiffTagRowsPerStrip, tiffTypeLong, []uint32{uint32(img.Height)}},
+		{tiffTagStripByteCounts, tiffTypeLong, []uint32{uint32(len(data))}},
+		{tiffTagPlanarConfiguration, tiffTypeShort, []uint32{tiffPlanarConfigContiguous}},
+	}
+	if params.Predictor {
+		entries = append(entries, tiffEntry{tiffTagPredictor, tiffTypeShort, []uint32{tiffPredictorHorizontal}})
+	}
+	if samples == 4 && photometric == tiffPhotometricRGB {
+		extra := uint32(tiffExtraSamplesUnassociatedAlpha)
+		if img.Premultiplied {
+			extra = tiffExtraSamplesAssociatedAlpha
+		}
+		entries = append(entries, tiffEntry{tiffTagExtraSamples, tiffTypeShort, []uint32{extra}})
+	}
+	return data, entries, nil
+}
+
+// tiffSamples returns the pixels of an image with its channels in TIFF's order, with an optional
+// horizontal differencing predictor. maxVal is the maximum value of a sample.
+func tiffSamples[T uint8 | uint16](img *Image, pix []T, samples int, maxVal T, predictor bool) []T {
+	sr, sg, sb, sa := channelOffsets(img.Format)
+	size := img.Type.Size()
+	raw := make([]T, img.Width*img.Height*samples)
+	srcN := img.NChan()
+	for y := 0; y < img.Height; y++ {
+		src := pix[y*img.Stride/size : y*img.Stride/size+img.Width*srcN]
+		dst := raw[y*img.Width*samples : (y+1)*img.Width*samples]
+		switch {
+		case samples == 1:
+			copy(dst, src)
+		case img.Format == PixelFormatCMYK:
+			// We store inverted (Adobe) CMYK, but TIFF stores the amount of ink
+			for i, v := range src {
+				dst[i] = maxVal - v
+			}
+		default:
+			for x := 0; x < img.Width; x++ {
+				s := src[x*srcN:]
+				d := dst[x*samples:]
+				d[0], d[1], d[2] = s[sr], s[sg], s[sb]
+				if samples == 4 {
+					d[3] = s[sa]
+				}
+			}
+		}
+		if predictor {
+			for i := len(dst) - 1; i >= samples; i-- {
+				dst[i] -= dst[i-samples]
+			}
+		}
+	}
+	return raw
+}
+
+// tiffPage presents a TIFF file to the TIFF decoder as though the IFD at ifd was the first IFD,
+// without copying the file.
+type tiffPage struct {
+	data   []byte
+	header [8]byte
+	pos    int64
+}
+
+func newTIFFPage(r *tiffReader, ifd uint32) *tiffPage {
+	p := &tiffPage{data: r.data}
+	copy(p.header[:4], r.data[:4])
+	r.bo.PutUint32(p.header[4:], ifd)
+	return p
+}
+
+func (p *tiffPage) ReadAt(b []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("Negative offset")
+	}
+	if off >= int64(len(p.data)) {
+		return 0, io.EOF
+	}
+	n := copy(b, p.data[off:])
+	if off < int64(len(p.header)) {
+		copy(b, p.header[off:])
+	}
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (p *tiffPage) Read(b []byte) (int, error) {
+	n, err := p.ReadAt(b, p.pos)
+	p.pos += int64(n)
+	return n, err
+}
+
+// tiffPageIFDs returns the offsets of all the IFDs in a TIFF file
+func tiffPageIFDs(encoded []byte) ([]uint32, *tiffReader, error) {
+	r, ok := newTIFFReader(encoded)
+	if !ok {
+		return nil, nil, errors.New("Invalid TIFF header")
+	}
+	ifds := []uint32{}
+	seen := map[uint32]bool{}
+	for ifd := r.firstIFD(); ifd != 0; ifd = r.nextIFD(ifd) {
+		if seen[ifd] {
+			// A corrupt file with a loop in its IFD chain
+			break
+		}
+		if _, ok := r.u16(ifd); !ok {
+			break
+		}
+		seen[ifd] = true
+		ifds = append(ifds, ifd)
+	}
+	if len(ifds) == 0 {
+		return nil, nil, errors.New("TIFF file has no pages")
+	}
+	return ifds, r, nil
+}
+
+// NumTIFFPages returns the number of pages (IFDs) in a TIFF file
+func NumTIFFPages(encoded []byte) (int, error) {
+	ifds, _, err := tiffPageIFDs(encoded)
+	return len(ifds), err
+}
+
+// DecompressTIFFPage decodes one page of a multi-page TIFF file.
+// page is zero-based. params may be nil, and are interpreted the same as for DecompressWithOptions.
+func DecompressTIFFPage(encoded []byte, page int, params *DecompressParams) (*Image, error) {
+	ifds, r, err := tiffPageIFDs(encoded)
+	if err != nil {
+		return nil, err
+	}
+	if page < 0 || page >= len(ifds) {
+		return nil, fmt.Errorf("TIFF page %v is out of range (file has %v pages)", page, len(ifds))
+	}
+	return decodeTIFFPage(r, ifds[page], params)
+}
+
+// DecompressTIFFPages decodes every page of a multi-page TIFF file.
+// params may be nil, and are interpreted the same as for DecompressWithOptions.
+// Limits are applied to each page individually.
+func DecompressTIFFPages(encoded []byte, params *DecompressParams) ([]*Image, error) {
+	ifds, r, err := tiffPageIFDs(encoded)
+	if err != nil {
+		return nil, err
+	}
+	pages := []*Image{}
+	for _, ifd := range ifds {
+		img, err := decodeTIFFPage(r, ifd, params)
+		if err != nil {
+			return nil, err
+		}
+		pages = append(pages, img)
+	}
+	return pages, nil
+}
+
+func decodeTIFFPage(r *tiffReader, ifd uint32, params *DecompressParams) (*Image, error) {
+	if params == nil {
+		params = &DecompressParams{}
+	}
+	if params.Limits != nil {
+		if err := params.Limits.checkInputSize(len(r.data)); err != nil {
+			return nil, err
+		}
+		width, _ := r.tag(ifd, tiffTagImageWidth)
+		height, _ := r.tag(ifd, tiffTagImageLength)
+		if err := params.Limits.checkDimensions(int(width), int(height)); err != nil {
+			return nil, err
+		}
+	}
+	return decodeTIFFIFD(r, ifd, params)
+}
+
+// decodeTIFFIFD decodes the page at ifd. We decode CMYK pages ourselves, and hand all other
+// pages to golang.org/x/image/tiff.
+func decodeTIFFIFD(r *tiffReader, ifd uint32, params *DecompressParams) (*Image, error) {
+	if photometric, _ := r.tag(ifd, tiffTagPhotometricInterpretation); photometric == tiffPhotometricSeparated {
+		img, err := decodeTIFFCMYK(r, ifd)
+		if err != nil {
+			return nil, err
+		}
+		return applyDecompressFormat(img, params), nil
+	}
+	return decodeTIFF(newTIFFPage(r, ifd), params)
+}
@@ -0,0 +1,133 @@
+package cimg
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"math"
+
+	"golang.org/x/image/tiff/lzw"
+)
+
+const (
+	tiffTagInkSet = 332
+
+	tiffCompressionNone        = 1
+	tiffCompressionLZW         = 5
+	tiffCompressionDeflate     = 8
+	tiffCompressionDeflateOld  = 32946
+	tiffPredictorHorizontal    = 2
+	tiffPlanarConfigContiguous = 1
+	tiffInkSetCMYK             = 1
+)
+
+// decodeTIFFCMYK decodes a CMYK page, which golang.org/x/image/tiff can't decode.
+// It reads the layouts that EncodeTIFF writes: 8 or 16 bits per sample, interleaved samples
+// in strips, uncompressed, LZW or Deflate, with or without the horizontal predictor.
+// TIFF stores the amount of ink, so the samples are inverted to match PixelFormatCMYK.
+func decodeTIFFCMYK(r *tiffReader, ifd uint32) (*Image, error) {
+	width, _ := r.tag(ifd, tiffTagImageWidth)
+	height, _ := r.tag(ifd, tiffTagImageLength)
+	samples, _ := r.tag(ifd, tiffTagSamplesPerPixel)
+	bits, _ := r.tag(ifd, tiffTagBitsPerSample)
+	compression, ok := r.tag(ifd, tiffTagCompression)
+	if !ok {
+		compression = tiffCompressionNone
+	}
+	predictor, _ := r.tag(ifd, tiffTagPredictor)
+	planar, ok := r.tag(ifd, tiffTagPlanarConfiguration)
+	if !ok {
+		planar = tiffPlanarConfigContiguous
+	}
+	inkSet, ok := r.tag(ifd, tiffTagInkSet)
+	if !ok {
+		inkSet = tiffInkSetCMYK
+	}
+	if samples != 4 || (bits != 8 && bits != 16) || planar != tiffPlanarConfigContiguous || inkSet != tiffInkSetCMYK {
+		return nil, fmt.Errorf("Unsupported CMYK TIFF with %v samples of %v bits", samples, bits)
+	}
+	if width == 0 || height == 0 || uint64(width)*uint64(height) > math.MaxInt32 {
+		return nil, fmt.Errorf("Invalid TIFF image dimensions %v x %v", width, height)
+	}
+	rowsPerStrip, ok := r.tag(ifd, tiffTagRowsPerStrip)
+	if !ok || rowsPerStrip == 0 || rowsPerStrip > height {
+		rowsPerStrip = height
+	}
+	offsets, okOffsets := r.tagValues(ifd, tiffTagStripOffsets)
+	counts, okCounts := r.tagValues(ifd, tiffTagStripByteCounts)
+	nStrips := int((height + rowsPerStrip - 1) / rowsPerStrip)
+	if !okOffsets || !okCounts || len(offsets) < nStrips || len(counts) < nStrips {
+		return nil, fmt.Errorf("TIFF file is missing strips")
+	}
+
+	typ := ComponentUint8
+	if bits == 16 {
+		typ = ComponentUint16
+	}
+	img := NewImageOfType(int(width), int(height), PixelFormatCMYK, typ)
+	stripSize := int(rowsPerStrip) * img.Stride
+	for i := 0; i < nStrips; i++ {
+		if uint64(offsets[i])+uint64(counts[i]) > uint64(len(r.data)) {
+			return nil, fmt.Errorf("TIFF strip %v is outside of the file", i)
+		}
+		src := r.data[offsets[i] : offsets[i]+counts[i]]
+		dst := img.Pixels[i*stripSize : min((i+1)*stripSize, len(img.Pixels))]
+		if err := tiffDecompressStrip(src, dst, compression); err != nil {
+			return nil, fmt.Errorf("TIFF strip %v: %w", i, err)
+		}
+	}
+
+	if typ == ComponentUint16 {
+		// Byte swap the samples from the file's byte order
+		pix := img.Pixels16()
+		for i := range pix {
+			pix[i] = r.bo.Uint16(img.Pixels[i*2:])
+		}
+		tiffInvertSamples(pix, img.Width*4, predictor == tiffPredictorHorizontal, 65535)
+	} else {
+		tiffInvertSamples(img.Pixels, img.Width*4, predictor == tiffPredictorHorizontal, 255)
+	}
+	return img, nil
+}
+
+// tiffDecompressStrip decompresses src into dst, which is the exact size of the strip's pixels
+func tiffDecompressStrip(src, dst []byte, compression uint32) error {
+	var rd io.ReadCloser
+	switch compression {
+	case tiffCompressionNone:
+		if len(src) < len(dst) {
+			return io.ErrUnexpectedEOF
+		}
+		copy(dst, src)
+		return nil
+	case tiffCompressionLZW:
+		rd = lzw.NewReader(bytes.NewReader(src), lzw.MSB, 8)
+	case tiffCompressionDeflate, tiffCompressionDeflateOld:
+		var err error
+		if rd, err = zlib.NewReader(bytes.NewReader(src)); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("Unsupported TIFF compression %v", compression)
+	}
+	defer rd.Close()
+	_, err := io.ReadFull(rd, dst)
+	return err
+}
+
+// tiffInvertSamples undoes the horizontal predictor (if any), and converts the amount of ink into
+// our inverted CMYK. Each row has rowLen samples.
+func tiffInvertSamples[T uint8 | uint16](pix []T, rowLen int, predictor bool, maxVal T) {
+	for y := 0; y < len(pix); y += rowLen {
+		row := pix[y : y+rowLen]
+		if predictor {
+			for i := 4; i < len(row); i++ {
+				row[i] += row[i-4]
+			}
+		}
+		for i, v := range row {
+			row[i] = maxVal - v
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package cimg
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// TIFF tags that we read directly
+const (
+	tiffTagImageWidth      = 256
+	tiffTagImageLength     = 257
+	tiffTagBitsPerSample   = 258
+	tiffTagSamplesPerPixel = 277
+)
+
+// TIFF field types
+const (
+	tiffTypeByte  = 1
+	tiffTypeShort = 3
+	tiffTypeLong  = 4
+)
+
+// tiffReader reads tags out of a TIFF-structured buffer.
+// This is either an entire TIFF file, or the EXIF block of a JPEG or PNG file.
+// All reads are bounds checked, so a corrupt buffer produces missing values, not a panic.
+type tiffReader struct {
+	data []byte
+	bo   binary.ByteOrder
+}
+
+func isTIFFHeader(data []byte) bool {
+	return len(data) >= 8 && (bytes.Equal(data[:4], []byte("II*\x00")) || bytes.Equal(data[:4], []byte("MM\x00*")))
+}
+
+func newTIFFReader(data []byte) (*tiffReader, bool) {
+	if !isTIFFHeader(data) {
+		return nil, false
+	}
+	r := &tiffReader{data: data}
+	if data[0] == 'I' {
+		r.bo = binary.LittleEndian
+	} else {
+		r.bo = binary.BigEndian
+	}
+	return r, true
+}
+
+func (r *tiffReader) u16(offset uint32) (uint16, bool) {
+	if uint64(offset)+2 > uint64(len(r.data)) {
+		return 0, false
+	}
+	return r.bo.Uint16(r.data[offset:]), true
+}
+
+func (r *tiffReader) u32(offset uint32) (uint32, bool) {
+	if uint64(offset)+4 > uint64(len(r.data)) {
+		return 0, false
+	}
+	return r.bo.Uint32(r.data[offset:]), true
+}
+
+// firstIFD returns the offset of the first IFD
+func (r *tiffReader) firstIFD() uint32 {
+	v, _ := r.u32(4)
+	return v
+}
+
+// nextIFD returns the offset of the IFD that follows ifd, or zero if there is none
+func (r *tiffReader) nextIFD(ifd uint32) uint32 {
+	n, ok := r.u16(ifd)
+	if !ok {
+		return 0
+	}
+	v, _ := r.u32(ifd + 2 + uint32(n)*12)
+	return v
+}
+
+// findTag returns the type, the number of values, and the offset of the value field of tag inside ifd
+func (r *tiffReader) findTag(ifd uint32, tag uint16) (typ uint16, count, valueOffset uint32, ok bool) {
+	n, ok := r.u16(ifd)
+	if !ok {
+		return 0, 0, 0, false
+	}
+	for i := uint32(0); i < uint32(n); i++ {
+		entry := ifd + 2 + i*12
+		id, _ := r.u16(entry)
+		if id != tag {
+			continue
+		}
+		typ, _ = r.u16(entry + 2)
+		count, _ = r.u32(entry + 4)
+		return typ, count, entry + 8, true
+	}
+	return 0, 0, 0, false
+}
+
+// tag returns the first value of a BYTE, SHORT or LONG tag inside ifd
+func (r *tiffReader) tag(ifd uint32, tag uint16) (uint32, bool) {
+	typ, count, valueOffset, ok := r.findTag(ifd, tag)
+	if !ok {
+		return 0, false
+	}
+	switch typ {
+	case tiffTypeByte:
+		if count > 4 {
+			valueOffset, _ = r.u32(valueOffset)
+		}
+		if int(valueOffset) >= len(r.data) {
+			return 0, false
+		}
+		return uint32(r.data[valueOffset]), true
+	case tiffTypeShort:
+		if count > 2 {
+			valueOffset, _ = r.u32(valueOffset)
+		}
+		v, ok := r.u16(valueOffset)
+		return uint32(v), ok
+	case tiffTypeLong:
+		if count > 1 {
+			valueOffset, _ = r.u32(valueOffset)
+		}
+		return r.u32(valueOffset)
+	}
+	return 0, false
+}
+
+// tagValues returns all the values of a SHORT or LONG tag inside ifd, such as the strip offsets
+func (r *tiffReader) tagValues(ifd uint32, tag uint16) ([]uint32, bool) {
+	typ, count, valueOffset, ok := r.findTag(ifd, tag)
+	if !ok || count == 0 || (typ != tiffTypeShort && typ != tiffTypeLong) {
+		return nil, false
+	}
+	size := uint64(2)
+	if typ == tiffTypeLong {
+		size = 4
+	}
+	if uint64(count)*size > 4 {
+		valueOffset, _ = r.u32(valueOffset)
+	}
+	if uint64(valueOffset)+uint64(count)*size > uint64(len(r.data)) {
+		return nil, false
+	}
+	values := make([]uint32, count)
+	for i := range values {
+		if typ == tiffTypeShort {
+			v, _ := r.u16(valueOffset + uint32(i)*2)
+			values[i] = uint32(v)
+		} else {
+			values[i], _ = r.u32(valueOffset + uint32(i)*4)
+		}
+	}
+	return values, true
+}
+
+// exifOrientation returns the orientation tag from the first IFD of a TIFF-structured
+// buffer, or zero if there is no orientation tag.
+func exifOrientation(data []byte) int {
+	r, ok := newTIFFReader(data)
+	if !ok {
+		return 0
+	}
+	v, _ := r.tag(r.firstIFD(), ExifTagOrientation)
+	return int(v)
+}
@@ -0,0 +1,95 @@
+package cimg
+
+// TIFF uses MSB-first LZW with 8-bit literals, just like compress/lzw, except that the code width
+// increases one code earlier than the standard algorithm (the "early change" quirk).
+// compress/lzw can't produce this, so we have our own encoder. It is modelled on the compress/lzw
+// Writer, and its output is read by golang.org/x/image/tiff/lzw.
+
+const (
+	tiffLZWClear   = 256
+	tiffLZWEOF     = 257
+	tiffLZWMaxCode = 4095
+)
+
+type tiffLZWEncoder struct {
+	out      []byte
+	bits     uint32
+	nBits    uint
+	width    uint
+	hi       uint32
+	overflow uint32
+	table    map[uint32]uint32 // (prefix code << 8 | byte) -> code
+}
+
+// tiffLZWCompress compresses data with TIFF-flavoured LZW
+func tiffLZWCompress(data []byte) []byte {
+	e := &tiffLZWEncoder{
+		out:   make([]byte, 0, len(data)/2),
+		table: map[uint32]uint32{},
+	}
+	e.reset()
+	e.write(tiffLZWClear)
+	if len(data) == 0 {
+		e.write(tiffLZWEOF)
+		return e.flush()
+	}
+	code := uint32(data[0])
+	for _, b := range data[1:] {
+		key := code<<8 | uint32(b)
+		if next, ok := e.table[key]; ok {
+			code = next
+			continue
+		}
+		e.write(code)
+		code = uint32(b)
+		if e.incHi() {
+			e.table[key] = e.hi
+		}
+	}
+	e.write(code)
+	e.incHi()
+	e.write(tiffLZWEOF)
+	return e.flush()
+}
+
+func (e *tiffLZWEncoder) reset() {
+	e.width = 9
+	e.hi = tiffLZWEOF
+	e.overflow = 1 << e.width
+	clear(e.table)
+}
+
+// incHi advances the next code, and returns false if the table was full and has been cleared
+func (e *tiffLZWEncoder) incHi() bool {
+	e.hi++
+	if e.hi == tiffLZWMaxCode {
+		e.write(tiffLZWClear)
+		e.reset()
+		return false
+	}
+	// This is where TIFF differs from the standard algorithm, which compares e.hi to e.overflow
+	if e.hi+1 == e.overflow {
+		e.width++
+		e.overflow <<= 1
+	}
+	return true
+}
+
+func (e *tiffLZWEncoder) write(code uint32) {
+	e.bits |= code << (32 - e.width - e.nBits)
+	e.nBits += e.width
+	for e.nBits >= 8 {
+		e.out = append(e.out, byte(e.bits>>24))
+		e.bits <<= 8
+		e.nBits -= 8
+	}
+}
+
+func (e *tiffLZWEncoder) flush() []byte {
+	if e.nBits > 0 {
+		e.out = append(e.out, byte(e.bits>>24))
+		e.bits = 0
+		e.nBits = 0
+	}
+	return e.out
+}
@@ -0,0 +1,191 @@
+package cimg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncodeTIFF(t *testing.T) {
+	org := MakeRGBA(61, 43)
+	AddAlphaNoise(org)
+	premul := org.Clone()
+	premul.Premultiply()
+
+	noise := NewImage(300, 200, PixelFormatRGB)
+	rand.New(rand.NewSource(1)).Read(noise.Pixels)
+
+	images := []*Image{
+		org.Convert(PixelFormatGRAY),
+		org.Convert(PixelFormatRGB),
+		org.Convert(PixelFormatBGRX),
+		org.Convert(PixelFormatBGRA),
+		org,
+		premul,
+		noise,
+	}
+	for _, compression := range []TIFFCompression{TIFFDeflate, TIFFLZW, TIFFUncompressed} {
+		for _, predictor := range []bool{false, true} {
+			for _, img := range images {
+				params := &TIFFParams{Compression: compression, Predictor: predictor}
+				enc, err := EncodeTIFF(img, params)
+				require.Nil(t, err)
+				dec, err := DecompressWithOptions(enc, &DecompressParams{Format: img.Format, HasFormat: true})
+				require.Nil(t, err, "%v %v %v", compression, predictor, img.Format)
+				require.Equal(t, img.Width, dec.Width)
+				require.Equal(t, img.Height, dec.Height)
+				require.Equal(t, img.Premultiplied, dec.Premultiplied)
+				require.Equal(t, img.Pixels, dec.Pixels, "%v %v %v", compression, predictor, img.Format)
+			}
+		}
+	}
+
+	// CMYK, which we decode ourselves
+	cmyk := org.Convert(PixelFormatCMYK)
+	for _, compression := range []TIFFCompression{TIFFDeflate, TIFFLZW, TIFFUncompressed} {
+		for _, predictor := range []bool{false, true} {
+			for _, img := range []*Image{cmyk, cmyk.ConvertType(ComponentUint16)} {
+				enc, err := EncodeTIFF(img, &TIFFParams{Compression: compression, Predictor: predictor})
+				require.Nil(t, err)
+				dec, err := Decompress(enc)
+				require.Nil(t, err, "%v %v %v", compression, predictor, img.Type)
+				require.Equal(t, PixelFormatCMYK, dec.Format)
+				require.Equal(t, img.Type, dec.Type)
+				require.Equal(t, img.Pixels, dec.Pixels, "%v %v %v", compression, predictor, img.Type)
+			}
+		}
+	}
+	enc, err := EncodeTIFF(cmyk, nil)
+	require.Nil(t, err)
+	dec, err := DecompressWithOptions(enc, &DecompressParams{Format: PixelFormatRGB, HasFormat: true})
+	require.Nil(t, err)
+	require.Equal(t, cmyk.Convert(PixelFormatRGB).Pixels, dec.Pixels)
+
+	// CMYK is stored as the amount of ink
+	enc, err = EncodeTIFF(cmyk, &TIFFParams{Compression: TIFFUncompressed})
+	require.Nil(t, err)
+	cfg, err := DecodeConfig(enc)
+	require.Nil(t, err)
+	require.Equal(t, ColorspaceCMYK, cfg.Colorspace)
+	require.Equal(t, 4, cfg.NChan)
+	r, _ := newTIFFReader(enc)
+	offset, _ := r.tag(r.firstIFD(), tiffTagStripOffsets)
+	for i := range cmyk.Pixels {
+		require.Equal(t, 255-cmyk.Pixels[i], enc[int(offset)+i])
+	}
+
+	// A truncated CMYK file fails cleanly
+	for _, n := range []int{len(enc) - 1, len(enc) / 2} {
+		_, err = Decompress(enc[:n])
+		require.NotNil(t, err)
+	}
+
+	// EncodeWriter
+	buf := bytes.Buffer{}
+	require.Nil(t, EncodeWriter(&buf, org, EncodeParams{Format: FormatTIFF, TIFF: &TIFFParams{Compression: TIFFLZW}}))
+	dec, err = Decompress(buf.Bytes())
+	require.Nil(t, err)
+	require.Equal(t, org.Pixels, dec.Pixels)
+}
+
+// Build a big-endian (Motorola) uncompressed grayscale TIFF by hand
+func makeBigEndianTIFF(width, height int) []byte {
+	bo := binary.BigEndian
+	entries := [][3]uint32{
+		{tiffTagImageWidth, tiffTypeLong, uint32(width)},
+		{tiffTagImageLength, tiffTypeLong, uint32(height)},
+		{tiffTagBitsPerSample, tiffTypeShort, 8},
+		{tiffTagCompression, tiffTypeShort, 1},
+		{tiffTagPhotometricInterpretation, tiffTypeShort, tiffPhotometricBlackIsZero},
+		{tiffTagStripOffsets, tiffTypeLong, 0},
+		{tiffTagSamplesPerPixel, tiffTypeShort, 1},
+		{tiffTagRowsPerStrip, tiffTypeLong, uint32(height)},
+		{tiffTagStripByteCounts, tiffTypeLong, uint32(width * height)},
+	}
+	dataOffset := uint32(8 + 2 + 12*len(entries) + 4)
+	b := []byte("MM\x00*")
+	b = bo.AppendUint32(b, 8)
+	b = bo.AppendUint16(b, uint16(len(entries)))
+	for _, e := range entries {
+		if e[0] == tiffTagStripOffsets {
+			e[2] = dataOffset
+		}
+		b = bo.AppendUint16(b, uint16(e[0]))
+		b = bo.AppendUint16(b, uint16(e[1]))
+		b = bo.AppendUint32(b, 1)
+		if e[1] == tiffTypeShort {
+			b = bo.AppendUint16(b, uint16(e[2]))
+			b = bo.AppendUint16(b, 0)
+		} else {
+			b = bo.AppendUint32(b, e[2])
+		}
+	}
+	b = bo.AppendUint32(b, 0)
+	for i := 0; i < width*height; i++ {
+		b = append(b, byte(i))
+	}
+	return b
+}
+
+func TestBigEndianTIFF(t *testing.T) {
+	enc := makeBigEndianTIFF(17, 11)
+	cfg, err := DecodeConfig(enc)
+	require.Nil(t, err)
+	require.Equal(t, FormatTIFF, cfg.Format)
+	require.Equal(t, 17, cfg.Width)
+	require.Equal(t, 11, cfg.Height)
+	require.Equal(t, 1, cfg.NChan)
+
+	img, err := Decompress(enc)
+	require.Nil(t, err)
+	require.Equal(t, PixelFormatGRAY, img.Format)
+	require.Equal(t, 17, img.Width)
+	require.Equal(t, 11, img.Height)
+	require.Equal(t, byte(20), img.Pixels[20])
+
+	n, err := NumTIFFPages(enc)
+	require.Nil(t, err)
+	require.Equal(t, 1, n)
+}
+
+func TestTIFFPages(t *testing.T) {
+	pages := []*Image{
+		MakeRGB(30, 20),
+		MakeGray(31, 21),
+		MakeRGBA(32, 22),
+		MakeRGB(33, 23).Convert(PixelFormatCMYK),
+	}
+	buf := bytes.Buffer{}
+	require.Nil(t, EncodeTIFFPages(&buf, pages, &TIFFParams{Compression: TIFFLZW}))
+	enc := buf.Bytes()
+
+	n, err := NumTIFFPages(enc)
+	require.Nil(t, err)
+	require.Equal(t, 4, n)
+
+	dec, err := DecompressTIFFPages(enc, nil)
+	require.Nil(t, err)
+	require.Equal(t, 4, len(dec))
+	for i := range pages {
+		require.Equal(t, pages[i].Width, dec[i].Width)
+		require.Equal(t, pages[i].Pixels, dec[i].Convert(pages[i].Format).Pixels)
+	}
+
+	second, err := DecompressTIFFPage(enc, 1, &DecompressParams{Format: PixelFormatGRAY, HasFormat: true})
+	require.Nil(t, err)
+	require.Equal(t, pages[1].Pixels, second.Pixels)
+
+	_, err = DecompressTIFFPage(enc, 4, nil)
+	require.NotNil(t, err)
+
+	_, err = DecompressTIFFPages(enc, &DecompressParams{Limits: &DecodeLimits{MaxWidth: 31}})
+	require.ErrorIs(t, err, ErrImageTooLarge)
+
+	// Decompress returns the first page
+	first, err := DecompressWithOptions(enc, &DecompressParams{Format: PixelFormatRGB, HasFormat: true})
+	require.Nil(t, err)
+	require.Equal(t, pages[0].Pixels, first.Pixels)
+}
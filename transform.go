@@ -0,0 +1,182 @@
+package cimg
+
+/*
+#include <turbojpeg.h>
+*/
+import "C"
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"runtime"
+	"unsafe"
+)
+
+// TransformOp is a lossless JPEG transform operation
+type TransformOp C.int
+
+const (
+	TransformNone       TransformOp = C.TJXOP_NONE       // No transformation
+	TransformHFlip      TransformOp = C.TJXOP_HFLIP      // Flip horizontally (mirror image)
+	TransformVFlip      TransformOp = C.TJXOP_VFLIP      // Flip vertically
+	TransformTranspose  TransformOp = C.TJXOP_TRANSPOSE  // Transpose (flip along the top-left to bottom-right axis)
+	TransformTransverse TransformOp = C.TJXOP_TRANSVERSE // Transverse transpose (flip along the bottom-left to top-right axis)
+	TransformRot90      TransformOp = C.TJXOP_ROT90      // Rotate 90 degrees clockwise
+	TransformRot180     TransformOp = C.TJXOP_ROT180     // Rotate 180 degrees
+	TransformRot270     TransformOp = C.TJXOP_ROT270     // Rotate 270 degrees clockwise (90 degrees counter-clockwise)
+)
+
+// TransformParams control a lossless JPEG transform.
+// Lossless transforms operate on the DCT coefficients, so the image is not decoded and re-encoded.
+// The catch is that the JPEG is made up of MCU blocks (see MCUSize), and partial blocks on the
+// right and bottom edges cannot be moved to a new position. Use Trim or Perfect to control
+// what happens to those blocks.
+type TransformParams struct {
+	Op               TransformOp
+	Crop             image.Rectangle // If not empty, crop to this region of the transformed image. Min.X and Min.Y must be multiples of the transformed MCU size.
+	Gray             bool            // Discard the color channels, producing a grayscale JPEG
+	Perfect          bool            // Fail if there are partial MCU blocks that cannot be transformed
+	Trim             bool            // Discard partial MCU blocks that cannot be transformed
+	Progressive      bool            // Produce a progressive JPEG
+	CopyNone         bool            // Do not copy any extra markers (such as EXIF) from the source image
+	ResetOrientation bool            // If the image has an EXIF orientation, then set it to 1 (normal)
+}
+
+// MCUSize returns the size of a JPEG MCU block, for the given chroma subsampling
+func MCUSize(sampling Sampling) (width, height int) {
+	switch sampling {
+	case Sampling444, SamplingGray:
+		return 8, 8
+	case Sampling422:
+		return 16, 8
+	case Sampling420:
+		return 16, 16
+	case Sampling440:
+		return 8, 16
+	case Sampling411:
+		return 32, 8
+	}
+	return 0, 0
+}
+
+// TransformForOrientation returns the transform that turns an image with the given EXIF
+// orientation into an image with natural orientation (see ExifData.GetOrientation).
+func TransformForOrientation(orientation int) TransformOp {
+	switch orientation {
+	case 2:
+		return TransformHFlip
+	case 3:
+		return TransformRot180
+	case 4:
+		return TransformVFlip
+	case 5:
+		return TransformTranspose
+	case 6:
+		return TransformRot90
+	case 7:
+		return TransformTransverse
+	case 8:
+		return TransformRot270
+	}
+	return TransformNone
+}
+
+// Transform losslessly transforms a JPEG image
+func Transform(encoded []byte, params TransformParams) ([]byte, error) {
+	if len(encoded) == 0 {
+		return nil, errors.New("Empty JPEG buffer")
+	}
+	t, err := getTransformer()
+	if err != nil {
+		return nil, err
+	}
+	defer putTransformer(t)
+	handle := t.handle
+
+	var xf C.tjtransform
+	xf.op = C.int(params.Op)
+	if !params.Crop.Empty() {
+		if params.Crop.Min.X < 0 || params.Crop.Min.Y < 0 {
+			return nil, fmt.Errorf("Invalid crop rectangle %v", params.Crop)
+		}
+		xf.options |= C.TJXOPT_CROP
+		xf.r.x = C.int(params.Crop.Min.X)
+		xf.r.y = C.int(params.Crop.Min.Y)
+		xf.r.w = C.int(params.Crop.Dx())
+		xf.r.h = C.int(params.Crop.Dy())
+	}
+	if params.Gray {
+		xf.options |= C.TJXOPT_GRAY
+	}
+	if params.Perfect {
+		xf.options |= C.TJXOPT_PERFECT
+	}
+	if params.Trim {
+		xf.options |= C.TJXOPT_TRIM
+	}
+	if params.Progressive {
+		xf.options |= C.TJXOPT_PROGRESSIVE
+	}
+	if params.CopyNone {
+		xf.options |= C.TJXOPT_COPYNONE
+	}
+
+	var outBuf *C.uchar
+	var outBufSize C.ulong
+
+	// int tjTransform(tjhandle handle, const unsigned char *jpegBuf, unsigned long jpegSize, int n,
+	// unsigned char **dstBufs, unsigned long *dstSizes, tjtransform *transforms, int flags);
+	res := C.tjTransform(handle, (*C.uchar)(&encoded[0]), C.ulong(len(encoded)), 1, &outBuf, &outBufSize, &xf, 0)
+
+	var out []byte
+	err = makeError(handle, res)
+	runtime.KeepAlive(t)
+	if outBuf != nil {
+		out = C.GoBytes(unsafe.Pointer(outBuf), C.int(outBufSize))
+		C.tjFree(outBuf)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if params.ResetOrientation && !params.CopyNone {
+		exif, err := LoadExif(out)
+		if err != nil {
+			return nil, err
+		}
+		if exif.GetOrientation() > 1 {
+			if err := exif.SetOrientation(1); err != nil {
+				return nil, err
+			}
+			buf := bytes.Buffer{}
+			if err := exif.Save(&buf); err != nil {
+				return nil, err
+			}
+			out = buf.Bytes()
+		}
+	}
+	return out, nil
+}
+
+// LosslessUnrotateExif is the lossless JPEG equivalent of UnrotateExif.
+// It reads the EXIF orientation of the JPEG, applies the transform that brings the image
+// into its natural orientation, and then sets the EXIF orientation to 1.
+// Partial MCU blocks on the edges that cannot be transformed are trimmed.
+// If the image has no EXIF orientation, then it is returned unmodified.
+func LosslessUnrotateExif(encoded []byte) ([]byte, error) {
+	exif, err := LoadExif(encoded)
+	if err != nil {
+		return nil, err
+	}
+	op := TransformForOrientation(exif.GetOrientation())
+	if op == TransformNone {
+		return encoded, nil
+	}
+	return Transform(encoded, TransformParams{
+		Op:               op,
+		Trim:             true,
+		ResetOrientation: true,
+	})
+}
@@ -0,0 +1,69 @@
+package cimg
+
+import (
+	"bytes"
+	"image"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransform(t *testing.T) {
+	org := MakeRGB(64, 48)
+	jpg, err := Compress(org, MakeCompressParams(Sampling444, 95, 0))
+	require.Nil(t, err)
+	ref, err := Decompress(jpg)
+	require.Nil(t, err)
+
+	for _, angle := range []int{90, 180, 270} {
+		op := map[int]TransformOp{90: TransformRot90, 180: TransformRot180, 270: TransformRot270}[angle]
+		out, err := Transform(jpg, TransformParams{Op: op, Perfect: true})
+		require.Nil(t, err)
+		img, err := Decompress(out)
+		require.Nil(t, err)
+		width, height := ref.Width, ref.Height
+		if angle != 180 {
+			width, height = height, width
+		}
+		expect := NewImage(width, height, ref.Format)
+		Rotate(ref, expect, float64(angle)*Deg2Rad, nil)
+		require.Less(t, AvgRGBDifference(expect, img), 3.0)
+	}
+
+	// Crop
+	out, err := Transform(jpg, TransformParams{Crop: image.Rect(8, 16, 40, 40)})
+	require.Nil(t, err)
+	cfg, err := DecodeConfig(out)
+	require.Nil(t, err)
+	require.Equal(t, 32, cfg.Width)
+	require.Equal(t, 24, cfg.Height)
+
+	// Crop that is not aligned to the MCU grid
+	_, err = Transform(jpg, TransformParams{Crop: image.Rect(3, 0, 40, 40)})
+	require.NotNil(t, err)
+
+	// Gray
+	out, err = Transform(jpg, TransformParams{Gray: true})
+	require.Nil(t, err)
+	cfg, err = DecodeConfig(out)
+	require.Nil(t, err)
+	require.Equal(t, SamplingGray, cfg.Sampling)
+}
+
+func TestLosslessUnrotateExif(t *testing.T) {
+	jpg, err := Compress(MakeRGB(64, 48), MakeCompressParams(Sampling420, 95, 0))
+	require.Nil(t, err)
+	jpgExif, err := LoadExif(jpg)
+	require.Nil(t, err)
+	require.Nil(t, jpgExif.SetOrientation(6))
+	buf := bytes.Buffer{}
+	require.Nil(t, jpgExif.Save(&buf))
+
+	out, err := LosslessUnrotateExif(buf.Bytes())
+	require.Nil(t, err)
+	cfg, err := DecodeConfig(out)
+	require.Nil(t, err)
+	require.Equal(t, 48, cfg.Width)
+	require.Equal(t, 64, cfg.Height)
+	require.Equal(t, 1, cfg.Orientation)
+}
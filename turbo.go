@@ -8,7 +8,10 @@ import "C"
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"io"
+	"runtime"
 	"unsafe"
 )
 
@@ -19,6 +22,21 @@ const (
 	Sampling422  Sampling = C.TJSAMP_422
 	Sampling420  Sampling = C.TJSAMP_420
 	SamplingGray Sampling = C.TJSAMP_GRAY
+	Sampling440  Sampling = C.TJSAMP_440
+	Sampling411  Sampling = C.TJSAMP_411
+
+	SamplingUnknown Sampling = -1 // Used for images that are not JPEG
+)
+
+// Colorspace is the colorspace of the pixels inside a JPEG file
+type Colorspace C.int
+
+const (
+	ColorspaceRGB   Colorspace = C.TJCS_RGB
+	ColorspaceYCbCr Colorspace = C.TJCS_YCbCr
+	ColorspaceGray  Colorspace = C.TJCS_GRAY
+	ColorspaceCMYK  Colorspace = C.TJCS_CMYK
+	ColorspaceYCCK  Colorspace = C.TJCS_YCCK
 )
 
 type PixelFormat C.int
@@ -75,11 +93,21 @@ func MakeCompressParams(sampling Sampling, quality int, flags Flags) CompressPar
 	}
 }
 
-// Compress compresses an image using TurboJPEG
+// Compress compresses an image using TurboJPEG.
+// JPEG stores 8 bits per channel, so 16-bit images are reduced to 8 bits first.
+// JPEG has no alpha channel, so alpha is discarded, after unpremultiplying if necessary.
 func Compress(img *Image, params CompressParams) ([]byte, error) {
-	encoder := C.tjInitCompress()
-	defer C.tjDestroy(encoder)
+	encoder, err := getEncoder()
+	if err != nil {
+		return nil, err
+	}
+	defer putEncoder(encoder)
+	return encoder.Compress(img, params)
+}
 
+// Compress is the same as the package-level Compress, but uses this Encoder's handle
+func (e *Encoder) Compress(img *Image, params CompressParams) ([]byte, error) {
+	img = img.asUint8().withStraightAlpha()
 	var outBuf *C.uchar
 	var outBufSize C.ulong
 
@@ -90,11 +118,12 @@ func Compress(img *Image, params CompressParams) ([]byte, error) {
 
 	// int tjCompress2(tjhandle handle, const unsigned char *srcBuf, int width, int pitch, int height, int pixelFormat,
 	// unsigned char **jpegBuf, unsigned long *jpegSize, int jpegSubsamp, int jpegQual, int flags);
-	res := C.tjCompress2(encoder, (*C.uchar)(&img.Pixels[0]), C.int(img.Width), C.int(img.Stride), C.int(img.Height), C.int(img.Format),
+	res := C.tjCompress2(e.handle, (*C.uchar)(&img.Pixels[0]), C.int(img.Width), C.int(img.Stride), C.int(img.Height), C.int(img.Format),
 		&outBuf, &outBufSize, C.int(params.Sampling), C.int(params.Quality), C.int(params.Flags))
 
 	var enc []byte
-	err := makeError(encoder, res)
+	err := makeError(e.handle, res)
+	runtime.KeepAlive(e)
 	if outBuf != nil {
 		enc = C.GoBytes(unsafe.Pointer(outBuf), C.int(outBufSize))
 		C.tjFree(outBuf)
@@ -106,39 +135,330 @@ func Compress(img *Image, params CompressParams) ([]byte, error) {
 	return enc, nil
 }
 
+// CompressBound returns the maximum size of a JPEG image with the given dimensions and
+// chroma subsampling. This is the size of the buffer that CompressInto needs.
+// Returns zero if the sampling is invalid.
+func CompressBound(width, height int, sampling Sampling) int {
+	size := C.tjBufSize(C.int(width), C.int(height), C.int(sampling))
+	if size == ^C.ulong(0) {
+		return 0
+	}
+	return int(size)
+}
+
+// CompressInto compresses an image into dst, and returns the number of bytes written.
+// dst must be at least CompressBound(img.Width, img.Height, params.Sampling) bytes long.
+// This avoids the allocation and copy of the output buffer that Compress performs.
+func CompressInto(img *Image, params CompressParams, dst []byte) (int, error) {
+	encoder, err := getEncoder()
+	if err != nil {
+		return 0, err
+	}
+	defer putEncoder(encoder)
+	return encoder.CompressInto(img, params, dst)
+}
+
+// CompressInto is the same as the package-level CompressInto, but uses this Encoder's handle
+func (e *Encoder) CompressInto(img *Image, params CompressParams, dst []byte) (int, error) {
+	img = img.asUint8().withStraightAlpha()
+	if img.Format == PixelFormatGRAY {
+		params.Sampling = SamplingGray
+	}
+	// With TJFLAG_NOREALLOC, TurboJPEG assumes that the buffer is tjBufSize bytes, regardless
+	// of the size that we pass in, so we must check it ourselves.
+	bound := CompressBound(img.Width, img.Height, params.Sampling)
+	if bound == 0 {
+		return 0, fmt.Errorf("Invalid JPEG sampling %v", params.Sampling)
+	}
+	if len(dst) < bound {
+		return 0, fmt.Errorf("JPEG output buffer is %v bytes, but needs to be at least %v bytes", len(dst), bound)
+	}
+
+	// outBuf is a Go pointer inside Go memory, so it must be pinned before we can pass its address to C
+	pinner := runtime.Pinner{}
+	defer pinner.Unpin()
+	outBuf := (*C.uchar)(&dst[0])
+	pinner.Pin(outBuf)
+	outBufSize := C.ulong(len(dst))
+
+	res := C.tjCompress2(e.handle, (*C.uchar)(&img.Pixels[0]), C.int(img.Width), C.int(img.Stride), C.int(img.Height), C.int(img.Format),
+		&outBuf, &outBufSize, C.int(params.Sampling), C.int(params.Quality), C.int(params.Flags|FlagNoRealloc))
+	err := makeError(e.handle, res)
+	runtime.KeepAlive(e)
+	if err != nil {
+		return 0, err
+	}
+	return int(outBufSize), nil
+}
+
+// CompressTo compresses an image and writes the JPEG to w.
+// The JPEG is written straight out of TurboJPEG's buffer, without first copying it into Go memory.
+func CompressTo(w io.Writer, img *Image, params CompressParams) error {
+	encoder, err := getEncoder()
+	if err != nil {
+		return err
+	}
+	defer putEncoder(encoder)
+	return encoder.CompressTo(w, img, params)
+}
+
+// CompressTo is the same as the package-level CompressTo, but uses this Encoder's handle
+func (e *Encoder) CompressTo(w io.Writer, img *Image, params CompressParams) error {
+	img = img.asUint8().withStraightAlpha()
+	var outBuf *C.uchar
+	var outBufSize C.ulong
+
+	if img.Format == PixelFormatGRAY {
+		params.Sampling = SamplingGray
+	}
+
+	res := C.tjCompress2(e.handle, (*C.uchar)(&img.Pixels[0]), C.int(img.Width), C.int(img.Stride), C.int(img.Height), C.int(img.Format),
+		&outBuf, &outBufSize, C.int(params.Sampling), C.int(params.Quality), C.int(params.Flags&^FlagNoRealloc))
+	if outBuf != nil {
+		defer C.tjFree(outBuf)
+	}
+	err := makeError(e.handle, res)
+	runtime.KeepAlive(e)
+	if err != nil {
+		return err
+	}
+	// io.Writer implementations must not retain the slice, so it's safe to free the buffer after Write returns
+	_, err = w.Write(unsafe.Slice((*byte)(unsafe.Pointer(outBuf)), int(outBufSize)))
+	return err
+}
+
+// ScalingFactor is a fraction (Num/Denom) by which TurboJPEG can scale an image during decompression.
+// Scaling is performed in the DCT domain, so it is much cheaper than decoding at full resolution and then resizing.
+type ScalingFactor struct {
+	Num   int
+	Denom int
+}
+
+// Scale returns the scaled size of dimension (this is the TJSCALED macro)
+func (s ScalingFactor) Scale(dimension int) int {
+	return (dimension*s.Num + s.Denom - 1) / s.Denom
+}
+
+// ScalingFactors returns the scaling factors supported by TurboJPEG, from largest to smallest
+func ScalingFactors() []ScalingFactor {
+	n := C.int(0)
+	factors := C.tjGetScalingFactors(&n)
+	list := unsafe.Slice(factors, int(n))
+	result := make([]ScalingFactor, 0, len(list))
+	for _, f := range list {
+		result = append(result, ScalingFactor{Num: int(f.num), Denom: int(f.denom)})
+	}
+	return result
+}
+
+// ChooseScalingFactor returns the scaling factor that produces the smallest image which is
+// still at least minWidth x minHeight. Only downscaling factors are considered, so if the
+// image is already smaller than minWidth x minHeight, then 1/1 is returned.
+func ChooseScalingFactor(width, height, minWidth, minHeight int) ScalingFactor {
+	best := ScalingFactor{Num: 1, Denom: 1}
+	for _, f := range ScalingFactors() {
+		if f.Num > f.Denom {
+			continue
+		}
+		if f.Scale(width) >= minWidth && f.Scale(height) >= minHeight && f.Num*best.Denom < best.Num*f.Denom {
+			best = f
+		}
+	}
+	return best
+}
+
+func isSupportedScalingFactor(s ScalingFactor) bool {
+	for _, f := range ScalingFactors() {
+		if f.Num*s.Denom == s.Num*f.Denom {
+			return true
+		}
+	}
+	return false
+}
+
+// DecompressParams control how an image is decoded
+type DecompressParams struct {
+	Format    PixelFormat   // Output pixel format. Only used if HasFormat is true.
+	HasFormat bool          // If false, then the decoder's natural format is used, so the zero value of DecompressParams keeps alpha.
+	Flags     Flags         // TurboJPEG decompression flags (ignored for PNG and TIFF)
+	Scale     ScalingFactor // DCT scaling for JPEG images. The zero value means no scaling. Ignored for PNG and TIFF.
+	Limits    *DecodeLimits // If not nil, then images that exceed these limits fail with ErrImageTooLarge
+}
+
+// outFormat returns the requested output format, or PixelFormatUNKNOWN for the decoder's natural format
+func (p *DecompressParams) outFormat() PixelFormat {
+	if !p.HasFormat {
+		return PixelFormatUNKNOWN
+	}
+	return p.Format
+}
+
+// isTIFF recognizes both little-endian (Intel) and big-endian (Motorola) TIFF files
+func isTIFF(encoded []byte) bool {
+	return len(encoded) > 4 && (bytes.Compare(encoded[:4], []byte("II*\x00")) == 0 || bytes.Compare(encoded[:4], []byte("MM\x00*")) == 0)
+}
+
+func isPNG(encoded []byte) bool {
+	return len(encoded) > 8 && bytes.Compare(encoded[:8], []byte("\x89\x50\x4e\x47\x0d\x0a\x1a\x0a")) == 0
+}
+
 // Load an image into memory.
 // JPEG: Uses TurboJPEG
 // PNG: Uses Go's native PNG library
 // TIFF: Uses golang.org/x/image/tiff
 // The resulting image is RGB for JPEGs, or RGBA/Gray for PNG
 func Decompress(encoded []byte) (*Image, error) {
-	if len(encoded) > 4 && bytes.Compare(encoded[:4], []byte("II*\x00")) == 0 {
-		return decompressTIFF(encoded)
+	return DecompressWithOptions(encoded, nil)
+}
+
+// Decompress is the same as the package-level Decompress, but uses this Decoder's handle
+func (d *Decoder) Decompress(encoded []byte) (*Image, error) {
+	return d.DecompressWithOptions(encoded, nil)
+}
+
+// DecompressWithOptions is like Decompress, but lets you choose the output pixel format.
+// JPEG images are decoded by TurboJPEG directly into the requested format, while images
+// in other formats are converted after decoding.
+// Returns ErrUnknownFormat if the image is not in any of the registered formats (see RegisterCodec).
+// If params is nil, then the behaviour is the same as Decompress.
+func DecompressWithOptions(encoded []byte, params *DecompressParams) (*Image, error) {
+	decoder, err := getDecoder()
+	if err != nil {
+		return nil, err
+	}
+	defer putDecoder(decoder)
+	return decoder.DecompressWithOptions(encoded, params)
+}
+
+// DecompressWithOptions is the same as the package-level DecompressWithOptions, but uses this Decoder's handle
+func (d *Decoder) DecompressWithOptions(encoded []byte, params *DecompressParams) (*Image, error) {
+	c := detectCodec(encoded)
+	if c == nil {
+		return nil, ErrUnknownFormat
+	}
+	return d.decompressWithCodec(c, encoded, params)
+}
+
+func (d *Decoder) decompressWithCodec(c *Codec, encoded []byte, params *DecompressParams) (*Image, error) {
+	if params == nil {
+		params = &DecompressParams{}
+	}
+	if err := d.checkLimitsWithCodec(c, params.Limits, encoded); err != nil {
+		return nil, err
+	}
+	if c == jpegCodec {
+		// Use our own handle, instead of one from the pool
+		return d.decompressJPEG(encoded, params)
 	}
-	if len(encoded) > 8 && bytes.Compare(encoded[:8], []byte("\x89\x50\x4e\x47\x0d\x0a\x1a\x0a")) == 0 {
-		return decompressPNG(encoded)
+	return c.Decode(encoded, params)
+}
+
+// DecompressScaled decodes an image at the smallest size that is at least minWidth x minHeight.
+// For JPEG images, this uses TurboJPEG's DCT scaling (see ChooseScalingFactor), and the aspect
+// ratio is preserved, so one of the dimensions may be larger than requested.
+// PNG and TIFF images are decoded at their original size.
+// params may be nil. The Scale field of params is ignored.
+func DecompressScaled(encoded []byte, minWidth, minHeight int, params *DecompressParams) (*Image, error) {
+	decoder, err := getDecoder()
+	if err != nil {
+		return nil, err
 	}
+	defer putDecoder(decoder)
+	return decoder.DecompressScaled(encoded, minWidth, minHeight, params)
+}
 
-	decoder := C.tjInitDecompress()
-	defer C.tjDestroy(decoder)
+// DecompressScaled is the same as the package-level DecompressScaled, but uses this Decoder's handle
+func (d *Decoder) DecompressScaled(encoded []byte, minWidth, minHeight int, params *DecompressParams) (*Image, error) {
+	p := DecompressParams{}
+	if params != nil {
+		p = *params
+	}
+	p.Scale = ScalingFactor{}
+	if p.Limits != nil {
+		if err := p.Limits.checkInputSize(len(encoded)); err != nil {
+			return nil, err
+		}
+	}
+	if detectCodec(encoded) == jpegCodec {
+		width, height, _, _, err := d.decompressJPEGHeader(encoded)
+		if err != nil {
+			return nil, err
+		}
+		p.Scale = ChooseScalingFactor(width, height, minWidth, minHeight)
+	}
+	return d.DecompressWithOptions(encoded, &p)
+}
 
-	width := C.int(0)
-	height := C.int(0)
-	sampling := C.int(0)
-	colorspace := C.int(0)
+// DecompressToFit decodes an image and resizes it to exactly width x height.
+// JPEG images are first decoded with DecompressScaled, so that the final resize has
+// as little work to do as possible.
+// params and resizeParams may be nil.
+func DecompressToFit(encoded []byte, width, height int, params *DecompressParams, resizeParams *ResizeParams) (*Image, error) {
+	decoder, err := getDecoder()
+	if err != nil {
+		return nil, err
+	}
+	defer putDecoder(decoder)
+	return decoder.DecompressToFit(encoded, width, height, params, resizeParams)
+}
 
-	err := makeError(decoder, C.tjDecompressHeader3(decoder, (*C.uchar)(&encoded[0]), C.ulong(len(encoded)), &width, &height, &sampling, &colorspace))
+// DecompressToFit is the same as the package-level DecompressToFit, but uses this Decoder's handle
+func (d *Decoder) DecompressToFit(encoded []byte, width, height int, params *DecompressParams, resizeParams *ResizeParams) (*Image, error) {
+	img, err := d.DecompressScaled(encoded, width, height, params)
 	if err != nil {
 		return nil, err
 	}
+	if img.Width == width && img.Height == height {
+		return img, nil
+	}
+	dst := NewImageOfType(width, height, img.Format, img.Type)
+	dst.Premultiplied = img.Premultiplied
+	if err := Resize(img, dst, resizeParams); err != nil {
+		return nil, err
+	}
+	return dst, nil
+}
 
-	outBuf := make([]byte, width*height*3)
-	stride := C.int(width * 3)
-	outFormat := PixelFormatRGB
+func (d *Decoder) decompressJPEGHeader(encoded []byte) (width, height int, sampling Sampling, colorspace Colorspace, err error) {
+	if len(encoded) == 0 {
+		return 0, 0, 0, 0, errors.New("Empty JPEG buffer")
+	}
+	w := C.int(0)
+	h := C.int(0)
+	s := C.int(0)
+	cs := C.int(0)
+	err = makeError(d.handle, C.tjDecompressHeader3(d.handle, (*C.uchar)(&encoded[0]), C.ulong(len(encoded)), &w, &h, &s, &cs))
+	runtime.KeepAlive(d)
+	return int(w), int(h), Sampling(s), Colorspace(cs), err
+}
+
+func (d *Decoder) decompressJPEG(encoded []byte, params *DecompressParams) (*Image, error) {
+	w, h, _, _, err := d.decompressJPEGHeader(encoded)
+	if err != nil {
+		return nil, err
+	}
+	width := C.int(w)
+	height := C.int(h)
+
+	if params.Scale.Num != 0 {
+		if !isSupportedScalingFactor(params.Scale) {
+			return nil, fmt.Errorf("Unsupported JPEG scaling factor %v/%v", params.Scale.Num, params.Scale.Denom)
+		}
+		width = C.int(params.Scale.Scale(int(width)))
+		height = C.int(params.Scale.Scale(int(height)))
+	}
+
+	outFormat := params.outFormat()
+	if outFormat == PixelFormatUNKNOWN {
+		outFormat = PixelFormatRGB
+	}
+	stride := C.int(NChan(outFormat)) * width
+	outBuf := make([]byte, stride*height)
 
 	// int tjDecompress2(tjhandle handle, const unsigned char *jpegBuf, unsigned long jpegSize, unsigned char *dstBuf,
 	// int width, int pitch, int height, int pixelFormat, int flags);
-	err = makeError(decoder, C.tjDecompress2(decoder, (*C.uchar)(&encoded[0]), C.ulong(len(encoded)), (*C.uchar)(&outBuf[0]), width, stride, height, C.int(outFormat), 0))
+	err = makeError(d.handle, C.tjDecompress2(d.handle, (*C.uchar)(&encoded[0]), C.ulong(len(encoded)), (*C.uchar)(&outBuf[0]), width, stride, height, C.int(outFormat), C.int(params.Flags)))
+	runtime.KeepAlive(d)
 	if err != nil {
 		return nil, err
 	}
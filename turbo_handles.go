@@ -0,0 +1,137 @@
+package cimg
+
+/*
+#include <turbojpeg.h>
+*/
+import "C"
+
+import (
+	"errors"
+	"runtime"
+	"sync"
+)
+
+// Encoder owns a TurboJPEG compression handle, which is reused for every image that it compresses.
+// An Encoder may be used for any number of images, but not from multiple goroutines at the same time.
+// The package-level functions (eg Compress) draw Encoders from a goroutine-safe pool, so you only
+// need an Encoder if you want explicit control over the handle's lifetime.
+type Encoder struct {
+	handle C.tjhandle
+}
+
+// Decoder owns a TurboJPEG decompression handle, which is reused for every image that it decompresses.
+// A Decoder may be used for any number of images, but not from multiple goroutines at the same time.
+// The package-level functions (eg Decompress) draw Decoders from a goroutine-safe pool, so you only
+// need a Decoder if you want explicit control over the handle's lifetime.
+type Decoder struct {
+	handle C.tjhandle
+}
+
+// transformer owns a TurboJPEG transform handle
+type transformer struct {
+	handle C.tjhandle
+}
+
+func initError(what string) error {
+	// With a nil handle, tjGetErrorStr2 returns the last global error
+	return errors.New("turbojpeg error: " + what + ": " + C.GoString(C.tjGetErrorStr2(nil)))
+}
+
+// NewEncoder creates a new TurboJPEG compressor.
+// Call Close when you are done with it. If you forget, the handle is freed when the Encoder is garbage collected.
+func NewEncoder() (*Encoder, error) {
+	handle := C.tjInitCompress()
+	if handle == nil {
+		return nil, initError("tjInitCompress")
+	}
+	e := &Encoder{handle: handle}
+	runtime.SetFinalizer(e, (*Encoder).Close)
+	return e, nil
+}
+
+// Close frees the TurboJPEG handle. It is safe to call Close more than once.
+func (e *Encoder) Close() {
+	if e.handle != nil {
+		C.tjDestroy(e.handle)
+		e.handle = nil
+	}
+}
+
+// NewDecoder creates a new TurboJPEG decompressor.
+// Call Close when you are done with it. If you forget, the handle is freed when the Decoder is garbage collected.
+func NewDecoder() (*Decoder, error) {
+	handle := C.tjInitDecompress()
+	if handle == nil {
+		return nil, initError("tjInitDecompress")
+	}
+	d := &Decoder{handle: handle}
+	runtime.SetFinalizer(d, (*Decoder).Close)
+	return d, nil
+}
+
+// Close frees the TurboJPEG handle. It is safe to call Close more than once.
+func (d *Decoder) Close() {
+	if d.handle != nil {
+		C.tjDestroy(d.handle)
+		d.handle = nil
+	}
+}
+
+func newTransformer() (*transformer, error) {
+	handle := C.tjInitTransform()
+	if handle == nil {
+		return nil, initError("tjInitTransform")
+	}
+	t := &transformer{handle: handle}
+	runtime.SetFinalizer(t, (*transformer).Close)
+	return t, nil
+}
+
+func (t *transformer) Close() {
+	if t.handle != nil {
+		C.tjDestroy(t.handle)
+		t.handle = nil
+	}
+}
+
+// Handles that are dropped by a sync.Pool are freed by their finalizers.
+// Because of the finalizers, every cgo call that uses a handle must be followed by runtime.KeepAlive
+// on its owner, otherwise the owner could be collected, and the handle destroyed, during the call.
+var (
+	encoderPool     sync.Pool
+	decoderPool     sync.Pool
+	transformerPool sync.Pool
+)
+
+func getEncoder() (*Encoder, error) {
+	if e, ok := encoderPool.Get().(*Encoder); ok {
+		return e, nil
+	}
+	return NewEncoder()
+}
+
+func putEncoder(e *Encoder) {
+	encoderPool.Put(e)
+}
+
+func getDecoder() (*Decoder, error) {
+	if d, ok := decoderPool.Get().(*Decoder); ok {
+		return d, nil
+	}
+	return NewDecoder()
+}
+
+func putDecoder(d *Decoder) {
+	decoderPool.Put(d)
+}
+
+func getTransformer() (*transformer, error) {
+	if t, ok := transformerPool.Get().(*transformer); ok {
+		return t, nil
+	}
+	return newTransformer()
+}
+
+func putTransformer(t *transformer) {
+	transformerPool.Put(t)
+}
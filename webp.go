@@ -0,0 +1,416 @@
+package cimg
+
+/*
+#cgo LDFLAGS: -lwebp
+#include <webp/decode.h>
+#include <webp/encode.h>
+
+// Encode with the advanced API, so that we can control the method and exactness.
+// Returns a WebPEncodingError, and on success, a buffer that must be freed with WebPFree.
+static int cimgWebPEncode(const uint8_t* pix, int width, int height, int stride, int hasAlpha, float quality, int method, int lossless, uint8_t** out, size_t* outSize) {
+	WebPConfig config;
+	WebPPicture pic;
+	WebPMemoryWriter wrt;
+	if (!WebPConfigInit(&config) || !WebPPictureInit(&pic))
+		return VP8_ENC_ERROR_INVALID_CONFIGURATION;
+	config.quality = quality;
+	config.method = method;
+	config.lossless = lossless;
+	// Don't discard the color of fully transparent pixels, so that lossless really is lossless
+	config.exact = lossless;
+	if (!WebPValidateConfig(&config))
+		return VP8_ENC_ERROR_INVALID_CONFIGURATION;
+
+	pic.use_argb = lossless;
+	pic.width = width;
+	pic.height = height;
+	int ok = hasAlpha ? WebPPictureImportRGBA(&pic, pix, stride) : WebPPictureImportRGB(&pic, pix, stride);
+	if (!ok) {
+		int err = pic.error_code;
+		WebPPictureFree(&pic);
+		return err == VP8_ENC_OK ? VP8_ENC_ERROR_OUT_OF_MEMORY : err;
+	}
+
+	WebPMemoryWriterInit(&wrt);
+	pic.writer = WebPMemoryWrite;
+	pic.custom_ptr = &wrt;
+	ok = WebPEncode(&config, &pic);
+	int err = pic.error_code;
+	WebPPictureFree(&pic);
+	if (!ok) {
+		WebPMemoryWriterClear(&wrt);
+		return err;
+	}
+	*out = wrt.mem;
+	*outSize = wrt.size;
+	return VP8_ENC_OK;
+}
+*/
+import "C"
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"time"
+	"unsafe"
+)
+
+// The defaults of NewWebPParams, which are the same as libwebp's
+const (
+	WebPDefaultQuality = 75
+	WebPDefaultMethod  = 4
+)
+
+// WebPParams are the options for encoding a WebP image.
+// Use NewWebPParams for the defaults. Zero is a valid Quality and Method.
+type WebPParams struct {
+	Quality  float32 // 0 to 100. For lossless, this is the compression effort.
+	Lossless bool    // Encode losslessly. Fully transparent pixels keep their color.
+	Method   int     // Compression effort, from 0 (fastest) to 6 (slowest and smallest)
+}
+
+// Return default WebP encoding parameters
+func NewWebPParams() *WebPParams {
+	return &WebPParams{
+		Quality: WebPDefaultQuality,
+		Method:  WebPDefaultMethod,
+	}
+}
+
+// WebPFrame is one frame of a WebP animation
+type WebPFrame struct {
+	Image   *Image          // The complete canvas, after this frame has been drawn onto it
+	Bounds  image.Rectangle // The area of the canvas that this frame draws
+	Delay   time.Duration   // How long to show this frame
+	Blend   bool            // If true, then the frame is alpha blended onto the canvas, otherwise it replaces Bounds
+	Dispose bool            // If true, then Bounds is cleared to transparent after this frame has been shown
+}
+
+// WebPAnimation is a decoded WebP animation
+type WebPAnimation struct {
+	Width           int
+	Height          int
+	Frames          []WebPFrame
+	LoopCount       int        // 0 loops forever
+	BackgroundColor color.RGBA // A hint from the file. Like libwebp, we clear the canvas to transparent.
+}
+
+var webpEncodingErrors = map[C.int]string{
+	C.VP8_ENC_ERROR_OUT_OF_MEMORY:           "out of memory",
+	C.VP8_ENC_ERROR_BITSTREAM_OUT_OF_MEMORY: "out of memory while flushing bits",
+	C.VP8_ENC_ERROR_NULL_PARAMETER:          "null parameter",
+	C.VP8_ENC_ERROR_INVALID_CONFIGURATION:   "invalid configuration",
+	C.VP8_ENC_ERROR_BAD_DIMENSION:           "bad image dimensions",
+	C.VP8_ENC_ERROR_PARTITION0_OVERFLOW:     "partition 0 is too big",
+	C.VP8_ENC_ERROR_PARTITION_OVERFLOW:      "partition is too big",
+	C.VP8_ENC_ERROR_BAD_WRITE:               "error while writing",
+	C.VP8_ENC_ERROR_FILE_TOO_BIG:            "file is too big",
+}
+
+func isWebP(encoded []byte) bool {
+	return len(encoded) > 16 && bytes.Equal(encoded[:4], []byte("RIFF")) && bytes.Equal(encoded[8:12], []byte("WEBP"))
+}
+
+func decodeConfigWebP(encoded []byte) (ImageConfig, error) {
+	cfg, _, err := webpInfo(encoded)
+	return cfg, err
+}
+
+// webpInfo reads the header of a WebP file, and returns true if the file is animated
+func webpInfo(encoded []byte) (ImageConfig, bool, error) {
+	if !isWebP(encoded) {
+		return ImageConfig{}, false, errors.New("Not a WebP file")
+	}
+	var f C.WebPBitstreamFeatures
+	if status := C.WebPGetFeatures((*C.uint8_t)(&encoded[0]), C.size_t(len(encoded)), &f); status != C.VP8_STATUS_OK {
+		return ImageConfig{}, false, fmt.Errorf("Invalid WebP file (status %v)", int(status))
+	}
+	cfg := ImageConfig{
+		Format:     FormatWebP,
+		Width:      int(f.width),
+		Height:     int(f.height),
+		NChan:      3,
+		BitDepth:   8,
+		Sampling:   SamplingUnknown,
+		Colorspace: ColorspaceRGB,
+	}
+	if f.has_alpha != 0 {
+		cfg.NChan = 4
+	}
+	return cfg, f.has_animation != 0, nil
+}
+
+// decodeWebPStill decodes a WebP file that is not animated, into RGB or RGBA
+func decodeWebPStill(encoded []byte, width, height int, format PixelFormat) (*Image, error) {
+	img := NewImage(width, height, format)
+	out := (*C.uint8_t)(unsafe.Pointer(&img.Pixels[0]))
+	var res *C.uint8_t
+	if format == PixelFormatRGBA {
+		res = C.WebPDecodeRGBAInto((*C.uint8_t)(&encoded[0]), C.size_t(len(encoded)), out, C.size_t(len(img.Pixels)), C.int(img.Stride))
+	} else {
+		res = C.WebPDecodeRGBInto((*C.uint8_t)(&encoded[0]), C.size_t(len(encoded)), out, C.size_t(len(img.Pixels)), C.int(img.Stride))
+	}
+	if res == nil {
+		return nil, errors.New("WebP decoding failed")
+	}
+	return img, nil
+}
+
+// decompressWebP decodes a WebP image. If the image is animated, then the first frame is decoded.
+// The image is RGBA if the file has an alpha channel, otherwise RGB.
+func decompressWebP(encoded []byte, params *DecompressParams) (*Image, error) {
+	cfg, animated, err := webpInfo(encoded)
+	if err != nil {
+		return nil, err
+	}
+	format := PixelFormatRGB
+	if cfg.NChan == 4 {
+		format = PixelFormatRGBA
+	}
+	if animated {
+		p := *params
+		if p.outFormat() == PixelFormatUNKNOWN {
+			p.Format, p.HasFormat = format, true
+		}
+		anim, err := decodeWebPAnimation(encoded, 1, &p)
+		if err != nil {
+			return nil, err
+		}
+		if len(anim.Frames) == 0 {
+			return nil, errors.New("WebP animation has no frames")
+		}
+		return anim.Frames[0].Image, nil
+	}
+	img, err := decodeWebPStill(encoded, cfg.Width, cfg.Height, format)
+	if err != nil {
+		return nil, err
+	}
+	return applyDecompressFormat(img, params), nil
+}
+
+// DecodeWebPAnimation decodes all of the frames of an animated WebP file.
+// Each frame's Image is the complete canvas after that frame has been drawn, which is what a
+// viewer would show. The frames are RGBA, unless params.Format specifies otherwise.
+// A WebP file that is not animated is returned as a single frame.
+// params may be nil. Limits are checked against the size of the canvas, and MaxPixels against the
+// total size of all of the frames.
+func DecodeWebPAnimation(encoded []byte, params *DecompressParams) (*WebPAnimation, error) {
+	if params == nil {
+		params = &DecompressParams{}
+	}
+	cfg, animated, err := webpInfo(encoded)
+	if err != nil {
+		return nil, err
+	}
+	if params.Limits != nil {
+		if err := params.Limits.checkInputSize(len(encoded)); err != nil {
+			return nil, err
+		}
+		if err := params.Limits.checkDimensions(cfg.Width, cfg.Height); err != nil {
+			return nil, err
+		}
+	}
+	if !animated {
+		img, err := decodeWebPStill(encoded, cfg.Width, cfg.Height, PixelFormatRGBA)
+		if err != nil {
+			return nil, err
+		}
+		return &WebPAnimation{
+			Width:  cfg.Width,
+			Height: cfg.Height,
+			Frames: []WebPFrame{{Image: applyDecompressFormat(img, params), Bounds: image.Rect(0, 0, cfg.Width, cfg.Height)}},
+		}, nil
+	}
+	return decodeWebPAnimation(encoded, -1, params)
+}
+
+// webpChunk is a RIFF chunk, including its 8 byte header and padding
+type webpChunk struct {
+	fourCC  string
+	payload []byte
+	raw     []byte
+}
+
+// webpChunks splits RIFF data into chunks
+func webpChunks(data []byte) ([]webpChunk, error) {
+	chunks := []webpChunk{}
+	for len(data) >= 8 {
+		size := int(binary.LittleEndian.Uint32(data[4:]))
+		if size > len(data)-8 {
+			return nil, errors.New("Truncated WebP chunk")
+		}
+		padded := min(8+size+size&1, len(data))
+		chunks = append(chunks, webpChunk{fourCC: string(data[:4]), payload: data[8 : 8+size], raw: data[:padded]})
+		data = data[padded:]
+	}
+	return chunks, nil
+}
+
+func webpUint24(b []byte) int {
+	return int(b[0]) | int(b[1])<<8 | int(b[2])<<16
+}
+
+// webpFrameFile wraps the ALPH, VP8, and VP8L chunks of an animation frame into a
+// standalone WebP file, so that libwebp can decode it.
+func webpFrameFile(frameChunks []webpChunk, width, height int) ([]byte, error) {
+	var alpha, bitstream []byte
+	for _, c := range frameChunks {
+		switch c.fourCC {
+		case "ALPH":
+			alpha = c.raw
+		case "VP8 ", "VP8L":
+			bitstream = c.raw
+		}
+	}
+	if bitstream == nil {
+		return nil, errors.New("WebP animation frame has no image data")
+	}
+	body := []byte("WEBP")
+	if alpha != nil && bytes.HasPrefix(bitstream, []byte("VP8 ")) {
+		vp8x := make([]byte, 18)
+		copy(vp8x, "VP8X")
+		binary.LittleEndian.PutUint32(vp8x[4:], 10)
+		vp8x[8] = 0x10 // alpha
+		putUint24 := func(b []byte, v int) { b[0], b[1], b[2] = byte(v), byte(v>>8), byte(v>>16) }
+		putUint24(vp8x[12:], width-1)
+		putUint24(vp8x[15:], height-1)
+		body = append(body, vp8x...)
+		body = append(body, alpha...)
+	}
+	body = append(body, bitstream...)
+	file := append([]byte("RIFF"), binary.LittleEndian.AppendUint32(nil, uint32(len(body)))...)
+	return append(file, body...), nil
+}
+
+// decodeWebPAnimation decodes the first maxFrames frames of an animation (or all of them, if maxFrames is -1)
+func decodeWebPAnimation(encoded []byte, maxFrames int, params *DecompressParams) (*WebPAnimation, error) {
+	chunks, err := webpChunks(encoded[12:min(len(encoded), 8+int(binary.LittleEndian.Uint32(encoded[4:])))])
+	if err != nil {
+		return nil, err
+	}
+	anim := &WebPAnimation{}
+	var canvas *Image
+	for _, c := range chunks {
+		switch c.fourCC {
+		case "VP8X":
+			if len(c.payload) < 10 {
+				return nil, errors.New("Invalid WebP VP8X chunk")
+			}
+			anim.Width = webpUint24(c.payload[4:]) + 1
+			anim.Height = webpUint24(c.payload[7:]) + 1
+			canvas = NewImage(anim.Width, anim.Height, PixelFormatRGBA)
+		case "ANIM":
+			if len(c.payload) < 6 {
+				return nil, errors.New("Invalid WebP ANIM chunk")
+			}
+			anim.BackgroundColor = color.RGBA{c.payload[2], c.payload[1], c.payload[0], c.payload[3]}
+			anim.LoopCount = int(binary.LittleEndian.Uint16(c.payload[4:]))
+		case "ANMF":
+			if canvas == nil || len(c.payload) < 16 {
+				return nil, errors.New("Invalid WebP ANMF chunk")
+			}
+			if maxFrames != -1 && len(anim.Frames) == maxFrames {
+				return anim, nil
+			}
+			if err := params.Limits.checkFrames(anim.Width, anim.Height, len(anim.Frames)+1); err != nil {
+				return nil, err
+			}
+			p := c.payload
+			x, y := webpUint24(p[0:])*2, webpUint24(p[3:])*2
+			w, h := webpUint24(p[6:])+1, webpUint24(p[9:])+1
+			frame := WebPFrame{
+				Bounds:  image.Rect(x, y, x+w, y+h),
+				Delay:   time.Duration(webpUint24(p[12:])) * time.Millisecond,
+				Blend:   p[15]&2 == 0,
+				Dispose: p[15]&1 != 0,
+			}
+			frameChunks, err := webpChunks(p[16:])
+			if err != nil {
+				return nil, err
+			}
+			file, err := webpFrameFile(frameChunks, w, h)
+			if err != nil {
+				return nil, err
+			}
+			img, err := decodeWebPStill(file, w, h, PixelFormatRGBA)
+			if err != nil {
+				return nil, err
+			}
+			webpDrawFrame(canvas, img, frame.Bounds, frame.Blend)
+			frame.Image = applyDecompressFormat(canvas.Clone(), params)
+			anim.Frames = append(anim.Frames, frame)
+			if frame.Dispose {
+				r := frame.Bounds.Intersect(image.Rect(0, 0, canvas.Width, canvas.Height))
+				for row := r.Min.Y; row < r.Max.Y; row++ {
+					clear(canvas.Pixels[canvas.PixelByte(r.Min.X, row):canvas.PixelByte(r.Max.X, row)])
+				}
+			}
+		}
+	}
+	return anim, nil
+}
+
+// webpDrawFrame draws a straight-alpha RGBA frame onto a straight-alpha RGBA canvas.
+// If blend is true, then the frame is composited over the canvas, otherwise it replaces it.
+func webpDrawFrame(canvas, frame *Image, bounds image.Rectangle, blend bool) {
+	r := bounds.Intersect(image.Rect(0, 0, canvas.Width, canvas.Height))
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		src := frame.Pixels[frame.PixelByte(r.Min.X-bounds.Min.X, y-bounds.Min.Y):]
+		dst := canvas.Pixels[canvas.PixelByte(r.Min.X, y):]
+		for x := 0; x < r.Dx()*4; x += 4 {
+			sa := uint32(src[x+3])
+			if !blend || sa == 255 {
+				copy(dst[x:x+4], src[x:x+4])
+				continue
+			}
+			if sa == 0 {
+				continue
+			}
+			// Straight alpha "over"
+			da := uint32(dst[x+3]) * (255 - sa) / 255
+			oa := sa + da
+			for c := 0; c < 3; c++ {
+				dst[x+c] = byte((uint32(src[x+c])*sa + uint32(dst[x+c])*da + oa/2) / oa)
+			}
+			dst[x+3] = byte(oa)
+		}
+	}
+}
+
+// EncodeWebP writes an image as a WebP.
+// Images with an alpha channel are written with alpha. If params is nil, then NewWebPParams is used.
+func EncodeWebP(w io.Writer, img *Image, params *WebPParams) error {
+	if params == nil {
+		params = NewWebPParams()
+	}
+	lossless := 0
+	if params.Lossless {
+		lossless = 1
+	}
+	src := img.asUint8().toGrayRGBOrRGBA()
+	if src.Format == PixelFormatGRAY {
+		src = src.Convert(PixelFormatRGB)
+	}
+	hasAlpha := 0
+	if src.Format == PixelFormatRGBA {
+		hasAlpha = 1
+	}
+	var out *C.uint8_t
+	var outSize C.size_t
+	res := C.cimgWebPEncode((*C.uint8_t)(unsafe.Pointer(&src.Pixels[0])), C.int(src.Width), C.int(src.Height), C.int(src.Stride), C.int(hasAlpha), C.float(params.Quality), C.int(params.Method), C.int(lossless), &out, &outSize)
+	if res != C.VP8_ENC_OK {
+		msg, ok := webpEncodingErrors[res]
+		if !ok {
+			msg = fmt.Sprintf("error %v", int(res))
+		}
+		return fmt.Errorf("WebP encoding failed: %v", msg)
+	}
+	defer C.WebPFree(unsafe.Pointer(out))
+	_, err := w.Write(unsafe.Slice((*byte)(out), int(outSize)))
+	return err
+}
@@ -0,0 +1,166 @@
+package cimg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebP(t *testing.T) {
+	org := MakeRGBA(61, 43)
+	AddAlphaNoise(org)
+	rgb := org.Convert(PixelFormatRGB)
+
+	// Lossless
+	for _, img := range []*Image{rgb, org, org.Convert(PixelFormatGRAY)} {
+		buf := bytes.Buffer{}
+		require.Nil(t, EncodeWebP(&buf, img, &WebPParams{Lossless: true}))
+		cfg, err := DecodeConfig(buf.Bytes())
+		require.Nil(t, err)
+		require.Equal(t, FormatWebP, cfg.Format)
+		dec, err := DecompressWithOptions(buf.Bytes(), &DecompressParams{Format: img.Format, HasFormat: true})
+		require.Nil(t, err)
+		require.Equal(t, img.Pixels, dec.Pixels, "%v", img.Format)
+	}
+
+	// Lossy. Higher quality and effort should be closer to the original.
+	smooth := NewImage(61, 43, PixelFormatRGBA)
+	for y := 0; y < smooth.Height; y++ {
+		for x := 0; x < smooth.Width; x++ {
+			copy(smooth.Pixels[smooth.PixelByte(x, y):], []byte{byte(x * 4), byte(y * 5), 128, byte(255 - x*2)})
+		}
+	}
+	var sizes []int
+	var diffs []float64
+	for _, params := range []*WebPParams{{Quality: 0, Method: 0}, {Quality: 30, Method: 1}, {Quality: 95, Method: 6}} {
+		buf := bytes.Buffer{}
+		require.Nil(t, EncodeWriter(&buf, smooth, EncodeParams{Format: FormatWebP, WebP: params}))
+		cfg, err := DecodeConfig(buf.Bytes())
+		require.Nil(t, err)
+		require.Equal(t, 4, cfg.NChan)
+		dec, err := Decompress(buf.Bytes())
+		require.Nil(t, err)
+		require.Equal(t, PixelFormatRGBA, dec.Format)
+		sizes = append(sizes, buf.Len())
+		diffs = append(diffs, AvgRGBDifference(smooth, dec))
+	}
+	require.Less(t, sizes[0], sizes[1])
+	require.Less(t, sizes[1], sizes[2])
+	require.Less(t, diffs[1], diffs[0])
+	require.Less(t, diffs[2], diffs[1])
+	require.Less(t, diffs[2], 5.0)
+
+	// Out of range
+	require.NotNil(t, EncodeWebP(&bytes.Buffer{}, smooth, &WebPParams{Quality: 101, Method: WebPDefaultMethod}))
+	require.NotNil(t, EncodeWebP(&bytes.Buffer{}, smooth, &WebPParams{Quality: WebPDefaultQuality, Method: 7}))
+
+	_, err := Decompress([]byte("RIFF\x10\x00\x00\x00WEBPVP8 \x04\x00\x00\x00junk"))
+	require.NotNil(t, err)
+}
+
+// Build an animated WebP by wrapping the chunks of still images in ANMF chunks
+func makeWebPAnimation(t *testing.T, width, height int, frames []*Image, bounds []image.Rectangle, flags []byte) []byte {
+	le := binary.LittleEndian
+	chunk := func(fourCC string, payload []byte) []byte {
+		c := append([]byte(fourCC), le.AppendUint32(nil, uint32(len(payload)))...)
+		c = append(c, payload...)
+		if len(payload)%2 == 1 {
+			c = append(c, 0)
+		}
+		return c
+	}
+	uint24 := func(b []byte, v int) []byte { return append(b, byte(v), byte(v>>8), byte(v>>16)) }
+
+	vp8x := []byte{0x12, 0, 0, 0} // animation and alpha
+	vp8x = uint24(vp8x, width-1)
+	vp8x = uint24(vp8x, height-1)
+	body := []byte("WEBP")
+	body = append(body, chunk("VP8X", vp8x)...)
+	body = append(body, chunk("ANIM", []byte{0, 0, 0, 0, 3, 0})...)
+	for i, f := range frames {
+		buf := bytes.Buffer{}
+		// Lossy with alpha produces ALPH and VP8 chunks, lossless produces a VP8L chunk
+		require.Nil(t, EncodeWebP(&buf, f, &WebPParams{Quality: 100, Lossless: i%2 == 0}))
+		anmf := uint24(nil, bounds[i].Min.X/2)
+		anmf = uint24(anmf, bounds[i].Min.Y/2)
+		anmf = uint24(anmf, bounds[i].Dx()-1)
+		anmf = uint24(anmf, bounds[i].Dy()-1)
+		anmf = uint24(anmf, 50*(i+1))
+		anmf = append(anmf, flags[i])
+		chunks, err := webpChunks(buf.Bytes()[12:])
+		require.Nil(t, err)
+		for _, c := range chunks {
+			if c.fourCC != "VP8X" {
+				anmf = append(anmf, c.raw...)
+			}
+		}
+		body = append(body, chunk("ANMF", anmf)...)
+	}
+	return append(append([]byte("RIFF"), le.AppendUint32(nil, uint32(len(body)))...), body...)
+}
+
+func TestWebPAnimation(t *testing.T) {
+	solid := func(w, h int, c []byte) *Image {
+		img := NewImage(w, h, PixelFormatRGBA)
+		for i := 0; i < len(img.Pixels); i += 4 {
+			copy(img.Pixels[i:], c)
+		}
+		return img
+	}
+	frames := []*Image{
+		solid(8, 8, []byte{255, 0, 0, 255}),
+		solid(4, 4, []byte{0, 0, 255, 128}),
+		solid(2, 2, []byte{0, 255, 0, 255}),
+	}
+	bounds := []image.Rectangle{image.Rect(0, 0, 8, 8), image.Rect(2, 2, 6, 6), image.Rect(0, 0, 2, 2)}
+	flags := []byte{0, 1, 2} // none, dispose, no blend
+	enc := makeWebPAnimation(t, 8, 8, frames, bounds, flags)
+
+	anim, err := DecodeWebPAnimation(enc, nil)
+	require.Nil(t, err)
+	require.Equal(t, 8, anim.Width)
+	require.Equal(t, 8, anim.Height)
+	require.Equal(t, 3, anim.LoopCount)
+	require.Equal(t, 3, len(anim.Frames))
+	require.Equal(t, 100*time.Millisecond, anim.Frames[1].Delay)
+	require.Equal(t, bounds[1], anim.Frames[1].Bounds)
+	require.True(t, anim.Frames[1].Blend)
+	require.True(t, anim.Frames[1].Dispose)
+	require.False(t, anim.Frames[2].Blend)
+
+	at := func(frame, x, y int) []byte {
+		img := anim.Frames[frame].Image
+		return img.Pixels[img.PixelByte(x, y) : img.PixelByte(x, y)+4]
+	}
+	require.Equal(t, []byte{255, 0, 0, 255}, at(0, 3, 3))
+	blended := at(1, 3, 3)
+	require.InDelta(t, 127, int(blended[0]), 3)
+	require.InDelta(t, 128, int(blended[2]), 3)
+	require.Equal(t, byte(255), blended[3])
+	require.Equal(t, []byte{0, 0, 0, 0}, at(2, 3, 3)) // frame 1 was disposed
+	require.Equal(t, []byte{0, 255, 0, 255}, at(2, 1, 1))
+	require.Equal(t, []byte{255, 0, 0, 255}, at(2, 7, 7))
+
+	// Decompress returns the first frame
+	cfg, err := DecodeConfig(enc)
+	require.Nil(t, err)
+	require.Equal(t, 4, cfg.NChan)
+	first, err := DecompressWithOptions(enc, &DecompressParams{Format: PixelFormatRGB, HasFormat: true})
+	require.Nil(t, err)
+	require.Equal(t, []byte{255, 0, 0}, first.Pixels[:3])
+
+	_, err = DecodeWebPAnimation(enc, &DecompressParams{Limits: &DecodeLimits{MaxPixels: 10}})
+	require.ErrorIs(t, err, ErrImageTooLarge)
+
+	// MaxPixels limits the total size of the frames
+	_, err = DecodeWebPAnimation(enc, &DecompressParams{Limits: &DecodeLimits{MaxPixels: 8*8*3 - 1}})
+	require.ErrorIs(t, err, ErrImageTooLarge)
+	_, err = DecodeWebPAnimation(enc, &DecompressParams{Limits: &DecodeLimits{MaxPixels: 8 * 8 * 3}})
+	require.Nil(t, err)
+	_, err = DecompressWithOptions(enc, &DecompressParams{Limits: &DecodeLimits{MaxPixels: 8 * 8}})
+	require.Nil(t, err)
+}
@@ -0,0 +1,293 @@
+package cimg
+
+/*
+#include <turbojpeg.h>
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"unsafe"
+)
+
+// YUVImage is a planar YUV (YCbCr) image, such as I420.
+// The Y plane is full resolution, and the U (Cb) and V (Cr) planes are subsampled according to Sampling.
+// A SamplingGray image has only a Y plane.
+// The dimensions of each plane are padded up to a multiple of the subsampling factor
+// (see YUVPlaneWidth and YUVPlaneHeight), which is the layout that TurboJPEG expects.
+type YUVImage struct {
+	Width    int
+	Height   int
+	Sampling Sampling
+	Planes   [3][]byte // Y, U, V
+	Strides  [3]int    // Distance from one line to the next, in bytes, for each plane
+}
+
+// YUVPlaneWidth returns the width of a plane (0 = Y, 1 = U, 2 = V) of a YUV image
+func YUVPlaneWidth(plane, width int, sampling Sampling) int {
+	return int(C.tjPlaneWidth(C.int(plane), C.int(width), C.int(sampling)))
+}
+
+// YUVPlaneHeight returns the height of a plane (0 = Y, 1 = U, 2 = V) of a YUV image
+func YUVPlaneHeight(plane, height int, sampling Sampling) int {
+	return int(C.tjPlaneHeight(C.int(plane), C.int(height), C.int(sampling)))
+}
+
+func yuvNumPlanes(sampling Sampling) int {
+	if sampling == SamplingGray {
+		return 1
+	}
+	return 3
+}
+
+// NumPlanes returns 1 for a grayscale image, or 3 for a color image
+func (y *YUVImage) NumPlanes() int {
+	return yuvNumPlanes(y.Sampling)
+}
+
+// checkYUVDimensions returns an error if NewYUVImage would panic
+func checkYUVDimensions(width, height int, sampling Sampling) error {
+	if YUVPlaneWidth(0, width, sampling) < 0 || YUVPlaneHeight(0, height, sampling) < 0 {
+		return fmt.Errorf("Invalid YUV image %v x %v, sampling %v", width, height, sampling)
+	}
+	return nil
+}
+
+// NewYUVImage allocates a new YUV image.
+// Panics if the dimensions or sampling are invalid.
+func NewYUVImage(width, height int, sampling Sampling) *YUVImage {
+	if err := checkYUVDimensions(width, height, sampling); err != nil {
+		panic(err)
+	}
+	img := &YUVImage{
+		Width:    width,
+		Height:   height,
+		Sampling: sampling,
+	}
+	for i := 0; i < img.NumPlanes(); i++ {
+		img.Strides[i] = YUVPlaneWidth(i, width, sampling)
+		img.Planes[i] = make([]byte, img.Strides[i]*YUVPlaneHeight(i, height, sampling))
+	}
+	return img
+}
+
+// WrapYUVImage wraps existing planes into a YUVImage (do not copy pixels).
+// For example, an I420 frame is WrapYUVImage(w, h, Sampling420, [][]byte{y, u, v}, []int{w, (w+1)/2, (w+1)/2}).
+// An error is returned if any of the planes are too small.
+func WrapYUVImage(width, height int, sampling Sampling, planes [][]byte, strides []int) (*YUVImage, error) {
+	img := &YUVImage{
+		Width:    width,
+		Height:   height,
+		Sampling: sampling,
+	}
+	n := img.NumPlanes()
+	if len(planes) != n || len(strides) != n {
+		return nil, fmt.Errorf("Expected %v planes and strides, but got %v planes and %v strides", n, len(planes), len(strides))
+	}
+	for i := 0; i < n; i++ {
+		img.Planes[i] = planes[i]
+		img.Strides[i] = strides[i]
+	}
+	if err := img.validate(); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+func (y *YUVImage) validate() error {
+	if y.Width <= 0 || y.Height <= 0 {
+		return fmt.Errorf("Invalid YUV image dimensions %v x %v", y.Width, y.Height)
+	}
+	for i := 0; i < y.NumPlanes(); i++ {
+		size := int64(C.tjPlaneSizeYUV(C.int(i), C.int(y.Width), C.int(y.Strides[i]), C.int(y.Height), C.int(y.Sampling)))
+		if size < 0 {
+			return fmt.Errorf("Invalid YUV sampling %v", y.Sampling)
+		}
+		if y.Strides[i] < YUVPlaneWidth(i, y.Width, y.Sampling) {
+			return fmt.Errorf("YUV plane %v stride %v is less than the plane width %v", i, y.Strides[i], YUVPlaneWidth(i, y.Width, y.Sampling))
+		}
+		if int64(len(y.Planes[i])) < size {
+			return fmt.Errorf("YUV plane %v is %v bytes, but needs to be at least %v bytes", i, len(y.Planes[i]), size)
+		}
+	}
+	return nil
+}
+
+// planePointers pins the planes of a YUV image, so that they can be passed to TurboJPEG.
+// The caller must call pinner.Unpin() when done.
+func (y *YUVImage) planePointers(pinner *runtime.Pinner) (planes [3]*C.uchar, strides [3]C.int) {
+	for i := 0; i < y.NumPlanes(); i++ {
+		planes[i] = (*C.uchar)(&y.Planes[i][0])
+		pinner.Pin(planes[i])
+		strides[i] = C.int(y.Strides[i])
+	}
+	return
+}
+
+// CompressYUV compresses a YUV image into a JPEG, without converting to RGB first.
+// The sampling of the JPEG is the sampling of the YUV image, so params.Sampling is ignored.
+func CompressYUV(img *YUVImage, params CompressParams) ([]byte, error) {
+	encoder, err := getEncoder()
+	if err != nil {
+		return nil, err
+	}
+	defer putEncoder(encoder)
+	return encoder.CompressYUV(img, params)
+}
+
+// CompressYUV is the same as the package-level CompressYUV, but uses this Encoder's handle
+func (e *Encoder) CompressYUV(img *YUVImage, params CompressParams) ([]byte, error) {
+	if err := img.validate(); err != nil {
+		return nil, err
+	}
+
+	pinner := runtime.Pinner{}
+	defer pinner.Unpin()
+	planes, strides := img.planePointers(&pinner)
+
+	var outBuf *C.uchar
+	var outBufSize C.ulong
+
+	// int tjCompressFromYUVPlanes(tjhandle handle, const unsigned char **srcPlanes, int width, const int *strides,
+	// int height, int subsamp, unsigned char **jpegBuf, unsigned long *jpegSize, int jpegQual, int flags);
+	res := C.tjCompressFromYUVPlanes(e.handle, &planes[0], C.int(img.Width), &strides[0], C.int(img.Height), C.int(img.Sampling),
+		&outBuf, &outBufSize, C.int(params.Quality), C.int(params.Flags))
+
+	var enc []byte
+	err := makeError(e.handle, res)
+	runtime.KeepAlive(e)
+	if outBuf != nil {
+		enc = C.GoBytes(unsafe.Pointer(outBuf), C.int(outBufSize))
+		C.tjFree(outBuf)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return enc, nil
+}
+
+// DecompressToYUV decodes a JPEG into a YUV image, without converting to RGB.
+// The YUV image has the same sampling as the JPEG.
+// The Scale, Flags, and Limits fields of params are used, and params may be nil.
+func DecompressToYUV(encoded []byte, params *DecompressParams) (*YUVImage, error) {
+	decoder, err := getDecoder()
+	if err != nil {
+		return nil, err
+	}
+	defer putDecoder(decoder)
+	return decoder.DecompressToYUV(encoded, params)
+}
+
+// DecompressToYUV is the same as the package-level DecompressToYUV, but uses this Decoder's handle
+func (d *Decoder) DecompressToYUV(encoded []byte, params *DecompressParams) (*YUVImage, error) {
+	if params == nil {
+		params = &DecompressParams{}
+	}
+	if err := d.checkLimits(params.Limits, encoded); err != nil {
+		return nil, err
+	}
+	width, height, sampling, _, err := d.decompressJPEGHeader(encoded)
+	if err != nil {
+		return nil, err
+	}
+	if params.Scale.Num != 0 {
+		if !isSupportedScalingFactor(params.Scale) {
+			return nil, fmt.Errorf("Unsupported JPEG scaling factor %v/%v", params.Scale.Num, params.Scale.Denom)
+		}
+		width = params.Scale.Scale(width)
+		height = params.Scale.Scale(height)
+	}
+	// TurboJPEG reports an unusual sampling as unknown, and that can't be represented as a YUVImage
+	if err := checkYUVDimensions(width, height, sampling); err != nil {
+		return nil, err
+	}
+
+	img := NewYUVImage(width, height, sampling)
+
+	pinner := runtime.Pinner{}
+	defer pinner.Unpin()
+	planes, strides := img.planePointers(&pinner)
+
+	// int tjDecompressToYUVPlanes(tjhandle handle, const unsigned char *jpegBuf, unsigned long jpegSize,
+	// unsigned char **dstPlanes, int width, int *strides, int height, int flags);
+	err = makeError(d.handle, C.tjDecompressToYUVPlanes(d.handle, (*C.uchar)(&encoded[0]), C.ulong(len(encoded)), &planes[0], C.int(width), &strides[0], C.int(height), C.int(params.Flags)))
+	runtime.KeepAlive(d)
+	if err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// EncodeYUV converts an image into a planar YUV image, with the given chroma subsampling
+func EncodeYUV(img *Image, sampling Sampling) (*YUVImage, error) {
+	encoder, err := getEncoder()
+	if err != nil {
+		return nil, err
+	}
+	defer putEncoder(encoder)
+	return encoder.EncodeYUV(img, sampling)
+}
+
+// EncodeYUV is the same as the package-level EncodeYUV, but uses this Encoder's handle
+func (e *Encoder) EncodeYUV(img *Image, sampling Sampling) (*YUVImage, error) {
+	img = img.asUint8().withStraightAlpha()
+	if img.Format == PixelFormatCMYK {
+		return nil, errors.New("Cannot convert a CMYK image to YUV")
+	}
+	if YUVPlaneWidth(0, img.Width, sampling) < 0 {
+		return nil, fmt.Errorf("Invalid YUV sampling %v", sampling)
+	}
+	dst := NewYUVImage(img.Width, img.Height, sampling)
+
+	pinner := runtime.Pinner{}
+	defer pinner.Unpin()
+	planes, strides := dst.planePointers(&pinner)
+
+	// int tjEncodeYUVPlanes(tjhandle handle, const unsigned char *srcBuf, int width, int pitch, int height,
+	// int pixelFormat, unsigned char **dstPlanes, int *strides, int subsamp, int flags);
+	err := makeError(e.handle, C.tjEncodeYUVPlanes(e.handle, (*C.uchar)(&img.Pixels[0]), C.int(img.Width), C.int(img.Stride), C.int(img.Height),
+		C.int(img.Format), &planes[0], &strides[0], C.int(sampling), 0))
+	runtime.KeepAlive(e)
+	if err != nil {
+		return nil, err
+	}
+	return dst, nil
+}
+
+// DecodeYUV converts a planar YUV image into an image of the given pixel format
+func DecodeYUV(yuv *YUVImage, format PixelFormat) (*Image, error) {
+	decoder, err := getDecoder()
+	if err != nil {
+		return nil, err
+	}
+	defer putDecoder(decoder)
+	return decoder.DecodeYUV(yuv, format)
+}
+
+// DecodeYUV is the same as the package-level DecodeYUV, but uses this Decoder's handle
+func (d *Decoder) DecodeYUV(yuv *YUVImage, format PixelFormat) (*Image, error) {
+	if err := yuv.validate(); err != nil {
+		return nil, err
+	}
+	if format == PixelFormatCMYK {
+		return nil, errors.New("Cannot convert YUV to CMYK")
+	}
+	dst := NewImage(yuv.Width, yuv.Height, format)
+
+	pinner := runtime.Pinner{}
+	defer pinner.Unpin()
+	planes, strides := yuv.planePointers(&pinner)
+
+	// int tjDecodeYUVPlanes(tjhandle handle, const unsigned char **srcPlanes, const int *strides, int subsamp,
+	// unsigned char *dstBuf, int width, int pitch, int height, int pixelFormat, int flags);
+	err := makeError(d.handle, C.tjDecodeYUVPlanes(d.handle, &planes[0], &strides[0], C.int(yuv.Sampling),
+		(*C.uchar)(&dst.Pixels[0]), C.int(dst.Width), C.int(dst.Stride), C.int(dst.Height), C.int(format), 0))
+	runtime.KeepAlive(d)
+	if err != nil {
+		return nil, err
+	}
+	return dst, nil
+}